@@ -0,0 +1,75 @@
+package authjwt
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// AuthDisabledSet sets, or clears, Disabled on the existing auth for email; I.E. to suspend
+// an account without deleting it. Disabled auths cannot login, and their API keys are
+// rejected. Disabling removes all tokens, single use tokens, and refresh tokens of email, and
+// increments the TokenVersion of the auth (see AuthTokenVersionBump), so existing tokens are
+// rejected; they remain rejected when the auth is enabled again. EventAuthDisable is sent so
+// applications can drop anything cached for email.
+func AuthDisabledSet(email string, disabled bool) error {
+	email = emailNormalize(email)
+	if err := authUpdate(email, false, func(auth *authentication) {
+		if disabled && !auth.Disabled {
+			auth.TokenVersion++
+		}
+		auth.Disabled = disabled
+	}); err != nil || !disabled {
+		return err
+	}
+
+	if _, err := userTokens(email, true); err != nil {
+		return runtimeh.SourceInfoError("userTokens error", err)
+	}
+	if err := userOneTimeTokensRemove(email); err != nil {
+		return err
+	}
+	eventSend(context.Background(), EventAuthDisable, email)
+	return nil
+}
+
+// accountDisabledValidate returns an error if the auth for email is deleted or disabled,
+// regardless of config.CheckAccountStateOnVerify; for API keys, which are not removed by
+// AuthDisabledSet.
+func accountDisabledValidate(email string) error {
+	if config.CheckAccountStateOnVerify {
+		return accountStateValidate(email)
+	}
+	auth, err := authGet(email)
+	if err != nil {
+		return runtimeh.SourceInfoError("authGet error", err)
+	}
+	if auth.Email == nil {
+		return fmt.Errorf("%s auth does not exist for email: %s", runtimeh.SourceInfo(), email)
+	}
+	if auth.Disabled {
+		return fmt.Errorf("%s auth is disabled for email: %s", runtimeh.SourceInfo(), email)
+	}
+	return nil
+}
+
+// accountStateValidate returns an error, when config.CheckAccountStateOnVerify is true, if the
+// auth for email is deleted or disabled. Without a DataSourcePath there are no auths, and
+// there is no error.
+func accountStateValidate(email string) error {
+	if !config.CheckAccountStateOnVerify || config.DataSourcePath == "" {
+		return nil
+	}
+	auth, err := authGet(email)
+	if err != nil {
+		return runtimeh.SourceInfoError("authGet error", err)
+	}
+	if auth.Email == nil {
+		return fmt.Errorf("%s auth does not exist for email: %s", runtimeh.SourceInfo(), email)
+	}
+	if auth.Disabled {
+		return fmt.Errorf("%s auth is disabled for email: %s", runtimeh.SourceInfo(), email)
+	}
+	return nil
+}
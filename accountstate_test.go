@@ -0,0 +1,146 @@
+package authjwt
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCheckAccountStateOnVerify verifies disabled auths cannot login and their tokens are
+// rejected, remaining rejected when enabled again, and with CheckAccountStateOnVerify tokens
+// of deleted auths are rejected immediately.
+func TestCheckAccountStateOnVerify(t *testing.T) {
+	for _, check := range []bool{false, true} {
+		t.Run(fmt.Sprintf("check %t", check), func(t *testing.T) {
+			testSetup()
+			config.CheckAccountStateOnVerify = check
+
+			em, credBytes, err := createAuth(t, nil)
+			if err != nil {
+				return
+			}
+			tokenBytes, _, err := login(t, credBytes)
+			if err != nil {
+				return
+			}
+
+			testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+			defer testServer.Close()
+			testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+			defer testServerLogin.Close()
+			client := &http.Client{}
+			request := func() (int, error) {
+				req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+				if err != nil {
+					return 0, err
+				}
+				req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+				resp, err := client.Do(req)
+				if err != nil {
+					return 0, err
+				}
+				resp.Body.Close()
+				return resp.StatusCode, nil
+			}
+			rejected := http.StatusNoContent
+			if check {
+				rejected = http.StatusUnauthorized
+			}
+
+			if err := AuthDisabledSet(em, true); err != nil {
+				t.Errorf("AuthDisabledSet error: %v", err)
+				return
+			}
+			if status, err := request(); err != nil || status != http.StatusUnauthorized {
+				t.Errorf("token of disabled auth did not return proper status: %d, error: %v", status, err)
+				return
+			}
+			req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+			if err != nil {
+				t.Errorf("NewRequest error: %v", err)
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil || resp.StatusCode != http.StatusForbidden {
+				t.Errorf("login of disabled auth did not return proper status: %d, error: %v", resp.StatusCode, err)
+				return
+			}
+
+			if err := AuthDisabledSet(em, false); err != nil {
+				t.Errorf("AuthDisabledSet error: %v", err)
+				return
+			}
+			if status, err := request(); err != nil || status != http.StatusUnauthorized {
+				t.Errorf("token from before disable did not return proper status: %d, error: %v", status, err)
+				return
+			}
+			if tokenBytes, _, err = login(t, credBytes); err != nil {
+				return
+			}
+			if status, err := request(); err != nil || status != http.StatusNoContent {
+				t.Errorf("token of enabled auth did not return proper status: %d, error: %v", status, err)
+				return
+			}
+
+			// The token remains in the token store; only the auth is deleted.
+			if _, err := kvsAuth.Delete(em); err != nil {
+				t.Errorf("kvsAuth.Delete error: %v", err)
+				return
+			}
+			if status, err := request(); err != nil || status != rejected {
+				t.Errorf("token of deleted auth did not return proper status: %d, error: %v", status, err)
+				return
+			}
+		})
+	}
+}
+
+// TestAuthDisabledSetAPIKey verifies API keys of disabled auths are rejected, without
+// CheckAccountStateOnVerify, and accepted again when enabled, and that disabling sends
+// EventAuthDisable.
+func TestAuthDisabledSetAPIKey(t *testing.T) {
+	testSetup()
+	var events []Event
+	config.EventHandler = func(e Event) {
+		events = append(events, e)
+	}
+
+	em, _, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	ak, err := apiKeyCreate(em, "ci")
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+	authenticate := func() error {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(apiKeyHeader, ak.Key)
+		_, err := apiKeyAuthenticate(httptest.NewRecorder(), req)
+		return err
+	}
+
+	if err := AuthDisabledSet(em, true); err != nil {
+		t.Errorf("AuthDisabledSet error: %v", err)
+		return
+	}
+	if err := authenticate(); err == nil {
+		t.Errorf("API key of disabled auth accepted")
+		return
+	}
+	if len(events) == 0 || events[len(events)-1].Type != EventAuthDisable || events[len(events)-1].Email != em {
+		t.Errorf("EventAuthDisable not sent: %+v", events)
+		return
+	}
+	if err := AuthDisabledSet(em, false); err != nil {
+		t.Errorf("AuthDisabledSet error: %v", err)
+		return
+	}
+	if err := authenticate(); err != nil {
+		t.Errorf("API key of enabled auth rejected: %v", err)
+		return
+	}
+}
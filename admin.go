@@ -0,0 +1,70 @@
+package authjwt
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+var (
+	// adminIPNets are the parsed config.AdminIPAllowlist.
+	adminIPNets []*net.IPNet
+)
+
+// adminAuthorized returns true if the caller with claims is an admin, not using an
+// impersonation token, making the request from an IP in config.AdminIPAllowlist. Otherwise
+// the header is written; http.StatusForbidden, or http.StatusInternalServerError on error.
+func adminAuthorized(w http.ResponseWriter, r *http.Request, claims *CustomClaims) bool {
+	if impersonationRejected(w, claims) {
+		return false
+	}
+	if !adminIPAllowed(clientIP(r)) {
+		lpf(logh.Warning, "admin request from IP not in AdminIPAllowlist: %s, email: %s", clientIP(r), claims.Email)
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	admin, err := authIsAdmin(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authIsAdmin error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if !admin {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// adminIPAllowed returns true if ip is in adminIPNets, or there is no AdminIPAllowlist.
+func adminIPAllowed(ip string) bool {
+	if len(adminIPNets) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range adminIPNets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminIPAllowlistLoad parses config.AdminIPAllowlist into adminIPNets.
+func adminIPAllowlistLoad() error {
+	adminIPNets = make([]*net.IPNet, 0, len(config.AdminIPAllowlist))
+	for _, cidr := range config.AdminIPAllowlist {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("%s AdminIPAllowlist CIDR %s, error: %w", runtimeh.SourceInfo(), cidr, err)
+		}
+		adminIPNets = append(adminIPNets, n)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package authjwt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAdminIPAllowlist verifies admin requests from an IP in AdminIPAllowlist are allowed,
+// requests from other IPs are rejected, and invalid CIDRs are rejected.
+func TestAdminIPAllowlist(t *testing.T) {
+	testSetup()
+	config.AuditStore = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(em, []string{RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerAuditExport)))
+	defer testServer.Close()
+	client := &http.Client{}
+	tests := []struct {
+		allowlist []string
+		status    int
+	}{
+		{nil, http.StatusOK},
+		{[]string{"10.0.0.0/8"}, http.StatusForbidden},
+		{[]string{"10.0.0.0/8", "127.0.0.0/8"}, http.StatusOK},
+		{[]string{"::1/128"}, http.StatusForbidden},
+	}
+	for i, tc := range tests {
+		config.AdminIPAllowlist = tc.allowlist
+		if err := adminIPAllowlistLoad(); err != nil {
+			t.Errorf("test %d, adminIPAllowlistLoad error: %v", i, err)
+			return
+		}
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("test %d did not return proper status: %d, error: %v", i, resp.StatusCode, err)
+			return
+		}
+	}
+
+	config.AdminIPAllowlist = []string{"10.0.0.0"}
+	if err := adminIPAllowlistLoad(); err == nil {
+		t.Errorf("adminIPAllowlistLoad did not error on an invalid CIDR")
+		return
+	}
+}
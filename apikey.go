@@ -0,0 +1,146 @@
+package authjwt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// APIKey is returned when an API key is created; this is the only time Key is available.
+type APIKey struct {
+	APIKeyInfo
+	// Key is supplied in the X-API-Key header of requests.
+	Key string
+}
+
+// APIKeyInfo is information about an API key, as listed for the user. The key is never included.
+type APIKeyInfo struct {
+	CreatedAt time.Time
+	ID        string
+	Label     string
+	LastUsed  time.Time `json:",omitempty"`
+}
+
+// apiKey is the persisted data about an API key; the key is stored only as a hash.
+type apiKey struct {
+	APIKeyInfo
+	Email   string
+	KeyHash []byte
+}
+
+const (
+	// apiKeyHeader is the request header containing the API key.
+	apiKeyHeader = "X-API-Key"
+	// apiKeySecretLength is the length in bytes of the random part of an API key.
+	apiKeySecretLength = 32
+)
+
+// apiKeyAuthenticate authenticates a request using the API key in the X-API-Key header,
+// updates the last used time of the key, and returns CustomClaims for the owner of the key.
+// On any error the header is written with http.StatusUnauthorized.
+func apiKeyAuthenticate(w http.ResponseWriter, r *http.Request) (*CustomClaims, error) {
+	id, secret, found := strings.Cut(r.Header.Get(apiKeyHeader), ".")
+	if !found {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%s API key malformed", runtimeh.SourceInfo())
+	}
+	ak, err := apiKeyGet(id)
+	if err != nil || ak.ID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%s API key not found, error: %v", runtimeh.SourceInfo(), err)
+	}
+	kh := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(kh[:], ak.KeyHash) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%s API key not valid", runtimeh.SourceInfo())
+	}
+
+	if err := accountDisabledValidate(ak.Email); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, err
+	}
+
+	ak.LastUsed = timeNow()
+	if err := kvsAPIKey.Serialize(ak.ID, ak); err != nil {
+		lpf(logh.Error, "kvsAPIKey.Serialize error:%+v", err)
+	}
+	return &CustomClaims{AuthMethod: AuthMethodAPIKey, Email: ak.Email}, nil
+}
+
+// apiKeyCreate creates and stores a new API key for the specified email.
+func apiKeyCreate(email string, label string) (APIKey, error) {
+	id, err := uniqueID(false)
+	if err != nil {
+		return APIKey{}, runtimeh.SourceInfoError("apiKeyCreate error", err)
+	}
+	sb := make([]byte, apiKeySecretLength)
+	if _, err := rand.Read(sb); err != nil {
+		return APIKey{}, runtimeh.SourceInfoError("generating API key", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(sb)
+	kh := sha256.Sum256([]byte(secret))
+
+	ak := apiKey{APIKeyInfo: APIKeyInfo{CreatedAt: timeNow(), ID: id, Label: label}, Email: email, KeyHash: kh[:]}
+	if err := kvsAPIKey.Serialize(id, ak); err != nil {
+		return APIKey{}, runtimeh.SourceInfoError("serialize error", err)
+	}
+	return APIKey{APIKeyInfo: ak.APIKeyInfo, Key: id + "." + secret}, nil
+}
+
+// apiKeyGet returns the API key with the specified id. If the id is not in kvsAPIKey there is
+// no error, but the returned apiKey is empty.
+func apiKeyGet(id string) (apiKey, error) {
+	ak := apiKey{}
+	if err := kvsAPIKey.Deserialize(id, &ak); err != nil {
+		return apiKey{}, runtimeh.SourceInfoError("apiKeyGet error", err)
+	}
+	return ak, nil
+}
+
+// apiKeyList returns information about all API keys for the specified email.
+func apiKeyList(email string) ([]APIKeyInfo, error) {
+	keys, err := kvsAPIKey.Keys()
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("kvsAPIKey.Keys error", err)
+	}
+	infos := []APIKeyInfo{}
+	for i := range keys {
+		ak, err := apiKeyGet(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		if ak.Email == email {
+			infos = append(infos, ak.APIKeyInfo)
+		}
+	}
+	return infos, nil
+}
+
+// apiKeysRemove removes all API keys for the specified email.
+func apiKeysRemove(email string) error {
+	keys, err := kvsAPIKey.Keys()
+	if err != nil {
+		return runtimeh.SourceInfoError("kvsAPIKey.Keys error", err)
+	}
+	for _, key := range keys {
+		ak, err := apiKeyGet(key)
+		if err != nil {
+			return err
+		}
+		if ak.Email != email {
+			continue
+		}
+		if _, err := kvsAPIKey.Delete(ak.ID); err != nil {
+			return runtimeh.SourceInfoError("kvsAPIKey.Delete error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package authjwt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"golang.org/x/crypto/argon2"
+)
+
+// Values of Config.PasswordHashAlgorithm.
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+)
+
+const (
+	// argon2idKeyLength and argon2idSaltLength are the lengths in bytes of the hash and salt
+	// of password hashes.
+	argon2idKeyLength  = 32
+	argon2idSaltLength = 16
+	// argon2idVersion is the Argon2 version v, 0x13.
+	argon2idVersion = argon2.Version
+
+	// argon2idMemoryMinimum is the minimum Argon2idMemory, in KiB, per lane.
+	argon2idMemoryMinimum = 8
+
+	defaultArgon2idMemory      = 64 * 1024
+	defaultArgon2idParallelism = 4
+	defaultArgon2idTime        = 3
+)
+
+// argon2idHash returns the encoded Argon2id hash of password, with a random salt and the
+// parameters from config, in the PHC string format:
+// $argon2id$v=19$m=<memory>,t=<time>,p=<parallelism>$<salt>$<hash>
+func argon2idHash(password string) ([]byte, error) {
+	salt := make([]byte, argon2idSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, runtimeh.SourceInfoError("rand.Read error", err)
+	}
+	ap := argon2idConfigParameters()
+	key := argon2idKey(password, salt, ap, argon2idKeyLength)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2idVersion, ap.memory, ap.time, ap.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// argon2idParameters are the cost parameters of an Argon2id hash.
+type argon2idParameters struct {
+	memory      uint32
+	parallelism uint8
+	time        uint32
+}
+
+// argon2idConfigParameters returns the Argon2id parameters from config.
+func argon2idConfigParameters() argon2idParameters {
+	return argon2idParameters{memory: config.Argon2idMemory, parallelism: config.Argon2idParallelism, time: config.Argon2idTime}
+}
+
+// argon2idParse returns the parameters, salt, and key of the encoded hash from argon2idHash.
+func argon2idParse(hash []byte) (argon2idParameters, []byte, []byte, error) {
+	ap := argon2idParameters{}
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != PasswordHashArgon2id {
+		return ap, nil, nil, fmt.Errorf("%s not an argon2id hash", runtimeh.SourceInfo())
+	}
+	var v uint32
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &v); err != nil || v != argon2idVersion {
+		return ap, nil, nil, fmt.Errorf("%s unsupported argon2id version: %s", runtimeh.SourceInfo(), parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &ap.memory, &ap.time, &ap.parallelism); err != nil || ap.time < 1 || ap.parallelism < 1 {
+		return ap, nil, nil, fmt.Errorf("%s invalid argon2id parameters: %s", runtimeh.SourceInfo(), parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return ap, nil, nil, runtimeh.SourceInfoError("argon2id salt decode error", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return ap, nil, nil, fmt.Errorf("%s invalid argon2id hash", runtimeh.SourceInfo())
+	}
+	return ap, salt, key, nil
+}
+
+// argon2idVerify returns nil if password hashes to the encoded hash from argon2idHash. The
+// parameters of hash are used, so hashes remain valid when the Config parameters change.
+func argon2idVerify(password string, hash []byte) error {
+	ap, salt, key, err := argon2idParse(hash)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(key, argon2idKey(password, salt, ap, uint32(len(key)))) != 1 {
+		return fmt.Errorf("%s password does not match", runtimeh.SourceInfo())
+	}
+	return nil
+}
+
+// argon2idKey returns the Argon2id key of keyLen bytes for password and salt, with the
+// parameters ap. Peppers are applied to password before hashing, with pepperPassword, so no
+// Argon2 secret is used.
+func argon2idKey(password string, salt []byte, ap argon2idParameters, keyLen uint32) []byte {
+	return argon2.IDKey([]byte(password), salt, ap.time, ap.memory, ap.parallelism, keyLen)
+}
@@ -0,0 +1,139 @@
+package authjwt
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestArgon2idKey verifies argon2idKey, and argon2idVerify of the PHC string of a key, against
+// known Argon2id keys, for parameters with multiple passes, lanes, and address blocks, and
+// memory that is not a multiple of the lanes. The RFC 9106 section 5.3 test vector uses an
+// Argon2 secret and associated data, which argon2.IDKey does not take.
+func TestArgon2idKey(t *testing.T) {
+	tests := []struct {
+		time        uint32
+		memory      uint32
+		parallelism uint8
+		key         string
+	}{
+		{1, 1024, 1, "efc8e8080d60d52b846f438cab1d8c70dd303a4b187c891b42fcf623e13bdbe711f2a524a5b2cdb4"},
+		{2, 4096, 3, "072a8b8b3770a5422724fc54531d7588008779f2a9d1a0a92bb3ddd93b069ad14a2b0117d3d0e7c5"},
+		{3, 1000, 4, "e337348185ad56af36277ae46ff13b973498f6af35eba07ebdab487f036487619a2aaf9c0c8fc8fc"},
+		{1, 65, 1, "d586991b9ab2c6d1818abf4e3c3a6c80d68f4142b88c2db7b13691bc47873054176168e7b82d5c11"},
+	}
+	for i, tc := range tests {
+		ap := argon2idParameters{memory: tc.memory, parallelism: tc.parallelism, time: tc.time}
+		key := argon2idKey("password", []byte("somesaltsomesalt"), ap, 40)
+		if hex.EncodeToString(key) != tc.key {
+			t.Errorf("test %d, key: %x, expected: %s", i, key, tc.key)
+			return
+		}
+	}
+
+	hash := "$argon2id$v=19$m=1024,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$78joCA1g1SuEb0OMqx2McN0wOksYfIkbQvz2I+E72+cR8qUkpbLNtA"
+	if err := argon2idVerify("password", []byte(hash)); err != nil {
+		t.Errorf("argon2idVerify error: %v", err)
+		return
+	}
+	if err := argon2idVerify("passwore", []byte(hash)); err == nil {
+		t.Errorf("argon2idVerify did not return an error for the wrong password")
+		return
+	}
+}
+
+// TestPasswordHashArgon2id verifies passwords set with PasswordHashArgon2id are stored as
+// Argon2id hashes and can login, bcrypt hashes still verify, and Argon2id hashes are
+// rejected as passwords.
+func TestPasswordHashArgon2id(t *testing.T) {
+	testSetup()
+	bcryptHash, err := passwordHash("P@ssword1234")
+	if err != nil {
+		t.Errorf("passwordHash error: %v", err)
+		return
+	}
+
+	config.PasswordHashAlgorithm = PasswordHashArgon2id
+	config.Argon2idMemory, config.Argon2idParallelism, config.Argon2idTime = 256, 2, 1
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	auth, err := authGet(em)
+	if err != nil {
+		t.Errorf("authGet error: %v", err)
+		return
+	}
+	if !strings.HasPrefix(string(auth.PasswordHash), "$argon2id$v=19$m=256,t=1,p=2$") {
+		t.Errorf("password hash is not argon2id: %s", auth.PasswordHash)
+		return
+	}
+	if _, _, err := login(t, credBytes); err != nil {
+		return
+	}
+
+	// The parameters are from the hash, not config.
+	config.Argon2idTime = 2
+	if err := passwordVerifyHash("P@ssword1234", auth.PasswordHash); err != nil {
+		t.Errorf("passwordVerifyHash error with changed parameters: %v", err)
+		return
+	}
+	if err := passwordVerifyHash("P@ssword1235", auth.PasswordHash); err == nil {
+		t.Errorf("passwordVerifyHash did not return an error for the wrong password")
+		return
+	}
+	if err := passwordVerifyHash("P@ssword1234", bcryptHash); err != nil {
+		t.Errorf("passwordVerifyHash error for bcrypt hash: %v", err)
+		return
+	}
+	if !passwordHashValidation.Match(auth.PasswordHash) {
+		t.Errorf("passwordHashValidation does not match argon2id hash: %s", auth.PasswordHash)
+		return
+	}
+}
+
+// TestPasswordHashConfigLoad verifies the password hash cost parameters are used, and
+// validated at Init.
+func TestPasswordHashConfigLoad(t *testing.T) {
+	testSetup()
+	config.BcryptCost = defaultBcryptCost + 1
+	hash, err := passwordHash("P@ssword1234")
+	if err != nil {
+		t.Errorf("passwordHash error: %v", err)
+		return
+	}
+	if cost, err := bcrypt.Cost(hash); err != nil || cost != config.BcryptCost {
+		t.Errorf("hash cost: %d, expected: %d, error: %v", cost, config.BcryptCost, err)
+		return
+	}
+
+	tests := []struct {
+		algorithm   string
+		bcryptCost  int
+		memory      uint32
+		parallelism uint8
+		valid       bool
+	}{
+		{PasswordHashBcrypt, 0, 0, 0, true},
+		{PasswordHashBcrypt, bcrypt.MaxCost, 0, 0, true},
+		{PasswordHashBcrypt, defaultBcryptCost - 1, 0, 0, false},
+		{PasswordHashBcrypt, bcrypt.MaxCost + 1, 0, 0, false},
+		{PasswordHashArgon2id, 0, 16, 2, true},
+		{PasswordHashArgon2id, 0, 15, 2, false},
+		{"scrypt", 0, 0, 0, false},
+	}
+	for i, tc := range tests {
+		config.PasswordHashAlgorithm, config.BcryptCost = tc.algorithm, tc.bcryptCost
+		config.Argon2idMemory, config.Argon2idParallelism = tc.memory, tc.parallelism
+		if err := passwordHashConfigLoad(); (err == nil) != tc.valid {
+			t.Errorf("test %d, passwordHashConfigLoad error: %v", i, err)
+			return
+		}
+	}
+	if config.Argon2idTime != defaultArgon2idTime {
+		t.Errorf("Argon2idTime default not set: %d", config.Argon2idTime)
+		return
+	}
+}
@@ -0,0 +1,201 @@
+package authjwt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// AuditRecord is an audit log record, as stored when Config.AuditStore is true and returned
+// from PathAuditExport.
+type AuditRecord struct {
+	// Auth identifies the caller; the Email (or pseudonym, with
+	// Config.AuditPseudonymizeEmails) for authenticated callers, or Config.AuditNoAuthMarker.
+	Auth string
+	// Cursor identifies the record; pass as query parameter after to continue an export.
+	Cursor  string
+	Message string
+	Method  string
+	Status  int
+	Time    time.Time
+	URL     string
+}
+
+const (
+	// auditCursorFormat formats the kvsAudit key, so that keys sort in time order.
+	auditCursorFormat = "%020d-%s"
+	// auditPseudonymKeyLength is the length in bytes of a generated audit pseudonym key.
+	auditPseudonymKeyLength = 32
+	// auditPseudonymLength is the length in bytes of the hash used as a pseudonym; the
+	// pseudonym is hex encoded.
+	auditPseudonymLength = 16
+	// auditPseudonymPrefix identifies pseudonyms in the audit log.
+	auditPseudonymPrefix = "pseudonym:"
+)
+
+var (
+	// auditPseudonymKey is the key used to hash emails; config.AuditPseudonymKey or a
+	// generated key.
+	auditPseudonymKey []byte
+)
+
+// auditEmail returns email as written to the audit log; a pseudonym when
+// config.AuditPseudonymizeEmails is true, otherwise email.
+func auditEmail(email string) string {
+	if !config.AuditPseudonymizeEmails {
+		return email
+	}
+	mac := hmac.New(sha256.New, auditPseudonymKey)
+	mac.Write([]byte(email))
+	return auditPseudonymPrefix + hex.EncodeToString(mac.Sum(nil)[:auditPseudonymLength])
+}
+
+// auditExport writes, as newline delimited JSON, the stored audit records with a Time in
+// [from, to) and a Cursor after the specified cursor, in time order. limit, when not zero,
+// is the maximum number of records written. Only keys are held in memory; records are
+// read and written one at a time.
+func auditExport(w http.ResponseWriter, from time.Time, to time.Time, after string, limit int) error {
+	keys, err := kvsAudit.Keys()
+	if err != nil {
+		return runtimeh.SourceInfoError("kvsAudit.Keys error", err)
+	}
+	sort.Strings(keys)
+
+	fromKey, toKey := "", ""
+	if !from.IsZero() {
+		fromKey = fmt.Sprintf(auditCursorFormat, from.UnixNano(), "")
+	}
+	if !to.IsZero() {
+		toKey = fmt.Sprintf(auditCursorFormat, to.UnixNano(), "")
+	}
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	written := 0
+	for _, key := range keys {
+		if key < fromKey || key <= after {
+			continue
+		}
+		if toKey != "" && key >= toKey {
+			break
+		}
+		if limit != 0 && written >= limit {
+			break
+		}
+		ar := AuditRecord{}
+		if err := kvsAudit.Deserialize(key, &ar); err != nil {
+			return runtimeh.SourceInfoError("kvsAudit.Deserialize error", err)
+		}
+		if err := enc.Encode(ar); err != nil {
+			return runtimeh.SourceInfoError("Encode error", err)
+		}
+		written++
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
+
+// auditPseudonymKeyLoad sets auditPseudonymKey from config.AuditPseudonymKey, or generates a
+// random key.
+func auditPseudonymKeyLoad() error {
+	if len(config.AuditPseudonymKey) > 0 {
+		auditPseudonymKey = config.AuditPseudonymKey
+		return nil
+	}
+	auditPseudonymKey = make([]byte, auditPseudonymKeyLength)
+	if _, err := rand.Read(auditPseudonymKey); err != nil {
+		return runtimeh.SourceInfoError("generating audit pseudonym key", err)
+	}
+	return nil
+}
+
+// auditRecords returns the stored audit records for email, in time order.
+func auditRecords(email string) ([]AuditRecord, error) {
+	keys, err := kvsAudit.Keys()
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("kvsAudit.Keys error", err)
+	}
+	sort.Strings(keys)
+	ars := []AuditRecord{}
+	for _, key := range keys {
+		ar := AuditRecord{}
+		if err := kvsAudit.Deserialize(key, &ar); err != nil {
+			return nil, runtimeh.SourceInfoError("kvsAudit.Deserialize error", err)
+		}
+		if ar.Auth == auditEmail(email) {
+			ars = append(ars, ar)
+		}
+	}
+	return ars, nil
+}
+
+// auditStore stores ar in kvsAudit; the Cursor is set from ar.Time.
+func auditStore(ar AuditRecord) error {
+	id, err := uniqueID(false)
+	if err != nil {
+		return runtimeh.SourceInfoError("auditStore error", err)
+	}
+	ar.Cursor = fmt.Sprintf(auditCursorFormat, ar.Time.UnixNano(), id)
+	if err := kvsAudit.Serialize(ar.Cursor, ar); err != nil {
+		return runtimeh.SourceInfoError("kvsAudit.Serialize error", err)
+	}
+	return nil
+}
+
+// handlerAuditExport streams stored audit records, as newline delimited JSON, to admins.
+// Query parameters: from and to (RFC3339) limit the time range; after (a Cursor) continues
+// a prior export; limit is the maximum number of records.
+func handlerAuditExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get the claims, in order to verify the caller is an admin.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	if !adminAuthorized(w, r, claims) {
+		return
+	}
+
+	q := r.URL.Query()
+	var from, to time.Time
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if err := auditExport(w, from, to, q.Get("after"), limit); err != nil {
+		lpf(logh.Error, "auditExport error:%v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package authjwt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHandlerAuditExport verifies stored audit records are exported in time order for a time
+// range, an export continues from a cursor, and only admins can export.
+func TestHandlerAuditExport(t *testing.T) {
+	testSetup()
+	config.AuditStore = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Stored out of order; the export is in time order.
+	for _, h := range []int{3, 0, 2, 1, 4} {
+		ar := AuditRecord{Auth: em, Method: http.MethodPost,
+			Status: http.StatusOK, Time: base.Add(time.Duration(h) * time.Hour)}
+		if err := auditStore(ar); err != nil {
+			t.Errorf("auditStore error: %v", err)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerAuditExport)))
+	defer testServer.Close()
+	client := &http.Client{}
+	export := func(q url.Values) ([]AuditRecord, int, error) {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer resp.Body.Close()
+		var ars []AuditRecord
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			ar := AuditRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), &ar); err != nil {
+				return nil, 0, err
+			}
+			ars = append(ars, ar)
+		}
+		return ars, resp.StatusCode, scanner.Err()
+	}
+
+	q := url.Values{"from": {base.Add(time.Hour).Format(time.RFC3339)}, "to": {base.Add(4 * time.Hour).Format(time.RFC3339)}}
+	if _, status, err := export(q); err != nil || status != http.StatusForbidden {
+		t.Errorf("non admin export did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if err := AuthRolesSet(em, []string{RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+
+	ars, status, err := export(q)
+	if err != nil || status != http.StatusOK || len(ars) != 3 {
+		t.Errorf("export did not return proper status: %d, records: %+v, error: %v", status, ars, err)
+		return
+	}
+	for i, ar := range ars {
+		if !ar.Time.Equal(base.Add(time.Duration(i+1)*time.Hour)) || ar.Cursor == "" || ar.Auth != em {
+			t.Errorf("record %d out of order or incomplete: %+v", i, ar)
+			return
+		}
+	}
+
+	q.Set("after", ars[0].Cursor)
+	q.Set("limit", "1")
+	next, status, err := export(q)
+	if err != nil || status != http.StatusOK || len(next) != 1 || next[0].Cursor != ars[1].Cursor {
+		t.Errorf("export with cursor did not return proper status: %d, records: %+v, error: %v", status, next, err)
+		return
+	}
+
+	q.Set("from", "yesterday")
+	if _, status, err := export(q); err != nil || status != http.StatusBadRequest {
+		t.Errorf("export with bad from did not return proper status: %d, error: %v", status, err)
+		return
+	}
+}
+
+// TestAuditLogStore verifies DELETE/POST/PUT requests through the wrappers are stored when
+// AuditStore is set, at the time from TimeSource.
+func TestAuditLogStore(t *testing.T) {
+	testSetup()
+	config.AuditStore = true
+	now := time.Now().Add(time.Hour)
+	config.TimeSource = func() time.Time { return now }
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerTest)))
+	defer testServer.Close()
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req, err := http.NewRequest(method, testServer.URL+"/path", nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusNoContent {
+			t.Errorf("request did not return proper status: %d, error: %v", resp.StatusCode, err)
+			return
+		}
+	}
+
+	keys, err := kvsAudit.Keys()
+	if err != nil || len(keys) != 1 {
+		t.Errorf("wrong audit records: %v, error: %v", keys, err)
+		return
+	}
+	ar := AuditRecord{}
+	if err := kvsAudit.Deserialize(keys[0], &ar); err != nil {
+		t.Errorf("Deserialize error: %v", err)
+		return
+	}
+	if ar.Method != http.MethodPost || ar.URL != "/path" || ar.Auth != config.AuditNoAuthMarker ||
+		ar.Status != http.StatusNoContent || !ar.Time.Equal(now) {
+		t.Errorf("wrong audit record: %+v", ar)
+		return
+	}
+}
+
+// TestAuditSampleRate verifies read requests are audited at approximately AuditSampleRate,
+// and writes are always audited.
+func TestAuditSampleRate(t *testing.T) {
+	testSetup()
+
+	for _, rate := range []float64{0, 0.1, 0.5, 1} {
+		config.AuditSampleRate = rate
+		n := 10000
+		sampled := 0
+		for i := 0; i < n; i++ {
+			if auditSampled() {
+				sampled++
+			}
+		}
+		if actual := float64(sampled) / float64(n); actual < rate-0.03 || actual > rate+0.03 {
+			t.Errorf("rate: %f, sampled: %f", rate, actual)
+			return
+		}
+	}
+
+	config.AuditStore = true
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerTest)))
+	defer testServer.Close()
+	tests := []struct {
+		rate    float64
+		method  string
+		records int
+	}{
+		{0, http.MethodGet, 0},
+		{0, http.MethodPost, 1},
+		{1, http.MethodGet, 2},
+	}
+	for i, tc := range tests {
+		config.AuditSampleRate = tc.rate
+		req, err := http.NewRequest(tc.method, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusNoContent {
+			t.Errorf("test %d did not return proper status: %d, error: %v", i, resp.StatusCode, err)
+			return
+		}
+		keys, err := kvsAudit.Keys()
+		if err != nil || len(keys) != tc.records {
+			t.Errorf("test %d, wrong number of audit records: %d, error: %v", i, len(keys), err)
+			return
+		}
+	}
+}
+
+// TestAuditPseudonymizeEmails verifies the audit log has a stable pseudonym of the email when
+// AuditPseudonymizeEmails is set, and the email otherwise.
+func TestAuditPseudonymizeEmails(t *testing.T) {
+	for _, pseudonymize := range []bool{false, true} {
+		t.Run(fmt.Sprintf("pseudonymize %t", pseudonymize), func(t *testing.T) {
+			auditPath := auditLogSetup(t)
+			defer auditLogShutdown()
+			testSetup()
+			config.AuditPseudonymizeEmails = pseudonymize
+			config.AuditStore = true
+
+			em, credBytes, err := createAuth(t, nil)
+			if err != nil {
+				return
+			}
+			tokenBytes, _, err := login(t, credBytes)
+			if err != nil {
+				return
+			}
+			testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+			defer testServer.Close()
+			for i := 0; i < 2; i++ {
+				req, err := http.NewRequest(http.MethodPost, testServer.URL, nil)
+				if err != nil {
+					t.Errorf("NewRequest error: %v", err)
+					return
+				}
+				req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil || resp.StatusCode != http.StatusNoContent {
+					t.Errorf("request did not return proper status: %d, error: %v", resp.StatusCode, err)
+					return
+				}
+			}
+
+			auth := em
+			if pseudonymize {
+				auth = auditEmail(em)
+				if !strings.HasPrefix(auth, auditPseudonymPrefix) || auditLogContains(t, auditPath, em) {
+					t.Errorf("audit log contains the email, pseudonym: %s", auth)
+					return
+				}
+			}
+			if !auditLogContains(t, auditPath, "auth: "+auth+"|") {
+				t.Errorf("audit log does not contain auth: %s", auth)
+				return
+			}
+			ars, err := auditRecords(em)
+			if err != nil || len(ars) != 2 || ars[0].Auth != ars[1].Auth || ars[0].Auth != auth {
+				t.Errorf("wrong audit records: %+v, error: %v", ars, err)
+				return
+			}
+		})
+	}
+}
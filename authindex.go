@@ -0,0 +1,112 @@
+package authjwt
+
+import (
+	"fmt"
+
+	"github.com/paulfdunn/go-helper/databaseh/kvs"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// authIndex is a store of the identifier of the auth, by the value of a unique attribute of
+// auths; I.E. the ContactEmail. Entries for auths that no longer have the value are ignored.
+type authIndex struct {
+	name  string
+	store kvs.KVS
+	field func(auth *authentication) *string
+}
+
+// authIndexes returns the authIndex of each indexed attribute.
+func authIndexes() []authIndex {
+	return []authIndex{contactEmailIndex(), phoneIndex()}
+}
+
+// contactEmailIndex returns the authIndex of ContactEmail.
+func contactEmailIndex() authIndex {
+	return authIndex{name: "contact email", store: kvsContactEmail, field: func(auth *authentication) *string { return &auth.ContactEmail }}
+}
+
+// phoneIndex returns the authIndex of Phone.
+func phoneIndex() authIndex {
+	return authIndex{name: "phone", store: kvsPhone, field: func(auth *authentication) *string { return &auth.Phone }}
+}
+
+// authIndexesMove updates the entries of each authIndex for the values of auth to identifier;
+// I.E. after the identifier of auth is changed, or to remove the entries when identifier is
+// empty.
+func authIndexesMove(auth authentication, identifier string) error {
+	for _, ai := range authIndexes() {
+		value := *ai.field(&auth)
+		if value == "" {
+			continue
+		}
+		if identifier == "" {
+			if _, err := ai.store.Delete(value); err != nil {
+				return runtimeh.SourceInfoError(ai.name+" index Delete error", err)
+			}
+			continue
+		}
+		if err := ai.store.Set(value, []byte(identifier)); err != nil {
+			return runtimeh.SourceInfoError(ai.name+" index Set error", err)
+		}
+	}
+	return nil
+}
+
+// identifier returns the identifier of the auth with value, or empty if there is none.
+func (ai authIndex) identifier(value string) (string, error) {
+	b, err := ai.store.Get(value)
+	if err != nil {
+		return "", runtimeh.SourceInfoError(ai.name+" index Get error", err)
+	}
+	if b == nil {
+		return "", nil
+	}
+	auth, err := authGet(string(b))
+	if err != nil {
+		return "", err
+	}
+	if auth.Email == nil || *ai.field(&auth) != value {
+		return "", nil
+	}
+	return *auth.Email, nil
+}
+
+// set sets the attribute of the existing auth for identifier to value, or clears it when value
+// is empty. ErrAuthExists is returned (wrapped) if value is that of another auth.
+func (ai authIndex) set(identifier string, value string) error {
+	authCreateMutex.Lock()
+	defer authCreateMutex.Unlock()
+
+	if value != "" {
+		owner, err := ai.identifier(value)
+		if err != nil {
+			return err
+		}
+		if owner != "" && owner != identifier {
+			return fmt.Errorf("%s %s of another auth, %w", runtimeh.SourceInfo(), ai.name, ErrAuthExists)
+		}
+	}
+	auth, err := authGet(identifier)
+	if err != nil {
+		return err
+	}
+	if auth.Email == nil {
+		return fmt.Errorf("%s auth does not exist for email: %s", runtimeh.SourceInfo(), identifier)
+	}
+	previous := *ai.field(&auth)
+	*ai.field(&auth) = value
+	if err := authCreate(auth); err != nil {
+		return err
+	}
+	if previous != "" && previous != value {
+		if _, err := ai.store.Delete(previous); err != nil {
+			return runtimeh.SourceInfoError(ai.name+" index Delete error", err)
+		}
+	}
+	if value != "" {
+		if err := ai.store.Set(value, []byte(identifier)); err != nil {
+			return runtimeh.SourceInfoError(ai.name+" index Set error", err)
+		}
+	}
+	return nil
+}
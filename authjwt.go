@@ -3,14 +3,21 @@ package authjwt
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -23,13 +30,175 @@ import (
 )
 
 type Config struct {
-	// AppName is used to populate the Issuer field of the Claims.
+	// AdminIPAllowlist, when not empty, is the CIDRs (I.E. 10.0.0.0/8) from which admin requests
+	// are allowed; admin requests from other IPs get http.StatusForbidden.
+	AdminIPAllowlist []string
+	// AllowReinitialize, when true, allows Init to be called again, replacing this
+	// configuration; the stores opened by this Init are closed first. Otherwise further calls
+	// to Init log a warning and are ignored.
+	AllowReinitialize bool
+	// APIKeysEnabled allows users to create API keys at PathAPIKeys. Requests through
+	// HandlerFuncAuthJWTWrapper may then authenticate with an API key in the X-API-Key
+	// header instead of a token. API keys cannot be used with the authjwt handlers.
+	APIKeysEnabled bool
+	// AppName is used to populate the Issuer field of the Claims, when Issuer is empty.
 	AppName string
+	// Argon2idMemory is the memory, in KiB, used to hash passwords with PasswordHashArgon2id.
+	// Init is fatal for less than 8 KiB per lane of Argon2idParallelism. If zero the default
+	// is used: 65536 (64 MiB)
+	Argon2idMemory uint32
+	// Argon2idParallelism is the number of lanes used to hash passwords with
+	// PasswordHashArgon2id. If zero the default is used: 4
+	Argon2idParallelism uint8
+	// Argon2idTime is the number of passes over memory used to hash passwords with
+	// PasswordHashArgon2id. If zero the default is used: 3
+	Argon2idTime uint32
+	// Audience, when not empty, is the Audience of issued access and single use tokens, and
+	// tokens with any other Audience are rejected. Set when multiple services share a signing
+	// key, so tokens issued for one service cannot be used at another. When empty, tokens are
+	// issued with AudienceAccess and the Audience is not validated.
+	Audience string
 	// AuditLogName is the name of the logh logger for the audit log. Callers
 	// must create their own logh loggers or output will go to STDOUT.
 	AuditLogName string
+	// AuditNoAuthMarker is logged in the auth field of audit records written by
+	// HandlerFuncNoAuthWrapper, so unauthenticated state changes stand out from authenticated
+	// ones, which log the caller's Email. If empty the default is used: none
+	AuditNoAuthMarker string
+	// AuditPseudonymizeEmails, when true, writes a pseudonym of each email to the audit log
+	// and stored audit records, instead of the email. The pseudonym is a keyed hash, so the
+	// same email always has the same pseudonym and events can still be correlated.
+	AuditPseudonymizeEmails bool
+	// AuditPseudonymKey is the key used to hash emails for AuditPseudonymizeEmails. All
+	// instances writing the same audit log should use the same key. If empty, a random key is
+	// generated by Init, and pseudonyms change when the process restarts.
+	AuditPseudonymKey []byte
+	// AuditSampleRate is the fraction, from 0 to 1, of read (I.E. GET) requests through the
+	// wrappers written to the audit log, so high volume endpoints do not flood the log.
+	// DELETE/POST/PUT requests are always written. Zero writes no read requests.
+	AuditSampleRate float64
+	// AuditStore, when true, also stores audit records in the DataSourcePath database, so
+	// admins can export them from PathAuditExport; I.E. for SIEM ingestion.
+	AuditStore bool
+	// BcryptCost is the bcrypt cost used to hash passwords with PasswordHashBcrypt; each
+	// increment doubles the time to hash and verify. Init is fatal for values less than the
+	// default, or greater than 31. If zero the default is used: 10
+	BcryptCost int
+	// BreachedPasswordChecker, when not nil, is called with the upper case hex SHA-1 hash of
+	// passwords when they are set, and returns true if the password is known to be breached;
+	// I.E. from a local bloom filter of the Have I Been Pwned hashes. Breached passwords are
+	// rejected by the password policy. Checked before BreachedPasswordURL.
+	BreachedPasswordChecker func(sha1Hex string) (bool, error)
+	// BreachedPasswordFailClosed, when true, rejects passwords when BreachedPasswordChecker or
+	// BreachedPasswordURL return an error. Otherwise the error is logged and the password is
+	// accepted, so an unavailable API does not block registration.
+	BreachedPasswordFailClosed bool
+	// BreachedPasswordURL, when not empty, is the URL of a Have I Been Pwned compatible range
+	// API, I.E. https://api.pwnedpasswords.com/range/, with which passwords are checked when
+	// they are set; breached passwords are rejected by the password policy. The first 5 hex
+	// characters of the SHA-1 hash of the password are appended to the URL; the password and
+	// full hash are not sent (k-anonymity).
+	BreachedPasswordURL string
+	// CheckAccountStateOnVerify, when true, rejects tokens and API keys of auths that are
+	// deleted or disabled (see AuthDisabledSet), even when the token is otherwise valid and
+	// not revoked. This adds a lookup of the auth to each authentication.
+	CheckAccountStateOnVerify bool
+	// ClaimsEnricher, when not nil, is called with the email each time an access token is
+	// created, including on refresh, and the returned claims are added to the token in
+	// CustomClaims.Extra; I.E. roles, tenant IDs, or feature flags. An error fails the token
+	// creation, so the request (I.E. login) fails.
+	ClaimsEnricher func(email string) (map[string]any, error)
+	// ClockSkewLeeway is allowed when validating the exp, iat, and nbf claims of tokens, for
+	// clock drift between the servers issuing and verifying tokens; I.E. 30 seconds. Zero
+	// allows none. Must not be negative.
+	ClockSkewLeeway time.Duration
+	// CSRFKey is the key used to sign CSRF tokens. All instances accepting the same tokens
+	// must use the same key. If empty, a random key is generated by Init.
+	CSRFKey []byte
+	// CSRFProtection, when true, requires DELETE/POST/PUT requests through
+	// HandlerFuncAuthJWTWrapper to include a CSRF token for the session in the X-CSRF-Token
+	// header, as returned from PathCSRFToken.
+	CSRFProtection bool
 	// DataSourcePath is the path to the SQLITE database used to persist auth and tokens.
 	DataSourcePath string
+	// DPoPEnabled, when true, binds the tokens issued at login to the key of the client, when
+	// the login request has a DPoP proof, RFC 9449. Bound tokens are only accepted in the
+	// Authorization header with the DPoP scheme, and a DPoP proof signed with the key; refreshed
+	// tokens keep the binding.
+	DPoPEnabled bool
+	// DPoPProofMaxAge is the maximum age of DPoP proofs, from the iat claim. If zero the default
+	// is used: 1 minute
+	DPoPProofMaxAge time.Duration
+	// DPoPRequired, when true, rejects login requests without a DPoP proof, so all tokens from
+	// login are bound; implies DPoPEnabled. Impersonation tokens are not bound.
+	DPoPRequired bool
+	// DeleteRequiresPassword, when true, requires the body of delete requests to be a
+	// Credential with the callers Password, so a stolen token alone cannot delete the auth.
+	DeleteRequiresPassword bool
+	// EmailChangeEnabled enables users changing their Email; a single use token is sent with
+	// TokenSender to the new Email when a change is requested at PathEmailChange, and the
+	// Email is changed when that token is confirmed at PathEmailChangeConfirm.
+	EmailChangeEnabled bool
+	// EmailChangeExpirationInterval is the duration for which an email change token is valid.
+	// If zero the default is used: 1 hour
+	EmailChangeExpirationInterval time.Duration
+	// EmailHistory, when true, keeps the prior Email, and the time of the change, in the
+	// PreviousEmails of the auth when the Email is changed with AuthEmailChange.
+	EmailHistory bool
+	// EmailNormalize, when true, normalizes Emails when auths are created, at login, when
+	// requesting tokens by Email, and in admin lookups and changes by Email; trimmed, Unicode
+	// normalized with EmailUnicodeNormalizer, and lower case, so User@auth.com and
+	// user@auth.com are the same auth. Init migrates existing auths with AuthEmailsNormalize.
+	EmailNormalize bool
+	// EmailUnicodeNormalizer, when not nil, is applied to Emails by EmailNormalize before
+	// lower casing; I.E. norm.NFC.String of golang.org/x/text/unicode/norm, on which this
+	// package does not depend. If nil Emails are not Unicode normalized.
+	EmailUnicodeNormalizer func(email string) string
+	// EmailUniqueCaseInsensitive, when true, rejects creating an auth when an auth exists for
+	// an Email differing only in case; User@auth.com cannot be created when user@auth.com
+	// exists. The stored Email keeps the case used at create.
+	EmailUniqueCaseInsensitive bool
+	// EnableTokenInvalidation is whether HandlerFuncAuthJWTWrapper checks that tokens are
+	// still in the token store, so logged out and revoked tokens are rejected. true requires a
+	// DataSourcePath; Init is fatal without one. false explicitly accepts any validly signed,
+	// unexpired token; I.E. for independent services without access to the token store. If
+	// nil, token invalidation is only checked when there is a DataSourcePath, and Init logs a
+	// warning when there is not.
+	EnableTokenInvalidation *bool
+	// EventHandler, when not nil, is called with an Event for each change to an auth.
+	// It is called synchronously; long running work should be done in a separate GO routine.
+	EventHandler func(Event)
+	// FirstUserIsAdmin, when true, gives the first auth created, when there are no auths, the
+	// role RoleAdmin; I.E. to bootstrap self-hosted deployments. Only one auth can be first.
+	FirstUserIsAdmin bool
+	// IdentifierValidator validates the identifier (Credential.Email) in AuthCreate. Use this
+	// for deployments that identify users by something other than an email address, such as
+	// a phone number or employee ID; IdentifierValidateUsername accepts usernames. If nil,
+	// identifierValidateEmail is used.
+	IdentifierValidator func(string) error
+	// IdleTimeout, when not zero, expires tokens that are not used for IdleTimeout; each
+	// authenticated request extends the expiration of the token, tracked in kvsToken, so active
+	// users stay logged in and idle sessions end. Tokens still expire at their exp claim, so
+	// JWTAuthExpirationInterval is the maximum session length. Each request then writes to the
+	// token store. Not enforced by AuthenticatedNoTokenInvalidation.
+	IdleTimeout time.Duration
+	// ImpersonationExpirationInterval is the duration for which impersonation tokens, issued at
+	// PathImpersonate, are valid. If zero the default is used: 15 minutes
+	ImpersonationExpirationInterval time.Duration
+	// IssueIDToken, when true, adds a signed ID token, with the profile claims of the user in
+	// IDClaims, to the login response; the response is then LoginTokens as JSON. ID tokens
+	// have Audience AudienceID and are rejected for authentication.
+	IssueIDToken bool
+	// IssueRefreshToken, when true, adds a refresh token to the login response; the response
+	// is then LoginTokens as JSON. Refresh tokens are exchanged at PathToken for a new access
+	// token, so JWTAuthExpirationInterval can be short without frequent logins. Each refresh
+	// token is single use; the exchange returns a new refresh token. Logout-all revokes the
+	// refresh tokens of the user.
+	IssueRefreshToken bool
+	// Issuer, when not empty, is the Issuer of issued tokens, and tokens with any other Issuer
+	// are rejected. When empty, tokens are issued with AppName and the Issuer is not
+	// validated.
+	Issuer string
 	// CreateRequiresAuth - when true, requires an already authorized caller to create new
 	// credentials. When false any caller can create their own auth.
 	CreateRequiresAuth bool
@@ -37,30 +206,220 @@ type Config struct {
 	// tokens, and invalidates all expired tokens. (A user can login from multiple devices
 	// and can have more than one outstanding token.)
 	JWTAuthRemoveInterval time.Duration
+	// JWTAllowedAlgorithms are the token signing algorithms accepted when verifying tokens;
+	// tokens with any other alg header, including none, are rejected. Supported values are
+	// RS256, RS384, RS512, and EdDSA. If empty the default is used: with RemoteJWKSURL all
+	// supported values, otherwise JWTSigningAlgorithm and the algorithms of the keys of
+	// JWTPreviousPublicKeyPaths. The accepted algorithms are logged by Init.
+	JWTAllowedAlgorithms []string
 	// JWTAuthExpirationInterval is the duration for which a token is valid.
 	JWTAuthExpirationInterval time.Duration
-	// JWTPrivateKeyPath is the path to the private key used for signing the tokens.
+	// JWTPreviousPublicKeyPaths are paths to the public keys of previous signing keys; PEM
+	// encoded PKIX RSA or Ed25519 keys. Tokens signed by these keys, identified by the kid
+	// header, are accepted until they expire. To rotate keys, add the current JWTPublicKeyPath
+	// here, then set JWTPrivateKeyPath and JWTPublicKeyPath to the new key.
+	JWTPreviousPublicKeyPaths []string
+	// JWTPrivateKeyPath is the path to the private key used for signing the tokens; a PEM
+	// encoded PKCS8 key of the type for JWTSigningAlgorithm.
 	JWTPrivateKeyPath string
-	// JWTPublicKeyPath is the path to the public key used for signing the tokens.
+	// JWTPublicKeyPath is the path to the public key used for signing the tokens; a PEM
+	// encoded PKIX key of the type for JWTSigningAlgorithm.
 	JWTPublicKeyPath string
+	// JWTSigningAlgorithm is the algorithm used to sign tokens, and the only algorithm
+	// accepted when verifying with JWTPublicKeyPath; SigningAlgorithmRS256 (RSA keys) or
+	// SigningAlgorithmEdDSA (Ed25519 keys). If empty the default is used: RS256
+	JWTSigningAlgorithm string
+	// LockoutDuration is how long an account, or source IP, is locked when the lockout
+	// threshold is reached; doubled for each further failed login, up to LockoutMaxDuration.
+	// Locked logins get http.StatusTooManyRequests with a Retry-After. If zero the default is
+	// used: 1 minute
+	LockoutDuration time.Duration
+	// LockoutIPThreshold is the number of failed logins from a source IP, for any email, before
+	// the IP is locked out. Zero disables tracking by IP.
+	LockoutIPThreshold int
+	// LockoutMaxDuration is the longest lockout. Failed logins are forgotten LockoutMaxDuration
+	// after the last failure, or the end of the lockout. If zero the default is used: 1 hour
+	LockoutMaxDuration time.Duration
+	// LockoutMaxRecords bounds the number of accounts and source IPs with failed logins that
+	// are tracked; the oldest are forgotten first. If zero the default is used: 100000
+	LockoutMaxRecords int
+	// LockoutThreshold is the number of failed logins for an account before the account is
+	// locked out; a successful login resets the count. Unknown emails are tracked the same
+	// way, so lockouts do not reveal which emails are registered. Zero disables tracking by
+	// account.
+	LockoutThreshold int
+	// LoginByContactEmail, when true, allows login with the ContactEmail of an auth, set with
+	// AuthContactEmailSet, instead of the identifier; I.E. for auths identified by username.
+	// Tokens are issued for the identifier.
+	LoginByContactEmail bool
 	// LogName is the name of the logh logger for general logging. Callers
 	// must create their own logh loggers or output will go to STDOUT.
 	LogName string
+	// LogSecretPrefixLength is the number of leading characters of tokens, API keys, and other
+	// secrets shown in logs; the rest is masked. Secrets shorter than twice the length are
+	// masked entirely, as are all secrets when negative. If zero the default is used: 4
+	LogSecretPrefixLength int
+	// MagicLinkEnabled enables passwordless login; a single use token is sent with TokenSender
+	// to a caller requesting a magic link, and that token is exchanged for a normal token.
+	MagicLinkEnabled bool
+	// MagicLinkExpirationInterval is the duration for which a magic link token is valid.
+	// If zero the default is used: 15 minutes
+	MagicLinkExpirationInterval time.Duration
+	// MaxAuthRecordSize limits the size in bytes of a serialized auth, so roles and other
+	// data cannot bloat the store. Creates and updates of larger auths fail with
+	// ErrAuthRecordTooLarge. Zero means no limit.
+	MaxAuthRecordSize int
+	// MaxConcurrentLogins limits the number of logins concurrently verifying a password, to
+	// prevent password hashing from exhausting CPU under a flood of logins. Logins, and checks
+	// from PathCheckPassword, beyond the limit get http.StatusServiceUnavailable with a
+	// Retry-After header. Zero means no limit.
+	MaxConcurrentLogins int
+	// MaxTokenDeletesPerRequest limits the number of tokens deleted by one logout-all request,
+	// so a user with many tokens cannot tie up the request and the store. When tokens remain,
+	// the status is http.StatusAccepted and the body is an Info with the OutstandingTokens;
+	// repeat the request to continue. The token used for the request is deleted last.
+	// Zero means no limit.
+	MaxTokenDeletesPerRequest int
+	// MaxSessionLifetime, when not zero, is the maximum age of a session regardless of
+	// refreshes or activity; tokens expire at most MaxSessionLifetime after the login that
+	// started the session, the AuthTime claim, and refresh fails after. Zero means sessions
+	// are not limited.
+	MaxSessionLifetime time.Duration
+	// MaxTokenTTL, when not zero, is the maximum duration for which a token is valid when
+	// the auth has a TokenTTLOverride, or from TokenTTLResolver or RoleTokenTTLs; longer TTLs
+	// are clamped to MaxTokenTTL.
+	MaxTokenTTL time.Duration
+	// MTLSBoundTokens, when true, binds the tokens issued at login to the TLS client certificate
+	// of the login request, RFC 8705, so they are only accepted on connections with the same
+	// certificate; refreshed tokens keep the binding. Requires this server to terminate TLS,
+	// with a tls.Config ClientAuth that requests client certificates; requests without a
+	// certificate get tokens that are not bound.
+	MTLSBoundTokens bool
+	// OneTimeTokenIDLength is the number of random bytes in the TokenID (nonce) of single use
+	// tokens, such as magic links. If zero the default is used: 16 (128 bits)
+	// Init is fatal for values less than the default.
+	OneTimeTokenIDLength int
+	// PasswordChangeKeepSession, when true, keeps the token used to change a password at
+	// PathPassword or PathCreateOrUpdate; all other tokens, and single use tokens including
+	// refresh tokens, of the auth are always removed when the password changes.
+	PasswordChangeKeepSession bool
+	// PasswordChangeWithoutCurrent, when true, allows PUT at PathCreateOrUpdate with the access
+	// token of the auth being updated, so users change their password without the current
+	// password. By default those requests get http.StatusForbidden, and users change their
+	// password at PathPassword, with the current password. PurposeChangePassword tokens, I.E.
+	// for recovery and MustChangePassword, and admins updating another auth are accepted.
+	PasswordChangeWithoutCurrent bool
+	// PasswordHashAlgorithm is the algorithm used to hash passwords when they are set;
+	// PasswordHashBcrypt or PasswordHashArgon2id. Passwords are verified with the algorithm
+	// of the stored hash, so existing hashes remain valid when this changes, and are hashed
+	// again with this algorithm, and the current cost parameters, at the next login. If empty
+	// the default is used: bcrypt
+	PasswordHashAlgorithm string
+	// PasswordHistoryLength, when not zero, is the number of passwords, including the current
+	// password, that cannot be reused when the password of an existing auth is changed; the
+	// prior password hashes are kept with the auth. Reuse is rejected by the password policy.
+	PasswordHistoryLength int
+	// PasswordMaxAge, when not zero, is the maximum age of passwords. Logins with an expired
+	// password are treated as with MustChangePassword; only a token for changing the password
+	// is returned, with the X-Password-Change-Required header, and refresh and remember me
+	// tokens are rejected. Passwords set before the change time was recorded expire
+	// PasswordMaxAge after the next login.
+	PasswordMaxAge time.Duration
+	// PasswordPepper, when not empty, is a secret of at least 32 bytes mixed into password
+	// hashes with HMAC-SHA256, so the stored hashes alone are insufficient for offline
+	// cracking. The application provides it, I.E. from an environment variable or a KMS; it
+	// must not be stored in the DataSourcePath database. Existing hashes, and hashes with one
+	// of PasswordPreviousPeppers, still verify, and are hashed with PasswordPepper at the next
+	// login.
+	PasswordPepper []byte
+	// PasswordPolicy, when not nil, is the password policy enforced when passwords are set,
+	// in addition to PasswordValidation; defaultPasswordValidation is not used unless
+	// PasswordValidation is set to it. Passwords that do not meet the policy are rejected
+	// with a PasswordPolicyError, or at the ReST API http.StatusBadRequest and a
+	// PasswordCheck body with the reason for each rule not met.
+	PasswordPolicy *PasswordPolicy
+	// PasswordPreviousPeppers are previous values of PasswordPepper; hashes with these are
+	// verified until users login again. Keep a pepper here until all users have logged in
+	// since it was replaced, or their passwords are reset. To remove the pepper, set
+	// PasswordPepper empty and keep it here.
+	PasswordPreviousPeppers [][]byte
+	// PasswordResetEnabled enables the forgot password flow; a single use reset token is sent
+	// with TokenSender to a caller requesting a reset at PathPasswordResetRequest, and that
+	// token sets a new password at PathPasswordReset.
+	PasswordResetEnabled bool
+	// PasswordResetExpirationInterval is the duration for which a password reset token is
+	// valid. If zero the default is used: 15 minutes
+	PasswordResetExpirationInterval time.Duration
+	// PasswordTrim is how leading and trailing whitespace in passwords is handled. The same
+	// handling is applied when a password is set and when it is verified at login, so users
+	// are not locked out by invisible characters. The default is PasswordTrimSpace.
+	PasswordTrim PasswordTrimMode
 	// PasswordValidation is a slice of REGEX used for password validation. If nothing is
-	// provided, defaultPasswordValidation is used.
+	// provided, and PasswordPolicy is nil, defaultPasswordValidation is used.
 	PasswordValidation []string
+	// PathAuditExport is the final portion of the URL path for exporting stored audit
+	// records. If empty the default is used: /auth/audit-export
+	// Valid HTTP methods: http.MethodGet
+	PathAuditExport string
+	// PathCheckPassword is the final portion of the URL path for checking a candidate
+	// password against the password policy, without an account. If empty the default is
+	// used: /auth/check-password
+	// Valid HTTP methods: http.MethodPost
+	PathCheckPassword string
+	// PathCheckToken is the final portion of the URL path for admins to check the status of
+	// a token. If empty the default is used: /auth/check-token
+	// Valid HTTP methods: http.MethodPost
+	PathCheckToken string
 	// PathCreateOrUpdate is the final portion of the URL path for auth create or update.
 	// If empty the default is used: /auth/createorupdate
 	// Valid HTTP methods: http.MethodPost, http.MethodPut
 	PathCreateOrUpdate string
+	// PathAPIKeys is the final portion of the URL path for creating (http.MethodPost),
+	// listing (http.MethodGet), and revoking (http.MethodDelete, with query parameter id)
+	// API keys. If empty the default is used: /auth/api-keys
+	// Valid HTTP methods: http.MethodDelete, http.MethodGet, http.MethodPost
+	PathAPIKeys string
+	// PathCSRFToken is the final portion of the URL path for getting a CSRF token. If empty
+	// the default is used: /auth/csrf-token
+	// Valid HTTP methods: http.MethodGet
+	PathCSRFToken string
 	// PathDelete is the final portion of the URL path for delete. If empty the
 	// default is used: /auth/delete
 	// Valid HTTP methods: http.MethodDelete
 	PathDelete string
+	// PathEmailChange is the final portion of the URL path for users to request changing their
+	// Email, as EmailChange; see handlerEmailChange. Registered with EmailChangeEnabled. If
+	// empty the default is used: /auth/email
+	// Valid HTTP methods: http.MethodPut
+	PathEmailChange string
+	// PathEmailChangeConfirm is the final portion of the URL path for confirming an email
+	// change with the token, as OneTimeToken, sent to the new Email. Registered with
+	// EmailChangeEnabled. If empty the default is used: /auth/email-confirm
+	// Valid HTTP methods: http.MethodPost
+	PathEmailChangeConfirm string
+	// PathExportMyData is the final portion of the URL path for users to export all data
+	// stored about them. If empty the default is used: /auth/export-my-data
+	// Valid HTTP methods: http.MethodGet
+	PathExportMyData string
+	// PathImpersonate is the final portion of the URL path for admins to get a token to act as
+	// the user with the Email in the Credential body. If empty the default is used:
+	// /auth/impersonate
+	// Valid HTTP methods: http.MethodPost
+	PathImpersonate string
 	// PathInfo is the final portion of the URL path for info. If empty the
 	// default is used: /auth/info
 	// Valid HTTP methods: http.MethodGet
 	PathInfo string
+	// PathJWKS is the URL path publishing the public keys that verify tokens, in JWK Set
+	// format, for resource servers using RemoteJWKSURL. Not registered when RemoteJWKSURL is
+	// set. If empty the default is used: /jwks.json
+	// Valid HTTP methods: http.MethodGet
+	PathJWKS string
+	// PathLockout is the final portion of the URL path for admins to get the LockoutState of
+	// the account with query parameter email, or unlock it with http.MethodDelete. Registered
+	// with LockoutThreshold. If empty the default is used: /auth/lockout
+	// Valid HTTP methods: http.MethodDelete, http.MethodGet
+	PathLockout string
 	// PathLogin is the final portion of the URL path for login. If empty the
 	// default is used: /auth/login
 	// Valid HTTP methods: http.MethodPut
@@ -72,48 +431,474 @@ type Config struct {
 	// PathLogoutAll is the final portion of the URL path for logout-all. If empty the
 	// default is used: /auth/logout-all
 	// Valid HTTP methods: http.MethodDelete
+	// Query parameter dryRun=true returns DryRun, without deleting tokens.
 	PathLogoutAll string
+	// PathMagicLinkConsume is the final portion of the URL path for exchanging a magic link
+	// token for a normal token. If empty the default is used: /auth/magic-link/consume
+	// Valid HTTP methods: http.MethodPost
+	PathMagicLinkConsume string
+	// PathMagicLinkRequest is the final portion of the URL path for requesting a magic link.
+	// If empty the default is used: /auth/magic-link/request
+	// Valid HTTP methods: http.MethodPost
+	PathMagicLinkRequest string
+	// PathToken is the final portion of the URL path for exchanging a refresh token, as
+	// OneTimeToken, for LoginTokens with a new access token and refresh token. Registered when
+	// IssueRefreshToken is true. If empty the default is used: /auth/token
+	// Valid HTTP methods: http.MethodPost
+	PathToken string
+	// PathTokenExchange is the final portion of the URL path for exchanging a token for a
+	// token for a downstream service, per RFC 8693; see handlerTokenExchange. Registered when
+	// TokenExchangeAudiences is not empty. If empty the default is used: /auth/token-exchange
+	// Valid HTTP methods: http.MethodPost
+	PathTokenExchange string
+	// PathPassword is the final portion of the URL path for users to change their password,
+	// with the current password; see handlerPassword. If empty the default is used:
+	// /auth/password
+	// Valid HTTP methods: http.MethodPut
+	PathPassword string
+	// PathPasswordReset is the final portion of the URL path for setting a new password with
+	// a password reset token, as PasswordReset; see handlerPasswordReset. Registered with
+	// PasswordResetEnabled. If empty the default is used: /auth/reset
+	// Valid HTTP methods: http.MethodPost
+	PathPasswordReset string
+	// PathPasswordResetRequest is the final portion of the URL path for requesting a password
+	// reset token. Registered with PasswordResetEnabled. If empty the default is used:
+	// /auth/reset-request
+	// Valid HTTP methods: http.MethodPost
+	PathPasswordResetRequest string
+	// PathPermissions is the final portion of the URL path for getting the callers
+	// permissions, per RolePermissions. If empty the default is used: /auth/permissions
+	// Valid HTTP methods: http.MethodGet
+	PathPermissions string
+	// PathPhone is the final portion of the URL path for users to register their Phone, as
+	// SMSCode, with a code sent to the phone, or remove it; see handlerPhone. Registered with
+	// SMSLoginEnabled. If empty the default is used: /auth/phone
+	// Valid HTTP methods: http.MethodDelete, http.MethodPut
+	PathPhone string
+	// PathPrefix, when not empty, is the common prefix of the auth paths; I.E. /auth for the
+	// defaults. Requests to unknown paths under PathPrefix get http.StatusNotFound from this
+	// package, rather than reaching another handler of the application.
+	PathPrefix string
+	// PathRecoveryToken is the final portion of the URL path for admins to generate an
+	// account recovery token. If empty the default is used: /auth/recovery-token
+	// Valid HTTP methods: http.MethodPost
+	PathRecoveryToken string
 	// PathRefresh is the final portion of the URL path for refresh. If empty the
 	// default is used: /auth/refresh
 	// Valid HTTP methods: http.MethodPost
 	PathRefresh string
+	// PathRememberMe is the final portion of the URL path for exchanging a remember me token
+	// for new tokens; see handlerRememberMe. Registered with RememberMeEnabled. If empty the
+	// default is used: /auth/remember-me
+	// Valid HTTP methods: http.MethodPost
+	PathRememberMe string
+	// PathRevoke is the final portion of the URL path for revoking a token by value, per RFC
+	// 7009; see handlerRevoke. If empty the default is used: /auth/revoke
+	// Valid HTTP methods: http.MethodPost
+	PathRevoke string
+	// PathSessions is the final portion of the URL path for users to list their outstanding
+	// tokens, as Session, or revoke one with http.MethodDelete of PathSessions/{TokenID}. Admins
+	// may list or revoke the sessions of another user with query parameter email. If empty the
+	// default is used: /auth/sessions
+	// Valid HTTP methods: http.MethodDelete, http.MethodGet
+	PathSessions string
+	// PathSMSCode is the final portion of the URL path for requesting a login code sent to the
+	// Phone, as SMSCode. Registered with SMSLoginEnabled. If empty the default is used:
+	// /auth/sms/code
+	// Valid HTTP methods: http.MethodPost
+	PathSMSCode string
+	// PathSMSLogin is the final portion of the URL path for login with the Phone and the code
+	// sent to it, as SMSCode; see handlerSMSLogin. Registered with SMSLoginEnabled. If empty
+	// the default is used: /auth/sms/login
+	// Valid HTTP methods: http.MethodPost
+	PathSMSLogin string
+	// PathStepUp is the final portion of the URL path for step up authentication; see
+	// AuthMethodStepUp. If empty the default is used: /auth/step-up
+	// Valid HTTP methods: http.MethodPost
+	PathStepUp string
+	// RefreshTokenExpirationInterval is the duration for which refresh tokens are valid. If
+	// zero the default is used: 30 days
+	RefreshTokenExpirationInterval time.Duration
+	// RecoveryExpirationInterval is the duration for which account recovery tokens, issued at
+	// PathRecoveryToken, are valid. If zero the default is used: 15 minutes
+	RecoveryExpirationInterval time.Duration
+	// RefreshBinding is how strictly a refresh must come from the client the token was
+	// originally issued to at login; refreshes from a different client get
+	// http.StatusForbidden. Other requests are not affected. The default is
+	// RefreshBindingNone.
+	RefreshBinding RefreshBindingMode
+	// RefreshLimit is the maximum number of refreshes per user in RefreshLimitInterval, so a
+	// client in a refresh loop cannot thrash the token store. Refreshes beyond the limit get
+	// http.StatusTooManyRequests with a Retry-After header. Zero means no limit.
+	RefreshLimit int
+	// RefreshLimitInterval is the interval for RefreshLimit. If zero the default is used:
+	// 1 minute
+	RefreshLimitInterval time.Duration
+	// RememberMeEnabled enables remember me tokens; logins with Credential.RememberMe also
+	// return a long lived token that can only be exchanged for new tokens at PathRememberMe.
+	// Remember me tokens are sessions in kvsToken, so they are listed and revoked with
+	// PathSessions, and revoked by logout-all.
+	RememberMeEnabled bool
+	// RememberMeExpirationInterval is the duration for which remember me tokens are valid. If
+	// zero the default is used: 30 days
+	RememberMeExpirationInterval time.Duration
+	// RemoteJWKSURL, when not empty, puts the package in consumer mode; tokens are verified
+	// using the public keys published at this URL in JWK Set format, selected by the kid header
+	// of the token. JWTPublicKeyPath is not required in this mode.
+	RemoteJWKSURL string
+	// RemoteJWKSRefreshInterval is the maximum age of the cached keys from RemoteJWKSURL
+	// before they are fetched again. Keys are also fetched when a token has an unknown kid.
+	// If zero the default is used: 1 hour
+	RemoteJWKSRefreshInterval time.Duration
+	// RequireJSONContentType, when true, requires requests to the credential endpoints
+	// (create or update, login, and magic link request) to have Content-Type
+	// application/json; other requests get http.StatusUnsupportedMediaType. This rejects
+	// form based CSRF, as forms cannot send JSON.
+	RequireJSONContentType bool
+	// RolePermissions maps roles to permissions. When not empty, PathPermissions returns
+	// the permissions of all roles of the caller.
+	RolePermissions map[string][]string
+	// RoleSessionLimits maps roles to the maximum number of unexpired tokens (sessions) a user
+	// may have; logins, including magic link and SMS logins and refresh token exchanges,
+	// beyond the limit get http.StatusConflict until the user logs out a session, or with
+	// SessionLimitEvictOldest evict the oldest sessions. The limit of the
+	// first role of the user, in the order set with AuthRolesSet, that has a limit is used;
+	// users without such a role use the limit for the empty role. Roles without a limit are
+	// not limited.
+	RoleSessionLimits map[string]int
+	// RoleTokenTTLs maps roles to the duration for which tokens of users with the role are
+	// valid; I.E. shorter for admins. The TTL of the first role of the user, in the order set
+	// with AuthRolesSet, that has a TTL is used; users without such a role use the TTL for
+	// the empty role, or JWTAuthExpirationInterval. See TokenTTLResolver for precedence.
+	RoleTokenTTLs map[string]time.Duration
+	// SessionLimitEvictOldest, when true, allows logins beyond the limit from
+	// RoleSessionLimits, and revokes the oldest sessions of the user, by issue time, to stay
+	// within the limit. The evicted sessions are revoked with their refresh token family.
+	SessionLimitEvictOldest bool
+	// SMSCodeExpirationInterval is the duration for which codes sent with SMSSender are valid.
+	// If zero the default is used: 5 minutes
+	SMSCodeExpirationInterval time.Duration
+	// SMSLoginEnabled enables login with a code sent with SMSSender to the Phone of the auth;
+	// users register a Phone at PathPhone, request a code at PathSMSCode, and login with the
+	// code at PathSMSLogin, getting the same token as from PathLogin.
+	SMSLoginEnabled bool
+	// SMSSender delivers codes to the specified phone, in E.164 format; I.E. with an SMS
+	// gateway. Required for SMSLoginEnabled.
+	SMSSender func(phone string, code string) error
+	// TimeSource returns the current time used for issuing tokens and expiring them from the
+	// stores. Times from TimeSource never go backwards; if the clock jumps backwards the last
+	// time is used until the clock catches up. If nil the default is used: time.Now
+	TimeSource func() time.Time
+	// TokenEncryptionKey, when not empty, is a 32 byte key with which issued tokens, other than
+	// ID tokens, are encrypted (JWE, direct A256GCM), so the claims are not readable by clients
+	// or intermediaries; tokens that are not encrypted are rejected. Servers verifying the
+	// tokens, including with RemoteJWKSURL, must have the same key. Requires TokenFormatJWT, or
+	// TokenFormatPASETOV4Local, for which it is the v4.local key.
+	TokenEncryptionKey []byte
+	// TokenExchangeAudiences are the audiences of the downstream services for which tokens
+	// can be requested at PathTokenExchange. Tokens with one of these audiences are rejected
+	// for authentication with this package, other than as the subject token of an exchange,
+	// so a service can exchange its token for a token of a further downstream service.
+	TokenExchangeAudiences []string
+	// TokenExchangeExpirationInterval is the duration for which tokens issued at
+	// PathTokenExchange are valid; never past the expiration of the subject token. If zero
+	// the default is used: 5 minutes
+	TokenExchangeExpirationInterval time.Duration
+	// TokenFormat is the format of issued tokens, and the only format accepted; TokenFormatJWT,
+	// TokenFormatPASETOV4Local, which requires TokenEncryptionKey, or
+	// TokenFormatPASETOV4Public, which requires JWTSigningAlgorithm EdDSA; the PASETO formats do
+	// not use JWTAllowedAlgorithms. With TokenFormatPASETOV4Local, ID tokens are JWTs signed per
+	// JWTSigningAlgorithm, since clients read them. If empty the default is used: TokenFormatJWT
+	TokenFormat string
+	// TokenTTLResolver, when not nil, returns the duration for which a new token for the user
+	// with email and roles is valid; return zero to use RoleTokenTTLs or
+	// JWTAuthExpirationInterval. The TTL of a token is the first that is set of: the
+	// TokenTTLOverride of the auth, TokenTTLResolver, RoleTokenTTLs, and
+	// JWTAuthExpirationInterval; all but JWTAuthExpirationInterval are clamped to MaxTokenTTL.
+	TokenTTLResolver func(email string, roles []string) time.Duration
+	// TokenSender delivers single use tokens to the user with the specified email; I.E.
+	// by sending an email containing a link with the token. purpose is one of the Purpose*
+	// constants. For PurposeEmailChange, email is the new Email, which must receive the
+	// token to confirm the change. Required for EmailChangeEnabled, MagicLinkEnabled, and
+	// PasswordResetEnabled.
+	TokenSender func(email string, purpose string, token string) error
+	// Tracer starts the spans when TracingEnabled is true.
+	Tracer Tracer
+	// TracingEnabled, when true, starts spans with Tracer in the wrappers, and around
+	// authentication lookups, password verification, and token store reads.
+	TracingEnabled bool
+	// TokenVersionEnforced, when true, rejects tokens issued before the last call to
+	// BumpTokenVersion. Requires a DataSourcePath.
+	TokenVersionEnforced bool
+	// WarningHeaders, when true, adds a Warning header to responses from handlers running in a
+	// discouraged mode: HandlerFuncNoAuthWrapper on application handlers, and
+	// HandlerFuncAuthJWTWrapper without token invalidation, where logged out tokens are
+	// accepted; see EnableTokenInvalidation.
+	WarningHeaders bool
 	// testing true bypasses loading keys.
 	testing bool
 }
 
+// PasswordTrimMode is how leading and trailing whitespace in passwords is handled.
+type PasswordTrimMode int
+
+const (
+	// PasswordTrimSpace removes leading and trailing whitespace.
+	PasswordTrimSpace PasswordTrimMode = iota
+	// PasswordTrimReject rejects passwords with leading or trailing whitespace when set.
+	PasswordTrimReject
+	// PasswordTrimNone keeps leading and trailing whitespace as part of the password.
+	PasswordTrimNone
+)
+
 // Credential is what is supplied by the HTTP request in order to authenticate.
+// Hashing, including the salt and cost, is entirely server controlled; any other fields
+// in the request body are ignored.
 type Credential struct {
 	Email    *string
 	Password *string
+	// RememberMe, at PathLogin with Config.RememberMeEnabled, also returns a remember me token
+	// in LoginTokens; see PurposeRememberMe.
+	RememberMe bool `json:",omitempty"`
 }
 
 // CustomClaims are the Claims for the JWT token.
 type CustomClaims struct {
 	jwt.StandardClaims
-	Email   string
+	Email string
+	// TokenID uniquely identifies the token; the same value as the standard jti claim, Id. The
+	// token store is keyed by Email and TokenID, so a specific token can be revoked; see
+	// TokenRevoke.
 	TokenID string
+	// Purpose is empty for normal tokens, or one of the Purpose* constants for single
+	// use tokens, which are not valid for authentication.
+	Purpose string `json:",omitempty"`
+	// Actor is the Email of the admin using an impersonation token for Email; empty for
+	// normal tokens.
+	Actor string `json:"act,omitempty"`
+	// TokenVersion is the global token version when the token was issued; see
+	// BumpTokenVersion.
+	TokenVersion int64 `json:",omitempty"`
+	// Client is the client fingerprint, per Config.RefreshBinding, of the login the token
+	// was issued to; refreshed tokens keep the fingerprint of the original login.
+	Client string `json:",omitempty"`
+	// UserTokenVersion is the TokenVersion of the auth when the token was issued; see
+	// AuthTokenVersionBump.
+	UserTokenVersion int64 `json:",omitempty"`
+	// AuthMethod is how the user authenticated, one of the AuthMethod* constants; refreshed
+	// tokens keep the method of the original login. Empty for impersonation tokens. See
+	// AuthMethodRequired.
+	AuthMethod string `json:"auth_method,omitempty"`
+	// AuthTime is the time, in Unix seconds, of the login that started the session; refreshed
+	// tokens keep the time of the original login. See Config.MaxSessionLifetime.
+	AuthTime int64 `json:"auth_time,omitempty"`
+	// Family identifies the refresh token family of access and refresh tokens issued from one
+	// login with Config.IssueRefreshToken; the TokenID starts with the Family. The family is
+	// revoked when a used refresh token is presented again.
+	Family string `json:"fam,omitempty"`
+	// NewEmail is the Email the auth is changed to when a PurposeEmailChange token is
+	// confirmed; empty for other tokens.
+	NewEmail string `json:"new_email,omitempty"`
+	// Confirmation binds the token to the DPoP key, RFC 9449, or TLS client certificate, RFC
+	// 8705, of the client; requests with the token must prove possession of the key. Nil for
+	// bearer tokens.
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	// Restriction limits the requests the token is valid for; nil for tokens valid for any
+	// request. See AuthTokenCreateRestricted.
+	Restriction *TokenRestriction `json:"rst,omitempty"`
+	// Scope is the space delimited scopes of a token issued at Config.PathTokenExchange; empty
+	// for tokens that are not limited to scopes.
+	Scope string `json:"scope,omitempty"`
+	// Extra are the claims from Config.ClaimsEnricher. They are nested, so they cannot
+	// replace the claims set by this package.
+	Extra map[string]any `json:"ext,omitempty"`
+}
+
+// DryRun is returned from bulk operations requested with the query parameter dryRun=true;
+// it reports what the operation would do, without changing anything.
+type DryRun struct {
+	// Deletes is the number of items the request would delete.
+	Deletes int
+	// Emails are the emails affected.
+	Emails []string
+	// Remaining is the number of items that would remain for a following request.
+	Remaining int
 }
 
 // Info is used to provide information back to the user.
 type Info struct {
 	OutstandingTokens int
+	// Sessions are the outstanding tokens, returned from PathInfo.
+	Sessions []Session `json:",omitempty"`
+}
+
+// Session is an outstanding token of a user. IP and UserAgent, identifying the device, are
+// those of the request the token was issued for; tokens issued without a request, I.E. by
+// AuthTokenCreateNotBefore, have none.
+type Session struct {
+	ExpiresAt int64
+	IP        string `json:",omitempty"`
+	IssuedAt  int64
+	// LastUsed is when the token last authenticated a request, within sessionLastUsedInterval;
+	// zero if the token was not used.
+	LastUsed int64 `json:",omitempty"`
+	// Purpose is PurposeRememberMe for remember me tokens; empty for other tokens.
+	Purpose   string `json:",omitempty"`
+	TokenID   string
+	UserAgent string `json:",omitempty"`
+}
+
+// UserData is all data stored about a user, excluding secrets, as returned from
+// PathExportMyData.
+type UserData struct {
+	APIKeys []APIKeyInfo
+	// Audit is the audit records for the user, when Config.AuditStore is true.
+	Audit              []AuditRecord `json:",omitempty"`
+	Authorizations     []string
+	ContactEmail       string `json:",omitempty"`
+	Disabled           bool
+	Email              string
+	MustChangePassword bool
+	Phone              string          `json:",omitempty"`
+	PreviousEmails     []PreviousEmail `json:",omitempty"`
+	Roles              []string
+	Sessions           []Session
+	TokenTTLOverride   time.Duration
+}
+
+// TokenCheck is supplied by the HTTP request to check the status of a token; either the
+// Token, or the TokenID (jti) of the token.
+type TokenCheck struct {
+	Token   string `json:",omitempty"`
+	TokenID string `json:",omitempty"`
+}
+
+// PasswordCheck is returned from PathCheckPassword.
+type PasswordCheck struct {
+	// Reasons the password does not meet the policy; empty when Valid.
+	Reasons []string
+	Valid   bool
+}
+
+// TokenStatus is returned from PathCheckToken.
+type TokenStatus struct {
+	Email     string
+	ExpiresAt int64
+	// Status is one of the TokenStatus* constants.
+	Status string
+}
+
+// Token statuses returned in TokenStatus.Status.
+const (
+	TokenStatusActive  = "active"
+	TokenStatusExpired = "expired"
+	TokenStatusRevoked = "revoked"
+)
+
+// tokenStore is the subset of kvs.KVS methods used for kvsToken.
+type tokenStore interface {
+	Delete(key string) (int64, error)
+	Get(key string) ([]byte, error)
+	Keys() ([]string, error)
+	Set(key string, value []byte) error
+}
+
+// tokenOptions are the optional claims of a new token; see authClaimsCreate and
+// oneTimeTokenCreateCommon. The zero value is a token without them.
+type tokenOptions struct {
+	// actor is the Email of the admin, for impersonation tokens.
+	actor string
+	// authTime is the AuthTime of the session the token is refreshed from; zero starts a new
+	// session.
+	authTime int64
+	// client is the client fingerprint; see clientFingerprint.
+	client string
+	// cnf binds the token to a DPoP key or client certificate; see tokenConfirmation.
+	cnf *Confirmation
+	// family is the refresh token family; see refreshTokenCreate.
+	family string
+	// method is the AuthMethod.
+	method string
+	// newEmail is the NewEmail of PurposeEmailChange tokens.
+	newEmail string
+	// notBefore, when in the future, sets the nbf claim, and the TTL starts at notBefore.
+	notBefore time.Time
 }
 
 // authentication is persisted data about a user and their authorization.
 type authentication struct {
 	Authorizations []string `json:",omitempty"`
-	Email          *string  `json:",omitempty"`
-	PasswordHash   []byte   `json:",omitempty"`
-	Role           *string  `json:",omitempty"`
+	// ContactEmail is the optional email of auths identified by something other than an
+	// email, I.E. a username; set with AuthContactEmailSet.
+	ContactEmail string `json:",omitempty"`
+	// Disabled is set with AuthDisabledSet.
+	Disabled bool    `json:",omitempty"`
+	Email    *string `json:",omitempty"`
+	// MustChangePassword is set with AuthMustChangePasswordSet.
+	MustChangePassword bool `json:",omitempty"`
+	// PasswordChangedAt is when the password was set; zero for auths with passwords set before
+	// it was recorded.
+	PasswordChangedAt time.Time `json:",omitempty"`
+	PasswordHash      []byte    `json:",omitempty"`
+	// PasswordHistory are the prior password hashes of the auth, oldest first, with
+	// Config.PasswordHistoryLength.
+	PasswordHistory [][]byte `json:",omitempty"`
+	// Phone is the optional phone of the auth, in E.164 format, for Config.SMSLoginEnabled; set
+	// with AuthPhoneSet.
+	Phone string `json:",omitempty"`
+	// PreviousEmails are the prior Emails of the auth, oldest first, with
+	// Config.EmailHistory.
+	PreviousEmails []PreviousEmail `json:",omitempty"`
+	// Role is retained for existing auths; new roles are set in Roles with AuthRolesSet.
+	Role  *string  `json:",omitempty"`
+	Roles []string `json:",omitempty"`
+	// TokenTTLOverride, when not zero, is used instead of Config.JWTAuthExpirationInterval
+	// for tokens of this auth; set with AuthTokenTTLOverrideSet.
+	TokenTTLOverride time.Duration `json:",omitempty"`
+	// TokenVersion is incremented by AuthTokenVersionBump and password changes.
+	TokenVersion int64 `json:",omitempty"`
 }
 
 const (
-	kvsAuthTable  = "authjwtAuth"
-	kvsTokenTable = "authjwtToken"
+	// RoleAdmin is the authentication Role for administrators.
+	RoleAdmin = "admin"
+)
+
+const (
+	kvsAPIKeyTable = "authjwtAPIKey"
+	kvsAuditTable  = "authjwtAudit"
+	kvsAuthTable   = "authjwtAuth"
+	// kvsContactEmailTable stores the identifier of the auth with each ContactEmail.
+	kvsContactEmailTable = "authjwtContactEmail"
+	kvsLockoutTable      = "authjwtLockout"
+	kvsOneTimeTable      = "authjwtOneTime"
+	// kvsPhoneTable stores the identifier of the auth with each Phone.
+	kvsPhoneTable   = "authjwtPhone"
+	kvsSMSCodeTable = "authjwtSMSCode"
+	kvsTokenTable   = "authjwtToken"
+	// kvsTokenVersionTable stores the global token version.
+	kvsTokenVersionTable = "authjwtTokenVersion"
 
 	// bcrypt, used to hash the password, has a length limit of 72
 	// https://pkg.go.dev/golang.org/x/crypto@v0.21.0/bcrypt#GenerateFromPassword
 	passwordLengthLimit = 72
+	// defaultBcryptCost is the default, and minimum, Config.BcryptCost.
+	defaultBcryptCost = bcrypt.DefaultCost
+
+	// notInitializedMessage is the body of responses to requests before Init completes.
+	notInitializedMessage = "authjwt not initialized"
+
+	// loginRetryAfter is the Retry-After value, in seconds, when MaxConcurrentLogins is reached.
+	loginRetryAfter = "1"
+)
+
+var (
+	// ErrAuthExists is returned (wrapped) when creating an auth that already exists.
+	ErrAuthExists = errors.New("auth exists")
+	// ErrAuthRecordTooLarge is returned (wrapped) when an auth exceeds Config.MaxAuthRecordSize.
+	ErrAuthRecordTooLarge = errors.New("auth record too large")
+	// ErrNoToken is returned (wrapped) when a request has no token.
+	ErrNoToken = errors.New("no token provided")
 )
 
 var (
@@ -123,16 +908,65 @@ var (
 	// default password validation: 8-32 characters, 1 lower case, 1 upper case, 1 special, 1 number.
 	defaultPasswordValidation = []string{`^[\S]{8,32}$`, `[a-z]`, `[A-Z]`, `[!#$%'()*+,-.\\/:;=?@\[\]^_{|}~]`, `[0-9]`}
 
+	// passwordHashValidation matches bcrypt and Argon2id hashes, peppered or not; passwords
+	// are rejected if they are already hashed, so clients cannot choose the stored hash.
+	passwordHashValidation = regexp.MustCompile(`^(\$pepper\$[0-9a-f]{16})?(\$2[abxy]?\$[0-9]{2}\$[./A-Za-z0-9]{53}|\$argon2id\$v=[0-9]+\$m=[0-9]+,t=[0-9]+,p=[0-9]+\$[+/A-Za-z0-9]+\$[+/A-Za-z0-9]+)$`)
+
+	// emailValidation is a minimal check that an identifier looks like an email address;
+	// something@something with no whitespace.
+	emailValidation = regexp.MustCompile(`^[^@\s]+@[^@\s]+$`)
+
 	lp  func(level logh.LoghLevel, v ...interface{})
 	lpf func(level logh.LoghLevel, format string, v ...interface{})
 
+	// The API key KVS stores API keys, by ID.
+	kvsAPIKey kvs.KVS
+	// The audit KVS stores AuditRecords, by Cursor, when config.AuditStore is true.
+	kvsAudit kvs.KVS
 	// The auth KVS stores authentications; one per Email.
 	kvsAuth kvs.KVS
+	// The contact email KVS stores the identifier of the auth, by ContactEmail.
+	kvsContactEmail kvs.KVS
+	// The lockout KVS stores a lockoutRecord of the failed logins per account and source IP.
+	kvsLockout kvs.KVS
+	// The one time KVS stores single use tokens; the key and value are the same as kvsToken.
+	kvsOneTime kvs.KVS
+	// The phone KVS stores the identifier of the auth, by Phone.
+	kvsPhone kvs.KVS
+	// The SMS code KVS stores an smsCode per phone login or phone registration.
+	kvsSMSCode kvs.KVS
 	// The token KVS stores the key (encoded as Email|TokenID) and the value is the
 	// experation in Unix (seconds) time. A user may have more than one valid token.
-	kvsToken           kvs.KVS
+	kvsToken tokenStore
+	// The token version KVS stores the global token version; see BumpTokenVersion.
+	kvsTokenVersion    kvs.KVS
 	passwordValidation []*regexp.Regexp
 
+	// authCreateMutex makes the check for an existing auth and the create atomic.
+	authCreateMutex sync.Mutex
+	// smsCodeMutex makes counting the attempts for an smsCode atomic.
+	smsCodeMutex sync.Mutex
+
+	// initialized is true once Init completes; until then the wrappers and Authenticated
+	// write http.StatusServiceUnavailable. initMutex serializes calls to Init.
+	initialized atomic.Bool
+	initMutex   sync.Mutex
+
+	// loginSemaphore limits concurrent password verification in handlerLogin; nil when
+	// config.MaxConcurrentLogins is zero.
+	loginSemaphore chan struct{}
+
+	// removeExpiredTokensRunning tracks the go routine from removeExpiredTokens while it uses
+	// the stores, so kvsClose does not close them first.
+	removeExpiredTokensRunning sync.WaitGroup
+
+	// timeLast is the last time returned from timeNow, protected by timeMutex.
+	timeLast  time.Time
+	timeMutex sync.Mutex
+
+	// bearerRegexp matches the parts of the Authorization header that are not the token.
+	bearerRegexp = regexp.MustCompile(`[bB]earer|\s*`)
+
 	rsaPrivateKey *rsa.PrivateKey
 	rsaPublicKey  *rsa.PublicKey
 )
@@ -141,11 +975,122 @@ var (
 // createRequiresAuth == true requires auth creates to be from an already authenticated
 // user. (Use for apps that require users be added by an admin.)
 func Init(configIn Config, mux *http.ServeMux) {
+	initMutex.Lock()
+	defer initMutex.Unlock()
+	if initialized.Load() {
+		if !config.AllowReinitialize {
+			lp(logh.Warning, "Init already called and AllowReinitialize is false; ignored")
+			return
+		}
+		initialized.Store(false)
+		kvsClose()
+	}
 	config = configIn
 
 	lp = logh.Map[config.LogName].Println
 	lpf = logh.Map[config.LogName].Printf
 
+	if config.AuditNoAuthMarker == "" {
+		config.AuditNoAuthMarker = "none"
+	}
+	loginSemaphore = nil
+	if config.MaxConcurrentLogins > 0 {
+		loginSemaphore = make(chan struct{}, config.MaxConcurrentLogins)
+	}
+	if err := csrfKeyLoad(); err != nil {
+		log.Fatalf("fatal: %s could not create CSRF key, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if err := auditPseudonymKeyLoad(); err != nil {
+		log.Fatalf("fatal: %s could not create audit pseudonym key, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if err := adminIPAllowlistLoad(); err != nil {
+		log.Fatalf("fatal: %s invalid AdminIPAllowlist, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if err := tokenInvalidationConfigLoad(); err != nil {
+		log.Fatalf("fatal: %s invalid token invalidation configuration, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if err := oneTimeTokenConfigLoad(); err != nil {
+		log.Fatalf("fatal: %s invalid single use token configuration, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if config.JWTSigningAlgorithm == "" {
+		config.JWTSigningAlgorithm = SigningAlgorithmRS256
+	}
+	if err := signingAlgorithmLoad(); err != nil {
+		log.Fatalf("fatal: %s invalid signing configuration, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if config.PasswordHashAlgorithm == "" {
+		config.PasswordHashAlgorithm = PasswordHashBcrypt
+	}
+	if err := passwordHashConfigLoad(); err != nil {
+		log.Fatalf("fatal: %s invalid password hash configuration, error: %v", runtimeh.SourceInfo(), err)
+	}
+	lockoutConfigLoad()
+	if err := tokenFormatLoad(); err != nil {
+		log.Fatalf("fatal: %s invalid TokenFormat, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if err := tokenEncryptionLoad(); err != nil {
+		log.Fatalf("fatal: %s invalid TokenEncryptionKey, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if config.ClockSkewLeeway < 0 {
+		log.Fatalf("fatal: %s ClockSkewLeeway is negative: %v", runtimeh.SourceInfo(), config.ClockSkewLeeway)
+	}
+	if config.LogSecretPrefixLength == 0 {
+		config.LogSecretPrefixLength = defaultLogSecretPrefixLength
+	}
+	if config.ImpersonationExpirationInterval == 0 {
+		config.ImpersonationExpirationInterval = defaultImpersonationExpirationInterval
+	}
+	if config.RefreshLimitInterval == 0 {
+		config.RefreshLimitInterval = defaultRefreshLimitInterval
+	}
+	if config.RecoveryExpirationInterval == 0 {
+		config.RecoveryExpirationInterval = defaultRecoveryExpirationInterval
+	}
+	if config.RefreshTokenExpirationInterval == 0 {
+		config.RefreshTokenExpirationInterval = defaultRefreshTokenExpirationInterval
+	}
+	if config.RememberMeExpirationInterval == 0 {
+		config.RememberMeExpirationInterval = defaultRememberMeExpirationInterval
+	}
+	if config.DPoPProofMaxAge == 0 {
+		config.DPoPProofMaxAge = defaultDPoPProofMaxAge
+	}
+	if config.DPoPRequired {
+		config.DPoPEnabled = true
+	}
+	if config.TokenExchangeExpirationInterval == 0 {
+		config.TokenExchangeExpirationInterval = defaultTokenExchangeExpirationInterval
+	}
+	if config.EmailChangeExpirationInterval == 0 {
+		config.EmailChangeExpirationInterval = defaultEmailChangeExpirationInterval
+	}
+	if config.EmailChangeEnabled && config.TokenSender == nil {
+		log.Fatalf("fatal: %s EmailChangeEnabled requires a TokenSender", runtimeh.SourceInfo())
+	}
+	if config.MagicLinkExpirationInterval == 0 {
+		config.MagicLinkExpirationInterval = defaultMagicLinkExpirationInterval
+	}
+	if config.MagicLinkEnabled && config.TokenSender == nil {
+		log.Fatalf("fatal: %s MagicLinkEnabled requires a TokenSender", runtimeh.SourceInfo())
+	}
+	if config.PasswordResetExpirationInterval == 0 {
+		config.PasswordResetExpirationInterval = defaultPasswordResetExpirationInterval
+	}
+	if config.PasswordResetEnabled && config.TokenSender == nil {
+		log.Fatalf("fatal: %s PasswordResetEnabled requires a TokenSender", runtimeh.SourceInfo())
+	}
+	if config.SMSCodeExpirationInterval == 0 {
+		config.SMSCodeExpirationInterval = defaultSMSCodeExpirationInterval
+	}
+	if config.SMSLoginEnabled && config.SMSSender == nil {
+		log.Fatalf("fatal: %s SMSLoginEnabled requires an SMSSender", runtimeh.SourceInfo())
+	}
+
+	dpopReplayReset()
+	lockoutReset()
+	refreshLimitReset()
+	remoteJWKSClear()
+	timeReset()
 	if configIn.testing {
 		var err error
 		rsaPrivateKey, err = rsa.GenerateKey(rand.Reader, 1024)
@@ -155,9 +1100,18 @@ func Init(configIn Config, mux *http.ServeMux) {
 		//nolint:errcheck // There is no error value to check.
 		pubKey := rsaPrivateKey.Public().(*rsa.PublicKey)
 		rsaPublicKey = pubKey
+		ed25519PublicKey, ed25519PrivateKey, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalf("could not generate keys for testing, error: %+v", err)
+		}
+		previousKeys = nil
 	} else {
 		loadKeys(config)
 	}
+	if err := allowedAlgorithmsLoad(); err != nil {
+		log.Fatalf("fatal: %s invalid JWTAllowedAlgorithms, error: %v", runtimeh.SourceInfo(), err)
+	}
+	lpf(logh.Info, "accepted token signing algorithms: %v", config.JWTAllowedAlgorithms)
 
 	// Applicaitons must provide a mux or register the handlers themselves.
 	// For testing purposes, no mux is required.
@@ -166,12 +1120,45 @@ func Init(configIn Config, mux *http.ServeMux) {
 		if config.PathCreateOrUpdate == "" {
 			config.PathCreateOrUpdate = "/auth/createorupdate"
 		}
+		if config.PathAPIKeys == "" {
+			config.PathAPIKeys = "/auth/api-keys"
+		}
+		if config.PathAuditExport == "" {
+			config.PathAuditExport = "/auth/audit-export"
+		}
+		if config.PathCheckPassword == "" {
+			config.PathCheckPassword = "/auth/check-password"
+		}
+		if config.PathCheckToken == "" {
+			config.PathCheckToken = "/auth/check-token"
+		}
+		if config.PathCSRFToken == "" {
+			config.PathCSRFToken = "/auth/csrf-token"
+		}
 		if config.PathDelete == "" {
 			config.PathDelete = "/auth/delete"
 		}
+		if config.PathEmailChange == "" {
+			config.PathEmailChange = "/auth/email"
+		}
+		if config.PathEmailChangeConfirm == "" {
+			config.PathEmailChangeConfirm = "/auth/email-confirm"
+		}
+		if config.PathExportMyData == "" {
+			config.PathExportMyData = "/auth/export-my-data"
+		}
+		if config.PathImpersonate == "" {
+			config.PathImpersonate = "/auth/impersonate"
+		}
 		if config.PathInfo == "" {
 			config.PathInfo = "/auth/info"
 		}
+		if config.PathJWKS == "" {
+			config.PathJWKS = "/jwks.json"
+		}
+		if config.PathLockout == "" {
+			config.PathLockout = "/auth/lockout"
+		}
 		if config.PathLogin == "" {
 			config.PathLogin = "/auth/login"
 		}
@@ -181,41 +1168,203 @@ func Init(configIn Config, mux *http.ServeMux) {
 		if config.PathLogoutAll == "" {
 			config.PathLogoutAll = "/auth/logout-all"
 		}
+		if config.PathMagicLinkConsume == "" {
+			config.PathMagicLinkConsume = "/auth/magic-link/consume"
+		}
+		if config.PathMagicLinkRequest == "" {
+			config.PathMagicLinkRequest = "/auth/magic-link/request"
+		}
+		if config.PathPassword == "" {
+			config.PathPassword = "/auth/password"
+		}
+		if config.PathPasswordReset == "" {
+			config.PathPasswordReset = "/auth/reset"
+		}
+		if config.PathPasswordResetRequest == "" {
+			config.PathPasswordResetRequest = "/auth/reset-request"
+		}
+		if config.PathPermissions == "" {
+			config.PathPermissions = "/auth/permissions"
+		}
+		if config.PathPhone == "" {
+			config.PathPhone = "/auth/phone"
+		}
+		if config.PathRecoveryToken == "" {
+			config.PathRecoveryToken = "/auth/recovery-token"
+		}
 		if config.PathRefresh == "" {
 			config.PathRefresh = "/auth/refresh"
 		}
+		if config.PathRememberMe == "" {
+			config.PathRememberMe = "/auth/remember-me"
+		}
+		if config.PathRevoke == "" {
+			config.PathRevoke = "/auth/revoke"
+		}
+		if config.PathSessions == "" {
+			config.PathSessions = "/auth/sessions"
+		}
+		if config.PathSMSCode == "" {
+			config.PathSMSCode = "/auth/sms/code"
+		}
+		if config.PathSMSLogin == "" {
+			config.PathSMSLogin = "/auth/sms/login"
+		}
+		if config.PathStepUp == "" {
+			config.PathStepUp = "/auth/step-up"
+		}
+		if config.PathToken == "" {
+			config.PathToken = "/auth/token"
+		}
+		if config.PathTokenExchange == "" {
+			config.PathTokenExchange = "/auth/token-exchange"
+		}
 
 		// Registering with the trailing slash means the naked path is redirected to this path.
 		crpath := config.PathCreateOrUpdate + "/"
 		if config.CreateRequiresAuth {
-			mux.HandleFunc(crpath, HandlerFuncAuthJWTWrapper(handlerCreateOrUpdate))
+			mux.HandleFunc(crpath, handlerFuncAuthJWTWrapperCommon(handlerCreateOrUpdate, true, PurposeChangePassword))
 		} else {
 			mux.HandleFunc(crpath, handlerCreateOrUpdate)
 		}
 		lpf(logh.Info, "Registered handler: %s\n", crpath)
+		if config.APIKeysEnabled {
+			akpath := config.PathAPIKeys + "/"
+			mux.HandleFunc(akpath, HandlerFuncAuthJWTWrapper(handlerAPIKeys))
+			lpf(logh.Info, "Registered handler: %s\n", akpath)
+		}
+		if config.AuditStore {
+			aepath := config.PathAuditExport + "/"
+			mux.HandleFunc(aepath, HandlerFuncAuthJWTWrapper(handlerAuditExport))
+			lpf(logh.Info, "Registered handler: %s\n", aepath)
+		}
+		cppath := config.PathCheckPassword + "/"
+		mux.HandleFunc(cppath, handlerFuncNoAuthWrapperCommon(handlerCheckPassword, false))
+		lpf(logh.Info, "Registered handler: %s\n", cppath)
+		ctpath := config.PathCheckToken + "/"
+		mux.HandleFunc(ctpath, HandlerFuncAuthJWTWrapper(handlerCheckToken))
+		lpf(logh.Info, "Registered handler: %s\n", ctpath)
+		if config.CSRFProtection {
+			csrfpath := config.PathCSRFToken + "/"
+			mux.HandleFunc(csrfpath, HandlerFuncAuthJWTWrapper(handlerCSRFToken))
+			lpf(logh.Info, "Registered handler: %s\n", csrfpath)
+		}
 		dltpath := config.PathDelete + "/"
 		mux.HandleFunc(dltpath, HandlerFuncAuthJWTWrapper(handlerDelete))
 		lpf(logh.Info, "Registered handler: %s\n", dltpath)
+		emdpath := config.PathExportMyData + "/"
+		mux.HandleFunc(emdpath, HandlerFuncAuthJWTWrapper(handlerExportMyData))
+		lpf(logh.Info, "Registered handler: %s\n", emdpath)
+		imppath := config.PathImpersonate + "/"
+		mux.HandleFunc(imppath, HandlerFuncAuthJWTWrapper(handlerImpersonate))
+		lpf(logh.Info, "Registered handler: %s\n", imppath)
 		infpath := config.PathInfo + "/"
 		mux.HandleFunc(infpath, HandlerFuncAuthJWTWrapper(handlerInfo))
 		lpf(logh.Info, "Registered handler: %s\n", infpath)
+		if config.RemoteJWKSURL == "" {
+			// Registered without the trailing slash; the JWK Set is a document, and clients
+			// should not need to follow a redirect.
+			mux.HandleFunc(config.PathJWKS, handlerFuncNoAuthWrapperCommon(handlerJWKS, false))
+			lpf(logh.Info, "Registered handler: %s\n", config.PathJWKS)
+		}
 		lipath := config.PathLogin + "/"
 		mux.HandleFunc(lipath, handlerLogin)
 		lpf(logh.Info, "Registered handler: %s\n", lipath)
 		lopath := config.PathLogout + "/"
-		mux.HandleFunc(lopath, HandlerFuncAuthJWTWrapper(handlerLogout))
+		mux.HandleFunc(lopath, handlerFuncAuthJWTWrapperCommon(handlerLogout, false, ""))
 		lpf(logh.Info, "Registered handler: %s\n", lopath)
 		loapath := config.PathLogoutAll + "/"
 		mux.HandleFunc(loapath, HandlerFuncAuthJWTWrapper(handlerLogoutAll))
 		lpf(logh.Info, "Registered handler: %s\n", loapath)
+		pwpath := config.PathPassword + "/"
+		mux.HandleFunc(pwpath, HandlerFuncAuthJWTWrapper(handlerPassword))
+		lpf(logh.Info, "Registered handler: %s\n", pwpath)
+		if len(config.RolePermissions) > 0 {
+			prmpath := config.PathPermissions + "/"
+			mux.HandleFunc(prmpath, HandlerFuncAuthJWTWrapper(handlerPermissions))
+			lpf(logh.Info, "Registered handler: %s\n", prmpath)
+		}
+		if config.PathPrefix != "" {
+			nfpath := config.PathPrefix + "/"
+			mux.HandleFunc(nfpath, handlerFuncNoAuthWrapperCommon(handlerNotFound, false))
+			lpf(logh.Info, "Registered handler: %s\n", nfpath)
+		}
+		rtpath := config.PathRecoveryToken + "/"
+		mux.HandleFunc(rtpath, HandlerFuncAuthJWTWrapper(handlerGenerateRecoveryToken))
+		lpf(logh.Info, "Registered handler: %s\n", rtpath)
 		rfpath := config.PathRefresh + "/"
 		mux.HandleFunc(rfpath, HandlerFuncAuthJWTWrapper(handlerRefresh))
 		lpf(logh.Info, "Registered handler: %s\n", rfpath)
+		rvpath := config.PathRevoke + "/"
+		mux.HandleFunc(rvpath, handlerFuncNoAuthWrapperCommon(handlerRevoke, false))
+		lpf(logh.Info, "Registered handler: %s\n", rvpath)
+		sspath := config.PathSessions + "/"
+		mux.HandleFunc(sspath, HandlerFuncAuthJWTWrapper(handlerSessions))
+		lpf(logh.Info, "Registered handler: %s\n", sspath)
+		supath := config.PathStepUp + "/"
+		mux.HandleFunc(supath, HandlerFuncAuthJWTWrapper(handlerStepUp))
+		lpf(logh.Info, "Registered handler: %s\n", supath)
+		if config.IssueRefreshToken {
+			tkpath := config.PathToken + "/"
+			mux.HandleFunc(tkpath, handlerFuncNoAuthWrapperCommon(handlerToken, false))
+			lpf(logh.Info, "Registered handler: %s\n", tkpath)
+		}
+		if len(config.TokenExchangeAudiences) > 0 {
+			tepath := config.PathTokenExchange + "/"
+			mux.HandleFunc(tepath, handlerFuncNoAuthWrapperCommon(handlerTokenExchange, false))
+			lpf(logh.Info, "Registered handler: %s\n", tepath)
+		}
+		if config.RememberMeEnabled {
+			rmpath := config.PathRememberMe + "/"
+			mux.HandleFunc(rmpath, handlerFuncNoAuthWrapperCommon(handlerRememberMe, false))
+			lpf(logh.Info, "Registered handler: %s\n", rmpath)
+		}
+		if config.MagicLinkEnabled {
+			mlcpath := config.PathMagicLinkConsume + "/"
+			mux.HandleFunc(mlcpath, handlerFuncNoAuthWrapperCommon(handlerConsumeMagicLink, false))
+			lpf(logh.Info, "Registered handler: %s\n", mlcpath)
+			mlrpath := config.PathMagicLinkRequest + "/"
+			mux.HandleFunc(mlrpath, handlerFuncNoAuthWrapperCommon(handlerRequestMagicLink, false))
+			lpf(logh.Info, "Registered handler: %s\n", mlrpath)
+		}
+		if config.EmailChangeEnabled {
+			ecpath := config.PathEmailChange + "/"
+			mux.HandleFunc(ecpath, HandlerFuncAuthJWTWrapper(handlerEmailChange))
+			lpf(logh.Info, "Registered handler: %s\n", ecpath)
+			eccpath := config.PathEmailChangeConfirm + "/"
+			mux.HandleFunc(eccpath, handlerFuncNoAuthWrapperCommon(handlerEmailChangeConfirm, false))
+			lpf(logh.Info, "Registered handler: %s\n", eccpath)
+		}
+		if config.LockoutThreshold > 0 {
+			lopath := config.PathLockout + "/"
+			mux.HandleFunc(lopath, HandlerFuncAuthJWTWrapper(handlerLockout))
+			lpf(logh.Info, "Registered handler: %s\n", lopath)
+		}
+		if config.PasswordResetEnabled {
+			prpath := config.PathPasswordReset + "/"
+			mux.HandleFunc(prpath, handlerFuncNoAuthWrapperCommon(handlerPasswordReset, false))
+			lpf(logh.Info, "Registered handler: %s\n", prpath)
+			prrpath := config.PathPasswordResetRequest + "/"
+			mux.HandleFunc(prrpath, handlerFuncNoAuthWrapperCommon(handlerRequestPasswordReset, false))
+			lpf(logh.Info, "Registered handler: %s\n", prrpath)
+		}
+		if config.SMSLoginEnabled {
+			phpath := config.PathPhone + "/"
+			mux.HandleFunc(phpath, HandlerFuncAuthJWTWrapper(handlerPhone))
+			lpf(logh.Info, "Registered handler: %s\n", phpath)
+			smcpath := config.PathSMSCode + "/"
+			mux.HandleFunc(smcpath, handlerFuncNoAuthWrapperCommon(handlerSMSCode, false))
+			lpf(logh.Info, "Registered handler: %s\n", smcpath)
+			smlpath := config.PathSMSLogin + "/"
+			mux.HandleFunc(smlpath, handlerFuncNoAuthWrapperCommon(handlerSMSLogin, false))
+			lpf(logh.Info, "Registered handler: %s\n", smlpath)
+		}
 	}
 
 	if config.DataSourcePath != "" {
 		lpf(logh.Info, "authjwt running with DataSourcePath: %s", config.DataSourcePath)
 		initializeKVS(config.DataSourcePath)
+		authEmailsNormalizeInit()
 		if err := passwordValidationLoad(); err != nil {
 			lpf(logh.Error, "passwordValidationLoad error:%+v", err)
 		}
@@ -223,22 +1372,122 @@ func Init(configIn Config, mux *http.ServeMux) {
 	} else {
 		lp(logh.Info, "authjwt running without DataSourcePath - tokens can only be validated")
 	}
+	initialized.Store(true)
+}
+
+// initializedCheck returns true if Init has completed. Otherwise the header is written with
+// http.StatusServiceUnavailable, with a message, and false is returned.
+func initializedCheck(w http.ResponseWriter) bool {
+	if initialized.Load() {
+		return true
+	}
+	http.Error(w, notInitializedMessage, http.StatusServiceUnavailable)
+	return false
 }
 
 // AuthCreate creates or updates an ID/authentication pair to kvsAuth. The scope of the function
 // is public to allow apps to create auths directly, without going through the ReST API.
 func (cred *Credential) AuthCreate() error {
+	return cred.AuthCreateCtx(context.Background())
+}
+
+// AuthCreateCtx is AuthCreate with a context. RequestInfo stored in ctx, using
+// ContextWithRequestInfo, is included in the Event sent to Config.EventHandler.
+func (cred *Credential) AuthCreateCtx(ctx context.Context) error {
+	return cred.authCreateCommon(ctx, false, "")
+}
+
+// authCreateCommon validates and hashes the credential, then creates or updates the auth.
+// When createOnly is true, ErrAuthExists is returned if the auth exists, per
+// Config.EmailUniqueCaseInsensitive. When the password of an existing auth is changed, the
+// tokens of the auth are removed, except keep, the kvsToken key of the token used for the
+// change; see passwordChangeTokensRevoke.
+func (cred *Credential) authCreateCommon(ctx context.Context, createOnly bool, keep string) error {
 	var err error
 	var ph []byte
+	changed := false
 	if err := cred.validate(); err != nil {
 		return err
 	}
+	if !createOnly && config.PasswordHistoryLength > 0 {
+		auth, err := authGet(*cred.Email)
+		if err != nil {
+			return err
+		}
+		if passwordReused(auth, *cred.Password) {
+			return fmt.Errorf("%s %w", runtimeh.SourceInfo(), &PasswordPolicyError{Reasons: []string{reasonPasswordReused}})
+		}
+	}
 	if ph, err = passwordHash(*cred.Password); err != nil {
 		return err
 	}
 
-	auth := authentication{Email: cred.Email, PasswordHash: ph}
-	return authCreate(auth)
+	if createOnly {
+		err = authCreateNew(authentication{Email: cred.Email, PasswordChangedAt: timeNow(), PasswordHash: ph})
+	} else {
+		// Updates keep the other fields of an existing auth; a new password satisfies
+		// MustChangePassword and PasswordMaxAge, and invalidates existing tokens.
+		err = authUpdate(*cred.Email, true, func(auth *authentication) {
+			if auth.PasswordHash != nil {
+				changed = true
+				auth.PasswordHistory = passwordHistoryAdd(auth.PasswordHistory, auth.PasswordHash)
+				auth.TokenVersion++
+			}
+			auth.Email = cred.Email
+			auth.MustChangePassword = false
+			auth.PasswordChangedAt = timeNow()
+			auth.PasswordHash = ph
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err := passwordChangeTokensRevoke(*cred.Email, keep); err != nil {
+			return err
+		}
+	}
+	eventSend(ctx, EventAuthCreate, *cred.Email)
+	return nil
+}
+
+// AuthMustChangePasswordSet sets, or clears, MustChangePassword on the existing auth for
+// email. While set, login returns a token that can only be used to change the password.
+func AuthMustChangePasswordSet(email string, mustChange bool) error {
+	return authUpdate(email, false, func(auth *authentication) {
+		auth.MustChangePassword = mustChange
+	})
+}
+
+// AuthRolesSet sets the roles of the existing auth for email, replacing any prior roles.
+// EventAuthRolesChange is sent so applications can drop cached roles and permissions.
+func AuthRolesSet(email string, roles []string) error {
+	email = emailNormalize(email)
+	if err := authUpdate(email, false, func(auth *authentication) {
+		auth.Roles = roles
+	}); err != nil {
+		return err
+	}
+	eventSend(context.Background(), EventAuthRolesChange, email)
+	return nil
+}
+
+// AuthTokenTTLOverrideSet sets the duration for which tokens of the existing auth for email
+// are valid, instead of Config.JWTAuthExpirationInterval; I.E. short tokens for kiosks.
+// Zero removes the override. Existing tokens are not changed.
+func AuthTokenTTLOverrideSet(email string, ttl time.Duration) error {
+	return authUpdate(email, false, func(auth *authentication) {
+		auth.TokenTTLOverride = ttl
+	})
+}
+
+// AuthTokenVersionBump increments the token version of the existing auth for email. When
+// Config.TokenVersionEnforced is true, all tokens of email issued before the bump are
+// rejected; other users are not affected.
+func AuthTokenVersionBump(email string) error {
+	return authUpdate(email, false, func(auth *authentication) {
+		auth.TokenVersion++
+	})
 }
 
 // Authenticated checks the request for a valid token and will return
@@ -246,19 +1495,7 @@ func (cred *Credential) AuthCreate() error {
 // exist in kvsToken; meaning the user has not logged out with that token. On any error the header
 // is written with the appropriate http.Status; callers should not write header status.
 func Authenticated(w http.ResponseWriter, r *http.Request) (*CustomClaims, error) {
-	var claims *CustomClaims
-	var err error
-	if claims, err = AuthenticatedNoTokenInvalidation(w, r); err != nil {
-		return nil, err
-	}
-	// Validate the token is in the token store; it may be invalidated by the user logging out,
-	// or the token expiring.
-	b, err := kvsToken.Get(claims.tokenKVSKey())
-	if b == nil || err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return nil, fmt.Errorf("%s token not valid", runtimeh.SourceInfo())
-	}
-	return claims, nil
+	return authenticated(w, r, true, "")
 }
 
 // AuthenticatedNoTokenInvalidation checks the request for a valid token and will return
@@ -268,19 +1505,145 @@ func Authenticated(w http.ResponseWriter, r *http.Request) (*CustomClaims, error
 // services that recieve tokens but don't have access to kvsToken. On any error the header
 // is written with the appropriate http.Status; callers should not write header status.
 func AuthenticatedNoTokenInvalidation(w http.ResponseWriter, r *http.Request) (*CustomClaims, error) {
+	return authenticated(w, r, false, "")
+}
+
+// ValidateTokenString validates tokenString, a token issued by this package, and returns the
+// users CustomClaims; the signature, expiration, Issuer, and Audience are checked. There is no
+// http.Request or kvsToken lookup, so other Go services can verify tokens in-process; as with
+// AuthenticatedNoTokenInvalidation, the token may have been invalidated. Single use tokens are
+// rejected. Tokens with a Confirmation are returned; the caller must verify the client has
+// the bound key. Likewise for a Restriction; see TokenRestriction.Allowed.
+func ValidateTokenString(tokenString string) (*CustomClaims, error) {
+	if !initialized.Load() {
+		return nil, fmt.Errorf("%s %s", runtimeh.SourceInfo(), notInitializedMessage)
+	}
+	claims, err := parseClaims(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, fmt.Errorf("%s single use token with purpose %s used for authentication", runtimeh.SourceInfo(), claims.Purpose)
+	}
+	return claims, nil
+}
+
+// authenticated implements Authenticated (tokenInvalidation true) and
+// AuthenticatedNoTokenInvalidation. Single use tokens are rejected, unless purpose is not
+// empty and matches the token Purpose, in which case the token must be in kvsOneTime.
+func authenticated(w http.ResponseWriter, r *http.Request, tokenInvalidation bool, purpose string) (*CustomClaims, error) {
+	if !initializedCheck(w) {
+		return nil, fmt.Errorf("%s %s", runtimeh.SourceInfo(), notInitializedMessage)
+	}
 	tokenString, err := tokenFromRequestHeader(r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return nil, err
 	}
-	claims, err := parseClaims(tokenString)
+	claims, err := tokenAuthenticated(r.Context(), tokenString, tokenInvalidation, purpose, false)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return nil, err
 	}
+	if err := dpopBindingValidate(r, tokenString, claims); err != nil {
+		w.Header().Set("WWW-Authenticate", dpopScheme+` error="invalid_dpop_proof"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, err
+	}
+	if err := mtlsBindingValidate(r, claims); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, err
+	}
+	if err := restrictionValidate(r, claims); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, err
+	}
+	return claims, nil
+}
+
+// tokenAuthenticated validates tokenString for authenticated, and returns the CustomClaims.
+// When exchange is true tokens with one of Config.TokenExchangeAudiences are also valid;
+// see parseClaimsCommon.
+func tokenAuthenticated(ctx context.Context, tokenString string, tokenInvalidation bool, purpose string, exchange bool) (*CustomClaims, error) {
+	claims, err := parseClaimsCommon(tokenString, exchange)
+	if err != nil {
+		return nil, err
+	}
+	if err := tokenVersionValidate(claims); err != nil {
+		return nil, err
+	}
+	if err := accountStateValidate(claims.Email); err != nil {
+		return nil, err
+	}
+	store := kvsToken
+	if claims.Purpose != "" {
+		if purpose == "" || claims.Purpose != purpose {
+			return nil, fmt.Errorf("%s single use token with purpose %s used for authentication", runtimeh.SourceInfo(), claims.Purpose)
+		}
+		store, tokenInvalidation = kvsOneTime, true
+		if claims.Purpose == PurposeRememberMe {
+			store = kvsToken
+		}
+	}
+	if !tokenInvalidation {
+		return claims, nil
+	}
+	// Validate the token is in the token store; it may be invalidated by the user logging out,
+	// or the token expiring.
+	_, span := spanStart(ctx, SpanTokenStoreGet)
+	b, err := store.Get(claims.tokenKVSKey())
+	span.SetAttribute(AttributeEmail, auditEmail(claims.Email))
+	span.SetAttribute(AttributeOutcome, b != nil && err == nil)
+	span.End()
+	if b == nil || err != nil {
+		if err == nil {
+			// A valid token with a TokenID (jti) not in the store was revoked, or for single use
+			// tokens already used; the token is being replayed.
+			lpf(logh.Warning, "revoked or used token replayed, jti: %s, email: %s", claims.TokenID, auditEmail(claims.Email))
+		}
+		return nil, fmt.Errorf("%s token not valid", runtimeh.SourceInfo())
+	}
+	if store == kvsToken {
+		if err := sessionUsed(claims, b); err != nil {
+			return nil, err
+		}
+	}
 	return claims, nil
 }
 
+// auditAuth identifies the caller in the audit log; the Email, and the Actor for
+// impersonation tokens.
+func (cc CustomClaims) auditAuth() string {
+	if cc.Actor == "" {
+		return auditEmail(cc.Email)
+	}
+	return fmt.Sprintf("%s (act: %s)", auditEmail(cc.Email), auditEmail(cc.Actor))
+}
+
+// Valid implements jwt.Claims; as jwt.StandardClaims.Valid, with config.ClockSkewLeeway
+// allowed for the exp, iat, and nbf claims.
+func (cc CustomClaims) Valid() error {
+	now := jwt.TimeFunc().Unix()
+	leeway := int64(config.ClockSkewLeeway / time.Second)
+	vErr := new(jwt.ValidationError)
+	if !cc.VerifyExpiresAt(now-leeway, false) {
+		vErr.Inner = fmt.Errorf("token is expired by %v", time.Unix(now, 0).Sub(time.Unix(cc.ExpiresAt, 0)))
+		vErr.Errors |= jwt.ValidationErrorExpired
+	}
+	if !cc.VerifyIssuedAt(now+leeway, false) {
+		vErr.Inner = fmt.Errorf("token used before issued")
+		vErr.Errors |= jwt.ValidationErrorIssuedAt
+	}
+	if !cc.VerifyNotBefore(now+leeway, false) {
+		vErr.Inner = fmt.Errorf("token is not valid yet")
+		vErr.Errors |= jwt.ValidationErrorNotValidYet
+	}
+	if vErr.Errors == 0 {
+		return nil
+	}
+	return vErr
+}
+
 // tokenKVSKey creates a key for kvsToken using the Email and TokenID.
 func (cc CustomClaims) tokenKVSKey() string {
 	return cc.Email + "|" + cc.TokenID
@@ -291,18 +1654,17 @@ func (cred *Credential) validate() error {
 	if cred.Email == nil || cred.Password == nil {
 		return fmt.Errorf("%s either email or password were nil in credential", runtimeh.SourceInfo())
 	}
-	if len(*cred.Password) > passwordLengthLimit {
-		return fmt.Errorf("%s password exceeds length limit of %d", runtimeh.SourceInfo(), passwordLengthLimit)
-	}
+	em := emailNormalize(strings.TrimSpace(*cred.Email))
+	reasons := passwordPolicyReasons(em, *cred.Password)
 
-	em := strings.TrimSpace(*cred.Email)
-	pwd := strings.TrimSpace(*cred.Password)
+	pwd := passwordTrim(*cred.Password)
 	cred.Email = &em
 	cred.Password = &pwd
-	for _, v := range passwordValidation {
-		if v.FindString(*cred.Password) == "" {
-			return fmt.Errorf("%s password does not meet validation criteria %s", runtimeh.SourceInfo(), v.String())
-		}
+	if err := identifierValidate(*cred.Email); err != nil {
+		return err
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("%s %w", runtimeh.SourceInfo(), &PasswordPolicyError{Reasons: reasons})
 	}
 	return nil
 }
@@ -320,111 +1682,437 @@ func authGet(id string) (authentication, error) {
 // authCreate sets an authentication in kvsAuth and will overwrite any existing
 // value.
 func authCreate(auth authentication) error {
-	if err := kvsAuth.Serialize(*auth.Email, auth); err != nil {
-		return runtimeh.SourceInfoError("serialize error", err)
+	b, err := json.Marshal(auth)
+	if err != nil {
+		return runtimeh.SourceInfoError("json.Marshal error", err)
+	}
+	if config.MaxAuthRecordSize != 0 && len(b) > config.MaxAuthRecordSize {
+		return fmt.Errorf("%s size %d, %w", runtimeh.SourceInfo(), len(b), ErrAuthRecordTooLarge)
+	}
+	if err := kvsAuth.Set(*auth.Email, b); err != nil {
+		return runtimeh.SourceInfoError("kvsAuth.Set error", err)
+	}
+	return nil
+}
+
+// authCreateNew sets an authentication in kvsAuth, returning ErrAuthExists if the
+// authentication exists. With Config.EmailUniqueCaseInsensitive all Emails are checked,
+// so the cost grows with the number of authentications.
+func authCreateNew(auth authentication) error {
+	authCreateMutex.Lock()
+	defer authCreateMutex.Unlock()
+
+	if err := authExists(*auth.Email, ""); err != nil {
+		return err
+	}
+	if err := authFirstUserAdmin(&auth); err != nil {
+		return err
+	}
+	return authCreate(auth)
+}
+
+// authExists returns ErrAuthExists (wrapped) if there is an auth for email, other than the
+// auth for self; with Config.EmailUniqueCaseInsensitive, an Email differing only in case
+// exists. Callers must hold authCreateMutex.
+func authExists(email string, self string) error {
+	b, err := kvsAuth.Get(email)
+	if err != nil {
+		return runtimeh.SourceInfoError("kvsAuth.Get error", err)
+	}
+	if b != nil && email != self {
+		return fmt.Errorf("%s %w", runtimeh.SourceInfo(), ErrAuthExists)
+	}
+	if config.EmailUniqueCaseInsensitive {
+		keys, err := kvsAuth.Keys()
+		if err != nil {
+			return runtimeh.SourceInfoError("kvsAuth.Keys error", err)
+		}
+		for _, key := range keys {
+			if key != self && strings.EqualFold(key, email) {
+				return fmt.Errorf("%s %w", runtimeh.SourceInfo(), ErrAuthExists)
+			}
+		}
+	}
+	return nil
+}
+
+// authFirstUserAdmin adds RoleAdmin to the Roles of auth, a new auth, when
+// config.FirstUserIsAdmin is true and there are no auths. Callers must hold authCreateMutex,
+// so only one auth can be first.
+func authFirstUserAdmin(auth *authentication) error {
+	if !config.FirstUserIsAdmin {
+		return nil
+	}
+	keys, err := kvsAuth.Keys()
+	if err != nil {
+		return runtimeh.SourceInfoError("kvsAuth.Keys error", err)
+	}
+	if len(keys) == 0 {
+		auth.Roles = append(auth.Roles, RoleAdmin)
 	}
 	return nil
 }
 
+// authUpdate applies update to the auth for email and stores it. Unless create is true, the
+// auth must exist.
+func authUpdate(email string, create bool, update func(auth *authentication)) error {
+	authCreateMutex.Lock()
+	defer authCreateMutex.Unlock()
+
+	auth, err := authGet(email)
+	if err != nil {
+		return err
+	}
+	if auth.Email == nil {
+		if !create {
+			return fmt.Errorf("%s auth does not exist for email: %s", runtimeh.SourceInfo(), email)
+		}
+		if err := authFirstUserAdmin(&auth); err != nil {
+			return err
+		}
+	}
+	update(&auth)
+	return authCreate(auth)
+}
+
+// authIsAdmin returns true if the authentication for email has role RoleAdmin.
+func authIsAdmin(email string) (bool, error) {
+	auth, err := authGet(email)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range authRoles(auth) {
+		if role == RoleAdmin {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authRoles returns all roles of auth; Role, if set, and Roles.
+func authRoles(auth authentication) []string {
+	if auth.Role == nil {
+		return auth.Roles
+	}
+	return append([]string{*auth.Role}, auth.Roles...)
+}
+
 // authTokenStringCreate stores a token in kvsToken, where the key is
-// generated using tokenKVSKey() and the value is the claims.ExpiresAt.
+// generated using tokenKVSKey() and the value is the claims.ExpiresAt, or the earlier idle
+// expiration with Config.IdleTimeout.
 func authTokenStringCreate(email string) (string, error) {
+	return authTokenStringCreateCommon(nil, email, tokenOptions{}, tokenTTL(email))
+}
+
+// authTokenStringCreateClient is authTokenStringCreate for request r, with the tokenOptions to
+// of the client that authenticated.
+func authTokenStringCreateClient(r *http.Request, email string, to tokenOptions) (string, error) {
+	return authTokenStringCreateCommon(r, email, to, tokenTTL(email))
+}
+
+// authTokenStringCreateCommon is authTokenStringCreate, for request r when not nil, with the
+// claims from authClaimsCreate.
+func authTokenStringCreateCommon(r *http.Request, email string, to tokenOptions, ttl time.Duration) (string, error) {
+	claims, err := authClaimsCreate(email, to, ttl)
+	if err != nil {
+		return "", err
+	}
+	return authClaimsStore(r, claims)
+}
+
+// authClaimsCreate returns the claims of a token for email, with the tokenOptions to, valid for
+// ttl.
+func authClaimsCreate(email string, to tokenOptions, ttl time.Duration) (CustomClaims, error) {
 	tokenID, err := uniqueID(true)
 	if err != nil {
-		return "", runtimeh.SourceInfoError("authTokenStringCreate error", err)
+		return CustomClaims{}, runtimeh.SourceInfoError("authTokenStringCreate error", err)
+	}
+	tokenID = familyTokenID(to.family, tokenID)
+	if ttl < 0 {
+		return CustomClaims{}, fmt.Errorf("%s token TTL is negative: %v", runtimeh.SourceInfo(), ttl)
+	}
+	tv, utv, err := tokenVersions(email)
+	if err != nil {
+		return CustomClaims{}, runtimeh.SourceInfoError("authTokenStringCreate error", err)
+	}
+	start := timeNow()
+	authTime := to.authTime
+	if authTime == 0 {
+		authTime = start.Unix()
+	}
+	notBefore := to.notBefore
+	if notBefore.After(start) {
+		start = notBefore
+	} else {
+		notBefore = time.Time{}
 	}
 	claims := CustomClaims{
-		jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(config.JWTAuthExpirationInterval).Unix(),
-			Issuer:    config.AppName,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  tokenAudience(),
+			ExpiresAt: sessionExpiration(authTime, start.Add(ttl).Unix()),
+			Id:        tokenID,
+			Issuer:    tokenIssuer(),
 		},
-		email,
-		tokenID,
+		Actor:            to.actor,
+		AuthMethod:       to.method,
+		AuthTime:         authTime,
+		Client:           to.client,
+		Email:            email,
+		Confirmation:     to.cnf,
+		Family:           to.family,
+		TokenID:          tokenID,
+		TokenVersion:     tv,
+		UserTokenVersion: utv,
+	}
+	if !notBefore.IsZero() {
+		claims.NotBefore = notBefore.Unix()
+	}
+	if config.ClaimsEnricher != nil {
+		if claims.Extra, err = config.ClaimsEnricher(email); err != nil {
+			return CustomClaims{}, runtimeh.SourceInfoError("ClaimsEnricher error", err)
+		}
+	}
+	return claims, nil
+}
+
+// authClaimsStore stores claims in kvsToken, as authTokenStringCreate, with the tokenMetadata
+// of request r, and returns the signed token.
+func authClaimsStore(r *http.Request, claims CustomClaims) (string, error) {
+	if err := tokenIDUnused(kvsToken, claims.tokenKVSKey()); err != nil {
+		return "", err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	buf := new(bytes.Buffer)
-	err = binary.Write(buf, binary.LittleEndian, claims.ExpiresAt)
+	b, err := tokenValue(idleExpiration(claims.ExpiresAt), requestTokenMetadata(r))
 	if err != nil {
-		if err := runtimeh.SourceInfoError("binary.Write failed", err); err != nil {
-			lpf(logh.Error, "runtimeh.SourceInfoError error:%+v", err)
-		}
+		lpf(logh.Error, "tokenValue error:%+v", err)
 	}
-	if err := kvsToken.Set(claims.tokenKVSKey(), buf.Bytes()); err != nil {
+	if err := kvsToken.Set(claims.tokenKVSKey(), b); err != nil {
 		lpf(logh.Error, "kvsToken.Set error:%+v", err)
 	}
-	return token.SignedString(rsaPrivateKey)
+	return tokenSign(claims)
+}
+
+// identifierValidate validates id with config.IdentifierValidator, or identifierValidateEmail.
+func identifierValidate(id string) error {
+	iv := identifierValidateEmail
+	if config.IdentifierValidator != nil {
+		iv = config.IdentifierValidator
+	}
+	if err := iv(id); err != nil {
+		return runtimeh.SourceInfoError("identifier validation error", err)
+	}
+	return nil
+}
+
+// identifierValidateEmail is the default IdentifierValidator; the identifier must be an
+// email address.
+func identifierValidateEmail(id string) error {
+	if !emailValidation.MatchString(id) {
+		return fmt.Errorf("%s identifier is not a valid email: %s", runtimeh.SourceInfo(), id)
+	}
+	return nil
 }
 
 // parseClaims parses a JWT token string (from the Authorization header)
 // into a CustomClaims object.
 func parseClaims(tokenString string) (*CustomClaims, error) {
-	claimsIn := &CustomClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claimsIn,
-		func(token *jwt.Token) (interface{}, error) {
-			return rsaPublicKey, nil
-		})
-	if err != nil {
-		return nil, runtimeh.SourceInfoError("ParseWithClaims error", err)
+	return parseClaimsCommon(tokenString, false)
+}
+
+// parseClaimsCommon is parseClaims; tokens with one of config.TokenExchangeAudiences, issued
+// at PathTokenExchange, are rejected unless exchange is true.
+func parseClaimsCommon(tokenString string, exchange bool) (*CustomClaims, error) {
+	claimsOut := &CustomClaims{}
+	if err := tokenParse(tokenString, claimsOut); err != nil {
+		return nil, runtimeh.SourceInfoError(fmt.Sprintf("tokenParse error, token: %s", maskSecret(tokenString)), err)
+	}
+	if config.Issuer != "" && claimsOut.Issuer != config.Issuer {
+		return nil, fmt.Errorf("%s token issuer %s is not %s", runtimeh.SourceInfo(), claimsOut.Issuer, config.Issuer)
 	}
-	//nolint:errcheck // There is no error value to check.
-	claimsOut := token.Claims.(*CustomClaims)
-	if !token.Valid {
-		return nil, fmt.Errorf("%s token not valid, token: %+v", runtimeh.SourceInfo(), *token)
+	if claimsOut.Audience != tokenAudience() && tokenExchangeAudience(claimsOut.Audience) {
+		if !exchange {
+			return nil, fmt.Errorf("%s token audience %s is for a downstream service", runtimeh.SourceInfo(), claimsOut.Audience)
+		}
+	} else if config.Audience != "" && claimsOut.Audience != config.Audience {
+		return nil, fmt.Errorf("%s token audience %s is not %s", runtimeh.SourceInfo(), claimsOut.Audience, config.Audience)
+	}
+	if err := sessionLifetimeValidate(claimsOut); err != nil {
+		return nil, err
 	}
 
 	return claimsOut, nil
 }
 
-// passwordHash hashes a password using bcrypt.
+// passwordHash hashes a password using config.PasswordHashAlgorithm, peppered when
+// config.PasswordPepper is set. For bcrypt the salt is generated by bcrypt and the cost is
+// config.BcryptCost; for Argon2id the salt is random and the parameters are from config.
+// Neither can be influenced by the caller.
 func passwordHash(pasword string) (hash []byte, err error) {
-	if hash, err = bcrypt.GenerateFromPassword([]byte(pasword), bcrypt.DefaultCost); err != nil {
+	if len(config.PasswordPepper) > 0 {
+		if hash, err = passwordHashAlgorithm(pepperPassword(config.PasswordPepper, pasword)); err != nil {
+			return nil, err
+		}
+		return append([]byte(pepperHashPrefix+pepperID(config.PasswordPepper)), hash...), nil
+	}
+	return passwordHashAlgorithm(pasword)
+}
+
+// passwordHashAlgorithm hashes a password using config.PasswordHashAlgorithm.
+func passwordHashAlgorithm(pasword string) (hash []byte, err error) {
+	if config.PasswordHashAlgorithm == PasswordHashArgon2id {
+		return argon2idHash(pasword)
+	}
+	if hash, err = bcrypt.GenerateFromPassword([]byte(pasword), config.BcryptCost); err != nil {
 		return nil, runtimeh.SourceInfoError("could not hash password, error: %+v", err)
 	}
 	return hash, nil
 }
 
+// passwordHashConfigLoad returns an error if config.PasswordHashAlgorithm is not a supported
+// algorithm, or the cost parameters are not valid, after setting the default parameters.
+func passwordHashConfigLoad() error {
+	if config.Argon2idMemory == 0 {
+		config.Argon2idMemory = defaultArgon2idMemory
+	}
+	if config.Argon2idParallelism == 0 {
+		config.Argon2idParallelism = defaultArgon2idParallelism
+	}
+	if config.Argon2idTime == 0 {
+		config.Argon2idTime = defaultArgon2idTime
+	}
+	if config.BcryptCost == 0 {
+		config.BcryptCost = defaultBcryptCost
+	}
+	switch config.PasswordHashAlgorithm {
+	case PasswordHashArgon2id, PasswordHashBcrypt:
+	default:
+		return fmt.Errorf("%s unsupported PasswordHashAlgorithm: %s", runtimeh.SourceInfo(), config.PasswordHashAlgorithm)
+	}
+	if err := pepperConfigLoad(); err != nil {
+		return err
+	}
+	if config.BcryptCost < defaultBcryptCost || config.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("%s BcryptCost %d not in %d to %d", runtimeh.SourceInfo(), config.BcryptCost, defaultBcryptCost, bcrypt.MaxCost)
+	}
+	if config.Argon2idMemory < argon2idMemoryMinimum*uint32(config.Argon2idParallelism) {
+		return fmt.Errorf("%s Argon2idMemory %d less than %d KiB per lane", runtimeh.SourceInfo(), config.Argon2idMemory, argon2idMemoryMinimum)
+	}
+	return nil
+}
+
+// passwordPolicyReasons returns the reasons password, of the auth with email, does not meet
+// the password policy; empty if the password is valid. email may be empty when unknown.
+func passwordPolicyReasons(email string, password string) []string {
+	reasons := []string{}
+	if len(password) > passwordLengthLimit {
+		reasons = append(reasons, fmt.Sprintf("password exceeds length limit of %d", passwordLengthLimit))
+	}
+	if passwordHashValidation.MatchString(strings.TrimSpace(password)) {
+		reasons = append(reasons, "password is a password hash")
+	}
+	if config.PasswordTrim == PasswordTrimReject && strings.TrimSpace(password) != password {
+		reasons = append(reasons, "password has leading or trailing whitespace")
+	}
+	pwd := passwordTrim(password)
+	for _, v := range passwordValidation {
+		if v.FindString(pwd) == "" {
+			reasons = append(reasons, fmt.Sprintf("password does not meet validation criteria %s", v.String()))
+		}
+	}
+	if config.PasswordPolicy != nil {
+		reasons = append(reasons, config.PasswordPolicy.reasons(email, pwd)...)
+	}
+	// The breach check may be remote, so is only made for passwords that are otherwise valid.
+	if len(reasons) == 0 {
+		reasons = append(reasons, breachedPasswordReasons(pwd)...)
+	}
+	return reasons
+}
+
+// passwordRehash hashes password again, and stores the hash for email, when hash, the
+// verified hash of password, is not hashed per the current configuration; so changes to
+// config.PasswordHashAlgorithm, the cost parameters, or config.PasswordPepper apply to
+// existing hashes at the next login. The hash is not replaced if it changed since it was
+// verified. Errors are logged; the login is not affected.
+func passwordRehash(email string, password string, hash []byte) {
+	if !passwordRehashNeeded(hash) {
+		return
+	}
+	ph, err := passwordHash(password)
+	if err != nil {
+		lpf(logh.Error, "passwordHash error:%v", err)
+		return
+	}
+	err = authUpdate(email, false, func(auth *authentication) {
+		if bytes.Equal(auth.PasswordHash, hash) {
+			auth.PasswordHash = ph
+		}
+	})
+	if err != nil {
+		lpf(logh.Error, "authUpdate error:%v", err)
+	}
+}
+
+// passwordRehashNeeded returns true if hash does not have the pepper, algorithm, and cost
+// parameters of the current configuration.
+func passwordRehashNeeded(hash []byte) bool {
+	id, inner, peppered := pepperHashSplit(hash)
+	if peppered != (len(config.PasswordPepper) > 0) || (peppered && id != pepperID(config.PasswordPepper)) {
+		return true
+	}
+	if !peppered {
+		inner = hash
+	}
+	if config.PasswordHashAlgorithm == PasswordHashArgon2id {
+		ap, _, _, err := argon2idParse(inner)
+		return err != nil || ap != argon2idConfigParameters()
+	}
+	cost, err := bcrypt.Cost(inner)
+	return err != nil || cost != config.BcryptCost
+}
+
+// passwordTrim applies config.PasswordTrim to password; used both when setting and
+// verifying a password.
+func passwordTrim(password string) string {
+	if config.PasswordTrim == PasswordTrimSpace {
+		return strings.TrimSpace(password)
+	}
+	return password
+}
+
 // passwordVerifyHash verifies that the provided password hashes to the provided hash,
-// or returns an error if they do not match.
+// or returns an error if they do not match. The algorithm, and pepper, are those of the hash.
 func passwordVerifyHash(password string, hash []byte) error {
+	if id, inner, ok := pepperHashSplit(hash); ok {
+		pepper, err := pepperFind(id)
+		if err != nil {
+			return err
+		}
+		password, hash = pepperPassword(pepper, password), inner
+	}
+	if strings.HasPrefix(string(hash), "$"+PasswordHashArgon2id+"$") {
+		return argon2idVerify(password, hash)
+	}
 	return bcrypt.CompareHashAndPassword(hash, []byte(password))
 }
 
 // removeExpiredTokens is a go routine that continuously runs in the background
-// and will remove tokens from kvsToken if expiresAt is more than expireInterval
-// old.
+// and will remove tokens from kvsToken and kvsOneTime if expiresAt is more than
+// expireInterval old.
 // Calling with rate == 0 causes the go routine to return after running once.
 // The logging alias lpf is not used as that triggers race detection errors in testing.
+// For the same reason the stores, logger, and time function are captured before starting the
+// go routine.
 func removeExpiredTokens(rate time.Duration, expireInterval time.Duration) {
+	stores := []tokenStore{kvsToken, kvsOneTime}
+	logger := logh.Map[config.LogName]
+	now := timeNowCaptured()
+	removeExpiredTokensRunning.Add(1)
 	go func() {
-		keys, err := kvsToken.Keys()
-		if err == nil {
-			for i := range keys {
-				b, err := kvsToken.Get(keys[i])
-				if err != nil {
-					logh.Map[config.LogName].Printf(logh.Error, "getting token: %v\n", err)
-					continue
-				}
-
-				buf := bytes.NewBuffer(b)
-				var expiresAt int64
-				err = binary.Read(buf, binary.LittleEndian, &expiresAt)
-				if err != nil {
-					logh.Map[config.LogName].Printf(logh.Error, "reading expiresAt: %v\n", err)
-					continue
-				}
-				if time.Since(time.Unix(expiresAt, 0)) > expireInterval {
-					_, err := kvsToken.Delete(keys[i])
-					if err != nil {
-						logh.Map[config.LogName].Printf(logh.Error, "deleting expired token: %v\n", err)
-						continue
-					}
-				}
-
-			}
-		} else {
-			logh.Map[config.LogName].Printf(logh.Error, "getting keys: %v\n", err)
+		for _, store := range stores {
+			removeExpiredTokensFromStore(store, expireInterval, logger, now)
 		}
+		removeExpiredTokensRunning.Done()
 
 		if rate == 0 {
 			return
@@ -434,15 +2122,276 @@ func removeExpiredTokens(rate time.Duration, expireInterval time.Duration) {
 	}()
 }
 
-// tokenFromRequestHeader returns the data in the Authorization header.
+// removeExpiredTokensFromStore removes tokens from store if expiresAt is more than
+// expireInterval old, at the time from now. Errors are logged to logger.
+func removeExpiredTokensFromStore(store tokenStore, expireInterval time.Duration, logger *logh.Logger, now func() time.Time) {
+	keys, err := store.Keys()
+	if err != nil {
+		logger.Printf(logh.Error, "getting keys: %v\n", err)
+		return
+	}
+	for i := range keys {
+		b, err := store.Get(keys[i])
+		if err != nil {
+			logger.Printf(logh.Error, "getting token: %v\n", err)
+			continue
+		}
+
+		buf := bytes.NewBuffer(b)
+		var expiresAt int64
+		err = binary.Read(buf, binary.LittleEndian, &expiresAt)
+		if err != nil {
+			logger.Printf(logh.Error, "reading expiresAt: %v\n", err)
+			continue
+		}
+		if now().Sub(time.Unix(expiresAt, 0)) > expireInterval {
+			_, err := tokenDelete(store, keys[i])
+			if err != nil {
+				logger.Printf(logh.Error, "deleting expired token: %v\n", err)
+				continue
+			}
+		}
+	}
+}
+
+// rolePermissions returns the sorted and de-duplicated permissions for roles, per
+// config.RolePermissions.
+func rolePermissions(roles []string) []string {
+	set := map[string]struct{}{}
+	for _, role := range roles {
+		for _, p := range config.RolePermissions[role] {
+			set[p] = struct{}{}
+		}
+	}
+	permissions := make([]string, 0, len(set))
+	for p := range set {
+		permissions = append(permissions, p)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+// verificationKey is the jwt.Keyfunc that returns the key used to verify token. The key is
+// selected by the kid header: the current signing key, or one of
+// config.JWTPreviousPublicKeyPaths. Tokens without a kid are verified with the current key.
+// Tokens signed with config.JWTSigningAlgorithm, or for previous keys the algorithm of the key,
+// are accepted; tokens with any other signing method, or not in config.JWTAllowedAlgorithms, are
+// rejected.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if !algorithmAllowed(token.Method.Alg()) {
+		return nil, fmt.Errorf("%s signing method %v is not allowed", runtimeh.SourceInfo(), token.Header["alg"])
+	}
+	if config.RemoteJWKSURL != "" {
+		return remoteJWKSKey(token)
+	}
+	method, _, key := signingKey()
+	if kid, _ := token.Header["kid"].(string); kid != "" {
+		if pk, ok := previousKeys[kid]; ok {
+			method, key = signingMethodForKey(pk), pk
+		} else if current, err := keyID(key); err != nil || kid != current {
+			return nil, fmt.Errorf("%s no key for kid: %s", runtimeh.SourceInfo(), kid)
+		}
+	}
+	if token.Method != method {
+		return nil, fmt.Errorf("%s signing method %v is not %s", runtimeh.SourceInfo(), token.Header["alg"], method.Alg())
+	}
+	return key, nil
+}
+
+// tokenAudience returns the Audience of issued access tokens; config.Audience, or
+// AudienceAccess when empty.
+func tokenAudience() string {
+	if config.Audience != "" {
+		return config.Audience
+	}
+	return AudienceAccess
+}
+
+// tokenIssuer returns the Issuer of issued tokens; config.Issuer, or config.AppName when empty.
+func tokenIssuer() string {
+	if config.Issuer != "" {
+		return config.Issuer
+	}
+	return config.AppName
+}
+
+// tokenInvalidationConfigLoad returns an error if config.EnableTokenInvalidation is true
+// without a DataSourcePath, and logs a warning when tokens will not be checked against the
+// token store.
+func tokenInvalidationConfigLoad() error {
+	if config.EnableTokenInvalidation != nil && *config.EnableTokenInvalidation && config.DataSourcePath == "" {
+		return fmt.Errorf("%s EnableTokenInvalidation requires a DataSourcePath", runtimeh.SourceInfo())
+	}
+	if !tokenInvalidationEnabled() {
+		if config.EnableTokenInvalidation == nil {
+			lp(logh.Warning, "EnableTokenInvalidation not set and no DataSourcePath; logged out and revoked tokens are accepted")
+		} else {
+			lp(logh.Warning, "EnableTokenInvalidation is false; logged out and revoked tokens are accepted")
+		}
+	}
+	return nil
+}
+
+// tokenInvalidationEnabled returns config.EnableTokenInvalidation, or when nil, true if there
+// is a DataSourcePath.
+func tokenInvalidationEnabled() bool {
+	if config.EnableTokenInvalidation != nil {
+		return *config.EnableTokenInvalidation
+	}
+	return config.DataSourcePath != ""
+}
+
+// timeNow returns the current time from config.TimeSource, or time.Now, and never returns a
+// time before a prior call.
+func timeNow() time.Time {
+	return timeNowFrom(config.TimeSource)
+}
+
+// timeNowCaptured returns a function that is timeNow with the current config.TimeSource; for
+// go routines, which must not read config as Init may change it.
+func timeNowCaptured() func() time.Time {
+	ts := config.TimeSource
+	return func() time.Time {
+		return timeNowFrom(ts)
+	}
+}
+
+// timeNowFrom is timeNow with the TimeSource ts.
+func timeNowFrom(ts func() time.Time) time.Time {
+	t := time.Now()
+	if ts != nil {
+		t = ts()
+	}
+	timeMutex.Lock()
+	defer timeMutex.Unlock()
+	if t.Before(timeLast) {
+		return timeLast
+	}
+	timeLast = t
+	return t
+}
+
+// timeReset clears the last time returned from timeNow.
+func timeReset() {
+	timeMutex.Lock()
+	defer timeMutex.Unlock()
+	timeLast = time.Time{}
+}
+
+// tokenFromRequestHeader returns the data in the Authorization header, with the Bearer or DPoP
+// scheme. A missing or empty token returns ErrNoToken.
 func tokenFromRequestHeader(r *http.Request) (string, error) {
 	var tokenHeader []string
 	var ok bool
 	if tokenHeader, ok = r.Header["Authorization"]; !ok {
-		return "", fmt.Errorf("%s no Authorization header provided", runtimeh.SourceInfo())
+		return "", fmt.Errorf("%s no Authorization header provided: %w", runtimeh.SourceInfo(), ErrNoToken)
 	}
 
-	return regexp.MustCompile(`[bB]earer|\s*`).ReplaceAllString(tokenHeader[0], ""), nil
+	token := bearerRegexp.ReplaceAllString(tokenHeader[0], "")
+	if strings.HasPrefix(tokenHeader[0], dpopScheme+" ") {
+		token = strings.TrimSpace(strings.TrimPrefix(tokenHeader[0], dpopScheme+" "))
+	}
+	if token == "" {
+		return "", fmt.Errorf("%s empty Authorization header provided: %w", runtimeh.SourceInfo(), ErrNoToken)
+	}
+	return token, nil
+}
+
+// tokenStatus returns the TokenStatus of tokenString. An error is returned if the token is not
+// a valid token, other than being expired.
+func tokenStatus(tokenString string) (TokenStatus, error) {
+	claims := &CustomClaims{}
+	err := tokenParse(tokenString, claims)
+	ts := TokenStatus{Email: claims.Email, ExpiresAt: claims.ExpiresAt}
+	var ve *jwt.ValidationError
+	switch {
+	case err == nil:
+	case errors.As(err, &ve) && ve.Errors == jwt.ValidationErrorExpired:
+		ts.Status = TokenStatusExpired
+		return ts, nil
+	default:
+		return TokenStatus{}, runtimeh.SourceInfoError("tokenParse error", err)
+	}
+
+	b, err := kvsToken.Get(claims.tokenKVSKey())
+	if err != nil {
+		return TokenStatus{}, runtimeh.SourceInfoError("kvsToken.Get error", err)
+	}
+	ts.Status = TokenStatusRevoked
+	if b != nil {
+		ts.Status = TokenStatusActive
+	}
+	return ts, nil
+}
+
+// tokenStatusByID returns the TokenStatus of the token in kvsToken with TokenID id. found is
+// false if there is no such token; revoked tokens are not in kvsToken.
+func tokenStatusByID(id string) (ts TokenStatus, found bool, err error) {
+	if id == "" {
+		return TokenStatus{}, false, fmt.Errorf("%s no TokenID", runtimeh.SourceInfo())
+	}
+	keys, err := kvsToken.Keys()
+	if err != nil {
+		return TokenStatus{}, false, runtimeh.SourceInfoError("kvsToken.Keys error", err)
+	}
+	for _, key := range keys {
+		// Emails may contain the separator; TokenIDs do not.
+		i := strings.LastIndex(key, "|")
+		if i < 0 || key[i+1:] != id {
+			continue
+		}
+		email := key[:i]
+		b, err := kvsToken.Get(key)
+		if err != nil || b == nil {
+			return TokenStatus{}, false, err
+		}
+		var expiresAt int64
+		if err := binary.Read(bytes.NewBuffer(b), binary.LittleEndian, &expiresAt); err != nil {
+			return TokenStatus{}, false, runtimeh.SourceInfoError("reading expiresAt error", err)
+		}
+		ts = TokenStatus{Email: email, ExpiresAt: expiresAt, Status: TokenStatusActive}
+		if timeNow().Unix() > expiresAt {
+			ts.Status = TokenStatusExpired
+		}
+		return ts, true, nil
+	}
+	return TokenStatus{}, false, nil
+}
+
+// tokenTTL returns the duration for which a new token for email is valid; the
+// TokenTTLOverride of the auth, from config.TokenTTLResolver, or from config.RoleTokenTTLs,
+// clamped to config.MaxTokenTTL, or config.JWTAuthExpirationInterval.
+func tokenTTL(email string) time.Duration {
+	auth, err := authGet(email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%+v", err)
+		return config.JWTAuthExpirationInterval
+	}
+	ttl := auth.TokenTTLOverride
+	if ttl <= 0 && config.TokenTTLResolver != nil {
+		ttl = config.TokenTTLResolver(email, authRoles(auth))
+	}
+	if ttl <= 0 {
+		ttl = roleTokenTTL(auth)
+	}
+	if ttl <= 0 {
+		return config.JWTAuthExpirationInterval
+	}
+	if config.MaxTokenTTL != 0 && ttl > config.MaxTokenTTL {
+		return config.MaxTokenTTL
+	}
+	return ttl
+}
+
+// roleTokenTTL returns the TTL from config.RoleTokenTTLs for auth; the TTL of the first role
+// of auth with a TTL, or the TTL for the empty role. Zero if there is none.
+func roleTokenTTL(auth authentication) time.Duration {
+	for _, role := range authRoles(auth) {
+		if ttl, ok := config.RoleTokenTTLs[role]; ok {
+			return ttl
+		}
+	}
+	return config.RoleTokenTTLs[""]
 }
 
 // uniqueID is used to generate 16 byte (32 character) ID's; as a UUID (includeHuphens) or
@@ -464,33 +2413,100 @@ func uniqueID(includeHyphens bool) (id string, err error) {
 	return fmt.Sprintf("%x", idBin[:]), err
 }
 
+// userData returns the UserData for email.
+func userData(email string) (UserData, error) {
+	auth, err := authGet(email)
+	if err != nil {
+		return UserData{}, err
+	}
+	ud := UserData{Authorizations: auth.Authorizations, ContactEmail: auth.ContactEmail, Disabled: auth.Disabled, Email: email, MustChangePassword: auth.MustChangePassword,
+		Phone: auth.Phone, PreviousEmails: auth.PreviousEmails, Roles: authRoles(auth), TokenTTLOverride: auth.TokenTTLOverride}
+
+	if ud.APIKeys, err = apiKeyList(email); err != nil {
+		return UserData{}, err
+	}
+	if config.AuditStore {
+		if ud.Audit, err = auditRecords(email); err != nil {
+			return UserData{}, err
+		}
+	}
+	if ud.Sessions, err = sessionsList(email); err != nil {
+		return UserData{}, err
+	}
+	return ud, nil
+}
+
+// userTokenKeys returns the keys in kvsToken for the specified email.
+func userTokenKeys(email string) ([]string, error) {
+	keys, err := kvsToken.Keys()
+	if err != nil {
+		lpf(logh.Error, "getting keys: %v\n", err)
+		return nil, err
+	}
+
+	var userKeys []string
+	for i := range keys {
+		if strings.HasPrefix(keys[i], email+"|") {
+			userKeys = append(userKeys, keys[i])
+		}
+	}
+	return userKeys, nil
+}
+
 // userTokens gets a count of tokens in kvsToken for the specified email. If
 // remove == true, all tokens are removed and the count is the number of removed
 // tokens.
 func userTokens(email string, remove bool) (int, error) {
-	keys, err := kvsToken.Keys()
+	if remove {
+		removed, _, err := userTokensRemove(email, "", 0, false)
+		return removed, err
+	}
+
+	keys, err := userTokenKeys(email)
+	return len(keys), err
+}
+
+// userTokensRemove removes up to limit tokens in kvsToken for the specified email, and
+// returns the number removed and the number remaining. The token with key keep, if any, is
+// removed only once no other tokens remain; this allows the caller to continue removing
+// tokens using the token with key keep. limit <= 0 removes all tokens. With dryRun the counts
+// are returned without removing any tokens.
+func userTokensRemove(email string, keep string, limit int, dryRun bool) (removed int, remaining int, err error) {
+	keys, err := userTokenKeys(email)
 	if err != nil {
-		lpf(logh.Error, "getting keys: %v\n", err)
-		return 0, err
+		return 0, 0, err
 	}
 
-	count := 0
+	keepFound := false
 	for i := range keys {
-		_, err := kvsToken.Get(keys[i])
-		if err != nil {
-			lpf(logh.Error, "getting token: %v\n", err)
-			return count, err
+		if keys[i] == keep {
+			keepFound = true
+			continue
 		}
-
-		if strings.HasPrefix(keys[i], email) {
-			if remove {
-				if _, err := kvsToken.Delete(keys[i]); err != nil {
-					lpf(logh.Error, "kvsToken.Delete error:%+v", err)
-				}
+		if limit > 0 && removed >= limit {
+			remaining++
+			continue
+		}
+		if !dryRun {
+			if _, err := tokenDelete(kvsToken, keys[i]); err != nil {
+				lpf(logh.Error, "kvsToken.Delete error:%+v", err)
+				return removed, len(keys) - removed, err
 			}
-			count++
 		}
+		removed++
 	}
 
-	return count, nil
+	if keepFound {
+		if remaining > 0 || (limit > 0 && removed >= limit) {
+			return removed, remaining + 1, nil
+		}
+		if !dryRun {
+			if _, err := tokenDelete(kvsToken, keep); err != nil {
+				lpf(logh.Error, "kvsToken.Delete error:%+v", err)
+				return removed, 1, err
+			}
+		}
+		removed++
+	}
+	return removed, remaining, nil
 }
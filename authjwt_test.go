@@ -2,13 +2,18 @@ package authjwt
 
 import (
 	"bytes"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -19,12 +24,14 @@ import (
 
 var (
 	dataSourcePath string
+	// dataSourceCount numbers the database of each testSetup.
+	dataSourceCount int
+	testDir         string
 )
 
 func init() {
 	t := testing.T{}
-	testDir := t.TempDir()
-	dataSourcePath = filepath.Join(testDir, "test.db")
+	testDir = t.TempDir()
 
 	// testSetup only to initialize config
 	testSetup()
@@ -71,6 +78,87 @@ func TestAuthCreateGetDelete(t *testing.T) {
 	}
 }
 
+// TestAuthCreateNewConcurrent verifies concurrent creates of case variants of the same email
+// with EmailUniqueCaseInsensitive result in exactly one auth.
+func TestAuthCreateNewConcurrent(t *testing.T) {
+	testSetup()
+	config.EmailUniqueCaseInsensitive = true
+
+	emails := []string{"race@auth.com", "Race@auth.com", "RACE@auth.com", "race@AUTH.com"}
+	errs := make(chan error, len(emails))
+	for i := range emails {
+		go func(em string) {
+			errs <- authCreateNew(authentication{Email: &em, PasswordHash: []byte("hash")})
+		}(emails[i])
+	}
+	created := 0
+	for range emails {
+		err := <-errs
+		if err == nil {
+			created++
+		} else if !errors.Is(err, ErrAuthExists) {
+			t.Errorf("authCreateNew error: %v", err)
+			return
+		}
+	}
+	if created != 1 {
+		t.Errorf("wrong number of auths created: %d", created)
+		return
+	}
+}
+
+// TestAuthCreateFirstUserIsAdmin verifies, with FirstUserIsAdmin, exactly one of concurrent
+// first creates gets RoleAdmin, and later creates do not.
+func TestAuthCreateFirstUserIsAdmin(t *testing.T) {
+	testSetup()
+	config.FirstUserIsAdmin = true
+
+	emails := []string{"first0@auth.com", "first1@auth.com", "first2@auth.com", "first3@auth.com"}
+	errs := make(chan error, len(emails))
+	for i := range emails {
+		go func(i int) {
+			if i%2 == 0 {
+				errs <- authCreateNew(authentication{Email: &emails[i], PasswordHash: []byte("hash")})
+				return
+			}
+			pwd := "P@ssw0rd"
+			cred := Credential{Email: &emails[i], Password: &pwd}
+			errs <- cred.AuthCreate()
+		}(i)
+	}
+	for range emails {
+		if err := <-errs; err != nil {
+			t.Errorf("create error: %v", err)
+			return
+		}
+	}
+	admins := 0
+	for _, em := range emails {
+		admin, err := authIsAdmin(em)
+		if err != nil {
+			t.Errorf("authIsAdmin error: %v", err)
+			return
+		}
+		if admin {
+			admins++
+		}
+	}
+	if admins != 1 {
+		t.Errorf("wrong number of admins: %d", admins)
+		return
+	}
+
+	em := "second@auth.com"
+	if err := authCreateNew(authentication{Email: &em, PasswordHash: []byte("hash")}); err != nil {
+		t.Errorf("authCreateNew error: %v", err)
+		return
+	}
+	if admin, err := authIsAdmin(em); admin || err != nil {
+		t.Errorf("later auth is admin: %t, error: %v", admin, err)
+		return
+	}
+}
+
 // TestAuthTokenCreate tests creating a token for a given auth.
 func TestAuthTokenCreate(t *testing.T) {
 	testSetup()
@@ -102,6 +190,394 @@ func TestAuthTokenCreate(t *testing.T) {
 	// fmt.Printf("claims %+v\n", *claimsOut)
 }
 
+// TestParseClaimsSigningMethod verifies only tokens signed with RS256 are accepted; I.E. an
+// HS256 token using the public key as the secret is rejected.
+func TestParseClaimsSigningMethod(t *testing.T) {
+	testSetup()
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(rsaPublicKey)
+	if err != nil {
+		t.Errorf("MarshalPKIXPublicKey error: %v", err)
+		return
+	}
+	claims := CustomClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()},
+		Email: "someone@auth.com"}
+	tests := []struct {
+		method jwt.SigningMethod
+		key    any
+		valid  bool
+	}{
+		{jwt.SigningMethodRS256, rsaPrivateKey, true},
+		{jwt.SigningMethodRS512, rsaPrivateKey, false},
+		{jwt.SigningMethodHS256, publicKeyBytes, false},
+	}
+	for i, tc := range tests {
+		tokenString, err := jwt.NewWithClaims(tc.method, claims).SignedString(tc.key)
+		if err != nil {
+			t.Errorf("test %d, SignedString error: %v", i, err)
+			return
+		}
+		if _, err := parseClaims(tokenString); (err == nil) != tc.valid {
+			t.Errorf("test %d, method: %s, parseClaims error: %v", i, tc.method.Alg(), err)
+			return
+		}
+	}
+}
+
+// TestIssuerAudience verifies tokens are issued with the configured Issuer and Audience, and
+// tokens with another Issuer or Audience, signed with the same key, are rejected.
+func TestIssuerAudience(t *testing.T) {
+	testSetup()
+	config.Issuer = "service-a"
+	config.Audience = "api-a"
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	_, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if claims.Issuer != config.Issuer || claims.Audience != config.Audience {
+		t.Errorf("wrong issuer: %s or audience: %s", claims.Issuer, claims.Audience)
+		return
+	}
+	oneTime, err := oneTimeTokenCreate(em, PurposeMagicLink, time.Minute)
+	if err != nil {
+		t.Errorf("oneTimeTokenCreate error: %v", err)
+		return
+	}
+	if _, err := parseClaims(oneTime); err != nil {
+		t.Errorf("single use token not valid: %v", err)
+		return
+	}
+
+	tests := []struct {
+		issuer   string
+		audience string
+		valid    bool
+	}{
+		{"service-a", "api-a", true},
+		{"service-b", "api-a", false},
+		{"service-a", "api-b", false},
+		{"", "", false},
+	}
+	for i, tc := range tests {
+		claims := CustomClaims{StandardClaims: jwt.StandardClaims{Audience: tc.audience,
+			ExpiresAt: time.Now().Add(time.Minute).Unix(), Issuer: tc.issuer}, Email: em}
+		tokenString, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(rsaPrivateKey)
+		if err != nil {
+			t.Errorf("test %d, SignedString error: %v", i, err)
+			return
+		}
+		if _, err := parseClaims(tokenString); (err == nil) != tc.valid {
+			t.Errorf("test %d, issuer: %s, audience: %s, parseClaims error: %v", i, tc.issuer, tc.audience, err)
+			return
+		}
+	}
+}
+
+// TestClockSkewLeeway verifies ClockSkewLeeway allows tokens just past exp, or just before nbf,
+// and only by the leeway.
+func TestClockSkewLeeway(t *testing.T) {
+	testSetup()
+
+	now := time.Now()
+	tests := []struct {
+		leeway    time.Duration
+		expiresAt time.Time
+		notBefore time.Time
+		valid     bool
+	}{
+		{0, now.Add(-10 * time.Second), time.Time{}, false},
+		{30 * time.Second, now.Add(-10 * time.Second), time.Time{}, true},
+		{30 * time.Second, now.Add(-time.Minute), time.Time{}, false},
+		{0, now.Add(time.Minute), now.Add(10 * time.Second), false},
+		{30 * time.Second, now.Add(time.Minute), now.Add(10 * time.Second), true},
+		{30 * time.Second, now.Add(2 * time.Minute), now.Add(time.Minute), false},
+	}
+	for i, tc := range tests {
+		config.ClockSkewLeeway = tc.leeway
+		claims := CustomClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: tc.expiresAt.Unix()},
+			Email: "someone@auth.com"}
+		if !tc.notBefore.IsZero() {
+			claims.NotBefore = tc.notBefore.Unix()
+		}
+		tokenString, err := tokenSign(claims)
+		if err != nil {
+			t.Errorf("test %d, tokenSign error: %v", i, err)
+			return
+		}
+		if _, err := parseClaims(tokenString); (err == nil) != tc.valid {
+			t.Errorf("test %d, parseClaims error: %v", i, err)
+			return
+		}
+	}
+}
+
+// TestClaimsEnricher verifies the claims from ClaimsEnricher are added to tokens for the email,
+// and an error fails the token creation.
+func TestClaimsEnricher(t *testing.T) {
+	testSetup()
+	enrichErr := errors.New("enricher failed")
+	config.ClaimsEnricher = func(email string) (map[string]any, error) {
+		if email == "fail@auth.com" {
+			return nil, enrichErr
+		}
+		return map[string]any{"email": "replaced@auth.com", "tenant": "tenant-" + email}, nil
+	}
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	_, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if claims.Email != em || claims.Extra["tenant"] != "tenant-"+em || claims.Extra["email"] != "replaced@auth.com" {
+		t.Errorf("wrong claims: %+v", claims)
+		return
+	}
+	if _, err := authTokenStringCreate("fail@auth.com"); !errors.Is(err, enrichErr) {
+		t.Errorf("ClaimsEnricher error not returned: %v", err)
+		return
+	}
+}
+
+// TestAuthTokenTTLOverride verifies a TokenTTLOverride shortens the tokens of one user, others
+// use JWTAuthExpirationInterval, and overrides are clamped to MaxTokenTTL.
+func TestAuthTokenTTLOverride(t *testing.T) {
+	testSetup()
+
+	kiosk := "kiosk@auth.com"
+	if _, _, err := createAuth(t, &kiosk); err != nil {
+		return
+	}
+	other, _, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	if err := AuthTokenTTLOverrideSet(kiosk, time.Minute); err != nil {
+		t.Errorf("AuthTokenTTLOverrideSet error: %v", err)
+		return
+	}
+	if err := AuthTokenTTLOverrideSet("unknown@auth.com", time.Minute); err == nil {
+		t.Errorf("AuthTokenTTLOverrideSet did not error for unknown email")
+		return
+	}
+
+	expiresIn := func(email string) (time.Duration, error) {
+		tokenString, err := authTokenStringCreate(email)
+		if err != nil {
+			return 0, err
+		}
+		claims, err := parseClaims(tokenString)
+		if err != nil {
+			return 0, err
+		}
+		return time.Until(time.Unix(claims.ExpiresAt, 0)).Round(time.Minute), nil
+	}
+	tests := []struct {
+		email       string
+		maxTokenTTL time.Duration
+		expected    time.Duration
+	}{
+		{kiosk, 0, time.Minute},
+		{other, 0, config.JWTAuthExpirationInterval},
+		{kiosk, 20 * time.Second, 0},
+		{other, 20 * time.Second, config.JWTAuthExpirationInterval},
+	}
+	for i, tc := range tests {
+		config.MaxTokenTTL = tc.maxTokenTTL
+		d, err := expiresIn(tc.email)
+		if err != nil || d != tc.expected {
+			t.Errorf("test %d, wrong expiration: %v, error: %v", i, d, err)
+			return
+		}
+	}
+}
+
+// TestTokenTTLResolver verifies the precedence of TokenTTLOverride, TokenTTLResolver, and
+// RoleTokenTTLs, and that MaxTokenTTL clamps them.
+func TestTokenTTLResolver(t *testing.T) {
+	testSetup()
+
+	admin := "admin@auth.com"
+	service := "service@auth.com"
+	kiosk := "kiosk@auth.com"
+	other := "other@auth.com"
+	for _, em := range []string{admin, service, kiosk, other} {
+		if _, _, err := createAuth(t, &em); err != nil {
+			return
+		}
+	}
+	if err := AuthRolesSet(admin, []string{RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	if err := AuthRolesSet(kiosk, []string{RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	if err := AuthTokenTTLOverrideSet(kiosk, time.Minute); err != nil {
+		t.Errorf("AuthTokenTTLOverrideSet error: %v", err)
+		return
+	}
+	config.RoleTokenTTLs = map[string]time.Duration{RoleAdmin: 15 * time.Minute, "": time.Hour}
+	config.TokenTTLResolver = func(email string, roles []string) time.Duration {
+		if email == service {
+			return 24 * time.Hour
+		}
+		return 0
+	}
+
+	tests := []struct {
+		email       string
+		maxTokenTTL time.Duration
+		expected    time.Duration
+	}{
+		{admin, 0, 15 * time.Minute},
+		{service, 0, 24 * time.Hour},
+		{kiosk, 0, time.Minute},
+		{other, 0, time.Hour},
+		{service, 2 * time.Hour, 2 * time.Hour},
+		{other, 30 * time.Minute, 30 * time.Minute},
+	}
+	for i, tc := range tests {
+		config.MaxTokenTTL = tc.maxTokenTTL
+		if ttl := tokenTTL(tc.email); ttl != tc.expected {
+			t.Errorf("test %d, email: %s, ttl: %v, expected: %v", i, tc.email, ttl, tc.expected)
+			return
+		}
+	}
+}
+
+// TestMaxAuthRecordSize verifies auths larger than MaxAuthRecordSize are rejected, for roles
+// and for create through handlerCreateOrUpdate, and normal auths are accepted.
+func TestMaxAuthRecordSize(t *testing.T) {
+	testSetup()
+	config.MaxAuthRecordSize = 512
+
+	em, _, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(em, []string{"viewer", "editor"}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	roles := make([]string, 100)
+	for i := range roles {
+		roles[i] = fmt.Sprintf("role-%d", i)
+	}
+	if err := AuthRolesSet(em, roles); !errors.Is(err, ErrAuthRecordTooLarge) {
+		t.Errorf("AuthRolesSet did not return ErrAuthRecordTooLarge: %v", err)
+		return
+	}
+	auth, err := authGet(em)
+	if err != nil || len(auth.Roles) != 2 {
+		t.Errorf("auth changed by rejected update: %+v, error: %v", auth, err)
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handlerCreateOrUpdate))
+	defer testServer.Close()
+	big := strings.Repeat("a", 600) + "@auth.com"
+	ps := "P@ssword1234"
+	credBytes, err := json.Marshal(Credential{Email: &big, Password: &ps})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	resp, err := http.Post(testServer.URL, "application/json", bytes.NewBuffer(credBytes))
+	if err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversize create did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+}
+
+// TestIdentifierValidator verifies the default email validation, and that a custom
+// IdentifierValidator replaces it.
+func TestIdentifierValidator(t *testing.T) {
+	testSetup()
+
+	ps := "P@ss1234"
+	em := "555-0100"
+	cred := Credential{Email: &em, Password: &ps}
+	if err := cred.AuthCreate(); err == nil {
+		t.Errorf("AuthCreate did not have error on non-email identifier: %s", em)
+		return
+	}
+
+	phone := regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+	config.IdentifierValidator = func(id string) error {
+		if !phone.MatchString(id) {
+			return fmt.Errorf("not a phone number: %s", id)
+		}
+		return nil
+	}
+	defer func() { config.IdentifierValidator = nil }()
+
+	for _, id := range []string{"+15550100123", " +442071838750 "} {
+		cred := Credential{Email: &id, Password: &ps}
+		if err := cred.AuthCreate(); err != nil {
+			t.Errorf("AuthCreate error on identifier: %s, err: %v", id, err)
+			return
+		}
+	}
+	for _, id := range []string{"someone@somewhere.com", "5550100", "+1555abc0100"} {
+		cred := Credential{Email: &id, Password: &ps}
+		if err := cred.AuthCreate(); err == nil {
+			t.Errorf("AuthCreate did not have error on identifier: %s", id)
+			return
+		}
+	}
+}
+
+// TestInitGuard verifies requests before Init get http.StatusServiceUnavailable, and Init
+// replaces the configuration only when AllowReinitialize.
+func TestInitGuard(t *testing.T) {
+	testSetup()
+	initialized.Store(false)
+	handlers := []func(w http.ResponseWriter, r *http.Request){
+		HandlerFuncAuthJWTWrapper(handlerTest),
+		HandlerFuncNoAuthWrapper(handlerTest),
+		func(w http.ResponseWriter, r *http.Request) { Authenticated(w, r) },
+	}
+	for i, hf := range handlers {
+		rr := httptest.NewRecorder()
+		hf(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), notInitializedMessage) {
+			t.Errorf("handler %d before Init did not return proper status: %d, body: %s", i, rr.Code, rr.Body.String())
+			return
+		}
+	}
+
+	testSetup()
+	cfg := config
+	cfg.AllowReinitialize = false
+	cfg.AppName = "reinitialized"
+	Init(cfg, nil)
+	if config.AppName != cfg.AppName {
+		t.Errorf("Init with AllowReinitialize did not replace the configuration: %s", config.AppName)
+		return
+	}
+	cfg.AppName = "ignored"
+	Init(cfg, nil)
+	if config.AppName != "reinitialized" {
+		t.Errorf("Init without AllowReinitialize replaced the configuration: %s", config.AppName)
+		return
+	}
+	// The stores opened by the replaced Init are usable.
+	if _, credBytes, err := createAuth(t, nil); err != nil {
+		return
+	} else if _, _, err := login(t, credBytes); err != nil {
+		return
+	}
+}
+
 func TestRemoveExpiredTokens(t *testing.T) {
 	testSetup()
 
@@ -140,6 +616,64 @@ func TestRemoveExpiredTokens(t *testing.T) {
 	}
 }
 
+// TestTimeSourceBackwards verifies a backward jump of TimeSource does not issue tokens that
+// expire before previously issued tokens, and negative TTLs do not issue tokens.
+func TestTimeSourceBackwards(t *testing.T) {
+	testSetup()
+
+	var mu sync.Mutex
+	clock := time.Now()
+	config.TimeSource = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	}
+	em, _, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+
+	expiresAt := func() (int64, error) {
+		tokenString, err := authTokenStringCreate(em)
+		if err != nil {
+			return 0, err
+		}
+		claims, err := parseClaims(tokenString)
+		if err != nil {
+			return 0, err
+		}
+		return claims.ExpiresAt, nil
+	}
+	before, err := expiresAt()
+	if err != nil {
+		t.Errorf("expiresAt error: %v", err)
+		return
+	}
+	mu.Lock()
+	clock = clock.Add(-time.Hour)
+	mu.Unlock()
+	after, err := expiresAt()
+	if err != nil || after < before {
+		t.Errorf("token after clock jump expires before prior token, before: %d, after: %d, error: %v", before, after, err)
+		return
+	}
+
+	// A negative override is ignored; a negative interval is an error.
+	if err := AuthTokenTTLOverrideSet(em, -time.Hour); err != nil {
+		t.Errorf("AuthTokenTTLOverrideSet error: %v", err)
+		return
+	}
+	if ttl := tokenTTL(em); ttl != config.JWTAuthExpirationInterval {
+		t.Errorf("negative override was used: %v", ttl)
+		return
+	}
+	config.JWTAuthExpirationInterval = -time.Minute
+	if _, err := authTokenStringCreate(em); err == nil {
+		t.Errorf("token created with negative TTL")
+		return
+	}
+}
+
 func TestValidateNegative(t *testing.T) {
 	testSetup()
 
@@ -186,6 +720,118 @@ func TestUniqueID(t *testing.T) {
 	}
 }
 
+// TestNoTokenNoStoreAccess verifies a request without a token is rejected with ErrNoToken
+// and http.StatusUnauthorized, without accessing kvsToken.
+func TestNoTokenNoStoreAccess(t *testing.T) {
+	testSetup()
+
+	spy := &tokenStoreSpy{tokenStore: kvsToken}
+	kvsToken = spy
+	// Restored so testSetup closes the store.
+	defer func() { kvsToken = spy.tokenStore }()
+
+	for _, header := range []string{"", "Bearer ", "Bearer"} {
+		req := httptest.NewRequest(http.MethodDelete, "/", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		if _, err := Authenticated(w, req); !errors.Is(err, ErrNoToken) {
+			t.Errorf("Authenticated error is not ErrNoToken, header: %s, error: %v", header, err)
+			return
+		}
+
+		w = httptest.NewRecorder()
+		HandlerFuncAuthJWTWrapper(handlerLogoutAll)(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("wrapper did not return proper status, header: %s, status: %d", header, w.Code)
+			return
+		}
+	}
+
+	if spy.calls != 0 {
+		t.Errorf("kvsToken was accessed %d times", spy.calls)
+	}
+}
+
+// TestValidateTokenString verifies tokens are validated offline, without accessing kvsToken,
+// and expired, tampered, and single use tokens are rejected.
+func TestValidateTokenString(t *testing.T) {
+	testSetup()
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	expired, err := tokenSign(CustomClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+		Email: em})
+	if err != nil {
+		t.Errorf("tokenSign error: %v", err)
+		return
+	}
+	oneTime, err := oneTimeTokenCreate(em, PurposeMagicLink, time.Minute)
+	if err != nil {
+		t.Errorf("oneTimeTokenCreate error: %v", err)
+		return
+	}
+
+	spy := &tokenStoreSpy{tokenStore: kvsToken}
+	kvsToken = spy
+	// Restored so testSetup closes the store.
+	defer func() { kvsToken = spy.tokenStore }()
+
+	tests := []struct {
+		token string
+		valid bool
+	}{
+		{string(tokenBytes), true},
+		{expired, false},
+		{string(tokenBytes[:len(tokenBytes)-2]) + "xx", false},
+		{oneTime, false},
+		{"", false},
+	}
+	for i, tc := range tests {
+		claims, err := ValidateTokenString(tc.token)
+		if (err == nil) != tc.valid || (tc.valid && claims.Email != em) {
+			t.Errorf("test %d, claims: %+v, error: %v", i, claims, err)
+			return
+		}
+	}
+	if spy.calls != 0 {
+		t.Errorf("kvsToken was accessed %d times", spy.calls)
+	}
+}
+
+// tokenStoreSpy counts the calls made to a tokenStore.
+type tokenStoreSpy struct {
+	tokenStore
+	calls int
+}
+
+func (tss *tokenStoreSpy) Delete(key string) (int64, error) {
+	tss.calls++
+	return tss.tokenStore.Delete(key)
+}
+
+func (tss *tokenStoreSpy) Get(key string) ([]byte, error) {
+	tss.calls++
+	return tss.tokenStore.Get(key)
+}
+
+func (tss *tokenStoreSpy) Keys() ([]string, error) {
+	tss.calls++
+	return tss.tokenStore.Keys()
+}
+
+func (tss *tokenStoreSpy) Set(key string, value []byte) error {
+	tss.calls++
+	return tss.tokenStore.Set(key, value)
+}
+
 // authDelete removes an ID/authentication pair from the KVS.
 // Returns the count, which is zero (and no error) if the id did not exist.
 func authDelete(id string) (int64, error) {
@@ -193,6 +839,52 @@ func authDelete(id string) (int64, error) {
 	return c, runtimeh.SourceInfoError("authDelete error", err)
 }
 
+// TestPasswordRehash verifies passwords are hashed again at login when the algorithm or cost
+// parameters change, and not when they are unchanged.
+func TestPasswordRehash(t *testing.T) {
+	testSetup()
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+
+	tests := []struct {
+		algorithm  string
+		bcryptCost int
+		time       uint32
+		prefix     string
+		rehashed   bool
+	}{
+		{PasswordHashBcrypt, defaultBcryptCost, 1, "$2a$10$", false},
+		{PasswordHashBcrypt, defaultBcryptCost + 1, 1, "$2a$11$", true},
+		{PasswordHashArgon2id, defaultBcryptCost + 1, 1, "$argon2id$v=19$m=64,t=1,p=1$", true},
+		{PasswordHashArgon2id, defaultBcryptCost + 1, 1, "$argon2id$v=19$m=64,t=1,p=1$", false},
+		{PasswordHashArgon2id, defaultBcryptCost + 1, 2, "$argon2id$v=19$m=64,t=2,p=1$", true},
+		{PasswordHashBcrypt, defaultBcryptCost, 2, "$2a$10$", true},
+	}
+	for i, tc := range tests {
+		previous, err := authGet(em)
+		if err != nil {
+			t.Errorf("test %d, authGet error: %v", i, err)
+			return
+		}
+		config.PasswordHashAlgorithm, config.BcryptCost = tc.algorithm, tc.bcryptCost
+		config.Argon2idMemory, config.Argon2idParallelism, config.Argon2idTime = 64, 1, tc.time
+		if _, _, err := login(t, credBytes); err != nil {
+			return
+		}
+		auth, err := authGet(em)
+		if err != nil {
+			t.Errorf("test %d, authGet error: %v", i, err)
+			return
+		}
+		if !strings.HasPrefix(string(auth.PasswordHash), tc.prefix) || bytes.Equal(auth.PasswordHash, previous.PasswordHash) != !tc.rehashed {
+			t.Errorf("test %d, password hash: %s, expected prefix: %s, rehashed: %t", i, auth.PasswordHash, tc.prefix, tc.rehashed)
+			return
+		}
+	}
+}
+
 // createAuth creates an entry in kvsAuth
 func createAuth(t *testing.T, email *string) (string, []byte, error) {
 	// create auth (user)
@@ -250,9 +942,19 @@ func login(t *testing.T, credBytes []byte) ([]byte, *CustomClaims, error) {
 }
 
 func testSetup() {
-	os.Remove(dataSourcePath)
+	// Close the stores from any prior setup before removing the database they use. Each
+	// setup uses a new database; SQLITE does not reliably handle a file being replaced at the
+	// same path.
+	kvsClose()
+	initialized.Store(false)
+	if dataSourcePath != "" {
+		os.Remove(dataSourcePath)
+	}
+	dataSourceCount++
+	dataSourcePath = filepath.Join(testDir, fmt.Sprintf("test%d.db", dataSourceCount))
 
-	config = Config{AppName: "auth", AuditLogName: "auth.audit", LogName: "auth",
+	// Tests modify config and call Init again, so reinitialization is allowed.
+	config = Config{AllowReinitialize: true, AppName: "auth", AuditLogName: "auth.audit", LogName: "auth",
 		JWTAuthExpirationInterval: time.Minute * 15, testing: true,
 	}
 	config.DataSourcePath = dataSourcePath
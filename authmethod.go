@@ -0,0 +1,36 @@
+package authjwt
+
+import (
+	"net/http"
+)
+
+// Values of CustomClaims.AuthMethod; how the user authenticated to obtain the token.
+const (
+	AuthMethodAPIKey    = "api-key"
+	AuthMethodMagicLink = "magic-link"
+	AuthMethodPassword  = "password"
+	// AuthMethodRememberMe is a token from a remember me token at PathRememberMe, without the
+	// user entering their password.
+	AuthMethodRememberMe = "remember-me"
+	// AuthMethodSMS is a token from a code sent to the Phone of the user, at PathSMSLogin.
+	AuthMethodSMS = "sms"
+	// AuthMethodStepUp is a token where the user re-entered their password at PathStepUp,
+	// while authenticated by any other method.
+	AuthMethodStepUp = "step-up"
+)
+
+// AuthMethodRequired returns true if claims were obtained using one of methods. Otherwise
+// http.StatusForbidden is written and false is returned. Used by handlers requiring step up
+// authentication; I.E. a billing handler allowing only tokens from a stronger method.
+func AuthMethodRequired(w http.ResponseWriter, claims *CustomClaims, methods ...string) bool {
+	for _, method := range methods {
+		if claims.AuthMethod != "" && claims.AuthMethod == method {
+			return true
+		}
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = "auth method not allowed: " + claims.AuthMethod
+	}
+	w.WriteHeader(http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,130 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAuthMethod verifies tokens carry the method used to authenticate, refresh keeps the
+// method, and AuthMethodRequired rejects tokens from other methods.
+func TestAuthMethod(t *testing.T) {
+	testSetup()
+	config.APIKeysEnabled = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	passwordToken, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if claims.AuthMethod != AuthMethodPassword {
+		t.Errorf("wrong auth method for login: %s", claims.AuthMethod)
+		return
+	}
+
+	magicLinkToken, err := oneTimeTokenCreate(em, PurposeMagicLink, time.Minute)
+	if err != nil {
+		t.Errorf("oneTimeTokenCreate error: %v", err)
+		return
+	}
+	b, err := json.Marshal(OneTimeToken{Token: magicLinkToken})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	testServerConsume := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerConsumeMagicLink)))
+	defer testServerConsume.Close()
+	resp, err := http.Post(testServerConsume.URL, "application/json", bytes.NewBuffer(b))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("magic link consume did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	magicLinkTokenBytes, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	if claims, err := parseClaims(string(magicLinkTokenBytes)); err != nil || claims.AuthMethod != AuthMethodMagicLink {
+		t.Errorf("wrong auth method for magic link: %+v, error: %v", claims, err)
+		return
+	}
+
+	testServerRefresh := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerRefresh)))
+	defer testServerRefresh.Close()
+	client := &http.Client{}
+	req, err := http.NewRequest(http.MethodPost, testServerRefresh.URL, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+string(magicLinkTokenBytes))
+	resp, err = client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("refresh did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	refreshedToken, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	if claims, err := parseClaims(string(refreshedToken)); err != nil || claims.AuthMethod != AuthMethodMagicLink {
+		t.Errorf("wrong auth method for refresh: %+v, error: %v", claims, err)
+		return
+	}
+
+	ak, err := apiKeyCreate(em, "ci")
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(apiKeyHeader, ak.Key)
+	if claims, err := apiKeyAuthenticate(httptest.NewRecorder(), req); err != nil || claims.AuthMethod != AuthMethodAPIKey {
+		t.Errorf("wrong auth method for API key: %+v, error: %v", claims, err)
+		return
+	}
+
+	// A handler requiring a magic link token.
+	handlerStepUp := func(w http.ResponseWriter, r *http.Request) {
+		claims, err := Authenticated(w, r)
+		if err != nil {
+			return
+		}
+		if !AuthMethodRequired(w, claims, AuthMethodMagicLink) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerStepUp)))
+	defer testServer.Close()
+	tests := []struct {
+		token  []byte
+		status int
+	}{
+		{passwordToken, http.StatusForbidden},
+		{refreshedToken, http.StatusNoContent},
+	}
+	for i, tc := range tests {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tc.token))
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("test %d did not return proper status: %d, error: %v", i, resp.StatusCode, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package authjwt
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+const (
+	// breachedPasswordBodyLimit bounds the size of range API responses.
+	breachedPasswordBodyLimit = 4 << 20
+	// breachedPasswordPrefixLength is the number of hex characters of the SHA-1 hash sent to
+	// the range API.
+	breachedPasswordPrefixLength = 5
+	// breachedPasswordTimeout is the timeout of range API requests.
+	breachedPasswordTimeout = 5 * time.Second
+
+	reasonBreachedPassword      = "password is in a known data breach"
+	reasonBreachedPasswordCheck = "password could not be checked against known data breaches"
+)
+
+// breachedPasswordReasons returns the reason password is rejected by the breach checks of
+// config.BreachedPasswordChecker and config.BreachedPasswordURL; empty if neither is set, or
+// the password is not known to be breached. Check errors are logged, and reject the password
+// only with config.BreachedPasswordFailClosed.
+func breachedPasswordReasons(password string) []string {
+	if config.BreachedPasswordChecker == nil && config.BreachedPasswordURL == "" {
+		return nil
+	}
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	breached, err := false, error(nil)
+	if config.BreachedPasswordChecker != nil {
+		breached, err = config.BreachedPasswordChecker(hash)
+	}
+	if err == nil && !breached && config.BreachedPasswordURL != "" {
+		breached, err = breachedPasswordRange(hash)
+	}
+	if err != nil {
+		lpf(logh.Error, "breached password check error:%v", err)
+		if config.BreachedPasswordFailClosed {
+			return []string{reasonBreachedPasswordCheck}
+		}
+		return nil
+	}
+	if breached {
+		return []string{reasonBreachedPassword}
+	}
+	return nil
+}
+
+// breachedPasswordRange returns true if the upper case hex SHA-1 hash is returned by the
+// range API at config.BreachedPasswordURL. Only the first breachedPasswordPrefixLength
+// characters are sent (k-anonymity), with padding requested so the response size does not
+// reveal the result.
+func breachedPasswordRange(hash string) (bool, error) {
+	prefix, suffix := hash[:breachedPasswordPrefixLength], hash[breachedPasswordPrefixLength:]
+	req, err := http.NewRequest(http.MethodGet, config.BreachedPasswordURL+prefix, nil)
+	if err != nil {
+		return false, runtimeh.SourceInfoError("range API request", err)
+	}
+	req.Header.Set("Add-Padding", "true")
+	client := http.Client{Timeout: breachedPasswordTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, runtimeh.SourceInfoError("range API request", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			lpf(logh.Error, "resp.Body.Close error:%+v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s range API status: %d", runtimeh.SourceInfo(), resp.StatusCode)
+	}
+
+	// Lines are SUFFIX:COUNT; padding has a count of 0.
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, breachedPasswordBodyLimit))
+	for scanner.Scan() {
+		s, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(s, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, runtimeh.SourceInfoError("reading range API response", err)
+	}
+	return false, nil
+}
@@ -0,0 +1,89 @@
+package authjwt
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestBreachedPassword verifies breached passwords are rejected by AuthCreate using the range
+// API and BreachedPasswordChecker, only the hash prefix is sent, and check errors reject
+// passwords only with BreachedPasswordFailClosed.
+func TestBreachedPassword(t *testing.T) {
+	testSetup()
+	breached := "P@ssword1234"
+	sum := sha1.Sum([]byte(breached))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	status := http.StatusOK
+	prefixes := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimPrefix(r.URL.Path, "/range/")
+		prefixes = append(prefixes, prefix)
+		w.WriteHeader(status)
+		// Padding, with a count of 0, is not a match.
+		fmt.Fprintf(w, "%s:0\r\n", hash[5:])
+		if prefix == hash[:5] {
+			fmt.Fprintf(w, "0018A45C4D1DEF81644B54AB7F969B88D65:3\r\n%s:42\r\n", hash[5:])
+		}
+	}))
+	defer testServer.Close()
+
+	create := func(password string) error {
+		em := "someone@auth.com"
+		cred := &Credential{Email: &em, Password: &password}
+		return cred.AuthCreate()
+	}
+
+	config.BreachedPasswordURL = testServer.URL + "/range/"
+	ppe := &PasswordPolicyError{}
+	if err := create(breached); !errors.As(err, &ppe) || !reflect.DeepEqual(ppe.Reasons, []string{reasonBreachedPassword}) {
+		t.Errorf("breached password was not rejected: %v", err)
+		return
+	}
+	if err := create("Not-Breached1234"); err != nil {
+		t.Errorf("AuthCreate error: %v", err)
+		return
+	}
+	if len(prefixes) != 2 || prefixes[0] != hash[:5] || len(prefixes[1]) != breachedPasswordPrefixLength {
+		t.Errorf("wrong prefixes sent: %v", prefixes)
+		return
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := create(breached); err != nil {
+		t.Errorf("fail open AuthCreate error: %v", err)
+		return
+	}
+	config.BreachedPasswordFailClosed = true
+	if err := create(breached); !errors.As(err, &ppe) || !reflect.DeepEqual(ppe.Reasons, []string{reasonBreachedPasswordCheck}) {
+		t.Errorf("fail closed did not reject the password: %v", err)
+		return
+	}
+
+	// An invalid password is not checked.
+	requests := len(prefixes)
+	if err := create("short"); err == nil || len(prefixes) != requests {
+		t.Errorf("invalid password was checked, error: %v", err)
+		return
+	}
+
+	config.BreachedPasswordURL = ""
+	config.BreachedPasswordChecker = func(sha1Hex string) (bool, error) {
+		return sha1Hex == hash, nil
+	}
+	if err := create(breached); !errors.As(err, &ppe) || !reflect.DeepEqual(ppe.Reasons, []string{reasonBreachedPassword}) {
+		t.Errorf("BreachedPasswordChecker did not reject the password: %v", err)
+		return
+	}
+	if err := create("Not-Breached1234"); err != nil {
+		t.Errorf("BreachedPasswordChecker AuthCreate error: %v", err)
+		return
+	}
+}
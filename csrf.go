@@ -0,0 +1,74 @@
+package authjwt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+const (
+	// csrfHeader is the request header containing the CSRF token.
+	csrfHeader = "X-CSRF-Token"
+	// csrfKeyLength is the length in bytes of a generated CSRF key.
+	csrfKeyLength = 32
+	// csrfNonceLength is the length in bytes of the random part of a CSRF token.
+	csrfNonceLength = 16
+)
+
+var (
+	// csrfKey is the key used to sign CSRF tokens; config.CSRFKey or a generated key.
+	csrfKey []byte
+)
+
+// csrfKeyLoad sets csrfKey from config.CSRFKey, or generates a random key.
+func csrfKeyLoad() error {
+	if len(config.CSRFKey) > 0 {
+		csrfKey = config.CSRFKey
+		return nil
+	}
+	csrfKey = make([]byte, csrfKeyLength)
+	if _, err := rand.Read(csrfKey); err != nil {
+		return runtimeh.SourceInfoError("generating CSRF key", err)
+	}
+	return nil
+}
+
+// csrfMAC returns the MAC binding nonce to the session identified by claims.
+func csrfMAC(claims *CustomClaims, nonce string) []byte {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(nonce + "|" + claims.tokenKVSKey()))
+	return mac.Sum(nil)
+}
+
+// csrfTokenCreate returns a new CSRF token bound to the session identified by claims.
+// The token is a random nonce and a MAC of the nonce and session, so no state is stored.
+func csrfTokenCreate(claims *CustomClaims) (string, error) {
+	nb := make([]byte, csrfNonceLength)
+	if _, err := rand.Read(nb); err != nil {
+		return "", runtimeh.SourceInfoError("generating CSRF nonce", err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(nb)
+	return nonce + "." + base64.RawURLEncoding.EncodeToString(csrfMAC(claims, nonce)), nil
+}
+
+// csrfTokenValidate returns an error if token is not a CSRF token for the session identified
+// by claims.
+func csrfTokenValidate(claims *CustomClaims, token string) error {
+	nonce, mac, found := strings.Cut(token, ".")
+	if !found {
+		return fmt.Errorf("%s CSRF token missing or malformed", runtimeh.SourceInfo())
+	}
+	mb, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil {
+		return runtimeh.SourceInfoError("decoding CSRF token", err)
+	}
+	if !hmac.Equal(mb, csrfMAC(claims, nonce)) {
+		return fmt.Errorf("%s CSRF token not valid for session", runtimeh.SourceInfo())
+	}
+	return nil
+}
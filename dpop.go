@@ -0,0 +1,233 @@
+package authjwt
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+const (
+	defaultDPoPProofMaxAge = time.Minute
+	// dpopHeader is the request header with the DPoP proof.
+	dpopHeader = "DPoP"
+	// dpopReplayLimit bounds the number of tracked proofs; proofs are rejected when the limit
+	// is reached, rather than growing dpopReplays without bound.
+	dpopReplayLimit = 100000
+	// dpopReplayPruneSize is the number of tracked proofs at which expired proofs are pruned.
+	dpopReplayPruneSize = 1024
+	// dpopScheme is the Authorization scheme for tokens bound to a DPoP key.
+	dpopScheme = "DPoP"
+	// dpopType is the typ header of DPoP proofs.
+	dpopType = "dpop+jwt"
+)
+
+// dpopClaims are the claims of a DPoP proof, RFC 9449 section 4.2.
+type dpopClaims struct {
+	Ath string `json:"ath,omitempty"`
+	Htm string `json:"htm"`
+	Htu string `json:"htu"`
+	Iat int64  `json:"iat"`
+	Jti string `json:"jti"`
+}
+
+var (
+	// dpopAlgorithms are the alg values accepted for DPoP proofs; asymmetric only, per RFC 9449.
+	dpopAlgorithms = []string{"ES256", "ES384", SigningAlgorithmEdDSA, "PS256", SigningAlgorithmRS256}
+
+	// dpopReplays has the expiration of used proofs, by key thumbprint and jti, protected by
+	// dpopReplayMutex.
+	dpopReplays     = map[string]time.Time{}
+	dpopReplayMutex sync.Mutex
+)
+
+// Valid implements jwt.Claims; the proof must have a jti, and be issued within
+// config.DPoPProofMaxAge, with config.ClockSkewLeeway.
+func (dc dpopClaims) Valid() error {
+	if dc.Jti == "" {
+		return fmt.Errorf("%s DPoP proof has no jti", runtimeh.SourceInfo())
+	}
+	now := jwt.TimeFunc()
+	iat := time.Unix(dc.Iat, 0)
+	if iat.After(now.Add(config.ClockSkewLeeway)) || now.Sub(iat) > config.DPoPProofMaxAge+config.ClockSkewLeeway {
+		return fmt.Errorf("%s DPoP proof iat %v not within %v", runtimeh.SourceInfo(), iat, config.DPoPProofMaxAge)
+	}
+	return nil
+}
+
+// dpopBindingValidate returns an error if claims are bound to a DPoP key, and r does not
+// present tokenString with the DPoP scheme and a valid proof for tokenString signed with the
+// key. Tokens not bound to a DPoP key are not checked.
+func dpopBindingValidate(r *http.Request, tokenString string, claims *CustomClaims) error {
+	if claims.Confirmation == nil || claims.Confirmation.JKT == "" {
+		return nil
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), dpopScheme+" ") {
+		return fmt.Errorf("%s DPoP bound token without the DPoP scheme", runtimeh.SourceInfo())
+	}
+	return dpopKeyValidate(r, tokenString, claims.Confirmation.JKT)
+}
+
+// dpopKeyValidate returns an error if r does not have a valid DPoP proof, for accessToken when
+// not empty, signed with the key with thumbprint jkt.
+func dpopKeyValidate(r *http.Request, accessToken string, jkt string) error {
+	proofJKT, err := dpopProofValidate(r, accessToken)
+	if err != nil {
+		return err
+	}
+	if proofJKT != jkt {
+		return fmt.Errorf("%s DPoP proof key does not match the token", runtimeh.SourceInfo())
+	}
+	return nil
+}
+
+// dpopLoginBinding returns the thumbprint of the DPoP key of a login request, when
+// config.DPoPEnabled is true and r has a DPoP proof, to bind the issued tokens to; empty
+// otherwise. false is returned, and the header written with http.StatusBadRequest, for an
+// invalid proof, or no proof when config.DPoPRequired is true.
+func dpopLoginBinding(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !config.DPoPEnabled {
+		return "", true
+	}
+	if len(r.Header.Values(dpopHeader)) == 0 {
+		if config.DPoPRequired {
+			lp(logh.Warning, "login without a DPoP proof")
+			w.WriteHeader(http.StatusBadRequest)
+			return "", false
+		}
+		return "", true
+	}
+	jkt, err := dpopProofValidate(r, "")
+	if err != nil {
+		lpf(logh.Warning, "login DPoP proof rejected:%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return "", false
+	}
+	return jkt, true
+}
+
+// dpopProofValidate validates the DPoP proof of r, RFC 9449 section 4.3, and returns the
+// thumbprint of the key the proof is signed with. The htm and htu claims must match the
+// method, host, and path of r; the scheme is not compared, as TLS is commonly terminated
+// by a proxy. When accessToken is not empty the ath claim must be its hash. Each proof is
+// accepted once.
+func dpopProofValidate(r *http.Request, accessToken string) (string, error) {
+	proofs := r.Header.Values(dpopHeader)
+	if len(proofs) != 1 {
+		return "", fmt.Errorf("%s requests must have one DPoP proof, not %d", runtimeh.SourceInfo(), len(proofs))
+	}
+
+	key := jwk{}
+	claims := dpopClaims{}
+	_, err := jwt.ParseWithClaims(proofs[0], &claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != dpopType {
+			return nil, fmt.Errorf("%s DPoP proof typ: %s", runtimeh.SourceInfo(), typ)
+		}
+		if !dpopAlgorithm(token.Method.Alg()) {
+			return nil, fmt.Errorf("%s DPoP proof alg not allowed: %s", runtimeh.SourceInfo(), token.Method.Alg())
+		}
+		members, ok := token.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s DPoP proof has no jwk", runtimeh.SourceInfo())
+		}
+		if _, ok := members["d"]; ok {
+			return nil, fmt.Errorf("%s DPoP proof jwk is a private key", runtimeh.SourceInfo())
+		}
+		b, err := json.Marshal(members)
+		if err != nil {
+			return nil, runtimeh.SourceInfoError("marshal DPoP proof jwk", err)
+		}
+		if err := json.Unmarshal(b, &key); err != nil {
+			return nil, runtimeh.SourceInfoError("unmarshal DPoP proof jwk", err)
+		}
+		return key.publicKey()
+	})
+	if err != nil {
+		return "", runtimeh.SourceInfoError("DPoP proof not valid", err)
+	}
+
+	if claims.Htm != r.Method {
+		return "", fmt.Errorf("%s DPoP proof htm %s for %s request", runtimeh.SourceInfo(), claims.Htm, r.Method)
+	}
+	htu, err := url.Parse(claims.Htu)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("parsing DPoP proof htu", err)
+	}
+	if htu.Host != r.Host || dpopPath(htu.Path) != dpopPath(r.URL.Path) {
+		return "", fmt.Errorf("%s DPoP proof htu %s for request to %s%s", runtimeh.SourceInfo(), claims.Htu, r.Host, r.URL.Path)
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if claims.Ath != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", fmt.Errorf("%s DPoP proof ath does not match the token", runtimeh.SourceInfo())
+		}
+	}
+
+	jkt, err := key.thumbprint()
+	if err != nil {
+		return "", err
+	}
+	expires := time.Unix(claims.Iat, 0).Add(config.DPoPProofMaxAge + config.ClockSkewLeeway)
+	if err := dpopReplayCheck(jkt+"|"+claims.Jti, expires); err != nil {
+		return "", err
+	}
+	return jkt, nil
+}
+
+// dpopAlgorithm returns true if alg is one of dpopAlgorithms.
+func dpopAlgorithm(alg string) bool {
+	for _, a := range dpopAlgorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// dpopPath returns path, or / when empty, for comparing the htu claim to the request.
+func dpopPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// dpopReplayCheck returns an error if the proof with key was already used, otherwise tracks
+// the proof until expires.
+func dpopReplayCheck(key string, expires time.Time) error {
+	dpopReplayMutex.Lock()
+	defer dpopReplayMutex.Unlock()
+
+	now := jwt.TimeFunc()
+	if len(dpopReplays) >= dpopReplayPruneSize {
+		for k, v := range dpopReplays {
+			if !now.Before(v) {
+				delete(dpopReplays, k)
+			}
+		}
+	}
+	if e, ok := dpopReplays[key]; ok && now.Before(e) {
+		return fmt.Errorf("%s DPoP proof replayed", runtimeh.SourceInfo())
+	}
+	if len(dpopReplays) >= dpopReplayLimit {
+		return fmt.Errorf("%s too many DPoP proofs tracked", runtimeh.SourceInfo())
+	}
+	dpopReplays[key] = expires
+	return nil
+}
+
+// dpopReplayReset clears the tracked proofs.
+func dpopReplayReset() {
+	dpopReplayMutex.Lock()
+	defer dpopReplayMutex.Unlock()
+	dpopReplays = map[string]time.Time{}
+}
@@ -0,0 +1,179 @@
+package authjwt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TestDPoP verifies tokens from a login with a DPoP proof are bound to the key, and are only
+// accepted with the DPoP scheme and a fresh proof for the request and token, signed with the
+// key; and that DPoPRequired rejects logins without a proof.
+func TestDPoP(t *testing.T) {
+	testSetup()
+	config.DPoPEnabled = true
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Errorf("GenerateKey error: %v", err)
+		return
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Errorf("GenerateKey error: %v", err)
+		return
+	}
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+
+	req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set(dpopHeader, testDPoPProof(t, key, http.MethodPut, testServerLogin.URL, ""))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("login with DPoP proof did not return proper status, error: %v", err)
+		return
+	}
+	tokenBytes, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	token := string(tokenBytes)
+	claims, err := parseClaims(token)
+	if err != nil || claims.Confirmation == nil || claims.Confirmation.JKT != testJWKThumbprint(t, &key.PublicKey) {
+		t.Errorf("token not bound to the DPoP key, claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	reused := testDPoPProof(t, key, http.MethodGet, testServer.URL, token)
+	tests := []struct {
+		scheme string
+		proof  string
+		status int
+	}{
+		{dpopScheme, reused, http.StatusNoContent},
+		{dpopScheme, reused, http.StatusUnauthorized},
+		{dpopScheme, testDPoPProof(t, key, http.MethodGet, testServer.URL, token), http.StatusNoContent},
+		{"Bearer", testDPoPProof(t, key, http.MethodGet, testServer.URL, token), http.StatusUnauthorized},
+		{dpopScheme, "", http.StatusUnauthorized},
+		{dpopScheme, testDPoPProof(t, otherKey, http.MethodGet, testServer.URL, token), http.StatusUnauthorized},
+		{dpopScheme, testDPoPProof(t, key, http.MethodPost, testServer.URL, token), http.StatusUnauthorized},
+		{dpopScheme, testDPoPProof(t, key, http.MethodGet, testServer.URL+"/other", token), http.StatusUnauthorized},
+		{dpopScheme, testDPoPProof(t, key, http.MethodGet, testServer.URL, "other"), http.StatusUnauthorized},
+	}
+	for i, tc := range tests {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", tc.scheme+" "+token)
+		if tc.proof != "" {
+			req.Header.Set(dpopHeader, tc.proof)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("test %d, status: %d, expected: %d, error: %v", i, resp.StatusCode, tc.status, err)
+			return
+		}
+	}
+
+	config.DPoPRequired = true
+	req, err = http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("login without DPoP proof did not return proper status, error: %v", err)
+		return
+	}
+}
+
+// TestDPoPProofAge verifies proofs older than DPoPProofMaxAge, or issued in the future, are
+// rejected.
+func TestDPoPProofAge(t *testing.T) {
+	testSetup()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Errorf("GenerateKey error: %v", err)
+		return
+	}
+	defer func() { jwt.TimeFunc = time.Now }()
+
+	for i, offset := range []time.Duration{0, 2 * time.Minute, -2 * time.Minute} {
+		proof := testDPoPProof(t, key, http.MethodGet, "http://auth.com/", "")
+		jwt.TimeFunc = func() time.Time { return time.Now().Add(offset) }
+		req := httptest.NewRequest(http.MethodGet, "http://auth.com/", nil)
+		req.Header.Set(dpopHeader, proof)
+		if _, err := dpopProofValidate(req, ""); (err == nil) != (offset == 0) {
+			t.Errorf("test %d, offset: %v, error: %v", i, offset, err)
+			return
+		}
+		jwt.TimeFunc = time.Now
+	}
+}
+
+// testDPoPProof returns a DPoP proof signed with key for a request with method to url, and
+// accessToken when not empty.
+func testDPoPProof(t *testing.T, key *ecdsa.PrivateKey, method string, url string, accessToken string) string {
+	jti, err := uniqueID(false)
+	if err != nil {
+		t.Errorf("uniqueID error: %v", err)
+		return ""
+	}
+	claims := dpopClaims{Htm: method, Htu: url, Iat: time.Now().Unix(), Jti: jti}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims.Ath = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = dpopType
+	token.Header["jwk"] = testJWK(&key.PublicKey)
+	proof, err := token.SignedString(key)
+	if err != nil {
+		t.Errorf("SignedString error: %v", err)
+		return ""
+	}
+	return proof
+}
+
+// testJWK returns the P-256 public key as a jwk.
+func testJWK(key *ecdsa.PublicKey) jwk {
+	return jwk{
+		Crv: "P-256",
+		Kty: "EC",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// testJWKThumbprint returns the thumbprint of key.
+func testJWKThumbprint(t *testing.T, key *ecdsa.PublicKey) string {
+	jkt, err := testJWK(key).thumbprint()
+	if err != nil {
+		t.Errorf("thumbprint error: %v", err)
+	}
+	return jkt
+}
@@ -0,0 +1,127 @@
+package authjwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Values of Config.JWTSigningAlgorithm.
+const (
+	SigningAlgorithmEdDSA = "EdDSA"
+	SigningAlgorithmRS256 = "RS256"
+)
+
+// signingMethodEd25519 implements jwt.SigningMethod for EdDSA with Ed25519 keys, RFC 8037,
+// which jwt-go does not provide. Keys are ed25519.PrivateKey and ed25519.PublicKey.
+type signingMethodEd25519 struct{}
+
+var (
+	// signingMethodEdDSA is registered with jwt, so tokens with alg EdDSA can be parsed.
+	signingMethodEdDSA = &signingMethodEd25519{}
+
+	ed25519PrivateKey ed25519.PrivateKey
+	ed25519PublicKey  ed25519.PublicKey
+)
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+// Alg returns the JWS alg of the signing method.
+func (m *signingMethodEd25519) Alg() string {
+	return SigningAlgorithmEdDSA
+}
+
+// Sign returns the encoded signature of signingString.
+func (m *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok || len(k) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(k, []byte(signingString))), nil
+}
+
+// Verify returns nil if signature is the encoded signature of signingString.
+func (m *signingMethodEd25519) Verify(signingString string, signature string, key interface{}) error {
+	k, ok := key.(ed25519.PublicKey)
+	if !ok || len(k) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(k, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// signingAlgorithmLoad returns an error if config.JWTSigningAlgorithm is not a supported
+// algorithm.
+func signingAlgorithmLoad() error {
+	switch config.JWTSigningAlgorithm {
+	case SigningAlgorithmEdDSA, SigningAlgorithmRS256:
+		return nil
+	default:
+		return fmt.Errorf("%s unsupported JWTSigningAlgorithm: %s", runtimeh.SourceInfo(), config.JWTSigningAlgorithm)
+	}
+}
+
+// signingKeyValidate returns an error if key, a private or public key, is not a key for
+// signing algorithm alg.
+func signingKeyValidate(alg string, key any) error {
+	ok := false
+	switch alg {
+	case SigningAlgorithmEdDSA:
+		switch key.(type) {
+		case ed25519.PrivateKey, ed25519.PublicKey:
+			ok = true
+		}
+	case SigningAlgorithmRS256:
+		switch key.(type) {
+		case *rsa.PrivateKey, *rsa.PublicKey:
+			ok = true
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%s key type %T is not for JWTSigningAlgorithm %s", runtimeh.SourceInfo(), key, alg)
+	}
+	return nil
+}
+
+// tokenSign returns the signed token string for claims, per tokenSignUnencrypted, encrypted
+// when config.TokenEncryptionKey is set; with TokenFormatPASETOV4Local the token is only
+// encrypted.
+func tokenSign(claims jwt.Claims) (string, error) {
+	if config.TokenFormat == TokenFormatPASETOV4Local {
+		return pasetoEncrypt(claims)
+	}
+	signed, err := tokenSignUnencrypted(claims)
+	if err != nil || len(config.TokenEncryptionKey) == 0 {
+		return signed, err
+	}
+	return jweEncrypt(signed)
+}
+
+// tokenSignUnencrypted returns the signed token string for claims, using
+// config.JWTSigningAlgorithm. The kid header identifies the signing key, so verifiers can
+// select the key after rotation.
+func tokenSignUnencrypted(claims jwt.Claims) (string, error) {
+	if config.TokenFormat == TokenFormatPASETOV4Public {
+		return pasetoSign(claims)
+	}
+	method, privateKey, publicKey := signingKey()
+	token := jwt.NewWithClaims(method, claims)
+	if kid, err := keyID(publicKey); err == nil {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(privateKey)
+}
@@ -0,0 +1,126 @@
+package authjwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TestEdDSA verifies tokens are signed with EdDSA when configured, tampered tokens and tokens
+// signed with RS256 are rejected, and Ed25519 keys are loaded from PEM files.
+func TestEdDSA(t *testing.T) {
+	testSetup()
+	config.JWTSigningAlgorithm = SigningAlgorithmEdDSA
+	config.JWTAllowedAlgorithms = []string{SigningAlgorithmEdDSA}
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	token, _, err := new(jwt.Parser).ParseUnverified(string(tokenBytes), &CustomClaims{})
+	if err != nil || token.Header["alg"] != SigningAlgorithmEdDSA {
+		t.Errorf("token not signed with EdDSA, header: %+v, error: %v", token.Header, err)
+		return
+	}
+	if _, err := parseClaims(string(tokenBytes)); err != nil {
+		t.Errorf("parseClaims error: %v", err)
+		return
+	}
+	parts := strings.Split(string(tokenBytes), ".")
+	tampered := parts[0] + "." + jwt.EncodeSegment([]byte(`{"email":"other@auth.com"}`)) + "." + parts[2]
+	if _, err := parseClaims(tampered); err == nil {
+		t.Errorf("tampered token was not rejected")
+		return
+	}
+
+	claims := CustomClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()},
+		Email: "someone@auth.com"}
+	rsaToken, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(rsaPrivateKey)
+	if err != nil {
+		t.Errorf("SignedString error: %v", err)
+		return
+	}
+	if _, err := parseClaims(rsaToken); err == nil {
+		t.Errorf("RS256 token was not rejected with EdDSA configured")
+		return
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Errorf("GenerateKey error: %v", err)
+		return
+	}
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Errorf("MarshalPKCS8PrivateKey error: %v", err)
+		return
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Errorf("MarshalPKIXPublicKey error: %v", err)
+		return
+	}
+	keyDir := t.TempDir()
+	privateKeyPath := filepath.Join(keyDir, "key.pem")
+	publicKeyPath := filepath.Join(keyDir, "key.pub")
+	if err := os.WriteFile(privateKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes}), 0600); err != nil {
+		t.Errorf("WriteFile error: %v", err)
+		return
+	}
+	if err := os.WriteFile(publicKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes}), 0600); err != nil {
+		t.Errorf("WriteFile error: %v", err)
+		return
+	}
+	loadKeys(Config{JWTPrivateKeyPath: privateKeyPath, JWTPublicKeyPath: publicKeyPath, JWTSigningAlgorithm: SigningAlgorithmEdDSA})
+	if !ed25519PrivateKey.Equal(privateKey) || !ed25519PublicKey.Equal(publicKey) {
+		t.Errorf("Ed25519 keys not loaded")
+		return
+	}
+	tokenString, err := tokenSign(claims)
+	if err != nil {
+		t.Errorf("tokenSign error: %v", err)
+		return
+	}
+	if _, err := parseClaims(tokenString); err != nil {
+		t.Errorf("parseClaims error with loaded keys: %v", err)
+		return
+	}
+}
+
+// TestSigningKeyValidate verifies keys are rejected for a JWTSigningAlgorithm of another key
+// type.
+func TestSigningKeyValidate(t *testing.T) {
+	testSetup()
+	tests := []struct {
+		alg   string
+		key   any
+		valid bool
+	}{
+		{SigningAlgorithmEdDSA, ed25519PrivateKey, true},
+		{SigningAlgorithmEdDSA, ed25519PublicKey, true},
+		{SigningAlgorithmEdDSA, rsaPrivateKey, false},
+		{SigningAlgorithmEdDSA, rsaPublicKey, false},
+		{SigningAlgorithmRS256, rsaPrivateKey, true},
+		{SigningAlgorithmRS256, rsaPublicKey, true},
+		{SigningAlgorithmRS256, ed25519PrivateKey, false},
+		{SigningAlgorithmRS256, ed25519PublicKey, false},
+	}
+	for i, tc := range tests {
+		if err := signingKeyValidate(tc.alg, tc.key); (err == nil) != tc.valid {
+			t.Errorf("test %d, signingKeyValidate alg: %s, key: %T, error: %v", i, tc.alg, tc.key, err)
+			return
+		}
+	}
+}
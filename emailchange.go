@@ -0,0 +1,250 @@
+package authjwt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+const (
+	defaultEmailChangeExpirationInterval = time.Hour
+)
+
+// EmailChange is the body of requests to PathEmailChange; the NewEmail, and the current
+// Password of the caller.
+type EmailChange struct {
+	NewEmail *string
+	Password *string
+}
+
+// PreviousEmail is a prior Email of an auth, kept with Config.EmailHistory.
+type PreviousEmail struct {
+	// ChangedAt is when the Email was changed from Email.
+	ChangedAt time.Time
+	Email     string
+}
+
+// AuthEmailChange changes the Email (identifier) of the existing auth for email to newEmail,
+// which is validated as in AuthCreate and must not exist. With Config.EmailHistory the prior
+// Email is kept in PreviousEmails. All tokens and single use tokens issued for email are
+// invalidated, and API keys of email are moved to newEmail.
+func AuthEmailChange(email string, newEmail string) error {
+	newEmail = emailNormalize(strings.TrimSpace(newEmail))
+	if newEmail == email {
+		return fmt.Errorf("%s email is unchanged: %s", runtimeh.SourceInfo(), email)
+	}
+	if err := identifierValidate(newEmail); err != nil {
+		return err
+	}
+	if err := authEmailMove(email, newEmail); err != nil {
+		return err
+	}
+
+	if _, err := userTokens(email, true); err != nil {
+		return runtimeh.SourceInfoError("userTokens error", err)
+	}
+	if err := userOneTimeTokensRemove(email); err != nil {
+		return err
+	}
+	keys, err := kvsAPIKey.Keys()
+	if err != nil {
+		return runtimeh.SourceInfoError("kvsAPIKey.Keys error", err)
+	}
+	for _, key := range keys {
+		ak, err := apiKeyGet(key)
+		if err != nil {
+			return err
+		}
+		if ak.Email != email {
+			continue
+		}
+		ak.Email = newEmail
+		if err := kvsAPIKey.Serialize(ak.ID, ak); err != nil {
+			return runtimeh.SourceInfoError("kvsAPIKey.Serialize error", err)
+		}
+	}
+	eventSend(context.Background(), EventAuthEmailChange, email)
+	return nil
+}
+
+// authEmailMove stores the auth for email as newEmail, recording email in PreviousEmails with
+// config.EmailHistory, and deletes the auth for email.
+func authEmailMove(email string, newEmail string) error {
+	authCreateMutex.Lock()
+	defer authCreateMutex.Unlock()
+
+	auth, err := authGet(email)
+	if err != nil {
+		return err
+	}
+	if auth.Email == nil {
+		return fmt.Errorf("%s auth does not exist for email: %s", runtimeh.SourceInfo(), email)
+	}
+	if err := authExists(newEmail, email); err != nil {
+		return err
+	}
+	if config.EmailHistory {
+		auth.PreviousEmails = append(auth.PreviousEmails, PreviousEmail{ChangedAt: timeNow(), Email: email})
+	}
+	auth.Email = &newEmail
+	if err := authCreate(auth); err != nil {
+		return err
+	}
+	if err := authIndexesMove(auth, newEmail); err != nil {
+		return err
+	}
+	if _, err := kvsAuth.Delete(email); err != nil {
+		return runtimeh.SourceInfoError("kvsAuth.Delete error", err)
+	}
+	return nil
+}
+
+// handlerEmailChange starts changing the Email of the caller to the NewEmail of the
+// EmailChange body, when the Password is the callers password. A single use
+// PurposeEmailChange token is sent with Config.TokenSender to NewEmail; the Email is changed
+// only when that token is confirmed at PathEmailChangeConfirm, so the user must receive email
+// at NewEmail. The token is valid for config.EmailChangeExpirationInterval.
+func handlerEmailChange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
+
+	// get the claims.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	if impersonationRejected(w, claims) {
+		return
+	}
+
+	ec := EmailChange{}
+	if err := httph.BodyUnmarshal(w, r, &ec); err != nil {
+		lpf(logh.Error, "email change error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	if ec.NewEmail == nil || ec.Password == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	newEmail := emailNormalize(strings.TrimSpace(*ec.NewEmail))
+	if newEmail == claims.Email || identifierValidate(newEmail) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	release, ok := loginSemaphoreAcquire(w)
+	if !ok {
+		return
+	}
+	defer release()
+
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ok, err = passwordVerifyLocked(w, r, claims.Email, passwordTrim(*ec.Password), auth.PasswordHash)
+	if !ok {
+		return
+	}
+	if err != nil {
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("email change with wrong password for email: %s", auditEmail(claims.Email))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err := authExists(newEmail, claims.Email); err != nil {
+		if errors.Is(err, ErrAuthExists) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		lpf(logh.Error, "authExists error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tokenString, err := oneTimeTokenCreateCommon(claims.Email, PurposeEmailChange, tokenOptions{newEmail: newEmail}, config.EmailChangeExpirationInterval)
+	if err != nil {
+		lpf(logh.Error, "oneTimeTokenCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := config.TokenSender(newEmail, PurposeEmailChange, tokenString); err != nil {
+		lpf(logh.Error, "TokenSender error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("email change to: %s requested for email: %s", auditEmail(newEmail), auditEmail(claims.Email))
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerEmailChangeConfirm changes the Email of the auth with AuthEmailChange, to the
+// NewEmail of the PurposeEmailChange token in the OneTimeToken body. The token cannot be used
+// again; http.StatusConflict is returned if an auth was created for the NewEmail after the
+// token was sent.
+func handlerEmailChangeConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
+
+	ott := OneTimeToken{}
+	if err := httph.BodyUnmarshal(w, r, &ott); err != nil {
+		lpf(logh.Error, "email change confirm error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+
+	claims, err := oneTimeTokenConsume(ott.Token, PurposeEmailChange)
+	if err != nil || claims.NewEmail == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The auth may have been deleted or disabled after the token was sent.
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil || auth.Disabled {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err := AuthEmailChange(claims.Email, claims.NewEmail); err != nil {
+		if errors.Is(err, ErrAuthExists) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		lpf(logh.Error, "AuthEmailChange error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("email changed to: %s for email: %s", auditEmail(claims.NewEmail), auditEmail(claims.Email))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
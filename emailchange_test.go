@@ -0,0 +1,197 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAuthEmailChange verifies changing the email moves the auth and API keys, records the
+// previous email with EmailHistory, invalidates tokens of the previous email, and rejects
+// changing to an existing email.
+func TestAuthEmailChange(t *testing.T) {
+	for _, history := range []bool{false, true} {
+		t.Run(fmt.Sprintf("history %t", history), func(t *testing.T) {
+			testSetup()
+			config.EmailHistory = history
+			changedAt := time.Now().Add(time.Minute)
+			config.TimeSource = func() time.Time { return changedAt }
+
+			em, credBytes, err := createAuth(t, nil)
+			if err != nil {
+				return
+			}
+			tokenBytes, _, err := login(t, credBytes)
+			if err != nil {
+				return
+			}
+			ak, err := apiKeyCreate(em, "ci")
+			if err != nil {
+				t.Errorf("apiKeyCreate error: %v", err)
+				return
+			}
+			otherEmail := "other@auth.com"
+			if _, _, err := createAuth(t, &otherEmail); err != nil {
+				return
+			}
+
+			if err := AuthEmailChange(em, otherEmail); !errors.Is(err, ErrAuthExists) {
+				t.Errorf("change to an existing email did not return ErrAuthExists: %v", err)
+				return
+			}
+			newEmail := "new@auth.com"
+			if err := AuthEmailChange(em, newEmail); err != nil {
+				t.Errorf("AuthEmailChange error: %v", err)
+				return
+			}
+
+			if auth, err := authGet(em); err != nil || auth.Email != nil {
+				t.Errorf("auth for previous email exists: %+v, error: %v", auth, err)
+				return
+			}
+			auth, err := authGet(newEmail)
+			if err != nil || auth.Email == nil || *auth.Email != newEmail || auth.PasswordHash == nil {
+				t.Errorf("auth for new email not valid: %+v, error: %v", auth, err)
+				return
+			}
+			expected := 0
+			if history {
+				expected = 1
+			}
+			if len(auth.PreviousEmails) != expected ||
+				(history && (auth.PreviousEmails[0].Email != em || !auth.PreviousEmails[0].ChangedAt.Equal(changedAt))) {
+				t.Errorf("wrong PreviousEmails: %+v", auth.PreviousEmails)
+				return
+			}
+			if ak, err := apiKeyGet(ak.ID); err != nil || ak.Email != newEmail {
+				t.Errorf("API key not moved: %+v, error: %v", ak, err)
+				return
+			}
+
+			testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+			defer testServer.Close()
+			req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+			if err != nil {
+				t.Errorf("NewRequest error: %v", err)
+				return
+			}
+			req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil || resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("token of previous email did not return proper status: %d, error: %v", resp.StatusCode, err)
+				return
+			}
+		})
+	}
+}
+
+// TestHandlerEmailChange tests the email change flow; the request requires the password and
+// a new email without an auth, the token is sent to the new email, and the email changes only
+// when the token is confirmed, once.
+func TestHandlerEmailChange(t *testing.T) {
+	testSetup()
+	sent := map[string]string{}
+	config.EmailChangeEnabled = true
+	config.TokenSender = func(email string, purpose string, token string) error {
+		if purpose != PurposeEmailChange {
+			t.Errorf("wrong purpose: %s", purpose)
+		}
+		sent[email] = token
+		return nil
+	}
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	otherEmail := "other@auth.com"
+	if _, _, err := createAuth(t, &otherEmail); err != nil {
+		return
+	}
+	testServerChange := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerEmailChange)))
+	defer testServerChange.Close()
+	testServerConfirm := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerEmailChangeConfirm)))
+	defer testServerConfirm.Close()
+	change := func(newEmail string, password string) (int, error) {
+		b, err := json.Marshal(EmailChange{NewEmail: &newEmail, Password: &password})
+		if err != nil {
+			return 0, err
+		}
+		req, err := http.NewRequest(http.MethodPut, testServerChange.URL, bytes.NewBuffer(b))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	confirm := func(token string) (int, error) {
+		b, err := json.Marshal(OneTimeToken{Token: token})
+		if err != nil {
+			return 0, err
+		}
+		resp, err := http.Post(testServerConfirm.URL, "application/json", bytes.NewBuffer(b))
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	newEmail := "new@auth.com"
+	tests := []struct {
+		newEmail string
+		password string
+		status   int
+	}{
+		{newEmail, "Wr0ng!Password", http.StatusUnauthorized},
+		{em, "P@ssword1234", http.StatusBadRequest},
+		{otherEmail, "P@ssword1234", http.StatusConflict},
+		{newEmail, "P@ssword1234", http.StatusAccepted},
+	}
+	for i, tc := range tests {
+		if status, err := change(tc.newEmail, tc.password); err != nil || status != tc.status {
+			t.Errorf("test %d, status: %d, expected: %d, error: %v", i, status, tc.status, err)
+			return
+		}
+	}
+	if len(sent) != 1 || sent[newEmail] == "" {
+		t.Errorf("token not sent to the new email: %+v", sent)
+		return
+	}
+	if auth, err := authGet(em); err != nil || auth.Email == nil {
+		t.Errorf("email changed before confirmation: %+v, error: %v", auth, err)
+		return
+	}
+
+	if status, err := confirm(sent[newEmail]); err != nil || status != http.StatusNoContent {
+		t.Errorf("confirm did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if status, err := confirm(sent[newEmail]); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("confirm reuse did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if auth, err := authGet(newEmail); err != nil || auth.Email == nil || *auth.Email != newEmail {
+		t.Errorf("auth for new email not valid: %+v, error: %v", auth, err)
+		return
+	}
+	if auth, err := authGet(em); err != nil || auth.Email != nil {
+		t.Errorf("auth for previous email exists: %+v, error: %v", auth, err)
+		return
+	}
+}
@@ -0,0 +1,64 @@
+package authjwt
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// AuthEmailsNormalize migrates existing auths to normalized Emails, per
+// Config.EmailNormalize; each auth with an Email that is not normalized is changed with
+// AuthEmailChange, so its tokens are invalidated. Emails that normalize to the Email of
+// another auth are not changed, and are returned; those must be resolved by an admin, I.E.
+// by deleting one of the auths. Init calls AuthEmailsNormalize when EmailNormalize is true.
+func AuthEmailsNormalize() ([]string, error) {
+	if !config.EmailNormalize {
+		return nil, nil
+	}
+	keys, err := kvsAuth.Keys()
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("kvsAuth.Keys error", err)
+	}
+	var conflicts []string
+	for _, key := range keys {
+		normalized := emailNormalize(key)
+		if normalized == key {
+			continue
+		}
+		if err := AuthEmailChange(key, normalized); err != nil {
+			if !errors.Is(err, ErrAuthExists) {
+				return conflicts, err
+			}
+			conflicts = append(conflicts, key)
+		}
+	}
+	return conflicts, nil
+}
+
+// authEmailsNormalizeInit runs AuthEmailsNormalize for Init, logging Emails that could not be
+// normalized.
+func authEmailsNormalizeInit() {
+	conflicts, err := AuthEmailsNormalize()
+	if err != nil {
+		lpf(logh.Error, "AuthEmailsNormalize error:%+v", err)
+	}
+	for _, email := range conflicts {
+		lpf(logh.Warning, "email not normalized, the normalized email exists: %s", auditEmail(email))
+	}
+}
+
+// emailNormalize returns email normalized with config.EmailNormalize; trimmed, Unicode
+// normalized with config.EmailUnicodeNormalizer, and lower case. email is returned unchanged
+// when EmailNormalize is false.
+func emailNormalize(email string) string {
+	if !config.EmailNormalize {
+		return email
+	}
+	email = strings.TrimSpace(email)
+	if config.EmailUnicodeNormalizer != nil {
+		email = config.EmailUnicodeNormalizer(email)
+	}
+	return strings.ToLower(email)
+}
@@ -0,0 +1,166 @@
+package authjwt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestEmailNormalize verifies that with EmailNormalize, Emails differing in case, surrounding
+// whitespace, or Unicode normalization are the same auth at create and login.
+func TestEmailNormalize(t *testing.T) {
+	testSetup()
+	config.EmailNormalize = true
+	// Stands in for norm.NFC.String; composes the decomposed é used below.
+	config.EmailUnicodeNormalizer = func(email string) string {
+		return strings.ReplaceAll(email, "e\u0301", "\u00e9")
+	}
+
+	tests := []struct {
+		email      string
+		normalized string
+	}{
+		{" User@Auth.com ", "user@auth.com"},
+		{"Rene\u0301@Auth.com", "ren\u00e9@auth.com"},
+	}
+	for i, tc := range tests {
+		if got := emailNormalize(tc.email); got != tc.normalized {
+			t.Errorf("test %d, emailNormalize: %s, expected: %s", i, got, tc.normalized)
+			return
+		}
+		email := tc.email
+		if _, _, err := createAuth(t, &email); err != nil {
+			return
+		}
+		if auth, err := authGet(tc.normalized); err != nil || auth.Email == nil || *auth.Email != tc.normalized {
+			t.Errorf("test %d, auth not stored normalized: %+v, error: %v", i, auth, err)
+			return
+		}
+		upper := strings.ToUpper(tc.normalized)
+		pwd := "P@ssword1234"
+		credBytes, err := json.Marshal(Credential{Email: &upper, Password: &pwd})
+		if err != nil {
+			t.Errorf("marshal error: %v", err)
+			return
+		}
+		if _, claims, err := login(t, credBytes); err != nil || claims.Email != tc.normalized {
+			t.Errorf("test %d, login claims: %+v, error: %v", i, claims, err)
+			return
+		}
+	}
+}
+
+// TestEmailNormalizeAdmin verifies that with EmailNormalize, the exported setters and admin
+// lookups by Email find the auth of a differently cased Email.
+func TestEmailNormalizeAdmin(t *testing.T) {
+	testSetup()
+	config.EmailNormalize = true
+	config.LockoutThreshold = 2
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	userToken, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	adminEmail := "admin@auth.com"
+	_, adminCredBytes, err := createAuth(t, &adminEmail)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(adminEmail, []string{RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	adminToken, _, err := login(t, adminCredBytes)
+	if err != nil {
+		return
+	}
+	upper := " " + strings.ToUpper(em) + " "
+
+	if err := AuthRolesSet(upper, []string{"viewer"}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	if auth, err := authGet(em); err != nil || len(auth.Roles) != 1 || auth.Roles[0] != "viewer" {
+		t.Errorf("roles not set: %+v, error: %v", auth, err)
+		return
+	}
+	if err := AuthDisabledSet(upper, false); err != nil {
+		t.Errorf("AuthDisabledSet error: %v", err)
+		return
+	}
+	if err := lockoutFailure(httptest.NewRequest(http.MethodPut, "/", nil), em); err != nil {
+		t.Errorf("lockoutFailure error: %v", err)
+		return
+	}
+	if ls, err := AuthLockout(upper); err != nil || ls.Email != em || ls.Failures != 1 {
+		t.Errorf("wrong LockoutState: %+v, error: %v", ls, err)
+		return
+	}
+	if err := AuthUnlock(upper); err != nil {
+		t.Errorf("AuthUnlock error: %v", err)
+		return
+	}
+	if ls, err := AuthLockout(em); err != nil || ls.Failures != 0 {
+		t.Errorf("account not unlocked: %+v, error: %v", ls, err)
+		return
+	}
+
+	// The user is not an admin, so the lookup only succeeds for their own, normalized, Email.
+	tests := []struct {
+		hf    http.HandlerFunc
+		token []byte
+	}{
+		{HandlerFuncAuthJWTWrapper(handlerInfo), userToken},
+		{HandlerFuncAuthJWTWrapper(handlerListAPIKeys), userToken},
+		{HandlerFuncAuthJWTWrapper(handlerSessions), userToken},
+		{HandlerFuncAuthJWTWrapper(handlerLockout), adminToken},
+	}
+	for i, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/?email="+url.QueryEscape(upper), nil)
+		req.Header.Set("Authorization", "Bearer "+string(tc.token))
+		rr := httptest.NewRecorder()
+		tc.hf(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("test %d did not return proper status: %d", i, rr.Code)
+			return
+		}
+	}
+}
+
+// TestAuthEmailsNormalize verifies existing auths are migrated to normalized Emails, and
+// Emails that normalize to the Email of another auth are returned unchanged.
+func TestAuthEmailsNormalize(t *testing.T) {
+	testSetup()
+	for _, email := range []string{"Mixed@auth.com", "Other@auth.com", "other@auth.com"} {
+		if _, _, err := createAuth(t, &email); err != nil {
+			return
+		}
+	}
+
+	config.EmailNormalize = true
+	conflicts, err := AuthEmailsNormalize()
+	if err != nil || len(conflicts) != 1 || strings.ToLower(conflicts[0]) != "other@auth.com" {
+		t.Errorf("wrong conflicts: %v, error: %v", conflicts, err)
+		return
+	}
+	keys, err := kvsAuth.Keys()
+	if err != nil {
+		t.Errorf("kvsAuth.Keys error: %v", err)
+		return
+	}
+	found := map[string]bool{}
+	for _, key := range keys {
+		found[key] = true
+	}
+	if len(keys) != 3 || !found["mixed@auth.com"] || !found["other@auth.com"] || !found[conflicts[0]] {
+		t.Errorf("wrong keys after migration: %v", keys)
+		return
+	}
+}
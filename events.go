@@ -0,0 +1,86 @@
+package authjwt
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Event describes a change to an auth, and is passed to Config.EventHandler.
+type Event struct {
+	// Type is one of the Event* constants.
+	Type  string
+	Email string
+	// IP and RequestID are from the RequestInfo in the context of the call, if any.
+	IP        string
+	RequestID string
+	Time      time.Time
+}
+
+// RequestInfo is metadata about the HTTP request that caused an Event.
+type RequestInfo struct {
+	IP        string
+	RequestID string
+}
+
+// requestInfoContextKey is the context key for RequestInfo.
+type requestInfoContextKey struct{}
+
+const (
+	// EventAuthCreate is sent when an auth is created or updated.
+	EventAuthCreate = "auth-create"
+	// EventAuthDelete is sent when an auth and its tokens are deleted. Applications caching
+	// claims or auth state should drop anything cached for the Email, and may publish the
+	// Event to other instances to do the same.
+	EventAuthDelete = "auth-delete"
+	// EventAuthDisable is sent when an auth is disabled with AuthDisabledSet, and its tokens
+	// are removed. Like EventAuthDelete, anything cached for the Email should be dropped.
+	EventAuthDisable = "auth-disable"
+	// EventAuthEmailChange is sent, with the prior Email, when the Email of an auth is
+	// changed with AuthEmailChange. Like EventAuthDelete, anything cached for the Email
+	// should be dropped.
+	EventAuthEmailChange = "auth-email-change"
+	// EventAuthRolesChange is sent when the roles of an auth are set with AuthRolesSet.
+	// Applications caching roles or permissions, I.E. from PathPermissions, for the Email
+	// should drop them.
+	EventAuthRolesChange = "auth-roles-change"
+
+	// requestIDHeader is the header from which RequestInfo.RequestID is populated.
+	requestIDHeader = "X-Request-ID"
+)
+
+// ContextWithRequestInfo returns a copy of ctx that carries ri.
+func ContextWithRequestInfo(ctx context.Context, ri RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoContextKey{}, ri)
+}
+
+// RequestInfoFromContext returns the RequestInfo stored in ctx, or an empty RequestInfo
+// if there is none.
+func RequestInfoFromContext(ctx context.Context) RequestInfo {
+	ri, _ := ctx.Value(requestInfoContextKey{}).(RequestInfo)
+	return ri
+}
+
+// eventSend sends an Event to config.EventHandler, if one was provided.
+func eventSend(ctx context.Context, eventType string, email string) {
+	if config.EventHandler == nil {
+		return
+	}
+	ri := RequestInfoFromContext(ctx)
+	config.EventHandler(Event{Type: eventType, Email: email, IP: ri.IP, RequestID: ri.RequestID, Time: time.Now()})
+}
+
+// clientIP returns the IP of the client making request r.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// requestContext returns the context of r, with the RequestInfo for r added.
+func requestContext(r *http.Request) context.Context {
+	return ContextWithRequestInfo(r.Context(), RequestInfo{IP: clientIP(r), RequestID: r.Header.Get(requestIDHeader)})
+}
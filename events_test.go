@@ -0,0 +1,152 @@
+package authjwt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// TestAuthCreateCtxEvent verifies RequestInfo in the context is included in the Event
+// sent from AuthCreateCtx, both for direct calls and calls through handlerCreateOrUpdate.
+func TestAuthCreateCtxEvent(t *testing.T) {
+	testSetup()
+
+	var mu sync.Mutex
+	var events []Event
+	config.EventHandler = func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+
+	em := "event@auth.com"
+	ps := "P@ss1234"
+	cred := Credential{Email: &em, Password: &ps}
+	ctx := ContextWithRequestInfo(context.Background(), RequestInfo{IP: "192.0.2.1", RequestID: "req-1"})
+	if err := cred.AuthCreateCtx(ctx); err != nil {
+		t.Errorf("AuthCreateCtx error: %v", err)
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handlerCreateOrUpdate))
+	defer testServer.Close()
+	em2 := "event2@auth.com"
+	credBytes, err := json.Marshal(Credential{Email: &em2, Password: &ps})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, testServer.URL, bytes.NewBuffer(credBytes))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set(requestIDHeader, "req-2")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("create error: %v", err)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []Event{
+		{Type: EventAuthCreate, Email: em, IP: "192.0.2.1", RequestID: "req-1"},
+		{Type: EventAuthCreate, Email: em2, IP: "127.0.0.1", RequestID: "req-2"},
+	}
+	if len(events) != len(expected) {
+		t.Errorf("wrong number of events: %+v", events)
+		return
+	}
+	for i := range expected {
+		e := events[i]
+		if e.Type != expected[i].Type || e.Email != expected[i].Email || e.IP != expected[i].IP ||
+			e.RequestID != expected[i].RequestID || e.Time.IsZero() {
+			t.Errorf("event %d: %+v, expected: %+v", i, e, expected[i])
+		}
+	}
+}
+
+// TestHandlerDeleteEvent verifies handlerDelete sends EventAuthDelete, so subscribers can
+// invalidate cached state for the Email.
+func TestHandlerDeleteEvent(t *testing.T) {
+	testSetup()
+
+	var mu sync.Mutex
+	var events []Event
+	config.EventHandler = func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handlerDelete))
+	defer testServer.Close()
+	req, err := http.NewRequest(http.MethodDelete, testServer.URL, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[1].Type != EventAuthDelete || events[1].Email != em {
+		t.Errorf("delete event not sent: %+v", events)
+		return
+	}
+}
+
+// TestAuthRolesSetEvent verifies AuthRolesSet sends EventAuthRolesChange, and no Event is sent
+// for an auth that does not exist.
+func TestAuthRolesSetEvent(t *testing.T) {
+	testSetup()
+
+	var mu sync.Mutex
+	var events []Event
+	config.EventHandler = func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+
+	em, _, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(em, []string{"viewer"}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	if err := AuthRolesSet("unknown@auth.com", []string{"viewer"}); err == nil {
+		t.Errorf("AuthRolesSet did not return an error for an unknown email")
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[1].Type != EventAuthRolesChange || events[1].Email != em {
+		t.Errorf("roles change event not sent: %+v", events)
+		return
+	}
+}
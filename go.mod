@@ -11,4 +11,7 @@ require (
 	golang.org/x/crypto v0.22.0
 )
 
-require github.com/mattn/go-sqlite3 v1.14.22 // indirect
+require (
+	github.com/mattn/go-sqlite3 v1.14.22 // indirect
+	golang.org/x/sys v0.19.0 // indirect
+)
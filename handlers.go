@@ -3,14 +3,23 @@
 package authjwt
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/paulfdunn/go-helper/logh"
 	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
 )
 
+// claimsContextKey is the context key for the CustomClaims of the caller.
+type claimsContextKey struct{}
+
 // AuditWriter is used to wrap the http.ResponseWriter passed to handlers in order to
 // store information that is then written to the audit log as the handler exits.
 // Applications using this package need to populate the Message as is done in these handlers
@@ -23,53 +32,460 @@ type AuditWriter struct {
 	StatusCode int
 }
 
+// Flush implements http.Flusher, so handlers can stream responses, when the wrapped
+// http.ResponseWriter does.
+func (aw *AuditWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (aw *AuditWriter) WriteHeader(status int) {
 	aw.StatusCode = status
 	aw.ResponseWriter.WriteHeader(status)
 }
 
+const (
+	// passwordChangeRequiredHeader is set on login responses when the token returned can only
+	// be used to change the password.
+	passwordChangeRequiredHeader = "X-Password-Change-Required"
+	// warningNoAuth is the Warning header text for HandlerFuncNoAuthWrapper.
+	warningNoAuth = `299 - "unauthenticated handler"`
+	// warningNoTokenInvalidation is the Warning header text for HandlerFuncAuthJWTWrapper
+	// without token invalidation; see Config.EnableTokenInvalidation.
+	warningNoTokenInvalidation = `299 - "token invalidation not checked"`
+)
+
 // HandlerFuncNoAuthWrapper is a basic wrapper that DOES NOT authenticate, but does
 // handle audit logging (logging for all DELETE/POST/PUT methods)
 func HandlerFuncNoAuthWrapper(hf func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return handlerFuncNoAuthWrapperCommon(hf, true)
+}
+
+// handlerFuncNoAuthWrapperCommon is HandlerFuncNoAuthWrapper, where warn false omits the
+// Config.WarningHeaders warning; used for the authjwt handlers that are unauthenticated by design.
+func handlerFuncNoAuthWrapperCommon(hf func(w http.ResponseWriter, r *http.Request), warn bool) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !initializedCheck(w) {
+			return
+		}
 		aw := &AuditWriter{w, "", 0}
-		hf(aw, r)
-		if r.Method == http.MethodDelete || r.Method == http.MethodPost || r.Method == http.MethodPut {
-			logh.Map[config.AuditLogName].Printf(logh.Audit, "status: %d| req:%+v| msg: %s|\n\n", aw.StatusCode, r, aw.Message)
+		ctx, span := spanStart(r.Context(), SpanRequest)
+		defer spanEndRequest(span, aw, r)
+		r = r.WithContext(ctx)
+		if warn && config.WarningHeaders {
+			aw.Header().Add("Warning", warningNoAuth)
 		}
+		hf(aw, r)
+		auditLog(aw, r, config.AuditNoAuthMarker)
 	}
 }
 
 // HandlerFuncAuthJWTWrapper is a basic wrapper that verifies the call is authenticated.
 // Use this directly, or for additional verification of Authorizations, Role, etc., use this as an example.
 // Note this wrapper also handles audit logging (logging for all DELETE/POST/PUT methods)
+// Requests without a token are rejected with http.StatusUnauthorized before any token parsing
+// or store access. The claims of the caller are available to hf with ClaimsFromContext.
 func HandlerFuncAuthJWTWrapper(hf func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return handlerFuncAuthJWTWrapperCommon(hf, true, "")
+}
+
+// handlerFuncAuthJWTWrapperCommon is HandlerFuncAuthJWTWrapper, where tokenInvalidation false
+// accepts tokens that are no longer in kvsToken; used for idempotent logout. A non empty
+// purpose also accepts single use tokens with that Purpose; hf must check the claims.
+func handlerFuncAuthJWTWrapperCommon(hf func(w http.ResponseWriter, r *http.Request), tokenInvalidation bool, purpose string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !initializedCheck(w) {
+			return
+		}
 		aw := &AuditWriter{w, "", 0}
+		ctx, span := spanStart(r.Context(), SpanRequest)
+		defer spanEndRequest(span, aw, r)
+		r = r.WithContext(ctx)
+		var claims *CustomClaims
 		var err error
-		if config.DataSourcePath != "" {
-			_, err = Authenticated(aw, r)
+		apiKeyAuth := config.APIKeysEnabled && r.Header.Get(apiKeyHeader) != ""
+		if apiKeyAuth {
+			claims, err = apiKeyAuthenticate(aw, r)
+		} else if tokenInvalidationEnabled() {
+			claims, err = authenticated(aw, r, tokenInvalidation, purpose)
 		} else {
-			_, err = AuthenticatedNoTokenInvalidation(aw, r)
+			if config.WarningHeaders && tokenInvalidation {
+				aw.Header().Add("Warning", warningNoTokenInvalidation)
+			}
+			claims, err = AuthenticatedNoTokenInvalidation(aw, r)
 		}
 		if err != nil {
 			return
 		}
-		hf(aw, r)
-		if r.Method == http.MethodDelete || r.Method == http.MethodPost || r.Method == http.MethodPut {
-			logh.Map[config.AuditLogName].Printf(logh.Audit, "status: %d| req:%+v| msg: %s|\n\n", aw.StatusCode, r, aw.Message)
+		span.SetAttribute(AttributeEmail, claims.auditAuth())
+		// API keys are not sent automatically by browsers, so are not subject to CSRF.
+		if config.CSRFProtection && !apiKeyAuth && methodStateChanging(r.Method) {
+			if err := csrfTokenValidate(claims, r.Header.Get(csrfHeader)); err != nil {
+				lpf(logh.Warning, "csrfTokenValidate error:%v", err)
+				aw.WriteHeader(http.StatusForbidden)
+				auditLog(aw, r, claims.auditAuth())
+				return
+			}
 		}
+		hf(aw, r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)))
+		auditLog(aw, r, claims.auditAuth())
+	}
+}
+
+// ClaimsFromContext returns the CustomClaims of the caller stored in ctx by
+// HandlerFuncAuthJWTWrapper, so handlers do not need to authenticate the request again; nil
+// if there are none.
+func ClaimsFromContext(ctx context.Context) *CustomClaims {
+	claims, _ := ctx.Value(claimsContextKey{}).(*CustomClaims)
+	return claims
+}
+
+// requestClaims returns the claims of the caller of the authjwt handlers; see
+// requestClaimsCommon.
+func requestClaims(w http.ResponseWriter, r *http.Request) (*CustomClaims, error) {
+	return requestClaimsCommon(w, r, true)
+}
+
+// requestClaimsCommon returns the claims from ClaimsFromContext, or when there are none
+// authenticates the request, as authenticated with tokenInvalidation. The authjwt handlers
+// require a token, so callers authenticated with an API key get http.StatusUnauthorized, and
+// with a restricted token http.StatusForbidden. On any error the header is written.
+func requestClaimsCommon(w http.ResponseWriter, r *http.Request, tokenInvalidation bool) (*CustomClaims, error) {
+	claims := ClaimsFromContext(r.Context())
+	if claims == nil {
+		var err error
+		if claims, err = authenticated(w, r, tokenInvalidation, ""); err != nil {
+			return nil, err
+		}
+	}
+	if claims.AuthMethod == AuthMethodAPIKey {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%s API key used for a handler requiring a token", runtimeh.SourceInfo())
+	}
+	if restrictedRejected(w, claims) {
+		return nil, fmt.Errorf("%s restricted token used for an authjwt handler", runtimeh.SourceInfo())
+	}
+	return claims, nil
+}
+
+// accountLocation returns the Location of the account resource for email; PathInfo, with
+// the email query escaped.
+func accountLocation(email string) string {
+	path := config.PathInfo
+	if path == "" {
+		path = "/auth/info"
+	}
+	return path + "?" + url.Values{"email": {email}}.Encode()
+}
+
+// auditLog writes the audit record for DELETE/POST/PUT methods, and a sample of other
+// methods per config.AuditSampleRate. auth identifies how the caller was authenticated; the
+// Email for authenticated callers, or config.AuditNoAuthMarker. With config.AuditStore the
+// record is also stored for export.
+func auditLog(aw *AuditWriter, r *http.Request, auth string) {
+	if methodStateChanging(r.Method) || auditSampled() {
+		logh.Map[config.AuditLogName].Printf(logh.Audit, "status: %d| auth: %s| req:%+v| msg: %s|\n\n", aw.StatusCode, auth, requestMasked(r), aw.Message)
+		if config.AuditStore && config.DataSourcePath != "" {
+			ar := AuditRecord{Auth: auth, Message: aw.Message, Method: r.Method, Status: aw.StatusCode,
+				Time: timeNow(), URL: r.URL.String()}
+			if err := auditStore(ar); err != nil {
+				lpf(logh.Error, "auditStore error:%v", err)
+			}
+		}
+	}
+}
+
+// auditSampled returns true for the config.AuditSampleRate fraction of calls.
+func auditSampled() bool {
+	return config.AuditSampleRate > 0 && rand.Float64() < config.AuditSampleRate
+}
+
+// contentTypeJSON returns true if the request has Content-Type application/json, or
+// config.RequireJSONContentType is false. Otherwise the header is written with
+// http.StatusUnsupportedMediaType.
+func contentTypeJSON(w http.ResponseWriter, r *http.Request) bool {
+	if !config.RequireJSONContentType {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
+
+// loginSemaphoreAcquire acquires loginSemaphore, returning the func to release it. When
+// config.MaxConcurrentLogins is reached the header is written with
+// http.StatusServiceUnavailable and a Retry-After, and false is returned.
+func loginSemaphoreAcquire(w http.ResponseWriter) (func(), bool) {
+	if loginSemaphore == nil {
+		return func() {}, true
+	}
+	select {
+	case loginSemaphore <- struct{}{}:
+		return func() { <-loginSemaphore }, true
+	default:
+		w.Header().Set("Retry-After", loginRetryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil, false
+	}
+}
+
+// spanEndRequest sets the request attributes of span, the span from a wrapper, and ends it.
+func spanEndRequest(span Span, aw *AuditWriter, r *http.Request) {
+	span.SetAttribute(AttributeHTTPMethod, r.Method)
+	span.SetAttribute(AttributeHTTPRoute, r.URL.Path)
+	span.SetAttribute(AttributeHTTPStatus, aw.StatusCode)
+	span.SetAttribute(AttributeOutcome, aw.StatusCode < http.StatusBadRequest)
+	span.End()
+}
+
+// methodStateChanging returns true for the methods that change state; DELETE/POST/PUT.
+func methodStateChanging(method string) bool {
+	return method == http.MethodDelete || method == http.MethodPost || method == http.MethodPut
+}
+
+// handlerAPIKeys creates (http.MethodPost), lists (http.MethodGet), or revokes
+// (http.MethodDelete) the callers API keys.
+func handlerAPIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodDelete:
+		handlerRevokeAPIKey(w, r)
+	case http.MethodGet:
+		handlerListAPIKeys(w, r)
+	case http.MethodPost:
+		handlerCreateAPIKey(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerCheckPassword returns the PasswordCheck of the Password in the Credential body, so
+// clients can check a candidate password against the password policy before registration.
+// No Email or account is required; when provided, the Email is used by rules such as
+// PasswordPolicy.BanEmailLocalPart. Checks share the Config.MaxConcurrentLogins limit.
+func handlerCheckPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
+	release, ok := loginSemaphoreAcquire(w)
+	if !ok {
+		return
+	}
+	defer release()
+
+	cred := Credential{}
+	if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+		lpf(logh.Error, "check password error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	if cred.Password == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	email := ""
+	if cred.Email != nil {
+		email = *cred.Email
+	}
+	pc := PasswordCheck{Reasons: passwordPolicyReasons(email, *cred.Password)}
+	pc.Valid = len(pc.Reasons) == 0
+
+	b, err := json.Marshal(pc)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// handlerCheckToken returns the TokenStatus of the token in the TokenCheck body, for admins.
+// A Token is reported as expired, active, or revoked (logged out). A TokenID is only found
+// while the token is in kvsToken, so revoked tokens get http.StatusNotFound.
+func handlerCheckToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get the claims, in order to verify the caller is an admin.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	if !adminAuthorized(w, r, claims) {
+		return
+	}
+
+	tc := TokenCheck{}
+	if err := httph.BodyUnmarshal(w, r, &tc); err != nil {
+		lpf(logh.Error, "check token error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	var ts TokenStatus
+	var found bool
+	if tc.Token != "" {
+		ts, err = tokenStatus(tc.Token)
+		found = err == nil
+	} else {
+		ts, found, err = tokenStatusByID(tc.TokenID)
+	}
+	if err != nil {
+		lpf(logh.Warning, "token status error:%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(ts)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("token checked for email: %s, status: %s", auditEmail(ts.Email), ts.Status)
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// handlerCSRFToken returns a new CSRF token for the callers session. The token is required
+// in the X-CSRF-Token header of DELETE/POST/PUT requests when Config.CSRFProtection is true.
+func handlerCSRFToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get the claims, in order to bind the CSRF token to the session.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	csrfToken, err := csrfTokenCreate(claims)
+	if err != nil {
+		lpf(logh.Error, "csrfTokenCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(csrfToken)); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// handlerConsumeMagicLink exchanges the magic link token in the request body for the same
+// response as from PathLogin, with AuthMethodMagicLink. The magic link token cannot be used
+// again.
+func handlerConsumeMagicLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ott := OneTimeToken{}
+	if err := httph.BodyUnmarshal(w, r, &ott); err != nil {
+		lpf(logh.Error, "magic link consume error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+
+	claims, err := oneTimeTokenConsume(ott.Token, PurposeMagicLink)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The auth may have been deleted or disabled after the magic link was sent.
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil || auth.Disabled {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	jkt, ok := dpopLoginBinding(w, r)
+	if !ok {
+		return
+	}
+
+	loginTokensWrite(w, r, claims.Email, auth, "magic link login", AuthMethodMagicLink, tokenConfirmation(r, jkt), false)
+}
+
+// handlerCreateAPIKey creates an API key for the caller, with the Label from the request
+// body, and returns the APIKey. This is the only time the key is available.
+func handlerCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	// get the claims; API keys cannot be used to create API keys.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	if impersonationRejected(w, claims) {
+		return
+	}
+
+	body := struct{ Label string }{}
+	if err := httph.BodyUnmarshal(w, r, &body); err != nil {
+		lpf(logh.Error, "API key create error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+
+	ak, err := apiKeyCreate(claims.Email, body.Label)
+	if err != nil {
+		lpf(logh.Error, "apiKeyCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(ak)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("API key %s created for email: %s", ak.ID, auditEmail(claims.Email))
+	}
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
 	}
 }
 
 // handlerCreateOrUpdate is the handler to create/update an auth (entry in kvsAuth). The handler
 // will error if there is already an auth for the specified Email for create (http.MethodPost).
-// Update (http.MethodPut) requires the user is logged in and provides a valid token.
+// Update (http.MethodPut) requires a PurposeChangePassword token for the auth, an admin token
+// for another auth, or with Config.PasswordChangeWithoutCurrent the token of the auth.
 func handlerCreateOrUpdate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost && r.Method != http.MethodPut {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
 
 	em := ""
 	pw := ""
@@ -79,6 +495,7 @@ func handlerCreateOrUpdate(w http.ResponseWriter, r *http.Request) {
 		// WriteHeader provided by BodyUnmarshal
 		return
 	}
+	em = emailNormalize(em)
 
 	// Either create or update require valid credentials in the body.
 	auth, err := authGet(em)
@@ -87,29 +504,67 @@ func handlerCreateOrUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// On create, the auth must not exist. On update, the user must be logged in.
-	if r.Method == http.MethodPost {
+	// On create, the auth must not exist; checked atomically with the create. On update,
+	// the user must be logged in, or have the change password token for the auth.
+	createOnly := r.Method == http.MethodPost
+	keep := ""
+	if createOnly {
+		if config.CreateRequiresAuth {
+			// re-authenticate; change password tokens cannot create auths.
+			claims, err := Authenticated(w, r)
+			if err != nil || restrictedRejected(w, claims) {
+				return
+			}
+		}
 		if auth.PasswordHash != nil {
 			w.WriteHeader(http.StatusConflict)
 			return
 		}
 	} else { // http.MethodPut
-		_, err := Authenticated(w, r)
+		claims, err := authenticated(w, r, true, PurposeChangePassword)
 		if err != nil {
 			return
 		}
+		if impersonationRejected(w, claims) || restrictedRejected(w, claims) {
+			return
+		}
+		// Users change their own password at PathPassword, with the current password, and only
+		// admins update other auths.
+		if claims.Purpose != PurposeChangePassword {
+			if claims.Email != em {
+				if !adminAuthorized(w, r, claims) {
+					return
+				}
+			} else if !config.PasswordChangeWithoutCurrent {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		keep = claims.tokenKVSKey()
+		if claims.Purpose == PurposeChangePassword {
+			if claims.Email != em {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			tokenString, _ := tokenFromRequestHeader(r)
+			if _, err := oneTimeTokenConsume(tokenString, PurposeChangePassword); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
 	}
 
-	if err := cred.AuthCreate(); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if err := cred.authCreateCommon(requestContext(r), createOnly, keep); err != nil {
+		authCreateFailed(w, err)
 		return
 	}
 
 	if aw, ok := w.(*AuditWriter); ok {
-		aw.Message = fmt.Sprintf("credential create or update for email: %s", *cred.Email)
+		aw.Message = fmt.Sprintf("credential create or update for email: %s", auditEmail(*cred.Email))
 	}
 
 	if r.Method == http.MethodPost {
+		w.Header().Set("Location", accountLocation(*cred.Email))
 		w.WriteHeader(http.StatusCreated)
 	} else { // http.MethodPut
 		w.WriteHeader(http.StatusNoContent)
@@ -124,43 +579,131 @@ func handlerDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// re-authenticate to get claims, in order to delete the auth and the token.
-	claims, err := Authenticated(w, r)
+	// get the claims, in order to delete the auth and the token.
+	claims, err := requestClaims(w, r)
 	if err != nil {
 		return
 	}
+	if impersonationRejected(w, claims) {
+		return
+	}
 
-	if aw, ok := w.(*AuditWriter); ok {
-		aw.Message = fmt.Sprintf("auth and tokens deleted for email: %s", claims.Email)
+	if config.DeleteRequiresPassword {
+		pw := ""
+		cred := Credential{Password: &pw}
+		if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+			lpf(logh.Error, "delete error:%v", err)
+			// WriteHeader provided by BodyUnmarshal
+			return
+		}
+		auth, err := authGet(claims.Email)
+		if err != nil {
+			lpf(logh.Error, "authGet error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ok, err := passwordVerifyLocked(w, r, claims.Email, passwordTrim(pw), auth.PasswordHash)
+		if !ok {
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 	}
 
-	// Remove all users tokens then delete the kvsAuth
-	// handlerLogoutCommon sets http.StatusNoContent
-	handlerLogoutCommon(w, r, true)
+	// Remove all users tokens, regardless of MaxTokenDeletesPerRequest, then delete the kvsAuth
+	if _, err := userTokens(claims.Email, true); err != nil {
+		lpf(logh.Error, "userTokens error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := userOneTimeTokensRemove(claims.Email); err != nil {
+		lpf(logh.Error, "userOneTimeTokensRemove error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := apiKeysRemove(claims.Email); err != nil {
+		lpf(logh.Error, "apiKeysRemove error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth, err := authGet(claims.Email); err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+	} else if err := authIndexesMove(auth, ""); err != nil {
+		lpf(logh.Error, "authIndexesMove error:%v", err)
+	}
 	if _, err := kvsAuth.Delete(claims.Email); err != nil {
 		lpf(logh.Error, "kvsAuth.Delete error: %+v", err)
 	}
+	eventSend(requestContext(r), EventAuthDelete, claims.Email)
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("auth and tokens deleted for email: %s", auditEmail(claims.Email))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerExportMyData returns the UserData of the caller; only the callers own data is
+// returned.
+func handlerExportMyData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get the claims, in order to get the callers data.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	ud, err := userData(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "userData error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(ud)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
 }
 
-// handlerInfo will return an Info object for the caller.
+// handlerInfo will return an Info object for the caller, with the Session of each
+// outstanding token. Admins may get the Info of another user with query parameter email.
 func handlerInfo(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	// re-authenticate to get claims, in order to get claims.
-	claims, err := Authenticated(w, r)
+	// get the claims.
+	claims, err := requestClaims(w, r)
 	if err != nil {
 		return
 	}
-	c, err := userTokens(claims.Email, false)
+	email := claims.Email
+	if qe := emailNormalize(r.URL.Query().Get("email")); qe != "" && qe != claims.Email {
+		if !adminAuthorized(w, r, claims) {
+			return
+		}
+		email = qe
+	}
+
+	sessions, err := sessionsList(email)
 	if err != nil {
-		lpf(logh.Error, "userTokens error:%v", err)
+		lpf(logh.Error, "sessionsList error:%v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	info := Info{OutstandingTokens: c}
+	info := Info{OutstandingTokens: len(sessions), Sessions: sessions}
 	b, err := json.Marshal(info)
 	if err != nil {
 		lpf(logh.Error, "json.Marshal error:%v", err)
@@ -173,6 +716,40 @@ func handlerInfo(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handlerListAPIKeys returns the APIKeyInfo for the callers API keys. Admins may list the
+// API keys of another user with query parameter email.
+func handlerListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+
+	email := claims.Email
+	if qe := emailNormalize(r.URL.Query().Get("email")); qe != "" && qe != claims.Email {
+		if !adminAuthorized(w, r, claims) {
+			return
+		}
+		email = qe
+	}
+
+	infos, err := apiKeyList(email)
+	if err != nil {
+		lpf(logh.Error, "apiKeyList error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(infos)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
 // handlerLogin will validate a callers credentials and, if the credentials are
 // valid, will return a JWT token for the caller.
 func handlerLogin(w http.ResponseWriter, r *http.Request) {
@@ -183,6 +760,9 @@ func handlerLogin(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
 
 	em := ""
 	pw := ""
@@ -192,45 +772,158 @@ func handlerLogin(w http.ResponseWriter, r *http.Request) {
 		// WriteHeader provided by BodyUnmarshal
 		return
 	}
+	em = emailNormalize(em)
+
+	// Limit the number of concurrent password verifications.
+	release, ok := loginSemaphoreAcquire(w)
+	if !ok {
+		return
+	}
+	defer release()
 
+	_, span := spanStart(r.Context(), SpanAuthGet)
+	span.SetAttribute(AttributeEmail, auditEmail(*cred.Email))
 	auth, err := authGet(*cred.Email)
+	span.SetAttribute(AttributeOutcome, err == nil)
+	span.End()
 	if err != nil {
 		lpf(logh.Error, "authGet error:%v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	if err := passwordVerifyHash(*cred.Password, auth.PasswordHash); err != nil {
+	// Logins with a ContactEmail continue with the identifier, so lockouts and tokens are for
+	// the auth.
+	if em, auth, err = loginIdentifier(em, auth); err != nil {
+		lpf(logh.Error, "loginIdentifier error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ok, err = passwordVerifyLocked(w, r, *cred.Email, passwordTrim(*cred.Password), auth.PasswordHash)
+	if !ok {
+		return
+	}
+	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	if auth.Disabled {
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("login for disabled email: %s", auditEmail(*cred.Email))
+		}
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	passwordRehash(*cred.Email, passwordTrim(*cred.Password), auth.PasswordHash)
+	passwordExpirationStart(*cred.Email, auth)
+	// The proof is checked after the password, so only valid logins are tracked for replay.
+	jkt, ok := dpopLoginBinding(w, r)
+	if !ok {
+		return
+	}
+	cnf := tokenConfirmation(r, jkt)
 
-	tokenString, err := authTokenStringCreate(*cred.Email)
+	loginTokensWrite(w, r, *cred.Email, auth, "login", AuthMethodPassword, cnf, config.RememberMeEnabled && cred.RememberMe)
+}
+
+// loginTokensWrite issues the tokens for a verified login by email, with auth, and writes them
+// as the response. Users that must change their password only get a token for changing the
+// password, and other logins are subject to the session limit of auth. login is the type of
+// login in audit messages, I.E. "login", and method is the AuthMethod of the tokens.
+func loginTokensWrite(w http.ResponseWriter, r *http.Request, email string, auth authentication, login, method string,
+	cnf *Confirmation, rememberMe bool) {
+	changeRequired := passwordChangeRequired(auth)
+
+	if !changeRequired {
+		unlock, ok := sessionLimitEnforce(w, email, auth, login)
+		if !ok {
+			return
+		}
+		defer unlock()
+	}
+
+	// Users that must change their password, or with an expired password, only get a token for
+	// changing the password.
+	var tokenString, family string
+	var err error
+	authTime := timeNow().Unix()
+	if changeRequired {
+		tokenString, err = oneTimeTokenCreate(email, PurposeChangePassword, config.JWTAuthExpirationInterval)
+		w.Header().Set(passwordChangeRequiredHeader, "true")
+	} else {
+		if config.IssueRefreshToken {
+			family, err = uniqueID(false)
+		}
+		if err == nil {
+			tokenString, err = authTokenStringCreateClient(r, email, tokenOptions{authTime: authTime, client: clientFingerprint(r), cnf: cnf,
+				family: family, method: method})
+		}
+	}
 	if err != nil {
-		lpf(logh.Error, "authTokenStringCreate error:%v", err)
+		lpf(logh.Error, "token create error:%v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// The response is the token, or LoginTokens as JSON when issuing an ID, refresh, or
+	// remember me token.
+	b := []byte(tokenString)
+	if (config.IssueIDToken || config.IssueRefreshToken || rememberMe) && !changeRequired {
+		lt := LoginTokens{AccessToken: tokenString}
+		if config.IssueIDToken {
+			if lt.IDToken, err = idTokenStringCreate(auth, tokenString); err != nil {
+				lpf(logh.Error, "ID token create error:%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if config.IssueRefreshToken {
+			if lt.RefreshToken, err = refreshTokenCreate(email, tokenOptions{authTime: authTime,
+				client: clientFingerprint(r), cnf: cnf, family: family, method: method}); err != nil {
+				lpf(logh.Error, "refresh token create error:%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if rememberMe {
+			if lt.RememberMeToken, err = rememberMeTokenCreate(r, email, cnf); err != nil {
+				lpf(logh.Error, "remember me token create error:%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if b, err = json.Marshal(lt); err != nil {
+			lpf(logh.Error, "json.Marshal error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	}
+
 	if aw, ok := w.(*AuditWriter); ok {
-		aw.Message = fmt.Sprintf("login for email: %s", *cred.Email)
+		aw.Message = fmt.Sprintf("%s for email: %s", login, auditEmail(email))
+		if changeRequired {
+			aw.Message += ", password change required"
+		}
 	}
 
 	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write([]byte(tokenString)); err != nil {
+	if _, err := w.Write(b); err != nil {
 		lpf(logh.Error, "w.Write error:%+v", err)
 	}
 }
 
 // handlerLogout will delete the token the caller is currently using,
 // effectively logging them out as the token is no longer valid.
+// Logout is idempotent; a token that is validly signed and not expired, but was already
+// logged out, also gets http.StatusNoContent.
 func handlerLogout(w http.ResponseWriter, r *http.Request) {
 	handlerLogoutCommon(w, r, false)
 }
 
 // handlerLogoutAll will delete all tokens for the current caller,
 // effectively logging them out of all sessions, as none of their issued
-// tokens will be valid.
+// tokens will be valid. See Config.MaxTokenDeletesPerRequest for partial completion. With
+// query parameter dryRun=true the DryRun is returned and no tokens are deleted.
 func handlerLogoutAll(w http.ResponseWriter, r *http.Request) {
 	handlerLogoutCommon(w, r, true)
 }
@@ -241,36 +934,123 @@ func handlerLogoutCommon(w http.ResponseWriter, r *http.Request, logoutAll bool)
 		return
 	}
 
-	// re-authenticate to get claims, in order to delete the token.
-	claims, err := Authenticated(w, r)
+	// get the claims, in order to delete the token. A single logout does not require the
+	// token to still be in kvsToken, so logout is idempotent.
+	claims, err := requestClaimsCommon(w, r, logoutAll)
 	if err != nil {
 		return
 	}
 
 	if logoutAll {
-		_, err := userTokens(claims.Email, true)
+		dryRun := false
+		if v := r.URL.Query().Get("dryRun"); v != "" {
+			if dryRun, err = strconv.ParseBool(v); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		n, remaining, err := userTokensRemove(claims.Email, claims.tokenKVSKey(), config.MaxTokenDeletesPerRequest, dryRun)
 		if err != nil {
-			lpf(logh.Error, "userTokens error:%v", err)
+			lpf(logh.Error, "userTokensRemove error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if dryRun {
+			if aw, ok := w.(*AuditWriter); ok {
+				aw.Message = fmt.Sprintf("dry run, %d tokens would be deleted, %d remaining, for email: %s", n, remaining, auditEmail(claims.Email))
+			}
+			b, err := json.Marshal(DryRun{Deletes: n, Emails: []string{claims.Email}, Remaining: remaining})
+			if err != nil {
+				lpf(logh.Error, "json.Marshal error:%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if _, err := w.Write(b); err != nil {
+				lpf(logh.Error, "w.Write error:%+v", err)
+			}
+			return
+		}
+		if remaining > 0 {
+			if aw, ok := w.(*AuditWriter); ok {
+				aw.Message = fmt.Sprintf("%d tokens deleted, %d remaining, for email: %s", n, remaining, auditEmail(claims.Email))
+			}
+			b, err := json.Marshal(Info{OutstandingTokens: remaining})
+			if err != nil {
+				lpf(logh.Error, "json.Marshal error:%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			if _, err := w.Write(b); err != nil {
+				lpf(logh.Error, "w.Write error:%+v", err)
+			}
+			return
+		}
+		// Refresh tokens, and other single use tokens, could otherwise get new tokens.
+		if err := userOneTimeTokensRemove(claims.Email); err != nil {
+			lpf(logh.Error, "userOneTimeTokensRemove error:%v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		if aw, ok := w.(*AuditWriter); ok {
-			aw.Message = fmt.Sprintf("all tokens deleted for email: %s", claims.Email)
+			aw.Message = fmt.Sprintf("all tokens deleted for email: %s", auditEmail(claims.Email))
 		}
 	} else {
-		n, err := kvsToken.Delete(claims.tokenKVSKey())
+		n, err := tokenDelete(kvsToken, claims.tokenKVSKey())
 		if err != nil {
 			lpf(logh.Error, "kvsToken.Delete error:%v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		if aw, ok := w.(*AuditWriter); ok {
-			aw.Message = fmt.Sprintf("%d tokens deleted for email: %s", n, claims.Email)
+			aw.Message = fmt.Sprintf("%d tokens deleted for email: %s", n, auditEmail(claims.Email))
 		}
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handlerNotFound is registered for Config.PathPrefix; paths under the prefix that are not
+// another auth path are not found.
+func handlerNotFound(w http.ResponseWriter, r *http.Request) {
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = "not found"
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// handlerPermissions returns the permissions of the callers roles, per
+// Config.RolePermissions.
+func handlerPermissions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get the claims, in order to get the auth.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(rolePermissions(authRoles(auth)))
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
 // handlerRefresh deletes the callers current token and returns
 // a new token.
 func handlerRefresh(w http.ResponseWriter, r *http.Request) {
@@ -282,30 +1062,121 @@ func handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// re-authenticate to get claims.
-	claims, err := Authenticated(w, r)
+	// get the claims.
+	claims, err := requestClaims(w, r)
 	if err != nil {
 		return
 	}
+	if impersonationRejected(w, claims) || refreshBindingRejected(w, r, claims) || refreshLimited(w, claims.Email) {
+		return
+	}
 
-	tokenString, err := authTokenStringCreate(claims.Email)
+	tokenString, err := authTokenStringCreateClient(r, claims.Email, tokenOptions{authTime: claims.AuthTime, client: claims.Client,
+		cnf: claims.Confirmation, family: claims.Family, method: claims.AuthMethod})
 	if err != nil {
 		lpf(logh.Error, "authTokenStringCreate error:%v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	n, err := kvsToken.Delete(claims.tokenKVSKey())
+	n, err := tokenDelete(kvsToken, claims.tokenKVSKey())
 	if err != nil {
 		lpf(logh.Error, "kvsToken.Delete error:%v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	if aw, ok := w.(*AuditWriter); ok {
-		aw.Message = fmt.Sprintf("%d tokens deleted during token refresh for email: %s", n, claims.Email)
+		aw.Message = fmt.Sprintf("%d tokens deleted during token refresh for email: %s", n, auditEmail(claims.Email))
 	}
 	w.WriteHeader(http.StatusCreated)
 	if _, err := w.Write([]byte(tokenString)); err != nil {
 		lpf(logh.Error, "w.Write error:%+v", err)
 	}
 }
+
+// handlerRevokeAPIKey revokes the API key with query parameter id. Users may only revoke their
+// own API keys, unless they are an admin; other keys get http.StatusNotFound.
+func handlerRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+
+	ak, err := apiKeyGet(r.URL.Query().Get("id"))
+	if err != nil {
+		lpf(logh.Error, "apiKeyGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if ak.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if ak.Email != claims.Email {
+		// Only admins learn that the API keys of other users exist.
+		admin, err := authIsAdmin(claims.Email)
+		if err != nil {
+			lpf(logh.Error, "authIsAdmin error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !admin {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !adminAuthorized(w, r, claims) {
+			return
+		}
+	}
+
+	if _, err := kvsAPIKey.Delete(ak.ID); err != nil {
+		lpf(logh.Error, "kvsAPIKey.Delete error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("API key %s for email: %s revoked by email: %s", ak.ID, auditEmail(ak.Email), auditEmail(claims.Email))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerRequestMagicLink sends a magic link token, using Config.TokenSender, to the Email in
+// the request body. The status is http.StatusAccepted whether or not there is an auth for
+// the Email, so callers cannot use this handler to discover which emails are registered.
+func handlerRequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
+
+	em := ""
+	cred := Credential{Email: &em}
+	if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+		lpf(logh.Error, "magic link request error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	em = emailNormalize(em)
+
+	auth, err := authGet(em)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if auth.Email != nil {
+		if err := oneTimeTokenSend(em, PurposeMagicLink, config.MagicLinkExpirationInterval); err != nil {
+			lpf(logh.Error, "oneTimeTokenSend error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("magic link sent for email: %s", auditEmail(em))
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -7,8 +7,17 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/paulfdunn/go-helper/logh"
 )
 
 // TestHandlerFuncAuthJWTWrapper tests the wrapper function to show that wrapping a handler
@@ -61,6 +70,463 @@ func TestHandlerFuncAuthJWTWrapper(t *testing.T) {
 	testServerWrapped.Close()
 }
 
+// TestClaimsFromContext verifies HandlerFuncAuthJWTWrapper stores the claims of the caller in
+// the request context, and the authjwt handlers still reject API keys.
+func TestClaimsFromContext(t *testing.T) {
+	testSetup()
+	config.APIKeysEnabled = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	ak, err := apiKeyCreate(em, "ci")
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+	if claims := ClaimsFromContext(httptest.NewRequest(http.MethodGet, "/", nil).Context()); claims != nil {
+		t.Errorf("claims from context without claims: %+v", claims)
+		return
+	}
+
+	var claims *CustomClaims
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(func(w http.ResponseWriter, r *http.Request) {
+		claims = ClaimsFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	defer testServer.Close()
+	testServerInfo := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerInfo)))
+	defer testServerInfo.Close()
+
+	tests := []struct {
+		url    string
+		header string
+		value  string
+		status int
+		method string
+	}{
+		{testServer.URL, "Authorization", "Bearer " + string(tokenBytes), http.StatusNoContent, AuthMethodPassword},
+		{testServer.URL, apiKeyHeader, ak.Key, http.StatusNoContent, AuthMethodAPIKey},
+		{testServerInfo.URL, "Authorization", "Bearer " + string(tokenBytes), http.StatusOK, ""},
+		{testServerInfo.URL, apiKeyHeader, ak.Key, http.StatusUnauthorized, ""},
+	}
+	for i, tc := range tests {
+		claims = nil
+		req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set(tc.header, tc.value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("test %d, status: %d, expected: %d, error: %v", i, resp.StatusCode, tc.status, err)
+			return
+		}
+		resp.Body.Close()
+		if tc.method != "" && (claims == nil || claims.Email != em || claims.AuthMethod != tc.method) {
+			t.Errorf("test %d, wrong claims from context: %+v", i, claims)
+			return
+		}
+	}
+}
+
+// TestHandlerFuncWrapperAuditAuth verifies audit records from HandlerFuncNoAuthWrapper carry
+// the no-auth marker, while those from HandlerFuncAuthJWTWrapper carry the caller's Email.
+func TestHandlerFuncWrapperAuditAuth(t *testing.T) {
+	auditPath := auditLogSetup(t)
+	defer auditLogShutdown()
+	testSetup()
+
+	testServerNoAuth := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerTest)))
+	defer testServerNoAuth.Close()
+	resp, err := http.Post(testServerNoAuth.URL, "application/json", nil)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("HandlerFuncNoAuthWrapper POST error: %v", err)
+		return
+	}
+	if !auditLogContains(t, auditPath, "auth: none|") {
+		t.Errorf("audit log does not contain the no-auth marker")
+		return
+	}
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	testServerAuth := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServerAuth.Close()
+	req, err := http.NewRequest(http.MethodPost, testServerAuth.URL, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	client := &http.Client{}
+	resp, err = client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("HandlerFuncAuthJWTWrapper POST error: %v", err)
+		return
+	}
+	if !auditLogContains(t, auditPath, "auth: "+em+"|") {
+		t.Errorf("audit log does not contain the caller email")
+		return
+	}
+}
+
+// TestHandlerCheckPassword verifies compliant passwords are valid, and non-compliant
+// passwords return the reasons they do not meet the policy.
+func TestHandlerCheckPassword(t *testing.T) {
+	testSetup()
+	testServer := httptest.NewServer(http.HandlerFunc(handlerFuncNoAuthWrapperCommon(handlerCheckPassword, false)))
+	defer testServer.Close()
+
+	tests := []struct {
+		password string
+		reasons  int
+	}{
+		{"P@ss!234", 0},
+		{"password", 3},
+		{"Pa$$word", 1},
+		{"$2a$10$" + strings.Repeat("a", 53), 3},
+		{strings.Repeat("aA1!", 19), 2},
+	}
+	for _, tc := range tests {
+		b, err := json.Marshal(Credential{Password: &tc.password})
+		if err != nil {
+			t.Errorf("Marshal error: %v", err)
+			return
+		}
+		resp, err := http.Post(testServer.URL, "application/json", bytes.NewBuffer(b))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("check password did not return proper status: %d, error: %v", resp.StatusCode, err)
+			return
+		}
+		pc := PasswordCheck{}
+		if err := json.NewDecoder(resp.Body).Decode(&pc); err != nil {
+			t.Errorf("Decode error: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if pc.Valid != (tc.reasons == 0) || len(pc.Reasons) != tc.reasons {
+			t.Errorf("password %s, wrong PasswordCheck: %+v", tc.password, pc)
+			return
+		}
+	}
+
+	resp, err := http.Post(testServer.URL, "application/json", bytes.NewBufferString("{}"))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("check without password did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+}
+
+// TestHandlerCheckToken verifies active, revoked, and expired tokens are reported correctly to
+// an admin, by token and by TokenID, and non admins are rejected.
+func TestHandlerCheckToken(t *testing.T) {
+	testSetup()
+
+	// Create the auth and issue the expired token first; the TimeSource cannot go backwards.
+	config.TimeSource = func() time.Time { return time.Now().Add(-time.Hour) }
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	expiredTokenString, err := authTokenStringCreate(em)
+	if err != nil {
+		t.Errorf("authTokenStringCreate error: %v", err)
+		return
+	}
+	expiredToken := []byte(expiredTokenString)
+	expiredClaims := &CustomClaims{}
+	if _, err := jwt.ParseWithClaims(expiredTokenString, expiredClaims, verificationKey); err == nil {
+		t.Errorf("token is not expired")
+		return
+	}
+	config.TimeSource = nil
+	activeToken, activeClaims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	revokedToken, revokedClaims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if _, err := kvsToken.Delete(revokedClaims.tokenKVSKey()); err != nil {
+		t.Errorf("kvsToken.Delete error: %v", err)
+		return
+	}
+	adminEmail := "admin@auth.com"
+	_, adminCredBytes, err := createAuth(t, &adminEmail)
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCredBytes)
+	if err != nil {
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerCheckToken)))
+	defer testServer.Close()
+	client := &http.Client{}
+	check := func(tc TokenCheck) (TokenStatus, int, error) {
+		b, err := json.Marshal(tc)
+		if err != nil {
+			return TokenStatus{}, 0, err
+		}
+		req, err := http.NewRequest(http.MethodPost, testServer.URL, bytes.NewBuffer(b))
+		if err != nil {
+			return TokenStatus{}, 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(adminToken))
+		resp, err := client.Do(req)
+		if err != nil {
+			return TokenStatus{}, 0, err
+		}
+		defer resp.Body.Close()
+		ts := TokenStatus{}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&ts)
+		}
+		return ts, resp.StatusCode, err
+	}
+
+	if _, status, err := check(TokenCheck{Token: string(activeToken)}); err != nil || status != http.StatusForbidden {
+		t.Errorf("non admin check did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if err := AuthRolesSet(adminEmail, []string{RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+
+	tests := []struct {
+		tc       TokenCheck
+		code     int
+		status   string
+		expireAt int64
+	}{
+		{TokenCheck{Token: string(activeToken)}, http.StatusOK, TokenStatusActive, activeClaims.ExpiresAt},
+		{TokenCheck{Token: string(revokedToken)}, http.StatusOK, TokenStatusRevoked, revokedClaims.ExpiresAt},
+		{TokenCheck{Token: string(expiredToken)}, http.StatusOK, TokenStatusExpired, expiredClaims.ExpiresAt},
+		{TokenCheck{TokenID: activeClaims.TokenID}, http.StatusOK, TokenStatusActive, activeClaims.ExpiresAt},
+		{TokenCheck{TokenID: expiredClaims.TokenID}, http.StatusOK, TokenStatusExpired, expiredClaims.ExpiresAt},
+		{TokenCheck{TokenID: revokedClaims.TokenID}, http.StatusNotFound, "", 0},
+		{TokenCheck{Token: "not.a.token"}, http.StatusBadRequest, "", 0},
+		{TokenCheck{}, http.StatusBadRequest, "", 0},
+	}
+	for i, tc := range tests {
+		ts, code, err := check(tc.tc)
+		if err != nil || code != tc.code {
+			t.Errorf("test %d did not return proper status: %d, error: %v", i, code, err)
+			return
+		}
+		if code == http.StatusOK && (ts.Status != tc.status || ts.Email != em || ts.ExpiresAt != tc.expireAt) {
+			t.Errorf("test %d wrong TokenStatus: %+v", i, ts)
+			return
+		}
+	}
+}
+
+// TestHandlerCSRFToken verifies a CSRF token from handlerCSRFToken passes the CSRF validation
+// in HandlerFuncAuthJWTWrapper, and that a missing token, or one for another session, fails.
+// TestHandlerAPIKeys verifies API keys can be created, used with HandlerFuncAuthJWTWrapper,
+// listed without the key, and revoked only by the owner or an admin.
+func TestHandlerAPIKeys(t *testing.T) {
+	testSetup()
+	config.APIKeysEnabled = true
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	otherEmail := "other@auth.com"
+	_, otherCredBytes, err := createAuth(t, &otherEmail)
+	if err != nil {
+		return
+	}
+	otherTokenBytes, _, err := login(t, otherCredBytes)
+	if err != nil {
+		return
+	}
+
+	testServerAPIKeys := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerAPIKeys)))
+	defer testServerAPIKeys.Close()
+	testServerTest := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServerTest.Close()
+	client := &http.Client{}
+	do := func(method string, url string, body []byte, header string, value string) (*http.Response, error) {
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(header, value)
+		return client.Do(req)
+	}
+
+	resp, err := do(http.MethodPost, testServerAPIKeys.URL, []byte(`{"Label":"ci"}`), "Authorization", "Bearer "+string(tokenBytes))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("API key create did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	ak := APIKey{}
+	if err := json.NewDecoder(resp.Body).Decode(&ak); err != nil || ak.Key == "" || ak.Label != "ci" {
+		t.Errorf("API key create returned bad key: %+v, error: %v", ak, err)
+		return
+	}
+	resp.Body.Close()
+
+	resp, err = do(http.MethodGet, testServerTest.URL, nil, apiKeyHeader, ak.Key)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("API key auth did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	// API keys cannot manage API keys.
+	resp, err = do(http.MethodGet, testServerAPIKeys.URL, nil, apiKeyHeader, ak.Key)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("API key list with API key did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+
+	resp, err = do(http.MethodGet, testServerAPIKeys.URL, nil, "Authorization", "Bearer "+string(tokenBytes))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("API key list did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	listBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	infos := []APIKeyInfo{}
+	if err := json.Unmarshal(listBytes, &infos); err != nil || len(infos) != 1 || infos[0].ID != ak.ID || infos[0].LastUsed.IsZero() {
+		t.Errorf("API key list incorrect: %+v, error: %v", infos, err)
+		return
+	}
+	if bytes.Contains(listBytes, []byte(ak.Key)) {
+		t.Errorf("API key list contains the key: %s", listBytes)
+		return
+	}
+
+	// Another user cannot list or revoke the key, until they are an admin.
+	resp, err = do(http.MethodGet, testServerAPIKeys.URL+"?email=someone@auth.com", nil, "Authorization", "Bearer "+string(otherTokenBytes))
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("API key list by other user did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	resp, err = do(http.MethodDelete, testServerAPIKeys.URL+"?id="+ak.ID, nil, "Authorization", "Bearer "+string(otherTokenBytes))
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("API key revoke by other user did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	auth, err := authGet(otherEmail)
+	if err != nil {
+		t.Errorf("authGet error: %v", err)
+		return
+	}
+	role := RoleAdmin
+	auth.Role = &role
+	if err := authCreate(auth); err != nil {
+		t.Errorf("authCreate error: %v", err)
+		return
+	}
+	resp, err = do(http.MethodDelete, testServerAPIKeys.URL+"?id="+ak.ID, nil, "Authorization", "Bearer "+string(otherTokenBytes))
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("API key revoke by admin did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+
+	resp, err = do(http.MethodGet, testServerTest.URL, nil, apiKeyHeader, ak.Key)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked API key auth did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+}
+
+func TestHandlerCSRFToken(t *testing.T) {
+	testSetup()
+	config.CSRFProtection = true
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	tokenBytesOther, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	testServerCSRF := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerCSRFToken)))
+	defer testServerCSRF.Close()
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	client := &http.Client{}
+	do := func(method string, url string, token []byte, csrfToken string) (*http.Response, error) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		if csrfToken != "" {
+			req.Header.Set(csrfHeader, csrfToken)
+		}
+		return client.Do(req)
+	}
+
+	resp, err := do(http.MethodPost, testServer.URL, tokenBytes, "")
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST without CSRF token did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	// GET does not require a CSRF token.
+	resp, err = do(http.MethodGet, testServer.URL, tokenBytes, "")
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("GET without CSRF token did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+
+	resp, err = do(http.MethodGet, testServerCSRF.URL, tokenBytes, "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("CSRF token GET did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	csrfBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	resp, err = do(http.MethodPost, testServer.URL, tokenBytes, string(csrfBytes))
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("POST with CSRF token did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	resp, err = do(http.MethodPost, testServer.URL, tokenBytesOther, string(csrfBytes))
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST with CSRF token of another session did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+}
+
 // TestHandlerCreateOrUpdate tests handlerCreateOrUpdate by creating an auth, verifying a GET
 // is rejected, and verifying a POST to an existing credential is rejected.
 func TestHandlerCreateOrUpdate(t *testing.T) {
@@ -113,6 +579,15 @@ func TestHandlerCreateOrUpdate(t *testing.T) {
 		return
 	}
 
+	if location := resp.Header.Get("Location"); location != "/auth/info?email=newAuth%40auth.com" {
+		t.Errorf("TestHandlerCreateOrUpdate wrong Location: %s", location)
+		return
+	}
+	if location := accountLocation("a+b&c=d@auth.com"); location != "/auth/info?email=a%2Bb%26c%3Dd%40auth.com" {
+		t.Errorf("TestHandlerCreateOrUpdate Location not escaped: %s", location)
+		return
+	}
+
 	_, err = kvsAuth.Get(em)
 	if err != nil {
 		t.Errorf("Get kvsAuth error: %v", err)
@@ -145,27 +620,131 @@ func TestHandlerCreateOrUpdate(t *testing.T) {
 		t.Errorf("TestHandlerCreateOrUpdate marshal error: %v", err)
 		return
 	}
-	// Update creds with token from login.
-	req, err := http.NewRequest(http.MethodPut, testServer.URL, bytes.NewBuffer(credBytes))
-	if err != nil {
-		t.Errorf("NewRequest error: %v", err)
-		return
-	}
-	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	// Update creds with token from login; only with PasswordChangeWithoutCurrent.
 	client := http.Client{}
-	resp, err = client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusNoContent {
-		t.Errorf("TestHandlerCreateOrUpdate did not return proper status: %d", resp.StatusCode)
-		return
-	}
-	// Login with updated creds.
-	_, _, err = login(t, credBytes)
-	if err != nil {
+	for _, withoutCurrent := range []bool{false, true} {
+		config.PasswordChangeWithoutCurrent = withoutCurrent
+		req, err := http.NewRequest(http.MethodPut, testServer.URL, bytes.NewBuffer(credBytes))
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		expected := http.StatusForbidden
+		if withoutCurrent {
+			expected = http.StatusNoContent
+		}
+		resp, err = client.Do(req)
+		if err != nil || resp.StatusCode != expected {
+			t.Errorf("TestHandlerCreateOrUpdate did not return proper status: %v, error: %v", resp, err)
+			return
+		}
+	}
+	// Login with updated creds.
+	_, _, err = login(t, credBytes)
+	if err != nil {
 		t.Errorf("TestHandlerCreateOrUpdate could not login with updated creds, error: %d", err)
 		return
 	}
 }
 
+// TestHandlerCreateOrUpdateCaseInsensitive verifies that with EmailUniqueCaseInsensitive a case
+// variant of an existing email gets http.StatusConflict, and without it the variant is created.
+func TestHandlerCreateOrUpdateCaseInsensitive(t *testing.T) {
+	testSetup()
+
+	testServer := httptest.NewServer(http.HandlerFunc(handlerCreateOrUpdate))
+	defer testServer.Close()
+
+	if _, _, err := createAuth(t, nil); err != nil {
+		return
+	}
+	em := "Someone@Auth.com"
+	pwd := "P@ss!234"
+	credBytes, err := json.Marshal(Credential{Email: &em, Password: &pwd})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+
+	config.EmailUniqueCaseInsensitive = true
+	resp, err := http.Post(testServer.URL, "application/json", bytes.NewBuffer(credBytes))
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("case variant create did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	if b, err := kvsAuth.Get(em); b != nil || err != nil {
+		t.Errorf("case variant was created, error: %v", err)
+		return
+	}
+
+	config.EmailUniqueCaseInsensitive = false
+	resp, err = http.Post(testServer.URL, "application/json", bytes.NewBuffer(credBytes))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("case variant create did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+}
+
+// TestHandlerCreateOrUpdateHashingHints verifies hashing hints in the credential body have no
+// effect on the stored hash, and that a pre-hashed password is rejected.
+func TestHandlerCreateOrUpdateHashingHints(t *testing.T) {
+	testSetup()
+
+	testServer := httptest.NewServer(http.HandlerFunc(handlerCreateOrUpdate))
+	defer testServer.Close()
+
+	em := "hints@auth.com"
+	pwd := "P@ss1234"
+	hint, err := bcrypt.GenerateFromPassword([]byte("Other!234"), bcrypt.MinCost)
+	if err != nil {
+		t.Errorf("GenerateFromPassword error: %v", err)
+		return
+	}
+	body := map[string]interface{}{"Email": em, "Password": pwd, "PasswordHash": hint,
+		"Salt": "client-salt", "Cost": bcrypt.MinCost}
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	resp, err := http.Post(testServer.URL, "application/json", bytes.NewBuffer(b))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("create did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	auth, err := authGet(em)
+	if err != nil {
+		t.Errorf("authGet error: %v", err)
+		return
+	}
+	cost, err := bcrypt.Cost(auth.PasswordHash)
+	if err != nil || cost != config.BcryptCost || bytes.Equal(auth.PasswordHash, hint) ||
+		passwordVerifyHash(pwd, auth.PasswordHash) != nil {
+		t.Errorf("stored hash was influenced by the request, cost: %d, error: %v", cost, err)
+		return
+	}
+
+	// Allow any password, so only the pre-hashed check applies.
+	config.PasswordValidation = []string{`.`}
+	if err := passwordValidationLoad(); err != nil {
+		t.Errorf("passwordValidationLoad error: %v", err)
+		return
+	}
+	em = "prehashed@auth.com"
+	pwd = string(hint)
+	b, err = json.Marshal(Credential{Email: &em, Password: &pwd})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	resp, err = http.Post(testServer.URL, "application/json", bytes.NewBuffer(b))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("create with pre-hashed password did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+}
+
 // TestHandlerDelete creates an auth via direct function calls and verifies a call to the
 // delete handler deletes the auth.
 func TestHandlerDelete(t *testing.T) {
@@ -223,6 +802,192 @@ func TestHandlerDelete(t *testing.T) {
 	// }
 }
 
+// TestHandlerDeleteAPIKey verifies deleting an auth removes its API keys, so they are rejected,
+// including after an auth with the same email is created again.
+func TestHandlerDeleteAPIKey(t *testing.T) {
+	testSetup()
+	config.APIKeysEnabled = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	ak, err := apiKeyCreate(em, "ci")
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+	do := func(hf http.HandlerFunc, method string, header string, value string) int {
+		req := httptest.NewRequest(method, "/", nil)
+		req.Header.Set(header, value)
+		rr := httptest.NewRecorder()
+		HandlerFuncAuthJWTWrapper(hf)(rr, req)
+		return rr.Code
+	}
+	if status := do(handlerTest, http.MethodGet, apiKeyHeader, ak.Key); status != http.StatusNoContent {
+		t.Errorf("API key did not return proper status: %d", status)
+		return
+	}
+	if status := do(handlerDelete, http.MethodDelete, "Authorization", "Bearer "+string(tokenBytes)); status != http.StatusNoContent {
+		t.Errorf("delete did not return proper status: %d", status)
+		return
+	}
+	if status := do(handlerTest, http.MethodGet, apiKeyHeader, ak.Key); status != http.StatusUnauthorized {
+		t.Errorf("API key of deleted auth did not return proper status: %d", status)
+		return
+	}
+	if _, _, err := createAuth(t, &em); err != nil {
+		return
+	}
+	if status := do(handlerTest, http.MethodGet, apiKeyHeader, ak.Key); status != http.StatusUnauthorized {
+		t.Errorf("API key of re-created auth did not return proper status: %d", status)
+		return
+	}
+
+	// An API key of an auth that does not exist is rejected.
+	other := "other@auth.com"
+	if ak, err = apiKeyCreate(other, "ci"); err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+	if status := do(handlerTest, http.MethodGet, apiKeyHeader, ak.Key); status != http.StatusUnauthorized {
+		t.Errorf("API key without an auth did not return proper status: %d", status)
+		return
+	}
+}
+
+// TestHandlerDeleteRequiresPassword verifies that with DeleteRequiresPassword a delete with a
+// missing or wrong password is rejected, and the correct password deletes the auth.
+func TestHandlerDeleteRequiresPassword(t *testing.T) {
+	testSetup()
+	config.DeleteRequiresPassword = true
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerDelete)))
+	defer testServer.Close()
+	client := http.Client{}
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	wrong := "Wr0ng!Password"
+	wrongBytes, err := json.Marshal(Credential{Password: &wrong})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	tests := []struct {
+		body   []byte
+		status int
+	}{
+		{nil, http.StatusUnprocessableEntity},
+		{wrongBytes, http.StatusUnauthorized},
+		{credBytes, http.StatusNoContent},
+	}
+	for i, tc := range tests {
+		req, err := http.NewRequest(http.MethodDelete, testServer.URL, bytes.NewBuffer(tc.body))
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("test %d did not return proper status: %d, error: %v", i, resp.StatusCode, err)
+			return
+		}
+		b, err := kvsAuth.Get(em)
+		if err != nil || (b == nil) != (tc.status == http.StatusNoContent) {
+			t.Errorf("test %d, auth deleted: %t, error: %v", i, b == nil, err)
+			return
+		}
+	}
+}
+
+// TestHandlerExportMyData verifies users get their own data, without secrets, and cannot get
+// the data of another user.
+func TestHandlerExportMyData(t *testing.T) {
+	testSetup()
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(em, []string{"viewer"}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	ak, err := apiKeyCreate(em, "ci")
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+	if _, _, err := login(t, credBytes); err != nil {
+		return
+	}
+	tokenBytes, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	other := "other@auth.com"
+	_, otherCredBytes, err := createAuth(t, &other)
+	if err != nil {
+		return
+	}
+	if _, _, err := login(t, otherCredBytes); err != nil {
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerExportMyData)))
+	defer testServer.Close()
+	req, err := http.NewRequest(http.MethodGet, testServer.URL+"?email="+other, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("export did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if bytes.Contains(b, []byte(other)) || bytes.Contains(b, []byte("PasswordHash")) ||
+		bytes.Contains(b, []byte(ak.Key)) || bytes.Contains(b, []byte("KeyHash")) {
+		t.Errorf("export contains data of another user or secrets: %s", b)
+		return
+	}
+	ud := UserData{}
+	if err := json.Unmarshal(b, &ud); err != nil {
+		t.Errorf("Unmarshal error: %v", err)
+		return
+	}
+	found := false
+	for _, s := range ud.Sessions {
+		found = found || s.TokenID == claims.TokenID
+	}
+	if ud.Email != em || len(ud.Roles) != 1 || len(ud.APIKeys) != 1 || ud.APIKeys[0].ID != ak.ID ||
+		len(ud.Sessions) != 2 || !found {
+		t.Errorf("wrong UserData: %+v", ud)
+		return
+	}
+}
+
 // TestHandlerInfo does several logins for one user and verifies the Info returned.
 func TestHandlerInfo(t *testing.T) {
 	testSetup()
@@ -245,257 +1010,1052 @@ func TestHandlerInfo(t *testing.T) {
 	if err != nil {
 		return
 	}
-	var tokenBytes []byte
-	for i := 0; i < manyLogins; i++ {
+	var tokenBytes []byte
+	for i := 0; i < manyLogins; i++ {
+
+		tokenBytes, _, err = login(t, credBytes)
+		if err != nil {
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerInfo)))
+	defer testServer.Close()
+	client := &http.Client{}
+	req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Errorf("client.Do error: %v", err)
+		return
+	}
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("reading body error: %v", err)
+		return
+	}
+	info := Info{}
+	err = json.Unmarshal(respBytes, &info)
+	if err != nil {
+		t.Errorf("unmarshal error: %v", err)
+		return
+	}
+	// fmt.Printf("%+v\n", info)
+	if info.OutstandingTokens != manyLogins {
+		t.Errorf("Wrong number of OutstandingTokens")
+	}
+}
+
+// TestHandlerLogin runs two tests, one positive test and one negative test, of the login handler.
+func TestHandlerLogin(t *testing.T) {
+	testSetup()
+
+	// Loop 0 - positive test:
+	// create credentials, PUT with no body to verify error, PUT with credentials to
+	// verify the returned body can be parsed to a token.
+	// loop 1 - negative test; login with no auth created.
+	// create then delete credentials, PUT with no body to verify error, PUT with credentials to
+	// verify the returned body can be parsed to a token.
+	for i := 0; i <= 1; i++ {
+
+		// For i==1 get credentials but delete the auth.
+		tem := fmt.Sprintf("testLogin@auth.com.%d", i)
+		_, credBytes, err := createAuth(t, &tem)
+		if err != nil {
+			t.Errorf("createAuth error:%+v", err)
+			return
+		}
+		if i == 1 {
+			if _, err := authDelete(tem); err != nil {
+				t.Errorf("authDelete error: %+v", err)
+				return
+			}
+		}
+
+		// tokenBytes, claims, err := login(t, credBytes)
+		// if err != nil {
+		// 	return
+		// }
+
+		testServer := httptest.NewServer(http.HandlerFunc(handlerLogin))
+		defer testServer.Close()
+
+		// negative test - GET not allowed.
+		resp, _ := http.Get(testServer.URL)
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("invalid method did not return proper status: %d", resp.StatusCode)
+			return
+		}
+
+		// negative test - PUT with no body.
+		client := &http.Client{}
+		req, err := http.NewRequest(http.MethodPut, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		resp, err = client.Do(req)
+		if err != nil || resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("error or Put with no body did not return proper status: %d", resp.StatusCode)
+			return
+		}
+
+		// positive test - PUT with credentials
+		expectedExpireTime := time.Now().Add(config.JWTAuthExpirationInterval).Unix()
+		req, err = http.NewRequest(http.MethodPut, testServer.URL, bytes.NewBuffer(credBytes))
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Errorf("PUT error: %v", err)
+			return
+		}
+		if i == 0 && resp.StatusCode != 200 {
+			t.Errorf("status code: %d", resp.StatusCode)
+			return
+		} else if i == 1 && resp.StatusCode != 401 {
+			t.Errorf("status code: %d", resp.StatusCode)
+			return
+		}
+
+		if i > 0 {
+			continue
+		}
+
+		tokenBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("ReadAll error: %v", err)
+		}
+		resp.Body.Close()
+		// fmt.Printf("tokenBytes :%s\n", string(tokenBytes))
+		claimsOut, err := parseClaims(string(tokenBytes))
+		expireDiff := expectedExpireTime - claimsOut.ExpiresAt
+		// fmt.Printf("expireDiff: %d\n", expireDiff)
+		if err != nil || claimsOut.Email != tem || expireDiff < -5 || expireDiff > 5 {
+			t.Errorf("token not valid and should be, error: %+v", err)
+			return
+		}
+	}
+}
+
+// TestHandlerLoginConcurrencyLimit verifies logins beyond MaxConcurrentLogins get
+// http.StatusServiceUnavailable with Retry-After, and succeed once a slot is free.
+func TestHandlerLoginConcurrencyLimit(t *testing.T) {
+	testSetup()
+	config.MaxConcurrentLogins = 2
+	Init(config, nil)
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServer.Close()
+	client := &http.Client{}
+
+	// Occupy all slots, as concurrent logins would.
+	for i := 0; i < config.MaxConcurrentLogins; i++ {
+		loginSemaphore <- struct{}{}
+	}
+	req, err := http.NewRequest(http.MethodPut, testServer.URL, bytes.NewBuffer(credBytes))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("saturated login did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+
+	// Free a slot; login succeeds and releases its slot.
+	<-loginSemaphore
+	for i := 0; i < 2; i++ {
+		if _, _, err := login(t, credBytes); err != nil {
+			return
+		}
+	}
+	if len(loginSemaphore) != config.MaxConcurrentLogins-1 {
+		t.Errorf("login did not release its slot, len: %d", len(loginSemaphore))
+	}
+}
+
+// TestHandlerLoginMustChangePassword verifies a flagged account gets a token that can only
+// change its own password, once, after which login returns normal tokens and other auth data
+// is kept.
+func TestHandlerLoginMustChangePassword(t *testing.T) {
+	testSetup()
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(em, []string{"viewer"}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	if err := AuthMustChangePasswordSet(em, true); err != nil {
+		t.Errorf("AuthMustChangePasswordSet error: %v", err)
+		return
+	}
+
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	testServerInfo := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerInfo)))
+	defer testServerInfo.Close()
+	testServerUpdate := httptest.NewServer(http.HandlerFunc(handlerFuncAuthJWTWrapperCommon(handlerCreateOrUpdate, true, PurposeChangePassword)))
+	defer testServerUpdate.Close()
+	client := &http.Client{}
+	do := func(method string, url string, token string, body []byte) (*http.Response, error) {
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return client.Do(req)
+	}
+
+	resp, err := do(http.MethodPut, testServerLogin.URL, "", credBytes)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get(passwordChangeRequiredHeader) != "true" {
+		t.Errorf("login did not return proper status: %d, headers: %v, error: %v", resp.StatusCode, resp.Header, err)
+		return
+	}
+	tokenBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	restricted := string(tokenBytes)
+
+	if resp, err = do(http.MethodGet, testServerInfo.URL, restricted, nil); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("restricted token used for info did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	other := "other@auth.com"
+	if _, _, err := createAuth(t, &other); err != nil {
+		return
+	}
+	pwd := "N3w!Passw0rd"
+	otherBytes, err := json.Marshal(Credential{Email: &other, Password: &pwd})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	if resp, err = do(http.MethodPut, testServerUpdate.URL, restricted, otherBytes); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("restricted token used for another email did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	config.CreateRequiresAuth = true
+	newEmail := "new@auth.com"
+	createBytes, err := json.Marshal(Credential{Email: &newEmail, Password: &pwd})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	if resp, err = do(http.MethodPost, testServerUpdate.URL, restricted, createBytes); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("restricted token used for create did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	config.CreateRequiresAuth = false
+	newBytes, err := json.Marshal(Credential{Email: &em, Password: &pwd})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	if resp, err = do(http.MethodPut, testServerUpdate.URL, restricted, newBytes); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("password change did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	if resp, err = do(http.MethodPut, testServerUpdate.URL, restricted, newBytes); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("restricted token reuse did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+
+	resp, err = do(http.MethodPut, testServerLogin.URL, "", newBytes)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get(passwordChangeRequiredHeader) != "" {
+		t.Errorf("login after change did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	tokenBytes, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp, err = do(http.MethodGet, testServerInfo.URL, string(tokenBytes), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("info after change did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	auth, err := authGet(em)
+	if err != nil || auth.MustChangePassword || len(auth.Roles) != 1 {
+		t.Errorf("auth after change is wrong: %+v, error: %v", auth, err)
+		return
+	}
+}
+
+// TestHandlerLoginPasswordTrim verifies a password with leading/trailing whitespace is handled
+// the same when set and at login, for each PasswordTrimMode.
+func TestHandlerLoginPasswordTrim(t *testing.T) {
+	tests := []struct {
+		mode PasswordTrimMode
+		// createOK is whether the padded password can be set.
+		createOK bool
+		// loginStatus is the login status with the padded and unpadded password.
+		loginStatus [2]int
+	}{
+		{PasswordTrimSpace, true, [2]int{http.StatusOK, http.StatusOK}},
+		{PasswordTrimReject, false, [2]int{}},
+		{PasswordTrimNone, true, [2]int{http.StatusOK, http.StatusUnauthorized}},
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServer.Close()
+	client := &http.Client{}
+	for _, tc := range tests {
+		testSetup()
+		config.PasswordTrim = tc.mode
+		// Allow internal whitespace so PasswordTrimNone can set a padded password.
+		config.PasswordValidation = []string{`^.{8,34}$`}
+		if err := passwordValidationLoad(); err != nil {
+			t.Errorf("passwordValidationLoad error: %v", err)
+			return
+		}
+
+		em := "trim@auth.com"
+		padded := " P@ss1234 "
+		cred := Credential{Email: &em, Password: &padded}
+		if err := cred.AuthCreate(); (err == nil) != tc.createOK {
+			t.Errorf("mode: %d, AuthCreate error: %v", tc.mode, err)
+			return
+		}
+		if !tc.createOK {
+			continue
+		}
+
+		for i, pwd := range []string{" P@ss1234 ", "P@ss1234"} {
+			b, err := json.Marshal(Credential{Email: &em, Password: &pwd})
+			if err != nil {
+				t.Errorf("marshal error: %v", err)
+				return
+			}
+			req, err := http.NewRequest(http.MethodPut, testServer.URL, bytes.NewBuffer(b))
+			if err != nil {
+				t.Errorf("NewRequest error: %v", err)
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil || resp.StatusCode != tc.loginStatus[i] {
+				t.Errorf("mode: %d, password: '%s', login status: %d, error: %v", tc.mode, pwd, resp.StatusCode, err)
+				return
+			}
+		}
+	}
+}
+
+func TestHandlerLogout(t *testing.T) {
+	testSetup()
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+
+	tokenBytes, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	// logout and verify token deleted from kvsToken
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLogout)))
+	defer testServer.Close()
+	client := &http.Client{}
+	// negative test with invalid method
+	req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Logout GET did not return proper status: %d", resp.StatusCode)
+		return
+	}
+	// negative test with  no credentials
+	req, err = http.NewRequest(http.MethodDelete, testServer.URL, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+	}
+	// req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	resp, err = client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Logout did not return proper status: %d", resp.StatusCode)
+		return
+	}
+	// positive test
+	req, err = http.NewRequest(http.MethodDelete, testServer.URL, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	resp, err = client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Logout did not return proper status: %d", resp.StatusCode)
+		return
+	} else if resp == nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Logout did not return proper status or was nil: %d", resp.StatusCode)
+		return
+	}
+	kvsBytes, err := kvsToken.Get(claims.tokenKVSKey())
+	if !(kvsBytes == nil && err == nil) {
+		t.Error("TokenID not deleted.")
+		return
+	}
+}
+
+// TestHandlerLogoutIdempotent verifies a second logout with the same token, using the handler
+// as registered by Init, gets http.StatusNoContent and the token stays invalid.
+func TestHandlerLogoutIdempotent(t *testing.T) {
+	testSetup()
+	mux := http.NewServeMux()
+	Init(config, mux)
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+	client := &http.Client{}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodDelete, testServer.URL+config.PathLogout+"/", nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Logout %d did not return proper status: %d, error: %v", i, resp.StatusCode, err)
+			return
+		}
+	}
+	kvsBytes, err := kvsToken.Get(claims.tokenKVSKey())
+	if !(kvsBytes == nil && err == nil) {
+		t.Error("TokenID not deleted.")
+		return
+	}
+
+	// The logged out token is still not valid for other handlers.
+	req, err := http.NewRequest(http.MethodGet, testServer.URL+config.PathInfo+"/", nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Info with logged out token did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+
+	// A token that is not validly signed is still rejected.
+	req, err = http.NewRequest(http.MethodDelete, testServer.URL+config.PathLogout+"/", nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes)+"x")
+	resp, err = client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Logout with invalid token did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+}
+
+func TestHandlerLogoutAll(t *testing.T) {
+	testSetup()
+
+	// Just put a random user in the DB
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+
+	_, _, err = login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	// Then add three tokens for the same user.
+	manyLogins := 3
+	userManyLogins := "many@login.com"
+	var tokenBytes []byte
+	for i := 0; i < manyLogins; i++ {
+		_, credBytes, err := createAuth(t, &userManyLogins)
+		if err != nil {
+			return
+		}
+
+		tokenBytes, _, err = login(t, credBytes)
+		if err != nil {
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLogoutAll)))
+	defer testServer.Close()
+	client := &http.Client{}
+	req, err := http.NewRequest(http.MethodDelete, testServer.URL, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	_, err = client.Do(req)
+	if err != nil {
+		t.Errorf("POST error: %v", err)
+		return
+	}
+
+	// This can be used to test the function directly.
+	// r, err := removeUserTokens(userManyLogins)
+	// if r != manyLogins || err != nil {
+	// 	t.Errorf("removeUserTokens returned error or wrong number of key removals")
+	// 	return
+	// }
+
+	k, err := kvsToken.Keys()
+	if len(k) != 1 || err != nil {
+		t.Errorf("There should still be one user token.")
+	}
+}
+
+// TestHandlerMagicLink tests the magic link flow; request, consume, and that the magic link
+// token cannot be reused or used for authentication.
+func TestHandlerMagicLink(t *testing.T) {
+	testSetup()
+	sent := map[string]string{}
+	config.MagicLinkEnabled = true
+	config.TokenSender = func(email string, purpose string, token string) error {
+		if purpose != PurposeMagicLink {
+			t.Errorf("wrong purpose: %s", purpose)
+		}
+		sent[email] = token
+		return nil
+	}
+
+	em, _, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	testServerRequest := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerRequestMagicLink)))
+	defer testServerRequest.Close()
+	testServerConsume := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerConsumeMagicLink)))
+	defer testServerConsume.Close()
+
+	// Unknown emails get the same status, but nothing is sent.
+	for _, e := range []string{em, "unknown@auth.com"} {
+		b, err := json.Marshal(Credential{Email: &e})
+		if err != nil {
+			t.Errorf("marshal error: %v", err)
+			return
+		}
+		resp, err := http.Post(testServerRequest.URL, "application/json", bytes.NewBuffer(b))
+		if err != nil || resp.StatusCode != http.StatusAccepted {
+			t.Errorf("magic link request did not return proper status: %d, error: %v", resp.StatusCode, err)
+			return
+		}
+	}
+	if len(sent) != 1 || sent[em] == "" {
+		t.Errorf("magic link not sent, or sent for unknown email: %+v", sent)
+		return
+	}
+
+	// The magic link token is not valid for authentication.
+	testServerInfo := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerInfo)))
+	defer testServerInfo.Close()
+	req, err := http.NewRequest(http.MethodGet, testServerInfo.URL, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+sent[em])
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("magic link token used for auth did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+
+	b, err := json.Marshal(OneTimeToken{Token: sent[em]})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	resp, err = http.Post(testServerConsume.URL, "application/json", bytes.NewBuffer(b))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("magic link consume did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	tokenBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	resp, err = client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("token from magic link did not authenticate: %d, error: %v", resp.StatusCode, err)
+		return
+	}
 
-		tokenBytes, _, err = login(t, credBytes)
-		if err != nil {
-			return
-		}
+	// Reuse is rejected.
+	resp, err = http.Post(testServerConsume.URL, "application/json", bytes.NewBuffer(b))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("magic link reuse did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
 	}
+}
 
-	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerInfo)))
-	defer testServer.Close()
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+// TestHandlerMagicLinkMustChangePassword verifies a magic link for a flagged account only
+// returns a token for changing the password.
+func TestHandlerMagicLinkMustChangePassword(t *testing.T) {
+	testSetup()
+
+	em, _, err := createAuth(t, nil)
 	if err != nil {
-		t.Errorf("NewRequest error: %v", err)
 		return
 	}
-	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
-	resp, err := client.Do(req)
-	if err != nil {
-		t.Errorf("client.Do error: %v", err)
+	if err := AuthMustChangePasswordSet(em, true); err != nil {
+		t.Errorf("AuthMustChangePasswordSet error: %v", err)
 		return
 	}
-	respBytes, err := io.ReadAll(resp.Body)
+	magicLinkToken, err := oneTimeTokenCreate(em, PurposeMagicLink, time.Minute)
 	if err != nil {
-		t.Errorf("reading body error: %v", err)
+		t.Errorf("oneTimeTokenCreate error: %v", err)
 		return
 	}
-	info := Info{}
-	err = json.Unmarshal(respBytes, &info)
+	b, err := json.Marshal(OneTimeToken{Token: magicLinkToken})
 	if err != nil {
-		t.Errorf("unmarshal error: %v", err)
+		t.Errorf("marshal error: %v", err)
 		return
 	}
-	// fmt.Printf("%+v\n", info)
-	if info.OutstandingTokens != manyLogins {
-		t.Errorf("Wrong number of OutstandingTokens")
+
+	req := httptest.NewRequest(http.MethodPost, "/magic", bytes.NewBuffer(b))
+	w := httptest.NewRecorder()
+	handlerConsumeMagicLink(w, req)
+	if w.Code != http.StatusOK || w.Header().Get(passwordChangeRequiredHeader) != "true" {
+		t.Errorf("magic link consume did not return proper status: %d, headers: %v", w.Code, w.Header())
+		return
+	}
+	if claims, err := parseClaims(w.Body.String()); err != nil || claims.Purpose != PurposeChangePassword {
+		t.Errorf("wrong claims: %+v, error: %v", claims, err)
+		return
 	}
 }
 
-// TestHandlerLogin runs two tests, one positive test and one negative test, of the login handler.
-func TestHandlerLogin(t *testing.T) {
+// TestHandlerLogoutAllBounded verifies logout-all for a user with many tokens deletes at most
+// MaxTokenDeletesPerRequest tokens per request, reports the remainder, and completes.
+func TestHandlerLogoutAllBounded(t *testing.T) {
 	testSetup()
+	config.MaxTokenDeletesPerRequest = 3
 
-	// Loop 0 - positive test:
-	// create credentials, PUT with no body to verify error, PUT with credentials to
-	// verify the returned body can be parsed to a token.
-	// loop 1 - negative test; login with no auth created.
-	// create then delete credentials, PUT with no body to verify error, PUT with credentials to
-	// verify the returned body can be parsed to a token.
-	for i := 0; i <= 1; i++ {
+	em := "bounded@auth.com"
+	otherEmail := "bounded@auth.com.other"
+	if _, err := authTokenStringCreate(otherEmail); err != nil {
+		t.Errorf("authTokenStringCreate error: %v", err)
+		return
+	}
+	tokens := 8
+	var tokenString string
+	for i := 0; i < tokens; i++ {
+		var err error
+		if tokenString, err = authTokenStringCreate(em); err != nil {
+			t.Errorf("authTokenStringCreate error: %v", err)
+			return
+		}
+	}
 
-		// For i==1 get credentials but delete the auth.
-		tem := fmt.Sprintf("testLogin@auth.com.%d", i)
-		_, credBytes, err := createAuth(t, &tem)
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLogoutAll)))
+	defer testServer.Close()
+	client := &http.Client{}
+	// 7 other tokens are deleted 3 at a time, then the token used for the requests.
+	for _, expected := range []int{5, 2, 0} {
+		req, err := http.NewRequest(http.MethodDelete, testServer.URL, nil)
 		if err != nil {
-			t.Errorf("createAuth error:%+v", err)
+			t.Errorf("NewRequest error: %v", err)
 			return
 		}
-		if i == 1 {
-			if _, err := authDelete(tem); err != nil {
-				t.Errorf("authDelete error: %+v", err)
-				return
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("DELETE error: %v", err)
+			return
+		}
+		if expected == 0 {
+			if resp.StatusCode != http.StatusNoContent {
+				t.Errorf("final logout-all did not return proper status: %d", resp.StatusCode)
 			}
+			break
+		}
+		info := Info{}
+		if resp.StatusCode != http.StatusAccepted || json.NewDecoder(resp.Body).Decode(&info) != nil ||
+			info.OutstandingTokens != expected {
+			t.Errorf("partial logout-all status: %d, info: %+v, expected: %d", resp.StatusCode, info, expected)
+			return
 		}
+		resp.Body.Close()
+	}
 
-		// tokenBytes, claims, err := login(t, credBytes)
-		// if err != nil {
-		// 	return
-		// }
+	if c, err := userTokens(em, false); c != 0 || err != nil {
+		t.Errorf("tokens remain: %d, error: %v", c, err)
+	}
+	// Emails sharing a prefix are not affected.
+	if c, err := userTokens(otherEmail, false); c != 1 || err != nil {
+		t.Errorf("other user tokens: %d, error: %v", c, err)
+	}
+}
 
-		testServer := httptest.NewServer(http.HandlerFunc(handlerLogin))
-		defer testServer.Close()
+// TestHandlerLogoutAllDryRun verifies a dry run reports the projected deletes, with and
+// without MaxTokenDeletesPerRequest, and deletes no tokens.
+func TestHandlerLogoutAllDryRun(t *testing.T) {
+	testSetup()
 
-		// negative test - GET not allowed.
-		resp, _ := http.Get(testServer.URL)
-		if resp.StatusCode != http.StatusMethodNotAllowed {
-			t.Errorf("invalid method did not return proper status: %d", resp.StatusCode)
+	em := "dryrun@auth.com"
+	tokens := 5
+	var tokenString string
+	for i := 0; i < tokens; i++ {
+		var err error
+		if tokenString, err = authTokenStringCreate(em); err != nil {
+			t.Errorf("authTokenStringCreate error: %v", err)
 			return
 		}
+	}
 
-		// negative test - PUT with no body.
-		client := &http.Client{}
-		req, err := http.NewRequest(http.MethodPut, testServer.URL, nil)
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLogoutAll)))
+	defer testServer.Close()
+	client := &http.Client{}
+	tests := []struct {
+		maxDeletes int
+		query      string
+		status     int
+		expected   DryRun
+	}{
+		{0, "?dryRun=true", http.StatusOK, DryRun{Deletes: 5, Emails: []string{em}}},
+		{3, "?dryRun=true", http.StatusOK, DryRun{Deletes: 3, Emails: []string{em}, Remaining: 2}},
+		{0, "?dryRun=maybe", http.StatusBadRequest, DryRun{}},
+	}
+	for _, tc := range tests {
+		config.MaxTokenDeletesPerRequest = tc.maxDeletes
+		req, err := http.NewRequest(http.MethodDelete, testServer.URL+tc.query, nil)
 		if err != nil {
 			t.Errorf("NewRequest error: %v", err)
 			return
 		}
-		resp, err = client.Do(req)
-		if err != nil || resp.StatusCode != http.StatusUnprocessableEntity {
-			t.Errorf("error or Put with no body did not return proper status: %d", resp.StatusCode)
-			return
-		}
-
-		// positive test - PUT with credentials
-		expectedExpireTime := time.Now().Add(config.JWTAuthExpirationInterval).Unix()
-		req, err = http.NewRequest(http.MethodPut, testServer.URL, bytes.NewBuffer(credBytes))
-		if err != nil {
-			t.Errorf("NewRequest error: %v", err)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("dry run did not return proper status: %d, error: %v", resp.StatusCode, err)
 			return
 		}
-		req.Header.Set("Content-Type", "application/json")
-		resp, err = client.Do(req)
-		if err != nil {
-			t.Errorf("PUT error: %v", err)
-			return
+		if tc.status == http.StatusOK {
+			dr := DryRun{}
+			if err := json.NewDecoder(resp.Body).Decode(&dr); err != nil || !reflect.DeepEqual(dr, tc.expected) {
+				t.Errorf("wrong DryRun: %+v, expected: %+v, error: %v", dr, tc.expected, err)
+				return
+			}
 		}
-		if i == 0 && resp.StatusCode != 200 {
-			t.Errorf("status code: %d", resp.StatusCode)
-			return
-		} else if i == 1 && resp.StatusCode != 401 {
-			t.Errorf("status code: %d", resp.StatusCode)
+		resp.Body.Close()
+		if c, err := userTokens(em, false); c != tokens || err != nil {
+			t.Errorf("dry run changed tokens: %d, error: %v", c, err)
 			return
 		}
+	}
+}
 
-		if i > 0 {
-			continue
-		}
+// TestHandlerNotFound verifies unknown paths under PathPrefix get http.StatusNotFound from
+// the package, and are audited, while the auth paths and other application paths are not
+// affected.
+func TestHandlerNotFound(t *testing.T) {
+	auditPath := auditLogSetup(t)
+	defer auditLogShutdown()
+	testSetup()
+	config.PathPrefix = "/auth"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handlerTest)
+	Init(config, mux)
 
-		tokenBytes, err := io.ReadAll(resp.Body)
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/auth/foo", http.StatusNotFound},
+		{http.MethodPost, "/auth/foo/bar", http.StatusNotFound},
+		{http.MethodGet, config.PathLogin + "/", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/other", http.StatusNoContent},
+	}
+	client := &http.Client{}
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, testServer.URL+tc.path, nil)
 		if err != nil {
-			t.Errorf("ReadAll error: %v", err)
+			t.Errorf("NewRequest error: %v", err)
+			return
 		}
-		resp.Body.Close()
-		// fmt.Printf("tokenBytes :%s\n", string(tokenBytes))
-		claimsOut, err := parseClaims(string(tokenBytes))
-		expireDiff := expectedExpireTime - claimsOut.ExpiresAt
-		// fmt.Printf("expireDiff: %d\n", expireDiff)
-		if err != nil || claimsOut.Email != tem || expireDiff < -5 || expireDiff > 5 {
-			t.Errorf("token not valid and should be, error: %+v", err)
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("%s %s did not return proper status: %d, error: %v", tc.method, tc.path, resp.StatusCode, err)
 			return
 		}
+		resp.Body.Close()
+	}
+	if !auditLogContains(t, auditPath, "/auth/foo/bar") {
+		t.Errorf("audit log does not contain the not found request")
 	}
 }
 
-func TestHandlerLogout(t *testing.T) {
+// TestHandlerPermissions verifies the permissions of overlapping roles are returned sorted and
+// de-duplicated, and roles without permissions are ignored.
+func TestHandlerPermissions(t *testing.T) {
 	testSetup()
+	config.RolePermissions = map[string][]string{
+		"auditor": {"read", "audit"},
+		"editor":  {"read", "write"},
+		"viewer":  {"read"},
+	}
 
-	_, credBytes, err := createAuth(t, nil)
+	em, credBytes, err := createAuth(t, nil)
 	if err != nil {
 		return
 	}
-
-	tokenBytes, claims, err := login(t, credBytes)
+	if err := AuthRolesSet(em, []string{"viewer", "editor", "auditor", "unmapped"}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	if err := AuthRolesSet("unknown@auth.com", []string{"viewer"}); err == nil {
+		t.Errorf("AuthRolesSet did not error for unknown email")
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
 	if err != nil {
 		return
 	}
 
-	// logout and verify token deleted from kvsToken
-	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLogout)))
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerPermissions)))
 	defer testServer.Close()
-	client := &http.Client{}
-	// negative test with invalid method
 	req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
 	if err != nil {
 		t.Errorf("NewRequest error: %v", err)
 		return
 	}
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	client := &http.Client{}
 	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusUnauthorized {
-		t.Errorf("Logout GET did not return proper status: %d", resp.StatusCode)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("permissions did not return proper status: %d, error: %v", resp.StatusCode, err)
 		return
 	}
-	// negative test with  no credentials
-	req, err = http.NewRequest(http.MethodDelete, testServer.URL, nil)
-	if err != nil {
-		t.Errorf("NewRequest error: %v", err)
+	permissions := []string{}
+	if err := json.NewDecoder(resp.Body).Decode(&permissions); err != nil {
+		t.Errorf("Decode error: %v", err)
+		return
 	}
-	// req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
-	resp, err = client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusUnauthorized {
-		t.Errorf("Logout did not return proper status: %d", resp.StatusCode)
+	resp.Body.Close()
+	if fmt.Sprint(permissions) != "[audit read write]" {
+		t.Errorf("wrong permissions: %v", permissions)
 		return
 	}
-	// positive test
-	req, err = http.NewRequest(http.MethodDelete, testServer.URL, nil)
+}
+
+// TestHandlerRequireJSONContentType verifies that with RequireJSONContentType the credential
+// endpoints accept application/json, and reject other or missing content types.
+func TestHandlerRequireJSONContentType(t *testing.T) {
+	testSetup()
+	config.RequireJSONContentType = true
+
+	testServerCreate := httptest.NewServer(http.HandlerFunc(handlerCreateOrUpdate))
+	defer testServerCreate.Close()
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+
+	em := "content-type@auth.com"
+	pwd := "P@ss!234"
+	credBytes, err := json.Marshal(Credential{Email: &em, Password: &pwd})
 	if err != nil {
-		t.Errorf("NewRequest error: %v", err)
+		t.Errorf("marshal error: %v", err)
 		return
 	}
-	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
-	resp, err = client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusNoContent {
-		t.Errorf("Logout did not return proper status: %d", resp.StatusCode)
-		return
-	} else if resp == nil || resp.StatusCode != http.StatusNoContent {
-		t.Errorf("Logout did not return proper status or was nil: %d", resp.StatusCode)
-		return
+	client := &http.Client{}
+	tests := []struct {
+		method      string
+		url         string
+		contentType string
+		status      int
+	}{
+		{http.MethodPost, testServerCreate.URL, "", http.StatusUnsupportedMediaType},
+		{http.MethodPost, testServerCreate.URL, "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{http.MethodPost, testServerCreate.URL, "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPost, testServerCreate.URL, "application/json; charset=utf-8", http.StatusCreated},
+		{http.MethodPut, testServerLogin.URL, "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPut, testServerLogin.URL, "application/json", http.StatusOK},
 	}
-	kvsBytes, err := kvsToken.Get(claims.tokenKVSKey())
-	if !(kvsBytes == nil && err == nil) {
-		t.Error("TokenID not deleted.")
-		return
+	for i, tc := range tests {
+		req, err := http.NewRequest(tc.method, tc.url, bytes.NewBuffer(credBytes))
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("test %d did not return proper status: %d, error: %v", i, resp.StatusCode, err)
+			return
+		}
 	}
 }
 
-func TestHandlerLogoutAll(t *testing.T) {
+// TestHandlerFuncAuthJWTWrapperTokenInvalidation verifies logged out tokens are rejected with
+// EnableTokenInvalidation true, and accepted with a Warning with it false, and that a
+// configuration requiring token invalidation without a DataSourcePath is rejected.
+func TestHandlerFuncAuthJWTWrapperTokenInvalidation(t *testing.T) {
 	testSetup()
+	config.WarningHeaders = true
 
-	// Just put a random user in the DB
 	_, credBytes, err := createAuth(t, nil)
 	if err != nil {
 		return
 	}
-
-	_, _, err = login(t, credBytes)
+	tokenBytes, claims, err := login(t, credBytes)
 	if err != nil {
 		return
 	}
+	if _, err := kvsToken.Delete(claims.tokenKVSKey()); err != nil {
+		t.Errorf("Delete error: %v", err)
+		return
+	}
 
-	// Then add three tokens for the same user.
-	manyLogins := 3
-	userManyLogins := "many@login.com"
-	var tokenBytes []byte
-	for i := 0; i < manyLogins; i++ {
-		_, credBytes, err := createAuth(t, &userManyLogins)
-		if err != nil {
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	client := &http.Client{}
+	enabled, disabled := true, false
+	tests := []struct {
+		enable  *bool
+		status  int
+		warning string
+	}{
+		{&enabled, http.StatusUnauthorized, ""},
+		{&disabled, http.StatusNoContent, warningNoTokenInvalidation},
+		{nil, http.StatusUnauthorized, ""},
+	}
+	for i, tc := range tests {
+		config.EnableTokenInvalidation = tc.enable
+		if err := tokenInvalidationConfigLoad(); err != nil {
+			t.Errorf("test %d, tokenInvalidationConfigLoad error: %v", i, err)
 			return
 		}
-
-		tokenBytes, _, err = login(t, credBytes)
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
 		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != tc.status || resp.Header.Get("Warning") != tc.warning {
+			t.Errorf("test %d, wrong status: %d, headers: %v, error: %v", i, resp.StatusCode, resp.Header, err)
 			return
 		}
 	}
 
-	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLogoutAll)))
-	defer testServer.Close()
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodDelete, testServer.URL, nil)
+	config.EnableTokenInvalidation = &enabled
+	config.DataSourcePath = ""
+	if err := tokenInvalidationConfigLoad(); err == nil {
+		t.Errorf("EnableTokenInvalidation without DataSourcePath did not return an error")
+	}
+	config.EnableTokenInvalidation = &disabled
+	if err := tokenInvalidationConfigLoad(); err != nil {
+		t.Errorf("explicit disabled without DataSourcePath returned an error: %v", err)
+	}
+}
+
+// TestHandlerWarningHeaders verifies the Warning header is only added in discouraged modes,
+// and only when WarningHeaders is set.
+func TestHandlerWarningHeaders(t *testing.T) {
+	testSetup()
+
+	_, credBytes, err := createAuth(t, nil)
 	if err != nil {
-		t.Errorf("NewRequest error: %v", err)
 		return
 	}
-	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
-	_, err = client.Do(req)
+	tokenBytes, _, err := login(t, credBytes)
 	if err != nil {
-		t.Errorf("POST error: %v", err)
 		return
 	}
 
-	// This can be used to test the function directly.
-	// r, err := removeUserTokens(userManyLogins)
-	// if r != manyLogins || err != nil {
-	// 	t.Errorf("removeUserTokens returned error or wrong number of key removals")
-	// 	return
-	// }
+	testServerNoAuth := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerTest)))
+	defer testServerNoAuth.Close()
+	testServerNoAuthInternal := httptest.NewServer(http.HandlerFunc(handlerFuncNoAuthWrapperCommon(handlerTest, false)))
+	defer testServerNoAuthInternal.Close()
+	testServerAuth := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServerAuth.Close()
+	client := &http.Client{}
+	warning := func(url string) (string, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusNoContent {
+			return "", fmt.Errorf("status: %d", resp.StatusCode)
+		}
+		return resp.Header.Get("Warning"), nil
+	}
 
-	k, err := kvsToken.Keys()
-	if len(k) != 1 || err != nil {
-		t.Errorf("There should still be one user token.")
+	tests := []struct {
+		warningHeaders bool
+		dataSourcePath string
+		url            string
+		warning        string
+	}{
+		{false, dataSourcePath, testServerNoAuth.URL, ""},
+		{false, "", testServerAuth.URL, ""},
+		{true, dataSourcePath, testServerNoAuth.URL, warningNoAuth},
+		{true, dataSourcePath, testServerNoAuthInternal.URL, ""},
+		{true, dataSourcePath, testServerAuth.URL, ""},
+		{true, "", testServerAuth.URL, warningNoTokenInvalidation},
+	}
+	for i, tc := range tests {
+		config.WarningHeaders = tc.warningHeaders
+		config.DataSourcePath = tc.dataSourcePath
+		w, err := warning(tc.url)
+		if err != nil || w != tc.warning {
+			t.Errorf("test %d, wrong Warning: %s, error: %v", i, w, err)
+			return
+		}
 	}
 }
 
@@ -565,6 +2125,36 @@ func TestHandlerRefresh(t *testing.T) {
 	}
 }
 
+// auditLogContains returns true if the audit log at auditPath contains substr.
+func auditLogContains(t *testing.T, auditPath string, substr string) bool {
+	b, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Errorf("ReadFile error: %v", err)
+		return false
+	}
+	return strings.Contains(string(b), substr)
+}
+
+// auditLogSetup creates the audit logger used by the tests and returns the path of
+// the file being written. Call before testSetup, as logh.Map is not safe to write while
+// the go routine from removeExpiredTokens is reading it.
+func auditLogSetup(t *testing.T) string {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	if err := logh.New("auth.audit", auditPath, logh.DefaultLevels, logh.Audit, logh.DefaultFlags, 100, 1e6); err != nil {
+		t.Fatalf("logh.New error: %v", err)
+	}
+	// logh appends the rotation to the file name.
+	return auditPath + ".0"
+}
+
+// auditLogShutdown shuts down and removes the logger created by auditLogSetup.
+func auditLogShutdown() {
+	if err := logh.Map["auth.audit"].Shutdown(); err != nil {
+		fmt.Printf("Shutdown error: %v\n", err)
+	}
+	delete(logh.Map, "auth.audit")
+}
+
 func handlerTest(w http.ResponseWriter, r *http.Request) {
 	// fmt.Println("handlerTest was called!")
 	// Return with something other than default (200), so it is clear the handler was processed
@@ -0,0 +1,14 @@
+package authjwt
+
+// idleExpiration returns the expiration stored in kvsToken for a token with expiration exp,
+// issued or used now; the earlier of exp and now plus config.IdleTimeout. exp when
+// IdleTimeout is zero.
+func idleExpiration(exp int64) int64 {
+	if config.IdleTimeout <= 0 {
+		return exp
+	}
+	if idle := timeNow().Add(config.IdleTimeout).Unix(); idle < exp {
+		return idle
+	}
+	return exp
+}
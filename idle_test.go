@@ -0,0 +1,77 @@
+package authjwt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestIdleTimeout verifies each request extends the expiration of a token per IdleTimeout,
+// and a token not used for IdleTimeout is rejected.
+func TestIdleTimeout(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+	config.IdleTimeout = time.Minute
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	request := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		rr := httptest.NewRecorder()
+		HandlerFuncAuthJWTWrapper(handlerTest)(rr, req)
+		return rr.Code
+	}
+
+	tests := []struct {
+		elapsed time.Duration
+		status  int
+	}{
+		{30 * time.Second, http.StatusNoContent},
+		// Past IdleTimeout since login, but within IdleTimeout of the last request.
+		{80 * time.Second, http.StatusNoContent},
+		{140 * time.Second, http.StatusUnauthorized},
+		// The idle token was removed from the token store.
+		{141 * time.Second, http.StatusUnauthorized},
+	}
+	start := now
+	for i, tc := range tests {
+		now = start.Add(tc.elapsed)
+		if status := request(); status != tc.status {
+			t.Errorf("test %d, request did not return proper status: %d, expected: %d", i, status, tc.status)
+			return
+		}
+	}
+}
+
+// TestIdleExpiration verifies idleExpiration does not extend past the token expiration.
+func TestIdleExpiration(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+
+	exp := now.Add(90 * time.Second).Unix()
+	if got := idleExpiration(exp); got != exp {
+		t.Errorf("idleExpiration without IdleTimeout: %d, expected: %d", got, exp)
+		return
+	}
+	config.IdleTimeout = time.Minute
+	if got, expected := idleExpiration(exp), now.Add(time.Minute).Unix(); got != expected {
+		t.Errorf("idleExpiration: %d, expected: %d", got, expected)
+		return
+	}
+	now = now.Add(time.Minute)
+	if got := idleExpiration(exp); got != exp {
+		t.Errorf("idleExpiration past exp: %d, expected: %d", got, exp)
+		return
+	}
+}
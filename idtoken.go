@@ -0,0 +1,62 @@
+package authjwt
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// Audiences of the tokens returned from login; access tokens are for API calls and ID tokens
+// are for client consumption.
+const (
+	AudienceAccess = "access"
+	AudienceID     = "id"
+)
+
+const (
+	// PurposeIDToken is the Purpose of ID tokens, so they are rejected for authentication.
+	PurposeIDToken = "id"
+)
+
+// IDClaims are the claims of an ID token, issued at login when Config.IssueIDToken is true.
+type IDClaims struct {
+	jwt.StandardClaims
+	Email string
+	// Purpose is PurposeIDToken.
+	Purpose string
+	Roles   []string `json:",omitempty"`
+}
+
+// LoginTokens is returned from PathLogin when Config.IssueIDToken or Config.IssueRefreshToken
+// is true, and from PathToken.
+type LoginTokens struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// RememberMeToken is returned from PathLogin with Credential.RememberMe; see
+	// PurposeRememberMe.
+	RememberMeToken string `json:"remember_me_token,omitempty"`
+}
+
+// idTokenStringCreate creates a signed ID token with the profile claims of auth, expiring
+// with the access token accessToken. ID tokens are not stored; they cannot be used for
+// authentication, so there is nothing to log out.
+func idTokenStringCreate(auth authentication, accessToken string) (string, error) {
+	access, err := parseClaims(accessToken)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("idTokenStringCreate error", err)
+	}
+	claims := IDClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  AudienceID,
+			ExpiresAt: access.ExpiresAt,
+			IssuedAt:  timeNow().Unix(),
+			Issuer:    tokenIssuer(),
+			Subject:   access.Email,
+		},
+		Email:   access.Email,
+		Purpose: PurposeIDToken,
+		Roles:   authRoles(auth),
+	}
+	// ID tokens are for client consumption, so they are never encrypted.
+	return tokenSignUnencrypted(claims)
+}
@@ -0,0 +1,86 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TestHandlerLoginIDToken verifies login returns an access token and an ID token when
+// IssueIDToken is set, both verify with the expected audiences, and only the access token
+// can be used for authentication.
+func TestHandlerLoginIDToken(t *testing.T) {
+	testSetup()
+	config.IssueIDToken = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(em, []string{"auditor"}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("login did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	lt := LoginTokens{}
+	if err := json.NewDecoder(resp.Body).Decode(&lt); err != nil {
+		t.Errorf("Decode error: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	access, err := parseClaims(lt.AccessToken)
+	if err != nil || access.Email != em || !access.VerifyAudience(AudienceAccess, true) {
+		t.Errorf("wrong access token claims: %+v, error: %v", access, err)
+		return
+	}
+	id := &IDClaims{}
+	token, err := jwt.ParseWithClaims(lt.IDToken, id, verificationKey)
+	if err != nil || !token.Valid {
+		t.Errorf("ID token not valid, error: %v", err)
+		return
+	}
+	if !id.VerifyAudience(AudienceID, true) || id.VerifyAudience(AudienceAccess, true) ||
+		id.Email != em || id.Subject != em || len(id.Roles) != 1 || id.Roles[0] != "auditor" ||
+		id.ExpiresAt != access.ExpiresAt {
+		t.Errorf("wrong ID token claims: %+v", id)
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	for _, tc := range []struct {
+		token  string
+		status int
+	}{
+		{lt.AccessToken, http.StatusNoContent},
+		{lt.IDToken, http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("request did not return proper status: %d, error: %v", resp.StatusCode, err)
+			return
+		}
+	}
+}
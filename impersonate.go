@@ -0,0 +1,78 @@
+package authjwt
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+)
+
+const (
+	defaultImpersonationExpirationInterval = 15 * time.Minute
+)
+
+// handlerImpersonate returns a token for the user with the Email in the Credential body, with
+// the calling admin as the Actor. The token is valid for config.ImpersonationExpirationInterval,
+// is in kvsToken so it can be logged out or checked like any other token, and requests using
+// it are audited with both identities.
+func handlerImpersonate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get the claims, in order to verify the caller is an admin.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	if !adminAuthorized(w, r, claims) {
+		return
+	}
+
+	em := ""
+	cred := Credential{Email: &em}
+	if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+		lpf(logh.Error, "impersonate error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	em = emailNormalize(em)
+	auth, err := authGet(em)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	tokenString, err := authTokenStringCreateCommon(r, em, tokenOptions{actor: claims.Email}, config.ImpersonationExpirationInterval)
+	if err != nil {
+		lpf(logh.Error, "authTokenStringCreateCommon error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("impersonation token for email: %s issued to: %s", auditEmail(em), auditEmail(claims.Email))
+	}
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write([]byte(tokenString)); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// impersonationRejected returns true, and writes http.StatusForbidden, for impersonation
+// tokens. Used by handlers that would extend, take over, or delete the impersonated account;
+// admin requests, refresh, API key creation, credential changes, and delete.
+func impersonationRejected(w http.ResponseWriter, claims *CustomClaims) bool {
+	if claims.Actor == "" {
+		return false
+	}
+	w.WriteHeader(http.StatusForbidden)
+	return true
+}
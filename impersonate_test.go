@@ -0,0 +1,114 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHandlerImpersonate verifies an admin gets a token for another user carrying the admin as
+// the Actor, requests with the token are audited with both identities, the token cannot be
+// refreshed or used for admin requests, and logout revokes it.
+func TestHandlerImpersonate(t *testing.T) {
+	auditPath := auditLogSetup(t)
+	defer auditLogShutdown()
+	testSetup()
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	userToken, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	adminEmail := "admin@auth.com"
+	_, adminCredBytes, err := createAuth(t, &adminEmail)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(adminEmail, []string{RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	adminToken, _, err := login(t, adminCredBytes)
+	if err != nil {
+		return
+	}
+
+	testServerImpersonate := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerImpersonate)))
+	defer testServerImpersonate.Close()
+	testServerTest := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServerTest.Close()
+	testServerRefresh := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerRefresh)))
+	defer testServerRefresh.Close()
+	testServerLogout := httptest.NewServer(http.HandlerFunc(handlerFuncAuthJWTWrapperCommon(handlerLogout, false, "")))
+	defer testServerLogout.Close()
+	client := &http.Client{}
+	do := func(method string, url string, token []byte, email string) (*http.Response, error) {
+		b, err := json.Marshal(Credential{Email: &email})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		return client.Do(req)
+	}
+
+	if resp, err := do(http.MethodPost, testServerImpersonate.URL, userToken, adminEmail); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non admin impersonate did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	if resp, err := do(http.MethodPost, testServerImpersonate.URL, adminToken, "unknown@auth.com"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("impersonate unknown user did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	resp, err := do(http.MethodPost, testServerImpersonate.URL, adminToken, em)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("impersonate did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	token, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	claims, err := parseClaims(string(token))
+	if err != nil || claims.Email != em || claims.Actor != adminEmail {
+		t.Errorf("wrong impersonation claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	if resp, err := do(http.MethodPost, testServerTest.URL, token, ""); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("impersonation token did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	if !auditLogContains(t, auditPath, "auth: "+em+" (act: "+adminEmail+")|") {
+		t.Errorf("audit log does not contain both identities")
+		return
+	}
+	if resp, err := do(http.MethodPost, testServerRefresh.URL, token, ""); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("impersonation token refresh did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	if resp, err := do(http.MethodPost, testServerImpersonate.URL, token, adminEmail); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("impersonation token impersonate did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+
+	if resp, err := do(http.MethodDelete, testServerLogout.URL, token, ""); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("impersonation token logout did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	if resp, err := do(http.MethodPost, testServerTest.URL, token, ""); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked impersonation token did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+}
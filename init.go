@@ -1,6 +1,7 @@
 package authjwt
 
 import (
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -13,23 +14,77 @@ import (
 	"github.com/paulfdunn/go-helper/osh/runtimeh"
 )
 
-// initializeKVS initializes KVS kvsAuth and kvsToken; these are the key
-// value stores (KVS) for authentication and tokens.
+// initializeKVS initializes KVS kvsAPIKey, kvsAudit, kvsAuth, kvsOneTime, kvsToken, and
+// kvsTokenVersion; these are the key value stores (KVS) for API keys, audit records,
+// authentication, single use tokens, tokens, and the global token version.
 func initializeKVS(dataSourcePath string) {
 	var err error
+	if kvsAPIKey, err = kvs.New(dataSourcePath, kvsAPIKeyTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsAudit, err = kvs.New(dataSourcePath, kvsAuditTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
+	}
+
 	if kvsAuth, err = kvs.New(dataSourcePath, kvsAuthTable); err != nil {
 		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
 	}
 
+	if kvsContactEmail, err = kvs.New(dataSourcePath, kvsContactEmailTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsLockout, err = kvs.New(dataSourcePath, kvsLockoutTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsOneTime, err = kvs.New(dataSourcePath, kvsOneTimeTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsPhone, err = kvs.New(dataSourcePath, kvsPhoneTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsSMSCode, err = kvs.New(dataSourcePath, kvsSMSCodeTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
+	}
+
 	if kvsToken, err = kvs.New(dataSourcePath, kvsTokenTable); err != nil {
 		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
 	}
+
+	if kvsTokenVersion, err = kvs.New(dataSourcePath, kvsTokenVersionTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
+	}
+}
+
+// kvsClose closes the KVS opened by initializeKVS, if any, and resets them so they are not
+// used after being closed. The go routine from removeExpiredTokens is waited for first.
+func kvsClose() {
+	removeExpiredTokensRunning.Wait()
+	if kvsAuth == (kvs.KVS{}) {
+		return
+	}
+	stores := []kvs.KVS{kvsAPIKey, kvsAudit, kvsAuth, kvsContactEmail, kvsLockout, kvsOneTime, kvsPhone, kvsSMSCode, kvsTokenVersion}
+	if kt, ok := kvsToken.(kvs.KVS); ok {
+		stores = append(stores, kt)
+	}
+	for _, store := range stores {
+		if err := store.Close(); err != nil {
+			lpf(logh.Error, "kvs Close error:%v", err)
+		}
+	}
+	kvsAPIKey, kvsAudit, kvsAuth, kvsContactEmail, kvsLockout, kvsOneTime, kvsPhone, kvsSMSCode, kvsTokenVersion = kvs.KVS{}, kvs.KVS{}, kvs.KVS{}, kvs.KVS{}, kvs.KVS{}, kvs.KVS{}, kvs.KVS{}, kvs.KVS{}, kvs.KVS{}
+	kvsToken = kvs.KVS{}
 }
 
-// passwordValidationLoad loads the default password validation rules.
+// passwordValidationLoad loads the password validation rules; config.PasswordValidation, or
+// the default rules when neither it nor config.PasswordPolicy is set.
 func passwordValidationLoad() error {
 	pwv := defaultPasswordValidation
-	if config.PasswordValidation != nil {
+	if config.PasswordValidation != nil || config.PasswordPolicy != nil {
 		pwv = config.PasswordValidation
 	}
 
@@ -45,7 +100,8 @@ func passwordValidationLoad() error {
 	return nil
 }
 
-// loadKeys loads the key for signing tokens.
+// loadKeys loads the key for signing tokens; keys that are not for config.JWTSigningAlgorithm
+// are fatal.
 func loadKeys(config Config) {
 	var privKeyBytes, pubKeyBytes []byte
 	var err error
@@ -61,24 +117,48 @@ func loadKeys(config Config) {
 		if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
 			log.Fatalf("x509.ParsePKCS1PrivateKey error: %+v", err)
 		}
-		if k, ok := key.(*rsa.PrivateKey); ok {
+		if err := signingKeyValidate(config.JWTSigningAlgorithm, key); err != nil {
+			log.Fatalf("fatal: %s private key from path: %s does not match JWTSigningAlgorithm, error: %v",
+				runtimeh.SourceInfo(), config.JWTPrivateKeyPath, err)
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
 			rsaPrivateKey = k
+		case ed25519.PrivateKey:
+			ed25519PrivateKey = k
 		}
 	} else {
 		lp(logh.Info, "No JWTPrivateKeyPath provided.")
 	}
 
+	// In consumer mode the public keys are fetched from RemoteJWKSURL.
+	if config.JWTPublicKeyPath == "" && config.RemoteJWKSURL != "" {
+		lp(logh.Info, "No JWTPublicKeyPath provided, using RemoteJWKSURL.")
+		return
+	}
+
 	if pubKeyBytes, err = os.ReadFile(config.JWTPublicKeyPath); err != nil {
 		log.Fatalf("fatal: %s could not load public key from path: %s, error: %v",
 			runtimeh.SourceInfo(), config.JWTPublicKeyPath, err)
 	}
 
-	block, _ := pem.Decode(pubKeyBytes)
-	var key any
-	if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
-		log.Fatalf("x509.ParsePKCS1PublicKey error: %+v", err)
+	key, err := publicKeyParse(pubKeyBytes)
+	if err != nil {
+		log.Fatalf("fatal: %s could not parse public key from path: %s, error: %v",
+			runtimeh.SourceInfo(), config.JWTPublicKeyPath, err)
 	}
-	if k, ok := key.(*rsa.PublicKey); ok {
+	if err := signingKeyValidate(config.JWTSigningAlgorithm, key); err != nil {
+		log.Fatalf("fatal: %s public key from path: %s does not match JWTSigningAlgorithm, error: %v",
+			runtimeh.SourceInfo(), config.JWTPublicKeyPath, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
 		rsaPublicKey = k
+	case ed25519.PublicKey:
+		ed25519PublicKey = k
+	}
+
+	if err := previousKeysLoad(config); err != nil {
+		log.Fatalf("fatal: %s could not load previous public keys, error: %v", runtimeh.SourceInfo(), err)
 	}
 }
@@ -0,0 +1,44 @@
+package authjwt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// TokenRevoke revokes the token with TokenID (jti) jti, as logout does for the token. found is
+// false if there is no such token in the token store; I.E. already revoked or expired.
+func TokenRevoke(jti string) (found bool, err error) {
+	if jti == "" {
+		return false, fmt.Errorf("%s no TokenID", runtimeh.SourceInfo())
+	}
+	keys, err := kvsToken.Keys()
+	if err != nil {
+		return false, runtimeh.SourceInfoError("kvsToken.Keys error", err)
+	}
+	for _, key := range keys {
+		// Emails may contain the separator; TokenIDs do not.
+		if !strings.HasSuffix(key, "|"+jti) {
+			continue
+		}
+		if _, err := tokenDelete(kvsToken, key); err != nil {
+			return false, runtimeh.SourceInfoError("kvsToken.Delete error", err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// tokenIDUnused returns an error if store already has a token with key; a duplicate TokenID
+// (jti) is never issued.
+func tokenIDUnused(store tokenStore, key string) error {
+	b, err := store.Get(key)
+	if err != nil {
+		return runtimeh.SourceInfoError("token store Get error", err)
+	}
+	if b != nil {
+		return fmt.Errorf("%s duplicate TokenID", runtimeh.SourceInfo())
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package authjwt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestTokenRevoke verifies tokens have a jti equal to the TokenID, a token revoked by jti is
+// rejected while other tokens of the auth are not, and duplicate TokenIDs are detected.
+func TestTokenRevoke(t *testing.T) {
+	testSetup()
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	revokedBytes, revoked, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	otherBytes, other, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if revoked.Id == "" || revoked.Id != revoked.TokenID || revoked.Id == other.Id {
+		t.Errorf("wrong jti: %s, TokenID: %s, other jti: %s", revoked.Id, revoked.TokenID, other.Id)
+		return
+	}
+
+	if found, err := TokenRevoke(revoked.Id); err != nil || !found {
+		t.Errorf("TokenRevoke found: %t, error: %v", found, err)
+		return
+	}
+	if found, err := TokenRevoke(revoked.Id); err != nil || found {
+		t.Errorf("TokenRevoke of revoked token found: %t, error: %v", found, err)
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	for _, tc := range []struct {
+		tokenBytes []byte
+		status     int
+	}{
+		{revokedBytes, http.StatusUnauthorized},
+		{otherBytes, http.StatusNoContent},
+	} {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tc.tokenBytes))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("request did not return proper status: %d, error: %v", resp.StatusCode, err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	if err := tokenIDUnused(kvsToken, other.tokenKVSKey()); err == nil {
+		t.Errorf("duplicate TokenID not detected")
+		return
+	}
+	if err := tokenIDUnused(kvsToken, revoked.tokenKVSKey()); err != nil {
+		t.Errorf("tokenIDUnused error for revoked TokenID: %v", err)
+		return
+	}
+}
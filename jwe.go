@@ -0,0 +1,116 @@
+package authjwt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// jweHeader is the protected header of the tokens encrypted with config.TokenEncryptionKey;
+// direct encryption with A256GCM, RFC 7516, of a signed JWT.
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Cty string `json:"cty"`
+	Enc string `json:"enc"`
+}
+
+const (
+	jweAlgorithm  = "dir"
+	jweEncryption = "A256GCM"
+	// tokenEncryptionKeyLength is the length in bytes of config.TokenEncryptionKey.
+	tokenEncryptionKeyLength = 32
+)
+
+// tokenEncryptionLoad returns an error if config.TokenEncryptionKey is set and invalid.
+func tokenEncryptionLoad() error {
+	if len(config.TokenEncryptionKey) == 0 {
+		return nil
+	}
+	if len(config.TokenEncryptionKey) != tokenEncryptionKeyLength {
+		return fmt.Errorf("%s TokenEncryptionKey length %d is not %d", runtimeh.SourceInfo(),
+			len(config.TokenEncryptionKey), tokenEncryptionKeyLength)
+	}
+	if config.TokenFormat != TokenFormatJWT && config.TokenFormat != TokenFormatPASETOV4Local {
+		return fmt.Errorf("%s TokenEncryptionKey requires TokenFormat %s or %s", runtimeh.SourceInfo(),
+			TokenFormatJWT, TokenFormatPASETOV4Local)
+	}
+	return nil
+}
+
+// jweAEAD returns the AEAD for config.TokenEncryptionKey.
+func jweAEAD() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(config.TokenEncryptionKey)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("aes.NewCipher error", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("cipher.NewGCM error", err)
+	}
+	return aead, nil
+}
+
+// jweDecrypt returns the signed JWT encrypted in the compact JWE tokenString.
+func jweDecrypt(tokenString string) (string, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 5 {
+		return "", fmt.Errorf("%s token is not an encrypted token", runtimeh.SourceInfo())
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", runtimeh.SourceInfoError("decoding header", err)
+	}
+	h := jweHeader{}
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return "", runtimeh.SourceInfoError("unmarshal header", err)
+	}
+	if h.Alg != jweAlgorithm || h.Enc != jweEncryption || parts[1] != "" {
+		return "", fmt.Errorf("%s unsupported alg: %s, or enc: %s", runtimeh.SourceInfo(), h.Alg, h.Enc)
+	}
+	var iv, ciphertext, tag []byte
+	for i, b := range []*[]byte{&iv, &ciphertext, &tag} {
+		if *b, err = base64.RawURLEncoding.DecodeString(parts[i+2]); err != nil {
+			return "", runtimeh.SourceInfoError("decoding token", err)
+		}
+	}
+	aead, err := jweAEAD()
+	if err != nil {
+		return "", err
+	}
+	if len(iv) != aead.NonceSize() || len(tag) != aead.Overhead() {
+		return "", fmt.Errorf("%s invalid iv or tag", runtimeh.SourceInfo())
+	}
+	plaintext, err := aead.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", runtimeh.SourceInfoError("decrypting token", err)
+	}
+	return string(plaintext), nil
+}
+
+// jweEncrypt returns signed, a signed JWT, as a compact JWE encrypted with
+// config.TokenEncryptionKey.
+func jweEncrypt(signed string) (string, error) {
+	hb, err := json.Marshal(jweHeader{Alg: jweAlgorithm, Cty: "JWT", Enc: jweEncryption})
+	if err != nil {
+		return "", runtimeh.SourceInfoError("marshal header", err)
+	}
+	header := base64.RawURLEncoding.EncodeToString(hb)
+	aead, err := jweAEAD()
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", runtimeh.SourceInfoError("rand.Read error", err)
+	}
+	sealed := aead.Seal(nil, iv, []byte(signed), []byte(header))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+	return strings.Join([]string{header, "", base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext), base64.RawURLEncoding.EncodeToString(tag)}, "."), nil
+}
@@ -0,0 +1,88 @@
+package authjwt
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestTokenEncryption verifies tokens are encrypted with TokenEncryptionKey and authenticate,
+// and unencrypted tokens, tampered tokens, tokens encrypted with another key, and invalid
+// configurations are rejected.
+func TestTokenEncryption(t *testing.T) {
+	testSetup()
+	config.TokenEncryptionKey = bytes.Repeat([]byte{1}, tokenEncryptionKeyLength)
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	parts := strings.Split(string(tokenBytes), ".")
+	if len(parts) != 5 || claims.Email != em {
+		t.Errorf("token is not encrypted: %s, claims: %+v", tokenBytes, claims)
+		return
+	}
+	signed, err := jweDecrypt(string(tokenBytes))
+	if err != nil || strings.Count(signed, ".") != 2 || strings.Contains(string(tokenBytes), strings.Split(signed, ".")[1]) {
+		t.Errorf("jweDecrypt: %s, error: %v", signed, err)
+		return
+	}
+	plain, err := tokenSignUnencrypted(claims)
+	if err != nil {
+		t.Errorf("tokenSignUnencrypted error: %v", err)
+		return
+	}
+	ciphertext := []byte(parts[3])
+	ciphertext[0] ^= 1
+	tampered := strings.Join([]string{parts[0], parts[1], parts[2], string(ciphertext), parts[4]}, ".")
+	config.TokenEncryptionKey = bytes.Repeat([]byte{2}, tokenEncryptionKeyLength)
+	otherKey, err := tokenSign(claims)
+	config.TokenEncryptionKey = bytes.Repeat([]byte{1}, tokenEncryptionKeyLength)
+	if err != nil {
+		t.Errorf("tokenSign error: %v", err)
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	for i, tc := range []struct {
+		token  string
+		status int
+	}{
+		{string(tokenBytes), http.StatusNoContent},
+		{plain, http.StatusUnauthorized},
+		{tampered, http.StatusUnauthorized},
+		{otherKey, http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("test %d, request did not return proper status: %d, error: %v", i, resp.StatusCode, err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	config.TokenEncryptionKey = []byte("short")
+	if err := tokenEncryptionLoad(); err == nil {
+		t.Errorf("tokenEncryptionLoad did not error for short key")
+		return
+	}
+	config.TokenEncryptionKey = bytes.Repeat([]byte{1}, tokenEncryptionKeyLength)
+	config.TokenFormat = TokenFormatPASETOV4Public
+	if err := tokenEncryptionLoad(); err == nil {
+		t.Errorf("tokenEncryptionLoad did not error for PASETO")
+		return
+	}
+}
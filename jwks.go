@@ -0,0 +1,346 @@
+package authjwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// jwk is a JSON Web Key, RFC 7517. Only the members used by this package are included.
+type jwk struct {
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	E   string `json:"e,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	Use string `json:"use,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwkSet is a JWK Set, RFC 7517.
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// remoteJWKSCache caches the keys fetched from config.RemoteJWKSURL, by kid. mu is not held
+// during fetches; fetching is not nil while a fetch is in progress, and is closed when it
+// completes, so there is one fetch at a time and requests with cached keys are not blocked.
+type remoteJWKSCache struct {
+	mu       sync.Mutex
+	err      error
+	fetched  time.Time
+	fetching chan struct{}
+	keys     map[string]interface{}
+}
+
+const (
+	defaultRemoteJWKSRefreshInterval = time.Hour
+	remoteJWKSFetchTimeout           = 10 * time.Second
+	// remoteJWKSBodyLimit bounds the size of a JWK Set read from config.RemoteJWKSURL.
+	remoteJWKSBodyLimit = 1 << 20
+)
+
+var (
+	remoteJWKS remoteJWKSCache
+
+	// remoteJWKSRefetchMinInterval is the minimum time between fetches triggered by an unknown
+	// kid, so tokens with random kid values cannot be used to flood config.RemoteJWKSURL.
+	remoteJWKSRefetchMinInterval = 10 * time.Second
+)
+
+// publicKey returns the public key represented by k.
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		nb, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, runtimeh.SourceInfoError("decoding n", err)
+		}
+		eb, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, runtimeh.SourceInfoError("decoding e", err)
+		}
+		e := new(big.Int).SetBytes(eb)
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("%s invalid exponent for kid: %s", runtimeh.SourceInfo(), k.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("%s unsupported crv: %s", runtimeh.SourceInfo(), k.Crv)
+		}
+		xb, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, runtimeh.SourceInfoError("decoding x", err)
+		}
+		yb, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, runtimeh.SourceInfoError("decoding y", err)
+		}
+		x, y := new(big.Int).SetBytes(xb), new(big.Int).SetBytes(yb)
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("%s invalid point for kid: %s", runtimeh.SourceInfo(), k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("%s unsupported crv: %s", runtimeh.SourceInfo(), k.Crv)
+		}
+		xb, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, runtimeh.SourceInfoError("decoding x", err)
+		}
+		if len(xb) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s invalid x for kid: %s", runtimeh.SourceInfo(), k.Kid)
+		}
+		return ed25519.PublicKey(xb), nil
+	default:
+		return nil, fmt.Errorf("%s unsupported kty: %s", runtimeh.SourceInfo(), k.Kty)
+	}
+}
+
+// thumbprint returns the JWK SHA-256 thumbprint of k, RFC 7638, base64url encoded; the hash
+// of the required members of the key type, in lexicographic order.
+func (k jwk) thumbprint() (string, error) {
+	var members interface{}
+	switch k.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	default:
+		return "", fmt.Errorf("%s unsupported kty: %s", runtimeh.SourceInfo(), k.Kty)
+	}
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("marshal JWK members", err)
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// remoteJWKSClear clears the cached keys, so they are fetched on next use.
+func remoteJWKSClear() {
+	remoteJWKS.mu.Lock()
+	defer remoteJWKS.mu.Unlock()
+	remoteJWKS.err = nil
+	remoteJWKS.keys = nil
+	remoteJWKS.fetched = time.Time{}
+}
+
+// remoteJWKSFetch fetches the JWK Set from config.RemoteJWKSURL and returns the keys, by kid.
+// Keys of types that are not used to sign tokens, and keys not for signatures, are skipped.
+func remoteJWKSFetch() (map[string]interface{}, error) {
+	client := http.Client{Timeout: remoteJWKSFetchTimeout}
+	resp, err := client.Get(config.RemoteJWKSURL)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("fetching JWKS", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			lpf(logh.Error, "resp.Body.Close error:%+v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s fetching JWKS, status: %d", runtimeh.SourceInfo(), resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, remoteJWKSBodyLimit))
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("reading JWKS", err)
+	}
+	set := jwkSet{}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, runtimeh.SourceInfoError("unmarshal JWKS", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if (k.Use != "" && k.Use != "sig") || (k.Kty != "RSA" && k.Kty != "OKP") {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			lpf(logh.Warning, "skipping JWKS key kid: %s, error: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pk
+	}
+	return keys, nil
+}
+
+// remoteJWKSLookup returns the cached key for kid, and true if there is one. The keys are
+// fetched again when older than config.RemoteJWKSRefreshInterval, or when the kid is unknown
+// and the last fetch was at least remoteJWKSRefetchMinInterval ago; also after a failed fetch,
+// so an unavailable RemoteJWKSURL is not fetched on every request. Concurrent callers wait
+// for the fetch in progress. The error of the fetch is returned when there is no key.
+func remoteJWKSLookup(kid string) (interface{}, bool, error) {
+	ri := config.RemoteJWKSRefreshInterval
+	if ri == 0 {
+		ri = defaultRemoteJWKSRefreshInterval
+	}
+
+	remoteJWKS.mu.Lock()
+	key, ok := remoteJWKS.keys[kid]
+	since := time.Since(remoteJWKS.fetched)
+	if (ok && since <= ri) || (!ok && since < remoteJWKSRefetchMinInterval && since <= ri) {
+		err := remoteJWKS.err
+		remoteJWKS.mu.Unlock()
+		return key, ok, err
+	}
+	if fetching := remoteJWKS.fetching; fetching != nil {
+		remoteJWKS.mu.Unlock()
+		<-fetching
+		remoteJWKS.mu.Lock()
+		defer remoteJWKS.mu.Unlock()
+		key, ok := remoteJWKS.keys[kid]
+		return key, ok, remoteJWKS.err
+	}
+	fetching := make(chan struct{})
+	remoteJWKS.fetching = fetching
+	remoteJWKS.fetched = time.Now()
+	remoteJWKS.mu.Unlock()
+
+	keys, err := remoteJWKSFetch()
+
+	remoteJWKS.mu.Lock()
+	defer remoteJWKS.mu.Unlock()
+	if err == nil {
+		remoteJWKS.keys = keys
+	}
+	remoteJWKS.err = err
+	remoteJWKS.fetching = nil
+	close(fetching)
+	key, ok = remoteJWKS.keys[kid]
+	return key, ok, err
+}
+
+// remoteJWKSKey returns the key from config.RemoteJWKSURL matching the kid header of token;
+// see remoteJWKSLookup.
+func remoteJWKSKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok, err := remoteJWKSLookup(kid)
+	if !ok {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s no JWKS key for kid: %s", runtimeh.SourceInfo(), kid)
+	}
+	if _, isRSA := key.(*rsa.PublicKey); isRSA {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("%s signing method %s does not match key for kid: %s",
+				runtimeh.SourceInfo(), token.Method.Alg(), kid)
+		}
+	}
+	if _, isEd25519 := key.(ed25519.PublicKey); isEd25519 && token.Method != signingMethodEdDSA {
+		return nil, fmt.Errorf("%s signing method %s does not match key for kid: %s",
+			runtimeh.SourceInfo(), token.Method.Alg(), kid)
+	}
+	return key, nil
+}
+
+// jwkFromPublicKey returns the JWK for public key key, with kid from keyID.
+func jwkFromPublicKey(key interface{}) (jwk, error) {
+	kid, err := keyID(key)
+	if err != nil {
+		return jwk{}, err
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jwk{Alg: jwt.SigningMethodRS256.Alg(), Kid: kid, Kty: "RSA", Use: "sig",
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			N: base64.RawURLEncoding.EncodeToString(k.N.Bytes())}, nil
+	case ed25519.PublicKey:
+		return jwk{Alg: SigningAlgorithmEdDSA, Crv: "Ed25519", Kid: kid, Kty: "OKP", Use: "sig",
+			X: base64.RawURLEncoding.EncodeToString(k)}, nil
+	default:
+		return jwk{}, fmt.Errorf("%s unsupported public key type: %T", runtimeh.SourceInfo(), key)
+	}
+}
+
+// handlerJWKS publishes the public keys that verify tokens, in JWK Set format: the current
+// signing key, then the keys of config.JWTPreviousPublicKeyPaths. Resource servers use it as
+// their RemoteJWKSURL.
+func handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, _, current := signingKey()
+	set := jwkSet{Keys: []jwk{}}
+	k, err := jwkFromPublicKey(current)
+	if err != nil {
+		lpf(logh.Error, "jwkFromPublicKey error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	set.Keys = append(set.Keys, k)
+	kids := make([]string, 0, len(previousKeys))
+	for kid := range previousKeys {
+		if kid != k.Kid {
+			kids = append(kids, kid)
+		}
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		pk, err := jwkFromPublicKey(previousKeys[kid])
+		if err != nil {
+			lpf(logh.Error, "jwkFromPublicKey error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		set.Keys = append(set.Keys, pk)
+	}
+
+	b, err := json.Marshal(set)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
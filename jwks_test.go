@@ -0,0 +1,272 @@
+package authjwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TestRemoteJWKS verifies tokens are verified using keys from a remote JWKS, that an unknown
+// kid triggers a refetch (key rollover), and that tokens with a kid not in the set fail.
+func TestRemoteJWKS(t *testing.T) {
+	testSetup()
+	defer remoteJWKSClear()
+
+	keyA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Errorf("GenerateKey error: %v", err)
+		return
+	}
+	keyB, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Errorf("GenerateKey error: %v", err)
+		return
+	}
+
+	var mu sync.Mutex
+	fetches := 0
+	set := jwkSet{Keys: []jwk{testJWKFromRSA("a", &keyA.PublicKey)}}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if err := json.NewEncoder(w).Encode(set); err != nil {
+			t.Errorf("Encode error: %v", err)
+		}
+	}))
+	defer testServer.Close()
+
+	config.RemoteJWKSURL = testServer.URL
+	refetchMin := remoteJWKSRefetchMinInterval
+	remoteJWKSRefetchMinInterval = 0
+	defer func() { remoteJWKSRefetchMinInterval = refetchMin }()
+
+	if _, err := parseClaims(testTokenSigned(t, "a", keyA)); err != nil {
+		t.Errorf("parseClaims error with kid a: %v", err)
+		return
+	}
+	if _, err := parseClaims(testTokenSigned(t, "a", keyA)); err != nil {
+		t.Errorf("parseClaims error with kid a: %v", err)
+		return
+	}
+
+	// Roll over to key b; the unknown kid causes a refetch.
+	mu.Lock()
+	set = jwkSet{Keys: []jwk{testJWKFromRSA("b", &keyB.PublicKey)}}
+	mu.Unlock()
+	if _, err := parseClaims(testTokenSigned(t, "b", keyB)); err != nil {
+		t.Errorf("parseClaims error with kid b: %v", err)
+		return
+	}
+	if _, err := parseClaims(testTokenSigned(t, "c", keyB)); err == nil {
+		t.Errorf("parseClaims had no error with unknown kid")
+		return
+	}
+	// A token claiming kid b, but signed by key a, fails verification.
+	if _, err := parseClaims(testTokenSigned(t, "b", keyA)); err == nil {
+		t.Errorf("parseClaims had no error with wrong key")
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Initial fetch, rollover fetch, and a fetch for the unknown kid c.
+	if fetches != 3 {
+		t.Errorf("wrong number of fetches: %d", fetches)
+	}
+}
+
+// TestRemoteJWKSFetchFailure verifies a failing RemoteJWKSURL is not fetched again on every
+// request, and a slow fetch does not block requests with cached keys.
+func TestRemoteJWKSFetchFailure(t *testing.T) {
+	testSetup()
+	defer remoteJWKSClear()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Errorf("GenerateKey error: %v", err)
+		return
+	}
+	var mu sync.Mutex
+	fetches := 0
+	fail := true
+	block := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		n, f := fetches, fail
+		mu.Unlock()
+		if f {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if n > 2 {
+			<-block
+		}
+		if err := json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{testJWKFromRSA("a", &key.PublicKey)}}); err != nil {
+			t.Errorf("Encode error: %v", err)
+		}
+	}))
+	defer testServer.Close()
+	config.RemoteJWKSURL = testServer.URL
+
+	for i := 0; i < 3; i++ {
+		if _, err := parseClaims(testTokenSigned(t, "a", key)); err == nil {
+			t.Errorf("parseClaims had no error with a failing JWKS")
+			return
+		}
+	}
+	mu.Lock()
+	if fetches != 1 {
+		t.Errorf("failed fetch retried, fetches: %d", fetches)
+	}
+	fail = false
+	mu.Unlock()
+
+	// The unknown kid refetch blocks in the server; cached keys still verify.
+	refetchMin := remoteJWKSRefetchMinInterval
+	remoteJWKSRefetchMinInterval = 0
+	defer func() { remoteJWKSRefetchMinInterval = refetchMin }()
+	if _, err := parseClaims(testTokenSigned(t, "a", key)); err != nil {
+		t.Errorf("parseClaims error after JWKS recovered: %v", err)
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := parseClaims(testTokenSigned(t, "unknown", key)); err == nil {
+			t.Errorf("parseClaims had no error with unknown kid")
+		}
+	}()
+	for {
+		mu.Lock()
+		n := fetches
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := parseClaims(testTokenSigned(t, "a", key)); err != nil {
+		t.Errorf("parseClaims error during a fetch: %v", err)
+	}
+	close(block)
+	<-done
+}
+
+// testJWKFromRSA returns the jwk for an RSA public key.
+func testJWKFromRSA(kid string, pub *rsa.PublicKey) jwk {
+	return jwk{Alg: "RS256", Kid: kid, Kty: "RSA", Use: "sig",
+		N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// testTokenSigned returns a token string signed by key, with the kid header set.
+func testTokenSigned(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	claims := CustomClaims{
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix(), Issuer: "remote"},
+		Email:          "remote@auth.com",
+		TokenID:        "tokenID",
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	ts, err := token.SignedString(key)
+	if err != nil {
+		t.Errorf("SignedString error: %v", err)
+	}
+	return ts
+}
+
+// TestJWKSPublish verifies handlerJWKS publishes the current and previous keys, for RS256 and
+// EdDSA, and that a resource server using it as RemoteJWKSURL verifies tokens issued here.
+func TestJWKSPublish(t *testing.T) {
+	for _, alg := range []string{SigningAlgorithmRS256, SigningAlgorithmEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			testSetup()
+			defer remoteJWKSClear()
+			config.JWTSigningAlgorithm = alg
+			// The previous key is RSA.
+			config.JWTAllowedAlgorithms = []string{alg, SigningAlgorithmRS256}
+
+			previous, err := rsa.GenerateKey(rand.Reader, 1024)
+			if err != nil {
+				t.Errorf("GenerateKey error: %v", err)
+				return
+			}
+			previousKid, err := keyID(&previous.PublicKey)
+			if err != nil {
+				t.Errorf("keyID error: %v", err)
+				return
+			}
+			previousKeys = map[string]interface{}{previousKid: &previous.PublicKey}
+			_, _, current := signingKey()
+			currentKid, err := keyID(current)
+			if err != nil {
+				t.Errorf("keyID error: %v", err)
+				return
+			}
+
+			testServer := httptest.NewServer(http.HandlerFunc(handlerFuncNoAuthWrapperCommon(handlerJWKS, false)))
+			defer testServer.Close()
+			resp, err := http.Post(testServer.URL, "application/json", nil)
+			if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+				t.Errorf("POST did not return proper status: %d, error: %v", resp.StatusCode, err)
+				return
+			}
+			resp, err = http.Get(testServer.URL)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Errorf("GET did not return proper status: %d, error: %v", resp.StatusCode, err)
+				return
+			}
+			defer resp.Body.Close()
+			set := jwkSet{}
+			if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+				t.Errorf("Decode error: %v", err)
+				return
+			}
+			if len(set.Keys) != 2 || set.Keys[0].Kid != currentKid || set.Keys[0].Alg != alg ||
+				set.Keys[1].Kid != previousKid {
+				t.Errorf("wrong JWK Set: %+v", set)
+				return
+			}
+
+			_, credBytes, err := createAuth(t, nil)
+			if err != nil {
+				return
+			}
+			tokenBytes, _, err := login(t, credBytes)
+			if err != nil {
+				return
+			}
+			config.RemoteJWKSURL = testServer.URL
+			if _, err := parseClaims(string(tokenBytes)); err != nil {
+				t.Errorf("parseClaims with published keys error: %v", err)
+				return
+			}
+			if _, err := parseClaims(testTokenSigned(t, previousKid, previous)); err != nil {
+				t.Errorf("parseClaims with published previous key error: %v", err)
+				return
+			}
+		})
+	}
+}
+
+// TestJWKThumbprint verifies the thumbprint of the Ed25519 example key of RFC 8037
+// appendix A.3.
+func TestJWKThumbprint(t *testing.T) {
+	k := jwk{Crv: "Ed25519", Kid: "ignored", Kty: "OKP", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	if jkt, err := k.thumbprint(); err != nil || jkt != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+		t.Errorf("thumbprint: %s, error: %v", jkt, err)
+		return
+	}
+}
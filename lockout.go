@@ -0,0 +1,379 @@
+package authjwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+const (
+	defaultLockoutDuration    = time.Minute
+	defaultLockoutMaxDuration = time.Hour
+	defaultLockoutMaxRecords  = 100000
+	// lockoutPruneInterval is the minimum time between removing expired records from
+	// kvsLockout.
+	lockoutPruneInterval = time.Minute
+
+	lockoutKeyEmail = "email:"
+	lockoutKeyIP    = "ip:"
+)
+
+// LockoutState is the failed logins, and lockout, of an account; returned by AuthLockout, and
+// from PathLockout.
+type LockoutState struct {
+	Email       string
+	Failures    int
+	LastFailure time.Time `json:",omitempty"`
+	Locked      bool
+	LockedUntil time.Time `json:",omitempty"`
+}
+
+// lockoutRecord is the failed logins of an account, or from a source IP, stored in kvsLockout.
+type lockoutRecord struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+var (
+	// lockoutMutex makes the read, update, and write of a lockoutRecord atomic, and protects
+	// lockoutPruned and lockoutRecords.
+	lockoutMutex sync.Mutex
+	// lockoutPruned is when expired records were last removed from kvsLockout.
+	lockoutPruned time.Time
+	// lockoutRecords is the number of records in kvsLockout at the last prune, plus those
+	// added since.
+	lockoutRecords int
+)
+
+// AuthLockout returns the LockoutState of the account of email; without failed logins, or
+// after they are forgotten, only the Email is set.
+func AuthLockout(email string) (LockoutState, error) {
+	email = emailNormalize(email)
+	ls := LockoutState{Email: email}
+	lr, exists, err := lockoutRecordGet(lockoutKeyEmail + email)
+	if err != nil {
+		return ls, err
+	}
+	now := timeNow()
+	if !exists || !now.Before(lr.expires()) {
+		return ls, nil
+	}
+	ls.Failures = lr.Failures
+	ls.LastFailure = lr.LastFailure
+	ls.Locked = now.Before(lr.LockedUntil)
+	ls.LockedUntil = lr.LockedUntil
+	return ls, nil
+}
+
+// AuthUnlock removes the failed logins, and any lockout, of the account of email. Lockouts of
+// source IPs are not changed.
+func AuthUnlock(email string) error {
+	email = emailNormalize(email)
+	lockoutMutex.Lock()
+	defer lockoutMutex.Unlock()
+	n, err := kvsLockout.Delete(lockoutKeyEmail + email)
+	if err != nil {
+		return runtimeh.SourceInfoError("kvsLockout.Delete error", err)
+	}
+	lockoutRecords -= int(n)
+	return nil
+}
+
+// expires returns when lr is forgotten; config.LockoutMaxDuration after the last failure or
+// the end of the lockout, whichever is later.
+func (lr lockoutRecord) expires() time.Time {
+	last := lr.LastFailure
+	if lr.LockedUntil.After(last) {
+		last = lr.LockedUntil
+	}
+	return last.Add(config.LockoutMaxDuration)
+}
+
+// handlerLockout returns, to admins, the LockoutState of the account with query parameter
+// email, or with http.MethodDelete unlocks the account with AuthUnlock. The unlocking admin is
+// logged in the audit log.
+func handlerLockout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get the claims, in order to verify the caller is an admin.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	if !adminAuthorized(w, r, claims) {
+		return
+	}
+	email := emailNormalize(r.URL.Query().Get("email"))
+	if email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := AuthUnlock(email); err != nil {
+			lpf(logh.Error, "AuthUnlock error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("lockout cleared for email: %s by: %s", auditEmail(email), auditEmail(claims.Email))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	ls, err := AuthLockout(email)
+	if err != nil {
+		lpf(logh.Error, "AuthLockout error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(ls)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// lockoutConfigLoad sets the lockout defaults.
+func lockoutConfigLoad() {
+	if config.LockoutDuration == 0 {
+		config.LockoutDuration = defaultLockoutDuration
+	}
+	if config.LockoutMaxDuration == 0 {
+		config.LockoutMaxDuration = defaultLockoutMaxDuration
+	}
+	if config.LockoutMaxRecords == 0 {
+		config.LockoutMaxRecords = defaultLockoutMaxRecords
+	}
+}
+
+// lockoutEnabled returns true if failed logins are tracked, per account or per source IP.
+func lockoutEnabled() bool {
+	return config.LockoutThreshold > 0 || config.LockoutIPThreshold > 0
+}
+
+// lockoutFailure records a failed login for email from r. The account, or source IP, is
+// locked when config.LockoutThreshold, or config.LockoutIPThreshold, failures are reached;
+// for config.LockoutDuration, doubled for each further failure, up to
+// config.LockoutMaxDuration.
+func lockoutFailure(r *http.Request, email string) error {
+	if !lockoutEnabled() {
+		return nil
+	}
+	lockoutMutex.Lock()
+	defer lockoutMutex.Unlock()
+
+	now := timeNow()
+	if err := lockoutPrune(now); err != nil {
+		return err
+	}
+	for key, threshold := range lockoutThresholds(r, email) {
+		lr, exists, err := lockoutRecordGet(key)
+		if err != nil {
+			return err
+		}
+		if exists && !now.Before(lr.expires()) {
+			lr = lockoutRecord{}
+		}
+		lr.Failures++
+		lr.LastFailure = now
+		if lr.Failures >= threshold {
+			lr.LockedUntil = now.Add(lockoutDuration(lr.Failures - threshold))
+		}
+		if err := kvsLockout.Serialize(key, lr); err != nil {
+			return runtimeh.SourceInfoError("kvsLockout.Serialize error", err)
+		}
+		if !exists {
+			lockoutRecords++
+		}
+	}
+	return nil
+}
+
+// lockoutDuration returns config.LockoutDuration doubled n times, up to
+// config.LockoutMaxDuration.
+func lockoutDuration(n int) time.Duration {
+	max := float64(config.LockoutMaxDuration)
+	d := float64(config.LockoutDuration) * math.Pow(2, float64(n))
+	if d > max {
+		return config.LockoutMaxDuration
+	}
+	return time.Duration(d)
+}
+
+// lockoutLocked returns true, and writes the header with http.StatusTooManyRequests and a
+// Retry-After, when the account of email, or the source IP of r, is locked. Locked logins are
+// rejected before the password is verified, so they are not counted as failures.
+func lockoutLocked(w http.ResponseWriter, r *http.Request, email string) bool {
+	if !lockoutEnabled() {
+		return false
+	}
+	now := timeNow()
+	for key := range lockoutThresholds(r, email) {
+		lr, _, err := lockoutRecordGet(key)
+		if err != nil {
+			lpf(logh.Error, "lockoutRecordGet error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return true
+		}
+		if now.Before(lr.LockedUntil) {
+			if aw, ok := w.(*AuditWriter); ok {
+				by := "account"
+				if strings.HasPrefix(key, lockoutKeyIP) {
+					by = "IP: " + clientIP(r)
+				}
+				aw.Message = fmt.Sprintf("login for email: %s locked out by %s", auditEmail(email), by)
+			}
+			retry := lr.LockedUntil.Sub(now)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return true
+		}
+	}
+	return false
+}
+
+// lockoutPrune removes expired records from kvsLockout, at most every lockoutPruneInterval,
+// or when config.LockoutMaxRecords is reached. When the records still exceed
+// config.LockoutMaxRecords, those with the oldest failures are removed, so failed logins for
+// many emails, or from many IPs, cannot grow kvsLockout without bound.
+func lockoutPrune(now time.Time) error {
+	if now.Sub(lockoutPruned) < lockoutPruneInterval && lockoutRecords < config.LockoutMaxRecords {
+		return nil
+	}
+	keys, err := kvsLockout.Keys()
+	if err != nil {
+		return runtimeh.SourceInfoError("kvsLockout.Keys error", err)
+	}
+	type keyRecord struct {
+		key string
+		lr  lockoutRecord
+	}
+	kept := []keyRecord{}
+	for _, key := range keys {
+		lr, _, err := lockoutRecordGet(key)
+		if err != nil {
+			return err
+		}
+		if now.Before(lr.expires()) {
+			kept = append(kept, keyRecord{key, lr})
+			continue
+		}
+		if _, err := kvsLockout.Delete(key); err != nil {
+			return runtimeh.SourceInfoError("kvsLockout.Delete error", err)
+		}
+	}
+	if len(kept) >= config.LockoutMaxRecords {
+		sort.Slice(kept, func(i, j int) bool { return kept[i].lr.LastFailure.Before(kept[j].lr.LastFailure) })
+		// Leave room for the records of the current failure.
+		n := len(kept) - config.LockoutMaxRecords + 2
+		if n > len(kept) {
+			n = len(kept)
+		}
+		remove := kept[:n]
+		for _, kr := range remove {
+			if _, err := kvsLockout.Delete(kr.key); err != nil {
+				return runtimeh.SourceInfoError("kvsLockout.Delete error", err)
+			}
+		}
+		lpf(logh.Warning, "lockout records at limit %d, removed oldest: %d", config.LockoutMaxRecords, len(remove))
+		kept = kept[len(remove):]
+	}
+	lockoutPruned = now
+	lockoutRecords = len(kept)
+	return nil
+}
+
+// lockoutRecordGet returns the lockoutRecord for key, and true if it exists.
+func lockoutRecordGet(key string) (lockoutRecord, bool, error) {
+	b, err := kvsLockout.Get(key)
+	if err != nil {
+		return lockoutRecord{}, false, runtimeh.SourceInfoError("kvsLockout.Get error", err)
+	}
+	if b == nil {
+		return lockoutRecord{}, false, nil
+	}
+	lr := lockoutRecord{}
+	if err := json.Unmarshal(b, &lr); err != nil {
+		return lockoutRecord{}, false, runtimeh.SourceInfoError("json.Unmarshal error", err)
+	}
+	return lr, true, nil
+}
+
+// lockoutReset clears the tracked prune state; records in kvsLockout are kept.
+func lockoutReset() {
+	lockoutMutex.Lock()
+	defer lockoutMutex.Unlock()
+	lockoutPruned = time.Time{}
+	lockoutRecords = 0
+}
+
+// passwordVerifyLocked verifies password against hash, as passwordVerifyHash, for the account
+// of email, with the lockout of logins; failures count toward config.LockoutThreshold and
+// config.LockoutIPThreshold, and a success resets the account. false is returned, with the
+// header written with http.StatusTooManyRequests, when the account or source IP is locked;
+// otherwise the error is from passwordVerifyHash.
+func passwordVerifyLocked(w http.ResponseWriter, r *http.Request, email string, password string, hash []byte) (bool, error) {
+	if lockoutLocked(w, r, email) {
+		return false, nil
+	}
+
+	_, span := spanStart(r.Context(), SpanPasswordVerify)
+	span.SetAttribute(AttributeEmail, auditEmail(email))
+	err := passwordVerifyHash(password, hash)
+	span.SetAttribute(AttributeOutcome, err == nil)
+	span.End()
+	if err != nil {
+		if err := lockoutFailure(r, email); err != nil {
+			lpf(logh.Error, "lockoutFailure error:%v", err)
+		}
+		return true, err
+	}
+	if err := lockoutSuccess(email); err != nil {
+		lpf(logh.Error, "lockoutSuccess error:%v", err)
+	}
+	return true, nil
+}
+
+// lockoutSuccess removes the failed logins for the account of email after a successful
+// login. Failures from the source IP are kept, so one valid account does not reset the
+// tracking of an IP guessing the passwords of others.
+func lockoutSuccess(email string) error {
+	if config.LockoutThreshold <= 0 {
+		return nil
+	}
+	return AuthUnlock(email)
+}
+
+// lockoutThresholds returns the kvsLockout keys of the account of email, and the source IP of
+// r, that are tracked, with the threshold of each.
+func lockoutThresholds(r *http.Request, email string) map[string]int {
+	thresholds := map[string]int{}
+	if config.LockoutThreshold > 0 {
+		thresholds[lockoutKeyEmail+email] = config.LockoutThreshold
+	}
+	if config.LockoutIPThreshold > 0 {
+		thresholds[lockoutKeyIP+clientIP(r)] = config.LockoutIPThreshold
+	}
+	return thresholds
+}
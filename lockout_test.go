@@ -0,0 +1,335 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestLockout verifies accounts are locked after LockoutThreshold failed logins, even with the
+// correct password, with the lockout doubling for each further failure, and that a successful
+// login resets the count.
+func TestLockout(t *testing.T) {
+	testSetup()
+	config.LockoutThreshold = 3
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	wrong := "Wr0ng!Password"
+	wrongBytes, err := json.Marshal(Credential{Email: &em, Password: &wrong})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	do := func(body []byte) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp, nil
+	}
+	fail := func(n int) bool {
+		for i := 0; i < n; i++ {
+			if resp, err := do(wrongBytes); err != nil || resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("failed login %d did not return proper status: %v, error: %v", i, resp, err)
+				return false
+			}
+		}
+		return true
+	}
+	locked := func(retryAfter string) bool {
+		resp, err := do(credBytes)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != retryAfter {
+			t.Errorf("locked login did not return proper status: %v, error: %v", resp, err)
+			return false
+		}
+		return true
+	}
+
+	// A success resets the count.
+	if !fail(2) {
+		return
+	}
+	if _, _, err := login(t, credBytes); err != nil {
+		return
+	}
+	if !fail(3) || !locked("60") {
+		return
+	}
+	now = now.Add(config.LockoutDuration)
+	if !fail(1) || !locked("120") {
+		return
+	}
+	now = now.Add(2 * config.LockoutDuration)
+	if _, _, err := login(t, credBytes); err != nil {
+		return
+	}
+}
+
+// TestLockoutIP verifies a source IP is locked after LockoutIPThreshold failed logins for any
+// emails, including unknown emails.
+func TestLockoutIP(t *testing.T) {
+	testSetup()
+	config.LockoutIPThreshold = 2
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	pwd := "Wr0ng!Password"
+	for i, tc := range []struct {
+		email  string
+		status int
+	}{
+		{"unknown1@auth.com", http.StatusUnauthorized},
+		{"unknown2@auth.com", http.StatusUnauthorized},
+		{"unknown3@auth.com", http.StatusTooManyRequests},
+	} {
+		b, err := json.Marshal(Credential{Email: &tc.email, Password: &pwd})
+		if err != nil {
+			t.Errorf("marshal error: %v", err)
+			return
+		}
+		req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(b))
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("test %d, error: %v", i, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("test %d, status: %d, expected: %d", i, resp.StatusCode, tc.status)
+			return
+		}
+	}
+	req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("login from locked IP did not return proper status: %v, error: %v", resp, err)
+		return
+	}
+}
+
+// TestLockoutPrune verifies failed login records expire, and are bounded by
+// LockoutMaxRecords, keeping the most recent.
+func TestLockoutPrune(t *testing.T) {
+	testSetup()
+	config.LockoutThreshold = 5
+	config.LockoutMaxRecords = 4
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+
+	r := httptest.NewRequest(http.MethodPut, "/", nil)
+	for i := 0; i < 6; i++ {
+		now = now.Add(time.Second)
+		if err := lockoutFailure(r, fmt.Sprintf("user%d@auth.com", i)); err != nil {
+			t.Errorf("lockoutFailure error: %v", err)
+			return
+		}
+	}
+	keys, err := kvsLockout.Keys()
+	if err != nil || len(keys) > config.LockoutMaxRecords {
+		t.Errorf("records not bounded: %v, error: %v", keys, err)
+		return
+	}
+	if _, exists, err := lockoutRecordGet(lockoutKeyEmail + "user5@auth.com"); err != nil || !exists {
+		t.Errorf("most recent record removed, error: %v", err)
+		return
+	}
+
+	now = now.Add(config.LockoutMaxDuration + lockoutPruneInterval)
+	if err := lockoutFailure(r, "user6@auth.com"); err != nil {
+		t.Errorf("lockoutFailure error: %v", err)
+		return
+	}
+	if keys, err := kvsLockout.Keys(); err != nil || len(keys) != 1 {
+		t.Errorf("expired records not removed: %v, error: %v", keys, err)
+		return
+	}
+}
+
+// TestHandlerLockout verifies only admins can get the LockoutState of an account and unlock
+// it, and the unlocking admin is audited.
+func TestHandlerLockout(t *testing.T) {
+	auditPath := auditLogSetup(t)
+	defer auditLogShutdown()
+	testSetup()
+	config.LockoutThreshold = 2
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	userToken, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	adminEmail := "admin@auth.com"
+	_, adminCredBytes, err := createAuth(t, &adminEmail)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(adminEmail, []string{RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	adminToken, _, err := login(t, adminCredBytes)
+	if err != nil {
+		return
+	}
+	r := httptest.NewRequest(http.MethodPut, "/", nil)
+	for i := 0; i < config.LockoutThreshold; i++ {
+		if err := lockoutFailure(r, em); err != nil {
+			t.Errorf("lockoutFailure error: %v", err)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLockout)))
+	defer testServer.Close()
+	do := func(method string, token []byte) (*http.Response, error) {
+		req, err := http.NewRequest(method, testServer.URL+"?email="+em, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		return http.DefaultClient.Do(req)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if resp, err := do(method, userToken); err != nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("non admin %s did not return proper status: %v, error: %v", method, resp, err)
+			return
+		}
+	}
+	resp, err := do(http.MethodGet, adminToken)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("get did not return proper status: %v, error: %v", resp, err)
+		return
+	}
+	ls := LockoutState{}
+	if err := json.NewDecoder(resp.Body).Decode(&ls); err != nil {
+		t.Errorf("Decode error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if ls.Email != em || ls.Failures != config.LockoutThreshold || !ls.Locked {
+		t.Errorf("wrong LockoutState: %+v", ls)
+		return
+	}
+
+	if resp, err := do(http.MethodDelete, adminToken); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unlock did not return proper status: %v, error: %v", resp, err)
+		return
+	}
+	if !auditLogContains(t, auditPath, "lockout cleared for email: "+em+" by: "+adminEmail) {
+		t.Errorf("audit log does not contain the unlocking admin")
+		return
+	}
+	if ls, err := AuthLockout(em); err != nil || ls.Failures != 0 || ls.Locked {
+		t.Errorf("account not unlocked: %+v, error: %v", ls, err)
+		return
+	}
+	if _, _, err := login(t, credBytes); err != nil {
+		return
+	}
+}
+
+// TestLockoutPasswordChecks verifies the password checks of authenticated requests count
+// toward LockoutThreshold, and are rejected while the account is locked, so a stolen token
+// cannot be used to guess the password.
+func TestLockoutPasswordChecks(t *testing.T) {
+	wrong := "Wr0ng!Password"
+	right := "P@ssword1234"
+	newPassword := "N3w!Password99"
+	newEmail := "new@auth.com"
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    func(password string) interface{}
+	}{
+		{"step up", handlerStepUp, http.MethodPost, func(password string) interface{} {
+			return Credential{Password: &password}
+		}},
+		{"password", handlerPassword, http.MethodPut, func(password string) interface{} {
+			return PasswordChange{CurrentPassword: &password, NewPassword: &newPassword}
+		}},
+		{"email change", handlerEmailChange, http.MethodPut, func(password string) interface{} {
+			return EmailChange{NewEmail: &newEmail, Password: &password}
+		}},
+		{"delete", handlerDelete, http.MethodDelete, func(password string) interface{} {
+			return Credential{Password: &password}
+		}},
+	}
+	for _, tc := range tests {
+		testSetup()
+		config.LockoutThreshold = 2
+		config.DeleteRequiresPassword = true
+		config.TokenSender = func(email string, purpose string, token string) error { return nil }
+
+		_, credBytes, err := createAuth(t, nil)
+		if err != nil {
+			return
+		}
+		token, _, err := login(t, credBytes)
+		if err != nil {
+			return
+		}
+		testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(tc.handler)))
+		status := func(password string) (int, error) {
+			b, err := json.Marshal(tc.body(password))
+			if err != nil {
+				return 0, err
+			}
+			req, err := http.NewRequest(tc.method, testServer.URL, bytes.NewBuffer(b))
+			if err != nil {
+				return 0, err
+			}
+			req.Header.Set("Authorization", "Bearer "+string(token))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return 0, err
+			}
+			resp.Body.Close()
+			return resp.StatusCode, nil
+		}
+
+		for i, expected := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+			password := wrong
+			if i == 2 {
+				password = right
+			}
+			if s, err := status(password); err != nil || s != expected {
+				testServer.Close()
+				t.Errorf("%s, request %d, status: %d, expected: %d, error: %v", tc.name, i, s, expected, err)
+				return
+			}
+		}
+		testServer.Close()
+	}
+}
@@ -0,0 +1,54 @@
+package authjwt
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// defaultLogSecretPrefixLength is the default for Config.LogSecretPrefixLength.
+	defaultLogSecretPrefixLength = 4
+	// secretMask replaces the masked part of a secret in logs.
+	secretMask = "****"
+)
+
+var (
+	// maskedHeaders are the request headers holding secrets, masked in the audit log.
+	maskedHeaders = []string{"Authorization", "Cookie", apiKeyHeader, csrfHeader}
+)
+
+// maskSecret returns s as it may be logged; at most the first config.LogSecretPrefixLength
+// characters, followed by secretMask. Use for any token, key, or password that may be logged.
+func maskSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	n := config.LogSecretPrefixLength
+	if n < 0 || len(s) < 2*n {
+		n = 0
+	}
+	return s[:n] + secretMask
+}
+
+// requestMasked returns a copy of r, for logging, with the values of maskedHeaders masked using
+// maskSecret. The scheme of the Authorization header (I.E. Bearer) is kept.
+func requestMasked(r *http.Request) *http.Request {
+	rc := r.Clone(r.Context())
+	for _, h := range maskedHeaders {
+		key := http.CanonicalHeaderKey(h)
+		values := rc.Header[key]
+		if len(values) == 0 {
+			continue
+		}
+		masked := make([]string, len(values))
+		for i, v := range values {
+			if scheme, credentials, found := strings.Cut(v, " "); found && key == "Authorization" {
+				masked[i] = scheme + " " + maskSecret(strings.TrimSpace(credentials))
+			} else {
+				masked[i] = maskSecret(v)
+			}
+		}
+		rc.Header[key] = masked
+	}
+	return rc
+}
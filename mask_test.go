@@ -0,0 +1,121 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestLogSecretsMasked verifies the audit log of login, refresh, and requests authenticated
+// with a token or API key has masked secrets, and no full token, API key, CSRF token, or
+// password.
+func TestLogSecretsMasked(t *testing.T) {
+	auditPath := auditLogSetup(t)
+	defer auditLogShutdown()
+	testSetup()
+	config.APIKeysEnabled = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	cred := Credential{}
+	if err := json.Unmarshal(credBytes, &cred); err != nil {
+		t.Errorf("unmarshal error: %v", err)
+		return
+	}
+	ak, err := apiKeyCreate(em, "ci")
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+
+	client := &http.Client{}
+	do := func(hf func(w http.ResponseWriter, r *http.Request), method string, body []byte, header http.Header) ([]byte, error) {
+		testServer := httptest.NewServer(http.HandlerFunc(hf))
+		defer testServer.Close()
+		req, err := http.NewRequest(method, testServer.URL, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return io.ReadAll(resp.Body)
+	}
+
+	tokenBytes, err := do(HandlerFuncNoAuthWrapper(handlerLogin), http.MethodPut, credBytes, http.Header{})
+	if err != nil {
+		t.Errorf("login error: %v", err)
+		return
+	}
+	csrfToken := "csrf-token-value"
+	refreshedBytes, err := do(HandlerFuncAuthJWTWrapper(handlerRefresh), http.MethodPost, nil,
+		http.Header{"Authorization": {"Bearer " + string(tokenBytes)}, csrfHeader: {csrfToken}})
+	if err != nil {
+		t.Errorf("refresh error: %v", err)
+		return
+	}
+	if _, err := do(HandlerFuncAuthJWTWrapper(handlerTest), http.MethodPost, nil,
+		http.Header{"Authorization": {"Bearer " + string(refreshedBytes)}}); err != nil {
+		t.Errorf("request error: %v", err)
+		return
+	}
+	if _, err := do(HandlerFuncAuthJWTWrapper(handlerTest), http.MethodPost, nil,
+		http.Header{apiKeyHeader: {ak.Key}}); err != nil {
+		t.Errorf("API key request error: %v", err)
+		return
+	}
+
+	for i, secret := range []string{string(tokenBytes), string(refreshedBytes), ak.Key, csrfToken, *cred.Password} {
+		if auditLogContains(t, auditPath, secret) {
+			t.Errorf("audit log contains secret %d: %s", i, secret)
+			return
+		}
+		if i < 3 && !auditLogContains(t, auditPath, maskSecret(secret)) {
+			t.Errorf("audit log does not contain masked secret %d: %s", i, maskSecret(secret))
+			return
+		}
+	}
+
+	// Errors do not contain the token.
+	tampered := string(refreshedBytes[:len(refreshedBytes)-2]) + "xx"
+	if _, err := parseClaims(tampered); err == nil || strings.Contains(err.Error(), tampered) {
+		t.Errorf("parseClaims error contains token: %v", err)
+		return
+	}
+}
+
+// TestMaskSecret verifies secrets are masked per LogSecretPrefixLength.
+func TestMaskSecret(t *testing.T) {
+	testSetup()
+
+	tests := []struct {
+		prefixLength int
+		secret       string
+		masked       string
+	}{
+		{0, "", ""},
+		{0, "abcdefghij", "abcd" + secretMask},
+		{0, "abcdefg", secretMask},
+		{2, "abcdefg", "ab" + secretMask},
+		{-1, "abcdefghij", secretMask},
+	}
+	for i, tc := range tests {
+		config.LogSecretPrefixLength = tc.prefixLength
+		if tc.prefixLength == 0 {
+			config.LogSecretPrefixLength = defaultLogSecretPrefixLength
+		}
+		if masked := maskSecret(tc.secret); masked != tc.masked {
+			t.Errorf("test %d, masked: %s, expected: %s", i, masked, tc.masked)
+			return
+		}
+	}
+}
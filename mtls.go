@@ -0,0 +1,56 @@
+package authjwt
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// Confirmation is the cnf claim, RFC 7800, of tokens bound to a key of the client.
+type Confirmation struct {
+	// JKT is the JWK SHA-256 thumbprint, RFC 7638, of the DPoP key; see DPoPEnabled.
+	JKT string `json:"jkt,omitempty"`
+	// X5TS256 is the SHA-256 thumbprint, RFC 8705, of the TLS client certificate; see
+	// MTLSBoundTokens.
+	X5TS256 string `json:"x5t#S256,omitempty"`
+}
+
+// certificateThumbprint returns the x5t#S256 thumbprint of the TLS client certificate of r;
+// empty when there is none. The TLS handshake proves the client has the private key, so
+// self signed certificates, I.E. with tls.RequireAnyClientCert, can also be bound.
+func certificateThumbprint(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// mtlsBindingValidate returns an error if claims are bound to a client certificate, and r does
+// not have the certificate. Tokens not bound to a certificate are not checked.
+func mtlsBindingValidate(r *http.Request, claims *CustomClaims) error {
+	if claims.Confirmation == nil || claims.Confirmation.X5TS256 == "" {
+		return nil
+	}
+	if certificateThumbprint(r) != claims.Confirmation.X5TS256 {
+		return fmt.Errorf("%s client certificate does not match the token", runtimeh.SourceInfo())
+	}
+	return nil
+}
+
+// tokenConfirmation returns the Confirmation of tokens issued for r; the DPoP key thumbprint
+// jkt, and with config.MTLSBoundTokens the thumbprint of the client certificate. Nil when the
+// tokens are not bound.
+func tokenConfirmation(r *http.Request, jkt string) *Confirmation {
+	cnf := Confirmation{JKT: jkt}
+	if config.MTLSBoundTokens {
+		cnf.X5TS256 = certificateThumbprint(r)
+	}
+	if cnf == (Confirmation{}) {
+		return nil
+	}
+	return &cnf
+}
@@ -0,0 +1,144 @@
+package authjwt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestMTLSBoundTokens verifies tokens from a login with a client certificate are bound to the
+// certificate, and are rejected on connections without it.
+func TestMTLSBoundTokens(t *testing.T) {
+	testSetup()
+	config.MTLSBoundTokens = true
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tlsServer := func(hf http.HandlerFunc) *httptest.Server {
+		s := httptest.NewUnstartedServer(hf)
+		s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+		s.StartTLS()
+		return s
+	}
+	testServerLogin := tlsServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	testServer := tlsServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+
+	client := func(cert *tls.Certificate) *http.Client {
+		c := testServer.Client()
+		transport := c.Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		return &http.Client{Transport: transport}
+	}
+	certA, err := testClientCertificate()
+	if err != nil {
+		t.Errorf("testClientCertificate error: %v", err)
+		return
+	}
+	certB, err := testClientCertificate()
+	if err != nil {
+		t.Errorf("testClientCertificate error: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	resp, err := client(&certA).Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("login with client certificate did not return proper status, error: %v", err)
+		return
+	}
+	tokenBytes, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	sum, err := testCertificateThumbprint(certA)
+	if err != nil {
+		t.Errorf("testCertificateThumbprint error: %v", err)
+		return
+	}
+	if claims, err := parseClaims(string(tokenBytes)); err != nil || claims.Confirmation == nil || claims.Confirmation.X5TS256 != sum {
+		t.Errorf("token not bound to the client certificate, claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	tests := []struct {
+		cert   *tls.Certificate
+		status int
+	}{
+		{&certA, http.StatusNoContent},
+		{&certB, http.StatusUnauthorized},
+		{nil, http.StatusUnauthorized},
+	}
+	for i, tc := range tests {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		resp, err := client(tc.cert).Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("test %d, status: %d, expected: %d, error: %v", i, resp.StatusCode, tc.status, err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	// Without a client certificate tokens are not bound.
+	if cnf := tokenConfirmation(httptest.NewRequest(http.MethodPut, "/", nil), ""); cnf != nil {
+		t.Errorf("token bound without a client certificate: %+v", cnf)
+		return
+	}
+}
+
+// testClientCertificate returns a self signed client certificate.
+func testClientCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// testCertificateThumbprint returns the x5t#S256 thumbprint of cert.
+func testCertificateThumbprint(cert tls.Certificate) (string, error) {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parsed}}
+	return certificateThumbprint(r), nil
+}
@@ -0,0 +1,23 @@
+package authjwt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// AuthTokenCreateNotBefore creates a token for the auth with email that is not valid before
+// notBefore, I.E. to pre-provision a token for a service. The token is valid for the token TTL
+// of the auth from notBefore; a notBefore that is not in the future creates a token valid now.
+// The token is stored, so it can be revoked before it becomes valid; see TokenRevoke.
+func AuthTokenCreateNotBefore(email string, notBefore time.Time) (string, error) {
+	auth, err := authGet(email)
+	if err != nil {
+		return "", err
+	}
+	if auth.Email == nil {
+		return "", fmt.Errorf("%s auth does not exist for email: %s", runtimeh.SourceInfo(), email)
+	}
+	return authTokenStringCreateCommon(nil, email, tokenOptions{notBefore: notBefore}, tokenTTL(email))
+}
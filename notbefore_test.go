@@ -0,0 +1,72 @@
+package authjwt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TestAuthTokenCreateNotBefore verifies a token created with a future notBefore is rejected
+// until notBefore, allowing ClockSkewLeeway, and expires the token TTL after notBefore.
+func TestAuthTokenCreateNotBefore(t *testing.T) {
+	testSetup()
+	config.ClockSkewLeeway = 30 * time.Second
+
+	em, _, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	if _, err := AuthTokenCreateNotBefore("unknown@auth.com", time.Now()); err == nil {
+		t.Errorf("AuthTokenCreateNotBefore did not error for unknown email")
+		return
+	}
+	notBefore := time.Now().Add(time.Hour)
+	tokenString, err := AuthTokenCreateNotBefore(em, notBefore)
+	if err != nil {
+		t.Errorf("AuthTokenCreateNotBefore error: %v", err)
+		return
+	}
+	soonString, err := AuthTokenCreateNotBefore(em, time.Now().Add(10*time.Second))
+	if err != nil {
+		t.Errorf("AuthTokenCreateNotBefore error: %v", err)
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	for i, tc := range []struct {
+		tokenString string
+		status      int
+	}{
+		{tokenString, http.StatusUnauthorized},
+		{soonString, http.StatusNoContent},
+	} {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+tc.tokenString)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("test %d, request did not return proper status: %d, error: %v", i, resp.StatusCode, err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	jwt.TimeFunc = func() time.Time { return notBefore.Add(time.Second) }
+	defer func() { jwt.TimeFunc = time.Now }()
+	claims, err := parseClaims(tokenString)
+	if err != nil {
+		t.Errorf("token not valid after notBefore: %v", err)
+		return
+	}
+	if claims.NotBefore != notBefore.Unix() || claims.ExpiresAt != notBefore.Add(config.JWTAuthExpirationInterval).Unix() {
+		t.Errorf("wrong nbf: %d or exp: %d", claims.NotBefore, claims.ExpiresAt)
+		return
+	}
+}
@@ -0,0 +1,172 @@
+package authjwt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// OneTimeToken is supplied by the HTTP request in order to use a single use token.
+type OneTimeToken struct {
+	Token string
+}
+
+// Purposes for single use tokens, set in CustomClaims.Purpose and passed to Config.TokenSender.
+const (
+	PurposeChangePassword = "change-password"
+	PurposeEmailChange    = "email-change"
+	PurposeMagicLink      = "magic"
+	PurposePasswordReset  = "password-reset"
+	PurposeRefreshToken   = "refresh"
+)
+
+// errOneTimeTokenUsed is returned from oneTimeTokenConsume for a valid token that is no longer
+// in kvsOneTime; it was used, or revoked.
+var errOneTimeTokenUsed = errors.New("token already used")
+
+const (
+	defaultMagicLinkExpirationInterval = 15 * time.Minute
+	// minOneTimeTokenIDLength is the default, and minimum, Config.OneTimeTokenIDLength.
+	minOneTimeTokenIDLength = 16
+)
+
+// oneTimeTokenConfigLoad sets the default config.OneTimeTokenIDLength, or returns an error if
+// it is less than minOneTimeTokenIDLength.
+func oneTimeTokenConfigLoad() error {
+	if config.OneTimeTokenIDLength == 0 {
+		config.OneTimeTokenIDLength = minOneTimeTokenIDLength
+	}
+	if config.OneTimeTokenIDLength < minOneTimeTokenIDLength {
+		return fmt.Errorf("%s OneTimeTokenIDLength %d is less than %d", runtimeh.SourceInfo(),
+			config.OneTimeTokenIDLength, minOneTimeTokenIDLength)
+	}
+	return nil
+}
+
+// oneTimeTokenConsume validates a single use token for the specified purpose, including the
+// token version with Config.TokenVersionEnforced, and removes it from kvsOneTime, so it cannot
+// be used again. The claims of the token are returned.
+func oneTimeTokenConsume(tokenString string, purpose string) (*CustomClaims, error) {
+	claims, err := parseClaims(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("%s token purpose %s is not %s", runtimeh.SourceInfo(), claims.Purpose, purpose)
+	}
+	// Tokens from before BumpTokenVersion or AuthTokenVersionBump cannot be exchanged, I.E.
+	// for new tokens with the current version.
+	if err := tokenVersionValidate(claims); err != nil {
+		return nil, err
+	}
+
+	// Delete is the single use check; only one caller can delete the key.
+	n, err := kvsOneTime.Delete(claims.tokenKVSKey())
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("kvsOneTime.Delete error", err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%s %w for email: %s", runtimeh.SourceInfo(), errOneTimeTokenUsed, claims.Email)
+	}
+	return claims, nil
+}
+
+// oneTimeTokenCreate creates a signed, single use token for the specified purpose, valid for
+// expiration. The token is stored in kvsOneTime, as authTokenStringCreate does for kvsToken.
+func oneTimeTokenCreate(email string, purpose string, expiration time.Duration) (string, error) {
+	return oneTimeTokenCreateCommon(email, purpose, tokenOptions{}, expiration)
+}
+
+// oneTimeTokenCreateCommon is oneTimeTokenCreate, with the tokenOptions to; the actor and
+// notBefore of to are not used. A non zero authTime limits the expiration per
+// sessionExpiration.
+func oneTimeTokenCreateCommon(email string, purpose string, to tokenOptions, expiration time.Duration) (string, error) {
+	tokenID, err := oneTimeTokenID()
+	if err != nil {
+		return "", runtimeh.SourceInfoError("oneTimeTokenCreate error", err)
+	}
+	tokenID = familyTokenID(to.family, tokenID)
+	tv, utv, err := tokenVersions(email)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("oneTimeTokenCreate error", err)
+	}
+	claims := CustomClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  config.Audience,
+			ExpiresAt: sessionExpiration(to.authTime, timeNow().Add(expiration).Unix()),
+			Id:        tokenID,
+			Issuer:    tokenIssuer(),
+		},
+		AuthMethod:       to.method,
+		AuthTime:         to.authTime,
+		Client:           to.client,
+		Confirmation:     to.cnf,
+		Email:            email,
+		Family:           to.family,
+		NewEmail:         to.newEmail,
+		TokenID:          tokenID,
+		Purpose:          purpose,
+		TokenVersion:     tv,
+		UserTokenVersion: utv,
+	}
+
+	if err := tokenIDUnused(kvsOneTime, claims.tokenKVSKey()); err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, claims.ExpiresAt); err != nil {
+		return "", runtimeh.SourceInfoError("binary.Write failed", err)
+	}
+	if err := kvsOneTime.Set(claims.tokenKVSKey(), buf.Bytes()); err != nil {
+		return "", runtimeh.SourceInfoError("kvsOneTime.Set error", err)
+	}
+	return tokenSign(claims)
+}
+
+// oneTimeTokenID returns a hex encoded TokenID of config.OneTimeTokenIDLength random bytes.
+func oneTimeTokenID() (string, error) {
+	b := make([]byte, config.OneTimeTokenIDLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", runtimeh.SourceInfoError("rand.Read error", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// oneTimeTokenSend creates a single use token for the specified purpose and delivers it
+// with config.TokenSender.
+func oneTimeTokenSend(email string, purpose string, expiration time.Duration) error {
+	if config.TokenSender == nil {
+		return fmt.Errorf("%s no TokenSender configured", runtimeh.SourceInfo())
+	}
+	tokenString, err := oneTimeTokenCreate(email, purpose, expiration)
+	if err != nil {
+		return err
+	}
+	return runtimeh.SourceInfoError("TokenSender error", config.TokenSender(email, purpose, tokenString))
+}
+
+// userOneTimeTokensRemove removes all single use tokens, including refresh tokens, of email
+// from kvsOneTime.
+func userOneTimeTokensRemove(email string) error {
+	keys, err := kvsOneTime.Keys()
+	if err != nil {
+		return runtimeh.SourceInfoError("kvsOneTime.Keys error", err)
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, email+"|") {
+			if _, err := kvsOneTime.Delete(key); err != nil {
+				return runtimeh.SourceInfoError("kvsOneTime.Delete error", err)
+			}
+		}
+	}
+	return nil
+}
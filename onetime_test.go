@@ -0,0 +1,79 @@
+package authjwt
+
+import (
+	"testing"
+	"time"
+)
+
+// TestOneTimeTokenConsume verifies single use tokens can be consumed once, and that expired
+// tokens or tokens for another purpose are rejected.
+func TestOneTimeTokenConsume(t *testing.T) {
+	testSetup()
+
+	em := "onetime@auth.com"
+	tokenString, err := oneTimeTokenCreate(em, PurposeMagicLink, time.Minute)
+	if err != nil {
+		t.Errorf("oneTimeTokenCreate error: %v", err)
+		return
+	}
+	if _, err := oneTimeTokenConsume(tokenString, "other"); err == nil {
+		t.Errorf("oneTimeTokenConsume had no error with the wrong purpose")
+		return
+	}
+	claims, err := oneTimeTokenConsume(tokenString, PurposeMagicLink)
+	if err != nil || claims.Email != em {
+		t.Errorf("oneTimeTokenConsume error: %v", err)
+		return
+	}
+	if _, err := oneTimeTokenConsume(tokenString, PurposeMagicLink); err == nil {
+		t.Errorf("oneTimeTokenConsume had no error on reuse")
+		return
+	}
+
+	tokenString, err = oneTimeTokenCreate(em, PurposeMagicLink, -time.Minute)
+	if err != nil {
+		t.Errorf("oneTimeTokenCreate error: %v", err)
+		return
+	}
+	if _, err := oneTimeTokenConsume(tokenString, PurposeMagicLink); err == nil {
+		t.Errorf("oneTimeTokenConsume had no error on expired token")
+		return
+	}
+}
+
+// TestOneTimeTokenIDLength verifies single use token IDs have the configured length, with a
+// 128 bit default, and that lengths below the default are rejected.
+func TestOneTimeTokenIDLength(t *testing.T) {
+	testSetup()
+
+	tests := []struct {
+		length   int
+		expected int
+		valid    bool
+	}{
+		{0, minOneTimeTokenIDLength, true},
+		{32, 32, true},
+		{minOneTimeTokenIDLength - 1, 0, false},
+	}
+	for i, tc := range tests {
+		config.OneTimeTokenIDLength = tc.length
+		err := oneTimeTokenConfigLoad()
+		if (err == nil) != tc.valid {
+			t.Errorf("test %d, oneTimeTokenConfigLoad error: %v", i, err)
+			return
+		}
+		if !tc.valid {
+			continue
+		}
+		tokenString, err := oneTimeTokenCreate("onetime@auth.com", PurposeMagicLink, time.Minute)
+		if err != nil {
+			t.Errorf("test %d, oneTimeTokenCreate error: %v", i, err)
+			return
+		}
+		claims, err := parseClaims(tokenString)
+		if err != nil || len(claims.TokenID) != 2*tc.expected {
+			t.Errorf("test %d, wrong TokenID length: %d, error: %v", i, len(claims.TokenID), err)
+			return
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package authjwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Values of Config.TokenFormat.
+const (
+	// TokenFormatJWT is a JWT, signed per Config.JWTSigningAlgorithm.
+	TokenFormatJWT = "jwt"
+	// TokenFormatPASETOV4Public is a PASETO v4.public token, signed with the Ed25519 keys of
+	// Config.JWTPrivateKeyPath.
+	TokenFormatPASETOV4Public = "v4.public"
+	// TokenFormatPASETOV4Local is a PASETO v4.local token, encrypted with
+	// Config.TokenEncryptionKey.
+	TokenFormatPASETOV4Local = "v4.local"
+
+	// pasetoV4LocalHeader prefixes v4.local tokens.
+	pasetoV4LocalHeader = "v4.local."
+	// pasetoV4LocalNonceLength and pasetoV4LocalTagLength are the lengths in bytes of the
+	// nonce and the authentication tag of v4.local tokens.
+	pasetoV4LocalNonceLength = 32
+	pasetoV4LocalTagLength   = 32
+	// pasetoV4PublicHeader prefixes v4.public tokens.
+	pasetoV4PublicHeader = "v4.public."
+)
+
+// pasetoFooter is the footer of PASETO tokens; the kid of the signing key, as for JWTs.
+type pasetoFooter struct {
+	Kid string `json:"kid,omitempty"`
+}
+
+// pasetoTimeClaims are the registered claims that are a NumericDate in a JWT, and an RFC 3339
+// date time in a PASETO token.
+var pasetoTimeClaims = []string{"exp", "iat", "nbf"}
+
+// tokenFormatLoad sets the default config.TokenFormat, or returns an error if it is not
+// supported with config.JWTSigningAlgorithm.
+func tokenFormatLoad() error {
+	switch config.TokenFormat {
+	case "":
+		config.TokenFormat = TokenFormatJWT
+	case TokenFormatJWT:
+	case TokenFormatPASETOV4Local:
+		if len(config.TokenEncryptionKey) == 0 {
+			return fmt.Errorf("%s TokenFormat %s requires TokenEncryptionKey", runtimeh.SourceInfo(),
+				TokenFormatPASETOV4Local)
+		}
+	case TokenFormatPASETOV4Public:
+		if config.JWTSigningAlgorithm != SigningAlgorithmEdDSA {
+			return fmt.Errorf("%s TokenFormat %s requires JWTSigningAlgorithm %s", runtimeh.SourceInfo(),
+				TokenFormatPASETOV4Public, SigningAlgorithmEdDSA)
+		}
+	default:
+		return fmt.Errorf("%s unsupported TokenFormat: %s", runtimeh.SourceInfo(), config.TokenFormat)
+	}
+	return nil
+}
+
+// pae is the Pre-Authentication Encoding of pieces, per the PASETO specification.
+func pae(pieces ...[]byte) []byte {
+	b := binary.LittleEndian.AppendUint64(nil, uint64(len(pieces))&(1<<63-1))
+	for _, p := range pieces {
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(p))&(1<<63-1))
+		b = append(b, p...)
+	}
+	return b
+}
+
+// pasetoClaimsConvert converts the pasetoTimeClaims of the JSON object b; to RFC 3339 strings
+// when toPASETO is true, otherwise to NumericDate.
+func pasetoClaimsConvert(b []byte, toPASETO bool) ([]byte, error) {
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, runtimeh.SourceInfoError("unmarshal claims", err)
+	}
+	for _, name := range pasetoTimeClaims {
+		v, ok := m[name]
+		if !ok {
+			continue
+		}
+		var err error
+		if toPASETO {
+			var n int64
+			if err = json.Unmarshal(v, &n); err == nil {
+				m[name], err = json.Marshal(time.Unix(n, 0).UTC().Format(time.RFC3339))
+			}
+		} else {
+			var s string
+			var t time.Time
+			if err = json.Unmarshal(v, &s); err == nil {
+				if t, err = time.Parse(time.RFC3339, s); err == nil {
+					m[name], err = json.Marshal(t.Unix())
+				}
+			}
+		}
+		if err != nil {
+			return nil, runtimeh.SourceInfoError(fmt.Sprintf("converting claim %s", name), err)
+		}
+	}
+	return json.Marshal(m)
+}
+
+// pasetoClaimsUnmarshal unmarshals m, the message of a PASETO token, into claims and returns
+// the error from claims.Valid.
+func pasetoClaimsUnmarshal(m []byte, claims jwt.Claims) error {
+	b, err := pasetoClaimsConvert(m, false)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, claims); err != nil {
+		return runtimeh.SourceInfoError("unmarshal claims", err)
+	}
+	return claims.Valid()
+}
+
+// pasetoDecrypt decrypts the v4.local token tokenString with config.TokenEncryptionKey and
+// unmarshals the claims into claims; errors from claims.Valid are returned unwrapped, as from
+// jwt.ParseWithClaims.
+func pasetoDecrypt(tokenString string, claims jwt.Claims) error {
+	m, _, err := pasetoLocalDecrypt(config.TokenEncryptionKey, tokenString)
+	if err != nil {
+		return err
+	}
+	return pasetoClaimsUnmarshal(m, claims)
+}
+
+// pasetoEncrypt returns the v4.local token for claims, encrypted with
+// config.TokenEncryptionKey.
+func pasetoEncrypt(claims jwt.Claims) (string, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("marshal claims", err)
+	}
+	m, err := pasetoClaimsConvert(b, true)
+	if err != nil {
+		return "", err
+	}
+	n := make([]byte, pasetoV4LocalNonceLength)
+	if _, err := rand.Read(n); err != nil {
+		return "", runtimeh.SourceInfoError("rand.Read error", err)
+	}
+	return pasetoLocalEncrypt(config.TokenEncryptionKey, n, m, nil)
+}
+
+// pasetoLocalDecrypt returns the message and footer of the v4.local token tokenString,
+// after verifying the authentication tag with key.
+func pasetoLocalDecrypt(key []byte, tokenString string) ([]byte, []byte, error) {
+	if !strings.HasPrefix(tokenString, pasetoV4LocalHeader) {
+		return nil, nil, fmt.Errorf("%s token is not %s", runtimeh.SourceInfo(), TokenFormatPASETOV4Local)
+	}
+	parts := strings.Split(strings.TrimPrefix(tokenString, pasetoV4LocalHeader), ".")
+	if len(parts) > 2 {
+		return nil, nil, fmt.Errorf("%s token has too many segments", runtimeh.SourceInfo())
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) < pasetoV4LocalNonceLength+pasetoV4LocalTagLength {
+		return nil, nil, fmt.Errorf("%s invalid payload", runtimeh.SourceInfo())
+	}
+	var footer []byte
+	if len(parts) == 2 {
+		if footer, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+			return nil, nil, runtimeh.SourceInfoError("decoding footer", err)
+		}
+	}
+	n, c := payload[:pasetoV4LocalNonceLength], payload[pasetoV4LocalNonceLength:len(payload)-pasetoV4LocalTagLength]
+	tag := payload[len(payload)-pasetoV4LocalTagLength:]
+	ek, n2, ak, err := pasetoLocalKeys(key, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	expected, err := pasetoLocalTag(ak, n, c, footer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hmac.Equal(tag, expected) {
+		return nil, nil, runtimeh.SourceInfoError("verifying token", jwt.ErrSignatureInvalid)
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(ek, n2)
+	if err != nil {
+		return nil, nil, runtimeh.SourceInfoError("chacha20 error", err)
+	}
+	m := make([]byte, len(c))
+	cipher.XORKeyStream(m, c)
+	return m, footer, nil
+}
+
+// pasetoLocalEncrypt returns the v4.local token with message m and footer, encrypted with key
+// and nonce n.
+func pasetoLocalEncrypt(key []byte, n []byte, m []byte, footer []byte) (string, error) {
+	ek, n2, ak, err := pasetoLocalKeys(key, n)
+	if err != nil {
+		return "", err
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(ek, n2)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("chacha20 error", err)
+	}
+	c := make([]byte, len(m))
+	cipher.XORKeyStream(c, m)
+	tag, err := pasetoLocalTag(ak, n, c, footer)
+	if err != nil {
+		return "", err
+	}
+	payload := append(append(append([]byte{}, n...), c...), tag...)
+	token := pasetoV4LocalHeader + base64.RawURLEncoding.EncodeToString(payload)
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+	return token, nil
+}
+
+// pasetoLocalKeys returns the encryption key, the XChaCha20 nonce, and the authentication key
+// for a v4.local token, derived from key and the token nonce n.
+func pasetoLocalKeys(key []byte, n []byte) ([]byte, []byte, []byte, error) {
+	h, err := blake2b.New(chacha20.KeySize+chacha20.NonceSizeX, key)
+	if err != nil {
+		return nil, nil, nil, runtimeh.SourceInfoError("blake2b error", err)
+	}
+	h.Write([]byte("paseto-encryption-key"))
+	h.Write(n)
+	tmp := h.Sum(nil)
+	if h, err = blake2b.New256(key); err != nil {
+		return nil, nil, nil, runtimeh.SourceInfoError("blake2b error", err)
+	}
+	h.Write([]byte("paseto-auth-key-for-aead"))
+	h.Write(n)
+	return tmp[:chacha20.KeySize], tmp[chacha20.KeySize:], h.Sum(nil), nil
+}
+
+// pasetoLocalTag returns the authentication tag of a v4.local token, with authentication key ak,
+// nonce n, ciphertext c, and footer.
+func pasetoLocalTag(ak []byte, n []byte, c []byte, footer []byte) ([]byte, error) {
+	h, err := blake2b.New256(ak)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("blake2b error", err)
+	}
+	h.Write(pae([]byte(pasetoV4LocalHeader), n, c, footer, nil))
+	return h.Sum(nil), nil
+}
+
+// pasetoParse verifies the v4.public token tokenString and unmarshals the claims into claims;
+// errors from claims.Valid are returned unwrapped, as from jwt.ParseWithClaims.
+func pasetoParse(tokenString string, claims jwt.Claims) error {
+	if !strings.HasPrefix(tokenString, pasetoV4PublicHeader) {
+		return fmt.Errorf("%s token is not %s", runtimeh.SourceInfo(), TokenFormatPASETOV4Public)
+	}
+	parts := strings.Split(strings.TrimPrefix(tokenString, pasetoV4PublicHeader), ".")
+	if len(parts) > 2 {
+		return fmt.Errorf("%s token has too many segments", runtimeh.SourceInfo())
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) < ed25519.SignatureSize {
+		return fmt.Errorf("%s invalid payload", runtimeh.SourceInfo())
+	}
+	var footer []byte
+	if len(parts) == 2 {
+		if footer, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+			return runtimeh.SourceInfoError("decoding footer", err)
+		}
+	}
+	pf := pasetoFooter{}
+	if len(footer) > 0 {
+		if err := json.Unmarshal(footer, &pf); err != nil {
+			return runtimeh.SourceInfoError("unmarshal footer", err)
+		}
+	}
+	key, err := pasetoVerificationKey(pf.Kid)
+	if err != nil {
+		return err
+	}
+	m, sig := payload[:len(payload)-ed25519.SignatureSize], payload[len(payload)-ed25519.SignatureSize:]
+	if !ed25519.Verify(key, pae([]byte(pasetoV4PublicHeader), m, footer, nil), sig) {
+		return runtimeh.SourceInfoError("verifying token", jwt.ErrSignatureInvalid)
+	}
+	return pasetoClaimsUnmarshal(m, claims)
+}
+
+// pasetoSign returns the v4.public token for claims, signed with the current Ed25519 key.
+func pasetoSign(claims jwt.Claims) (string, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("marshal claims", err)
+	}
+	m, err := pasetoClaimsConvert(b, true)
+	if err != nil {
+		return "", err
+	}
+	pf := pasetoFooter{}
+	if pf.Kid, err = keyID(ed25519PublicKey); err != nil {
+		return "", err
+	}
+	footer, err := json.Marshal(pf)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("marshal footer", err)
+	}
+	if len(ed25519PrivateKey) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+	sig := ed25519.Sign(ed25519PrivateKey, pae([]byte(pasetoV4PublicHeader), m, footer, nil))
+	return pasetoV4PublicHeader + base64.RawURLEncoding.EncodeToString(append(m, sig...)) + "." +
+		base64.RawURLEncoding.EncodeToString(footer), nil
+}
+
+// pasetoVerificationKey returns the Ed25519 key with kid: from config.RemoteJWKSURL, the current
+// key, or a key of config.JWTPreviousPublicKeyPaths. An empty kid is the current key.
+func pasetoVerificationKey(kid string) (ed25519.PublicKey, error) {
+	var key interface{} = ed25519PublicKey
+	if config.RemoteJWKSURL != "" {
+		var err error
+		if key, err = remoteJWKSKey(&jwt.Token{Header: map[string]interface{}{"kid": kid}, Method: signingMethodEdDSA}); err != nil {
+			return nil, err
+		}
+	} else if pk, ok := previousKeys[kid]; ok {
+		key = pk
+	} else if current, err := keyID(ed25519PublicKey); kid != "" && (err != nil || kid != current) {
+		return nil, fmt.Errorf("%s no key for kid: %s", runtimeh.SourceInfo(), kid)
+	}
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s key for kid: %s is not an Ed25519 key", runtimeh.SourceInfo(), kid)
+	}
+	return k, nil
+}
+
+// tokenParse verifies tokenString, in config.TokenFormat and decrypted with
+// config.TokenEncryptionKey when set, and unmarshals the claims into claims. As
+// jwt.ParseWithClaims, claims are populated when only validation of the claims fails, with a
+// *jwt.ValidationError.
+func tokenParse(tokenString string, claims jwt.Claims) error {
+	switch config.TokenFormat {
+	case TokenFormatPASETOV4Local:
+		return pasetoDecrypt(tokenString, claims)
+	case TokenFormatPASETOV4Public:
+		return pasetoParse(tokenString, claims)
+	}
+	if len(config.TokenEncryptionKey) != 0 {
+		signed, err := jweDecrypt(tokenString)
+		if err != nil {
+			return err
+		}
+		tokenString = signed
+	}
+	_, err := jwt.ParseWithClaims(tokenString, claims, verificationKey)
+	return err
+}
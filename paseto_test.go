@@ -0,0 +1,231 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TestPAE verifies pae with the examples of the PASETO specification.
+func TestPAE(t *testing.T) {
+	tests := []struct {
+		pieces   [][]byte
+		expected string
+	}{
+		{nil, "\x00\x00\x00\x00\x00\x00\x00\x00"},
+		{[][]byte{{}}, "\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"},
+		{[][]byte{[]byte("test")}, "\x01\x00\x00\x00\x00\x00\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00test"},
+	}
+	for i, tc := range tests {
+		if b := pae(tc.pieces...); !bytes.Equal(b, []byte(tc.expected)) {
+			t.Errorf("test %d, pae: %q, expected: %q", i, b, tc.expected)
+			return
+		}
+	}
+}
+
+// TestPASETO verifies tokens are issued and authenticated as PASETO v4.public with
+// TokenFormatPASETOV4Public, with RFC 3339 time claims, and that tampered tokens, JWTs, and
+// invalid configurations are rejected.
+func TestPASETO(t *testing.T) {
+	testSetup()
+	config.JWTSigningAlgorithm = SigningAlgorithmEdDSA
+	config.TokenFormat = TokenFormatPASETOV4Public
+	if err := tokenFormatLoad(); err != nil {
+		t.Errorf("tokenFormatLoad error: %v", err)
+		return
+	}
+
+	jwtString, err := jwt.NewWithClaims(signingMethodEdDSA, CustomClaims{StandardClaims: jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(time.Minute).Unix()}, Email: "someone@auth.com"}).SignedString(ed25519PrivateKey)
+	if err != nil {
+		t.Errorf("SignedString error: %v", err)
+		return
+	}
+	if _, err := parseClaims(jwtString); err == nil {
+		t.Errorf("JWT accepted with TokenFormatPASETOV4Public")
+		return
+	}
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(string(tokenBytes), pasetoV4PublicHeader) || claims.Email != em {
+		t.Errorf("wrong token: %s, claims: %+v", tokenBytes, claims)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(string(tokenBytes), pasetoV4PublicHeader), ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Errorf("DecodeString error: %v", err)
+		return
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(payload[:len(payload)-64], &m); err != nil {
+		t.Errorf("Unmarshal error: %v", err)
+		return
+	}
+	if exp, ok := m["exp"].(string); !ok || exp != time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339) {
+		t.Errorf("exp is not RFC 3339: %v", m["exp"])
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	tampered := pasetoV4PublicHeader + base64.RawURLEncoding.EncodeToString(
+		bytes.Replace(payload, []byte(em), []byte("xx"+em[2:]), 1)) + "." + parts[1]
+	for i, tc := range []struct {
+		token  string
+		status int
+	}{
+		{string(tokenBytes), http.StatusNoContent},
+		{tampered, http.StatusUnauthorized},
+		{jwtString, http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != tc.status {
+			t.Errorf("test %d, request did not return proper status: %d, error: %v", i, resp.StatusCode, err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	expired, err := tokenSign(CustomClaims{StandardClaims: jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(-time.Minute).Unix()}, Email: em, TokenID: "expired"})
+	if err != nil {
+		t.Errorf("tokenSign error: %v", err)
+		return
+	}
+	if ts, err := tokenStatus(expired); err != nil || ts.Status != TokenStatusExpired {
+		t.Errorf("expired token status: %+v, error: %v", ts, err)
+		return
+	}
+
+	for _, tc := range []struct{ alg, format string }{
+		{SigningAlgorithmRS256, TokenFormatPASETOV4Public},
+		// Without TokenEncryptionKey.
+		{SigningAlgorithmEdDSA, TokenFormatPASETOV4Local},
+	} {
+		config.JWTSigningAlgorithm, config.TokenFormat = tc.alg, tc.format
+		if err := tokenFormatLoad(); err == nil {
+			t.Errorf("tokenFormatLoad did not error for alg: %s, format: %s", tc.alg, tc.format)
+			return
+		}
+	}
+}
+
+// TestPASETOLocal verifies pasetoLocalEncrypt and pasetoLocalDecrypt with test vectors of the
+// PASETO specification, and that tokens are issued and authenticated as PASETO v4.local with
+// TokenFormatPASETOV4Local.
+func TestPASETOLocal(t *testing.T) {
+	key, err := hex.DecodeString("707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f")
+	if err != nil {
+		t.Errorf("DecodeString error: %v", err)
+		return
+	}
+	tests := []struct {
+		nonce   string
+		payload string
+		footer  string
+		token   string
+	}{
+		// 4-E-1
+		{"0000000000000000000000000000000000000000000000000000000000000000",
+			`{"data":"this is a secret message","exp":"2022-01-01T00:00:00+00:00"}`, "",
+			"v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvSwscFlAl1pk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XJ5hOb_4v9RmDkneN0S92dx0OW4pgy7omxgf3S8c3LlQg"},
+		// 4-E-3
+		{"df654812bac492663825520ba2f6e67cf5ca5bdc13d4e7507a98cc4c2fcc3ad8",
+			`{"data":"this is a secret message","exp":"2022-01-01T00:00:00+00:00"}`, "",
+			"v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WkwMsYXw6FSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t6-tyebyWG6Ov7kKvBdkrrAJ837lKP3iDag2hzUPHuMKA"},
+	}
+	// tamper changes a character of the ciphertext of token.
+	tamper := func(token string) string {
+		i, c := len(pasetoV4LocalHeader)+50, "A"
+		if token[i] == 'A' {
+			c = "B"
+		}
+		return token[:i] + c + token[i+1:]
+	}
+	for i, tc := range tests {
+		n, err := hex.DecodeString(tc.nonce)
+		if err != nil {
+			t.Errorf("test %d, DecodeString error: %v", i, err)
+			return
+		}
+		if token, err := pasetoLocalEncrypt(key, n, []byte(tc.payload), []byte(tc.footer)); err != nil || token != tc.token {
+			t.Errorf("test %d, pasetoLocalEncrypt: %s, error: %v", i, token, err)
+			return
+		}
+		if m, footer, err := pasetoLocalDecrypt(key, tc.token); err != nil || string(m) != tc.payload || string(footer) != tc.footer {
+			t.Errorf("test %d, pasetoLocalDecrypt: %s, footer: %s, error: %v", i, m, footer, err)
+			return
+		}
+		if _, _, err := pasetoLocalDecrypt(key, tamper(tc.token)); err == nil {
+			t.Errorf("test %d, tampered token decrypted", i)
+			return
+		}
+	}
+
+	testSetup()
+	config.TokenEncryptionKey = key
+	config.TokenFormat = TokenFormatPASETOV4Local
+	if err := tokenFormatLoad(); err != nil {
+		t.Errorf("tokenFormatLoad error: %v", err)
+		return
+	}
+	if err := tokenEncryptionLoad(); err != nil {
+		t.Errorf("tokenEncryptionLoad error: %v", err)
+		return
+	}
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(string(tokenBytes), pasetoV4LocalHeader) || claims.Email != em {
+		t.Errorf("wrong token: %s, claims: %+v", tokenBytes, claims)
+		return
+	}
+	if bytes.Contains(tokenBytes, []byte(base64.RawURLEncoding.EncodeToString([]byte(em)))) {
+		t.Errorf("token is not encrypted: %s", tokenBytes)
+		return
+	}
+	for i, tc := range []struct {
+		token  string
+		status int
+	}{
+		{string(tokenBytes), http.StatusNoContent},
+		{tamper(string(tokenBytes)), http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		rr := httptest.NewRecorder()
+		HandlerFuncAuthJWTWrapper(handlerTest)(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("test %d, request did not return proper status: %d, expected: %d", i, rr.Code, tc.status)
+			return
+		}
+	}
+}
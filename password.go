@@ -0,0 +1,129 @@
+package authjwt
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// PasswordChange is the body of requests to PathPassword.
+type PasswordChange struct {
+	CurrentPassword *string
+	NewPassword     *string
+}
+
+// authCreateFailed writes the header for err from authCreateCommon; http.StatusConflict for
+// ErrAuthExists, http.StatusRequestEntityTooLarge for ErrAuthRecordTooLarge, the reasons for
+// a PasswordPolicyError, otherwise http.StatusBadRequest.
+func authCreateFailed(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrAuthExists) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrAuthRecordTooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	ppe := &PasswordPolicyError{}
+	if errors.As(err, &ppe) {
+		passwordPolicyRejected(w, ppe.Reasons)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+}
+
+// passwordChangeTokensRevoke removes the tokens in kvsToken, and single use tokens including
+// refresh tokens, of email after a password change, so a stolen token does not survive the
+// change. With config.PasswordChangeKeepSession, the token with kvsToken key keep, used for
+// the change, is kept.
+func passwordChangeTokensRevoke(email string, keep string) error {
+	if !config.PasswordChangeKeepSession {
+		keep = ""
+	}
+	keys, err := userTokenKeys(email)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key == keep {
+			continue
+		}
+		if _, err := tokenDelete(kvsToken, key); err != nil {
+			return runtimeh.SourceInfoError("kvsToken.Delete error", err)
+		}
+	}
+	return userOneTimeTokensRemove(email)
+}
+
+// handlerPassword changes the password of the caller to the NewPassword of the PasswordChange
+// body, when the CurrentPassword is the callers password; so a stolen token alone cannot
+// change the password. The new password is validated as in AuthCreate.
+func handlerPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
+
+	// get the claims.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	if impersonationRejected(w, claims) {
+		return
+	}
+
+	pc := PasswordChange{}
+	if err := httph.BodyUnmarshal(w, r, &pc); err != nil {
+		lpf(logh.Error, "password change error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	if pc.CurrentPassword == nil || pc.NewPassword == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	release, ok := loginSemaphoreAcquire(w)
+	if !ok {
+		return
+	}
+	defer release()
+
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ok, err = passwordVerifyLocked(w, r, claims.Email, passwordTrim(*pc.CurrentPassword), auth.PasswordHash)
+	if !ok {
+		return
+	}
+	if err != nil {
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("password change with wrong current password for email: %s", auditEmail(claims.Email))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	em := claims.Email
+	cred := Credential{Email: &em, Password: pc.NewPassword}
+	if err := cred.authCreateCommon(requestContext(r), false, claims.tokenKVSKey()); err != nil {
+		authCreateFailed(w, err)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("password changed for email: %s", auditEmail(claims.Email))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,201 @@
+package authjwt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHandlerPassword verifies users change their password at PathPassword only with the
+// current password, and without PasswordChangeWithoutCurrent cannot change it at
+// PathCreateOrUpdate.
+func TestHandlerPassword(t *testing.T) {
+	testSetup()
+	// The token is used after the change.
+	config.PasswordChangeKeepSession = true
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerPassword)))
+	defer testServer.Close()
+	testServerUpdate := httptest.NewServer(http.HandlerFunc(handlerFuncAuthJWTWrapperCommon(handlerCreateOrUpdate, true, PurposeChangePassword)))
+	defer testServerUpdate.Close()
+	client := &http.Client{}
+	do := func(method string, url string, body interface{}) (int, error) {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(b))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	current, wrong, weak, changed := "P@ssword1234", "P@ssword1235", "weak", "N3w!Passw0rd"
+	tests := []struct {
+		method string
+		body   PasswordChange
+		status int
+	}{
+		{http.MethodPost, PasswordChange{CurrentPassword: &current, NewPassword: &changed}, http.StatusMethodNotAllowed},
+		{http.MethodPut, PasswordChange{NewPassword: &changed}, http.StatusBadRequest},
+		{http.MethodPut, PasswordChange{CurrentPassword: &wrong, NewPassword: &changed}, http.StatusUnauthorized},
+		{http.MethodPut, PasswordChange{CurrentPassword: &current, NewPassword: &weak}, http.StatusBadRequest},
+		{http.MethodPut, PasswordChange{CurrentPassword: &current, NewPassword: &changed}, http.StatusNoContent},
+		{http.MethodPut, PasswordChange{CurrentPassword: &current, NewPassword: &changed}, http.StatusUnauthorized},
+	}
+	for i, tc := range tests {
+		if status, err := do(tc.method, testServer.URL, tc.body); err != nil || status != tc.status {
+			t.Errorf("test %d, status: %d, expected: %d, error: %v", i, status, tc.status, err)
+			return
+		}
+	}
+	auth, err := authGet(em)
+	if err != nil || passwordVerifyHash(changed, auth.PasswordHash) != nil {
+		t.Errorf("password not changed, error: %v", err)
+		return
+	}
+
+	// The access token of the auth cannot update its password at PathCreateOrUpdate.
+	if status, err := do(http.MethodPut, testServerUpdate.URL, Credential{Email: &em, Password: &current}); err != nil || status != http.StatusForbidden {
+		t.Errorf("update without PasswordChangeWithoutCurrent, status: %d, error: %v", status, err)
+		return
+	}
+	other := "other@auth.com"
+	if status, err := do(http.MethodPut, testServerUpdate.URL, Credential{Email: &other, Password: &current}); err != nil || status != http.StatusForbidden {
+		t.Errorf("update of another auth by non admin, status: %d, error: %v", status, err)
+		return
+	}
+	config.PasswordChangeWithoutCurrent = true
+	if status, err := do(http.MethodPut, testServerUpdate.URL, Credential{Email: &other, Password: &current}); err != nil || status != http.StatusForbidden {
+		t.Errorf("update of another auth by non admin with PasswordChangeWithoutCurrent, status: %d, error: %v", status, err)
+		return
+	}
+	if status, err := do(http.MethodPut, testServerUpdate.URL, Credential{Email: &em, Password: &current}); err != nil || status != http.StatusNoContent {
+		t.Errorf("update with PasswordChangeWithoutCurrent, status: %d, error: %v", status, err)
+		return
+	}
+}
+
+// TestPasswordChangeTokensRevoke verifies a password change removes the tokens, and refresh
+// tokens, of the auth, except with PasswordChangeKeepSession the token used for the change.
+func TestPasswordChangeTokensRevoke(t *testing.T) {
+	for _, keepSession := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keep %t", keepSession), func(t *testing.T) {
+			testSetup()
+			config.IssueRefreshToken = true
+			config.PasswordChangeKeepSession = keepSession
+			em, credBytes, err := createAuth(t, nil)
+			if err != nil {
+				return
+			}
+			testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+			defer testServerLogin.Close()
+			login := func() (LoginTokens, error) {
+				lt := LoginTokens{}
+				req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+				if err != nil {
+					return lt, err
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return lt, err
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					return lt, fmt.Errorf("login status: %d", resp.StatusCode)
+				}
+				return lt, json.NewDecoder(resp.Body).Decode(&lt)
+			}
+			changing, err := login()
+			if err != nil {
+				t.Errorf("login error: %v", err)
+				return
+			}
+			other, err := login()
+			if err != nil {
+				t.Errorf("login error: %v", err)
+				return
+			}
+
+			testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerPassword)))
+			defer testServer.Close()
+			current, changed := "P@ssword1234", "N3w!Passw0rd"
+			b, err := json.Marshal(PasswordChange{CurrentPassword: &current, NewPassword: &changed})
+			if err != nil {
+				t.Errorf("marshal error: %v", err)
+				return
+			}
+			req, err := http.NewRequest(http.MethodPut, testServer.URL, bytes.NewBuffer(b))
+			if err != nil {
+				t.Errorf("NewRequest error: %v", err)
+				return
+			}
+			req.Header.Set("Authorization", "Bearer "+changing.AccessToken)
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil || resp.StatusCode != http.StatusNoContent {
+				t.Errorf("password change did not return proper status: %v, error: %v", resp, err)
+				return
+			}
+			resp.Body.Close()
+
+			for i, tc := range []struct {
+				token string
+				valid bool
+			}{
+				{changing.AccessToken, keepSession},
+				{other.AccessToken, false},
+			} {
+				if _, err := tokenAuthenticated(context.Background(), tc.token, true, "", false); (err == nil) != tc.valid {
+					t.Errorf("token %d, valid: %t, error: %v", i, tc.valid, err)
+					return
+				}
+			}
+			for i, rt := range []string{changing.RefreshToken, other.RefreshToken} {
+				if _, err := oneTimeTokenConsume(rt, PurposeRefreshToken); err == nil {
+					t.Errorf("refresh token %d not removed", i)
+					return
+				}
+			}
+
+			expected := 0
+			if keepSession {
+				expected = 1
+			}
+			if n, err := userTokens(em, false); err != nil || n != expected {
+				t.Errorf("tokens remaining: %d, error: %v", n, err)
+				return
+			}
+			// Changes with AuthCreate remove all tokens.
+			cred := &Credential{Email: &em, Password: &current}
+			if err := cred.AuthCreate(); err != nil {
+				t.Errorf("AuthCreate error: %v", err)
+				return
+			}
+			if n, err := userTokens(em, false); err != nil || n != 0 {
+				t.Errorf("tokens remaining after AuthCreate: %d, error: %v", n, err)
+				return
+			}
+		})
+	}
+}
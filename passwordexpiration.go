@@ -0,0 +1,40 @@
+package authjwt
+
+import (
+	"github.com/paulfdunn/go-helper/logh"
+)
+
+// passwordChangeRequired returns true if the user of auth must change the password before
+// getting tokens other than a PurposeChangePassword token; auth.MustChangePassword is set,
+// or the password is expired.
+func passwordChangeRequired(auth authentication) bool {
+	return auth.MustChangePassword || passwordExpired(auth)
+}
+
+// passwordExpired returns true if config.PasswordMaxAge is set, and the password of auth was
+// changed longer ago. Passwords without a PasswordChangedAt are not expired; see
+// passwordExpirationStart.
+func passwordExpired(auth authentication) bool {
+	if config.PasswordMaxAge <= 0 || auth.PasswordChangedAt.IsZero() {
+		return false
+	}
+	return !timeNow().Before(auth.PasswordChangedAt.Add(config.PasswordMaxAge))
+}
+
+// passwordExpirationStart sets PasswordChangedAt of the auth for email to now, when
+// config.PasswordMaxAge is set and auth, the auth of a login, has none; so passwords set
+// before PasswordChangedAt was recorded expire PasswordMaxAge after the next login, rather
+// than all at once. Errors are logged; the login is not affected.
+func passwordExpirationStart(email string, auth authentication) {
+	if config.PasswordMaxAge <= 0 || !auth.PasswordChangedAt.IsZero() {
+		return
+	}
+	err := authUpdate(email, false, func(auth *authentication) {
+		if auth.PasswordChangedAt.IsZero() {
+			auth.PasswordChangedAt = timeNow()
+		}
+	})
+	if err != nil {
+		lpf(logh.Error, "authUpdate error:%v", err)
+	}
+}
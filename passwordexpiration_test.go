@@ -0,0 +1,107 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TestPasswordMaxAge verifies logins with an expired password only get a token for changing
+// the password, changing the password restarts the age, and passwords without a change time
+// start to age at the next login.
+func TestPasswordMaxAge(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+	defer func(tf func() time.Time) { jwt.TimeFunc = tf }(jwt.TimeFunc)
+	jwt.TimeFunc = func() time.Time { return now }
+	config.PasswordMaxAge = 24 * time.Hour
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	testServerUpdate := httptest.NewServer(http.HandlerFunc(handlerFuncAuthJWTWrapperCommon(handlerCreateOrUpdate, true, PurposeChangePassword)))
+	defer testServerUpdate.Close()
+	client := &http.Client{}
+	do := func(method string, url string, token string, body []byte) (*http.Response, []byte, error) {
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return resp, b, err
+	}
+	// loginChangeRequired returns the login token, and whether a password change is required.
+	loginChangeRequired := func() (string, bool, error) {
+		resp, b, err := do(http.MethodPut, testServerLogin.URL, "", credBytes)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("login did not return proper status: %v, error: %v", resp, err)
+			return "", false, err
+		}
+		return string(b), resp.Header.Get(passwordChangeRequiredHeader) == "true", nil
+	}
+
+	if _, changeRequired, err := loginChangeRequired(); err != nil || changeRequired {
+		t.Errorf("login of new password required a change")
+		return
+	}
+	now = now.Add(config.PasswordMaxAge)
+	token, changeRequired, err := loginChangeRequired()
+	if err != nil || !changeRequired {
+		t.Errorf("login of expired password did not require a change")
+		return
+	}
+	claims, err := parseClaims(token)
+	if err != nil || claims.Purpose != PurposeChangePassword {
+		t.Errorf("login of expired password returned wrong token, claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	pwd := "N3w!Passw0rd"
+	b, err := json.Marshal(Credential{Email: &em, Password: &pwd})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	if resp, _, err := do(http.MethodPut, testServerUpdate.URL, token, b); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("password change did not return proper status: %v, error: %v", resp, err)
+		return
+	}
+	credBytes = b
+	if _, changeRequired, err := loginChangeRequired(); err != nil || changeRequired {
+		t.Errorf("login after password change required a change")
+		return
+	}
+
+	// Auths without a change time start to age at login.
+	if err := authUpdate(em, false, func(auth *authentication) { auth.PasswordChangedAt = time.Time{} }); err != nil {
+		t.Errorf("authUpdate error: %v", err)
+		return
+	}
+	now = now.Add(2 * config.PasswordMaxAge)
+	if _, changeRequired, err := loginChangeRequired(); err != nil || changeRequired {
+		t.Errorf("login without a change time required a change")
+		return
+	}
+	if auth, err := authGet(em); err != nil || !auth.PasswordChangedAt.Equal(now) {
+		t.Errorf("PasswordChangedAt not set at login: %v, error: %v", auth.PasswordChangedAt, err)
+		return
+	}
+}
@@ -0,0 +1,36 @@
+package authjwt
+
+const reasonPasswordReused = "password was used recently"
+
+// passwordHistoryAdd returns history with hash, the replaced password hash, appended, keeping
+// the most recent config.PasswordHistoryLength-1 hashes, so with the current hash
+// PasswordHistoryLength passwords are kept.
+func passwordHistoryAdd(history [][]byte, hash []byte) [][]byte {
+	keep := config.PasswordHistoryLength - 1
+	if keep <= 0 {
+		return nil
+	}
+	history = append(history, hash)
+	if len(history) > keep {
+		history = history[len(history)-keep:]
+	}
+	return history
+}
+
+// passwordReused returns true if password is the current password of auth, or one of the
+// passwords in auth.PasswordHistory within config.PasswordHistoryLength.
+func passwordReused(auth authentication, password string) bool {
+	if config.PasswordHistoryLength <= 0 || auth.PasswordHash == nil {
+		return false
+	}
+	history := auth.PasswordHistory
+	if keep := config.PasswordHistoryLength - 1; len(history) > keep {
+		history = history[len(history)-keep:]
+	}
+	for _, h := range append([][]byte{auth.PasswordHash}, history...) {
+		if passwordVerifyHash(password, h) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package authjwt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestPasswordHistory verifies the current and prior passwords, within PasswordHistoryLength,
+// cannot be reused, and older passwords can.
+func TestPasswordHistory(t *testing.T) {
+	testSetup()
+	config.PasswordHistoryLength = 3
+	em := "someone@auth.com"
+	set := func(password string) error {
+		cred := &Credential{Email: &em, Password: &password}
+		return cred.AuthCreate()
+	}
+
+	tests := []struct {
+		password string
+		reused   bool
+	}{
+		{"P@ssword0001", false},
+		{"P@ssword0002", false},
+		{"P@ssword0003", false},
+		{"P@ssword0003", true},
+		{"P@ssword0002", true},
+		{"P@ssword0001", true},
+		{"P@ssword0004", false},
+		{"P@ssword0001", false},
+		{"P@ssword0003", true},
+	}
+	for i, tc := range tests {
+		err := set(tc.password)
+		ppe := &PasswordPolicyError{}
+		if reused := errors.As(err, &ppe) && reflect.DeepEqual(ppe.Reasons, []string{reasonPasswordReused}); reused != tc.reused || (!reused && err != nil) {
+			t.Errorf("test %d, password %s, reused: %t, error: %v", i, tc.password, tc.reused, err)
+			return
+		}
+	}
+	auth, err := authGet(em)
+	if err != nil {
+		t.Errorf("authGet error: %v", err)
+		return
+	}
+	if len(auth.PasswordHistory) != config.PasswordHistoryLength-1 || passwordVerifyHash("P@ssword0001", auth.PasswordHash) != nil {
+		t.Errorf("wrong password history length: %d", len(auth.PasswordHistory))
+		return
+	}
+
+	// Without a history, the current password can be set again.
+	config.PasswordHistoryLength = 0
+	if err := set("P@ssword0001"); err != nil {
+		t.Errorf("AuthCreate without history error: %v", err)
+		return
+	}
+}
@@ -0,0 +1,113 @@
+package authjwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/paulfdunn/go-helper/logh"
+)
+
+// passwordPolicyEmailMinLength is the minimum length of an email local part that is banned
+// from passwords by PasswordPolicy.BanEmailLocalPart; shorter local parts would ban common
+// text.
+const passwordPolicyEmailMinLength = 3
+
+// PasswordPolicy is the password policy of Config.PasswordPolicy. Rules that are zero are not
+// applied. Lengths are in characters (runes), of the password after Config.PasswordTrim.
+type PasswordPolicy struct {
+	// BanEmailLocalPart, when true, rejects passwords containing the local part of the email
+	// (before the @), ignoring case, when it has at least 3 characters.
+	BanEmailLocalPart bool
+	// BannedSubstrings are rejected anywhere in a password, ignoring case; I.E. the
+	// application or company name.
+	BannedSubstrings []string
+	// MinLength is the minimum length of passwords.
+	MinLength int
+	// RequireDigit, when true, requires a decimal digit.
+	RequireDigit bool
+	// RequireLower, when true, requires a lower case letter.
+	RequireLower bool
+	// RequireSymbol, when true, requires a punctuation or symbol character.
+	RequireSymbol bool
+	// RequireUpper, when true, requires an upper case letter.
+	RequireUpper bool
+	// Rules are application provided rules, applied after the other rules.
+	Rules []PasswordRule
+}
+
+// PasswordPolicyError is returned (wrapped) when a password does not meet the password
+// policy, with the reason for each rule that is not met.
+type PasswordPolicyError struct {
+	Reasons []string
+}
+
+// PasswordRule is an application provided password rule. The rule returns the reason, which
+// is returned to the client, if password does not meet the rule; empty otherwise. email is
+// empty when unknown, I.E. at PathCheckPassword without an email.
+type PasswordRule func(email string, password string) string
+
+// Error implements error.
+func (ppe *PasswordPolicyError) Error() string {
+	return "password does not meet the password policy: " + strings.Join(ppe.Reasons, "; ")
+}
+
+// reasons returns the reasons password, of the auth with email, does not meet pp.
+func (pp *PasswordPolicy) reasons(email string, password string) []string {
+	reasons := []string{}
+	if pp.MinLength > 0 && utf8.RuneCountInString(password) < pp.MinLength {
+		reasons = append(reasons, fmt.Sprintf("password is shorter than %d characters", pp.MinLength))
+	}
+	classes := []struct {
+		required bool
+		in       func(rune) bool
+		name     string
+	}{
+		{pp.RequireDigit, unicode.IsDigit, "a digit"},
+		{pp.RequireLower, unicode.IsLower, "a lower case letter"},
+		{pp.RequireSymbol, func(r rune) bool { return unicode.IsPunct(r) || unicode.IsSymbol(r) }, "a symbol"},
+		{pp.RequireUpper, unicode.IsUpper, "an upper case letter"},
+	}
+	for _, c := range classes {
+		if c.required && strings.IndexFunc(password, c.in) < 0 {
+			reasons = append(reasons, fmt.Sprintf("password does not contain %s", c.name))
+		}
+	}
+
+	lower := strings.ToLower(password)
+	for _, b := range pp.BannedSubstrings {
+		if b != "" && strings.Contains(lower, strings.ToLower(b)) {
+			reasons = append(reasons, fmt.Sprintf("password contains banned text: %s", b))
+		}
+	}
+	if local, _, _ := strings.Cut(email, "@"); pp.BanEmailLocalPart &&
+		utf8.RuneCountInString(local) >= passwordPolicyEmailMinLength && strings.Contains(lower, strings.ToLower(local)) {
+		reasons = append(reasons, "password contains the email")
+	}
+
+	for _, rule := range pp.Rules {
+		if reason := rule(email, password); reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+	return reasons
+}
+
+// passwordPolicyRejected writes the header with http.StatusBadRequest, and a PasswordCheck
+// body with reasons, for a password that does not meet the password policy.
+func passwordPolicyRejected(w http.ResponseWriter, reasons []string) {
+	b, err := json.Marshal(PasswordCheck{Reasons: reasons})
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestPasswordPolicy verifies each rule of PasswordPolicy, and that the default password
+// validation is not applied with a policy.
+func TestPasswordPolicy(t *testing.T) {
+	testSetup()
+	config.PasswordPolicy = &PasswordPolicy{
+		BanEmailLocalPart: true,
+		BannedSubstrings:  []string{"AuthJWT", ""},
+		MinLength:         10,
+		RequireDigit:      true,
+		RequireLower:      true,
+		RequireSymbol:     true,
+		RequireUpper:      true,
+		Rules: []PasswordRule{func(email string, password string) string {
+			if strings.HasSuffix(password, "!") {
+				return "password ends with !"
+			}
+			return ""
+		}},
+	}
+	if err := passwordValidationLoad(); err != nil {
+		t.Errorf("passwordValidationLoad error: %v", err)
+		return
+	}
+
+	tests := []struct {
+		email    string
+		password string
+		reasons  []string
+	}{
+		{"someone@auth.com", "Çorrect-Horse-9", []string{}},
+		// Lengths are in characters; ß is 2 bytes.
+		{"someone@auth.com", "ßßßßßßßA-9", []string{}},
+		{"someone@auth.com", "ßßßßßßA-9", []string{"password is shorter than 10 characters"}},
+		{"someone@auth.com", "correcthorse", []string{"password does not contain a digit",
+			"password does not contain a symbol", "password does not contain an upper case letter"}},
+		{"someone@auth.com", "CORRECT-HORSE-9", []string{"password does not contain a lower case letter"}},
+		{"someone@auth.com", "My-authjwt-9", []string{"password contains banned text: AuthJWT"}},
+		{"someone@auth.com", "Hi-SomeOne-9", []string{"password contains the email"}},
+		{"", "Hi-SomeOne-9", []string{}},
+		{"me@auth.com", "Hi-MeMe-9000", []string{}},
+		{"someone@auth.com", "Correct-Horse-9!", []string{"password ends with !"}},
+	}
+	for i, tc := range tests {
+		if reasons := passwordPolicyReasons(tc.email, tc.password); !reflect.DeepEqual(reasons, tc.reasons) {
+			t.Errorf("test %d, reasons: %v, expected: %v", i, reasons, tc.reasons)
+			return
+		}
+	}
+}
+
+// TestPasswordPolicyCreate verifies passwords that do not meet the policy are rejected by
+// AuthCreate with a PasswordPolicyError, and by the create handler with the reasons.
+func TestPasswordPolicyCreate(t *testing.T) {
+	testSetup()
+	config.PasswordPolicy = &PasswordPolicy{BanEmailLocalPart: true, MinLength: 14}
+	if err := passwordValidationLoad(); err != nil {
+		t.Errorf("passwordValidationLoad error: %v", err)
+		return
+	}
+
+	em, pwd := "someone@auth.com", "someone1234"
+	cred := &Credential{Email: &em, Password: &pwd}
+	ppe := &PasswordPolicyError{}
+	if err := cred.AuthCreate(); !errors.As(err, &ppe) || len(ppe.Reasons) != 2 {
+		t.Errorf("AuthCreate did not return a PasswordPolicyError: %v", err)
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handlerCreateOrUpdate))
+	defer testServer.Close()
+	b, err := json.Marshal(Credential{Email: &em, Password: &pwd})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	resp, err := http.Post(testServer.URL, "application/json", bytes.NewBuffer(b))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("create did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	pc := PasswordCheck{}
+	if err := json.NewDecoder(resp.Body).Decode(&pc); err != nil {
+		t.Errorf("Decode error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if pc.Valid || !reflect.DeepEqual(pc.Reasons, ppe.Reasons) {
+		t.Errorf("wrong PasswordCheck: %+v, expected reasons: %v", pc, ppe.Reasons)
+		return
+	}
+
+	pwd = "Correct-Horse-Battery"
+	cred = &Credential{Email: &em, Password: &pwd}
+	if err := cred.AuthCreate(); err != nil {
+		t.Errorf("AuthCreate error for compliant password: %v", err)
+		return
+	}
+}
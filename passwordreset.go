@@ -0,0 +1,127 @@
+package authjwt
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+)
+
+const (
+	defaultPasswordResetExpirationInterval = 15 * time.Minute
+)
+
+// PasswordReset is the body of requests to PathPasswordReset; the reset Token delivered by
+// Config.TokenSender, and the NewPassword.
+type PasswordReset struct {
+	NewPassword *string
+	Token       string
+}
+
+// handlerPasswordReset sets the password of the user of the reset token in the PasswordReset
+// body to the NewPassword. The new password is validated as in AuthCreate, before the token
+// is used, so a rejected password does not use the token. The token cannot be used again,
+// and the other tokens of the user are removed.
+func handlerPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
+
+	pr := PasswordReset{}
+	if err := httph.BodyUnmarshal(w, r, &pr); err != nil {
+		lpf(logh.Error, "password reset error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	if pr.NewPassword == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	claims, err := parseClaims(pr.Token)
+	if err != nil || claims.Purpose != PurposePasswordReset {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	em := claims.Email
+	check := Credential{Email: &em, Password: pr.NewPassword}
+	if err := check.validate(); err != nil {
+		authCreateFailed(w, err)
+		return
+	}
+	if _, err := oneTimeTokenConsume(pr.Token, PurposePasswordReset); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The auth may have been deleted or disabled after the reset token was sent.
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil || auth.Disabled {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	cred := Credential{Email: &em, Password: pr.NewPassword}
+	if err := cred.authCreateCommon(requestContext(r), false, ""); err != nil {
+		authCreateFailed(w, err)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("password reset for email: %s", auditEmail(claims.Email))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerRequestPasswordReset sends a password reset token, using Config.TokenSender, to the
+// Email in the request body. The token is valid for config.PasswordResetExpirationInterval.
+// The status is http.StatusAccepted whether or not there is an auth for the Email, so callers
+// cannot use this handler to discover which emails are registered.
+func handlerRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
+
+	em := ""
+	cred := Credential{Email: &em}
+	if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+		lpf(logh.Error, "password reset request error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	em = emailNormalize(em)
+
+	auth, err := authGet(em)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if auth.Email != nil && !auth.Disabled {
+		if err := oneTimeTokenSend(em, PurposePasswordReset, config.PasswordResetExpirationInterval); err != nil {
+			lpf(logh.Error, "oneTimeTokenSend error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("password reset sent for email: %s", auditEmail(em))
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
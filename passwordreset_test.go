@@ -0,0 +1,143 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TestHandlerPasswordReset tests the password reset flow; request, reset, that rejected
+// passwords do not use the token, and that the token cannot be reused, used for
+// authentication, or used after it expires.
+func TestHandlerPasswordReset(t *testing.T) {
+	testSetup()
+	sent := map[string]string{}
+	config.PasswordResetEnabled = true
+	config.TokenSender = func(email string, purpose string, token string) error {
+		if purpose != PurposePasswordReset {
+			t.Errorf("wrong purpose: %s", purpose)
+		}
+		sent[email] = token
+		return nil
+	}
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	userToken, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	testServerRequest := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerRequestPasswordReset)))
+	defer testServerRequest.Close()
+	testServerReset := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerPasswordReset)))
+	defer testServerReset.Close()
+	testServerInfo := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerInfo)))
+	defer testServerInfo.Close()
+	info := func(token string) (int, error) {
+		req, err := http.NewRequest(http.MethodGet, testServerInfo.URL, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	request := func() error {
+		b, err := json.Marshal(Credential{Email: &em})
+		if err != nil {
+			return err
+		}
+		resp, err := http.Post(testServerRequest.URL, "application/json", bytes.NewBuffer(b))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("reset request did not return proper status: %d", resp.StatusCode)
+		}
+		return nil
+	}
+	reset := func(token string, password string) (int, error) {
+		b, err := json.Marshal(PasswordReset{NewPassword: &password, Token: token})
+		if err != nil {
+			return 0, err
+		}
+		resp, err := http.Post(testServerReset.URL, "application/json", bytes.NewBuffer(b))
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// Unknown emails get the same status, but nothing is sent.
+	unknown := "unknown@auth.com"
+	b, err := json.Marshal(Credential{Email: &unknown})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	resp, err := http.Post(testServerRequest.URL, "application/json", bytes.NewBuffer(b))
+	if err != nil || resp.StatusCode != http.StatusAccepted || len(sent) != 0 {
+		t.Errorf("unknown email reset request, status: %d, sent: %+v, error: %v", resp.StatusCode, sent, err)
+		return
+	}
+	if err := request(); err != nil || sent[em] == "" {
+		t.Errorf("reset token not sent, error: %v", err)
+		return
+	}
+	resetToken := sent[em]
+
+	if status, err := info(resetToken); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("reset token used for auth did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if status, err := reset(resetToken, "short"); err != nil || status != http.StatusBadRequest {
+		t.Errorf("invalid password did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	pwd := "N3w!Passw0rd"
+	if status, err := reset(resetToken, pwd); err != nil || status != http.StatusNoContent {
+		t.Errorf("reset did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if status, err := reset(resetToken, "Another!Passw0rd"); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("reset token reuse did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if status, err := info(string(userToken)); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("token from before the reset did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	newBytes, err := json.Marshal(Credential{Email: &em, Password: &pwd})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	if _, _, err := login(t, newBytes); err != nil {
+		return
+	}
+
+	// Expired reset tokens are rejected.
+	if err := request(); err != nil {
+		t.Errorf("reset request error: %v", err)
+		return
+	}
+	defer func() { jwt.TimeFunc = time.Now }()
+	jwt.TimeFunc = func() time.Time { return time.Now().Add(config.PasswordResetExpirationInterval + time.Minute) }
+	if status, err := reset(sent[em], "Another!Passw0rd"); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("expired reset token did not return proper status: %d, error: %v", status, err)
+		return
+	}
+}
@@ -0,0 +1,73 @@
+package authjwt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+const (
+	// pepperHashPrefix prefixes the stored hashes of peppered passwords, followed by the
+	// pepperID of the pepper, "$", and the hash of the peppered password.
+	pepperHashPrefix = "$pepper$"
+	// pepperIDLength is the length in bytes of pepper IDs, before hex encoding.
+	pepperIDLength = 8
+	// pepperMinimumLength is the minimum length in bytes of peppers.
+	pepperMinimumLength = 32
+)
+
+// pepperConfigLoad returns an error if config.PasswordPepper or config.PasswordPreviousPeppers
+// are shorter than pepperMinimumLength.
+func pepperConfigLoad() error {
+	for i, p := range append([][]byte{config.PasswordPepper}, config.PasswordPreviousPeppers...) {
+		if (i > 0 || len(p) > 0) && len(p) < pepperMinimumLength {
+			return fmt.Errorf("%s pepper %d shorter than %d bytes", runtimeh.SourceInfo(), i, pepperMinimumLength)
+		}
+	}
+	return nil
+}
+
+// pepperID returns the identifier of pepper that is stored with hashes; a truncated hash, so
+// the pepper cannot be recovered from it.
+func pepperID(pepper []byte) string {
+	sum := sha256.Sum256(pepper)
+	return hex.EncodeToString(sum[:pepperIDLength])
+}
+
+// pepperFind returns the pepper, config.PasswordPepper or one of
+// config.PasswordPreviousPeppers, with identifier id.
+func pepperFind(id string) ([]byte, error) {
+	for _, p := range append([][]byte{config.PasswordPepper}, config.PasswordPreviousPeppers...) {
+		if len(p) > 0 && pepperID(p) == id {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("%s no pepper with id: %s", runtimeh.SourceInfo(), id)
+}
+
+// pepperHashSplit returns the pepperID and hash of the peppered password of hash, or false
+// if hash is not peppered.
+func pepperHashSplit(hash []byte) (string, []byte, bool) {
+	if !bytes.HasPrefix(hash, []byte(pepperHashPrefix)) {
+		return "", nil, false
+	}
+	id, inner, ok := strings.Cut(string(hash[len(pepperHashPrefix):]), "$")
+	if !ok {
+		return "", nil, false
+	}
+	return id, []byte("$" + inner), true
+}
+
+// pepperPassword returns password mixed with pepper, with HMAC-SHA256; encoded, as bcrypt
+// does not accept all bytes.
+func pepperPassword(pepper []byte, password string) string {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(password))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
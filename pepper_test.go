@@ -0,0 +1,85 @@
+package authjwt
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestPasswordPepper verifies existing hashes are peppered at the next login, peppers can be
+// rotated with PasswordPreviousPeppers, and peppered hashes do not verify without the pepper.
+func TestPasswordPepper(t *testing.T) {
+	testSetup()
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	pepper1, pepper2 := bytes.Repeat([]byte{1}, pepperMinimumLength), bytes.Repeat([]byte{2}, pepperMinimumLength)
+
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	loginStatus := func() int {
+		req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return 0
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("login error: %v", err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		pepper   []byte
+		previous [][]byte
+		status   int
+		prefix   string
+	}{
+		{pepper1, nil, http.StatusOK, pepperHashPrefix + pepperID(pepper1) + "$2"},
+		{pepper2, [][]byte{pepper1}, http.StatusOK, pepperHashPrefix + pepperID(pepper2) + "$2"},
+		// Without the pepper, the hash does not verify and is not replaced.
+		{nil, nil, http.StatusUnauthorized, pepperHashPrefix + pepperID(pepper2) + "$2"},
+		{nil, [][]byte{pepper2}, http.StatusOK, "$2"},
+	}
+	for i, tc := range tests {
+		config.PasswordPepper, config.PasswordPreviousPeppers = tc.pepper, tc.previous
+		if err := pepperConfigLoad(); err != nil {
+			t.Errorf("test %d, pepperConfigLoad error: %v", i, err)
+			return
+		}
+		if status := loginStatus(); status != tc.status {
+			t.Errorf("test %d, login status: %d, expected: %d", i, status, tc.status)
+			return
+		}
+		auth, err := authGet(em)
+		if err != nil {
+			t.Errorf("test %d, authGet error: %v", i, err)
+			return
+		}
+		if !strings.HasPrefix(string(auth.PasswordHash), tc.prefix) || !passwordHashValidation.Match(auth.PasswordHash) {
+			t.Errorf("test %d, password hash: %s, expected prefix: %s", i, auth.PasswordHash, tc.prefix)
+			return
+		}
+		if _, inner, ok := pepperHashSplit(auth.PasswordHash); ok && passwordVerifyHash("P@ssword1234", inner) == nil {
+			t.Errorf("test %d, peppered hash verified without the pepper", i)
+			return
+		}
+	}
+
+	config.PasswordPepper = pepper1[1:]
+	if err := pepperConfigLoad(); err == nil {
+		t.Errorf("short pepper did not return an error")
+		return
+	}
+	config.PasswordPepper, config.PasswordPreviousPeppers = nil, [][]byte{nil}
+	if err := pepperConfigLoad(); err == nil {
+		t.Errorf("empty previous pepper did not return an error")
+		return
+	}
+}
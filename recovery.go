@@ -0,0 +1,68 @@
+package authjwt
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+)
+
+const (
+	defaultRecoveryExpirationInterval = 15 * time.Minute
+)
+
+// handlerGenerateRecoveryToken returns, to admins, a single use change password token for the
+// user with the Email in the Credential body; I.E. for a user that lost access entirely, and
+// was verified out of band. The token is valid for config.RecoveryExpirationInterval, and
+// allows one credential update (http.MethodPut) at PathCreateOrUpdate. The issuing admin is
+// logged in the audit log.
+func handlerGenerateRecoveryToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get the claims, in order to verify the caller is an admin.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	if !adminAuthorized(w, r, claims) {
+		return
+	}
+
+	em := ""
+	cred := Credential{Email: &em}
+	if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+		lpf(logh.Error, "recovery token error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	em = emailNormalize(em)
+	auth, err := authGet(em)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	tokenString, err := oneTimeTokenCreate(em, PurposeChangePassword, config.RecoveryExpirationInterval)
+	if err != nil {
+		lpf(logh.Error, "oneTimeTokenCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("recovery token for email: %s issued by: %s", auditEmail(em), auditEmail(claims.Email))
+	}
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write([]byte(tokenString)); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHandlerGenerateRecoveryToken verifies only admins can generate a recovery token, the
+// issuing admin is audited, and the token allows a single credential reset.
+func TestHandlerGenerateRecoveryToken(t *testing.T) {
+	auditPath := auditLogSetup(t)
+	defer auditLogShutdown()
+	testSetup()
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	userToken, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	adminEmail := "admin@auth.com"
+	_, adminCredBytes, err := createAuth(t, &adminEmail)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(adminEmail, []string{RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	adminToken, _, err := login(t, adminCredBytes)
+	if err != nil {
+		return
+	}
+
+	testServerRecovery := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerGenerateRecoveryToken)))
+	defer testServerRecovery.Close()
+	testServerUpdate := httptest.NewServer(http.HandlerFunc(handlerFuncAuthJWTWrapperCommon(handlerCreateOrUpdate, true, PurposeChangePassword)))
+	defer testServerUpdate.Close()
+	client := &http.Client{}
+	do := func(method string, url string, token string, body []byte) (*http.Response, error) {
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return client.Do(req)
+	}
+	emailBytes, err := json.Marshal(Credential{Email: &em})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+
+	if resp, err := do(http.MethodPost, testServerRecovery.URL, string(userToken), emailBytes); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non admin recovery token did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	unknown := "unknown@auth.com"
+	unknownBytes, err := json.Marshal(Credential{Email: &unknown})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	if resp, err := do(http.MethodPost, testServerRecovery.URL, string(adminToken), unknownBytes); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown user recovery token did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	resp, err := do(http.MethodPost, testServerRecovery.URL, string(adminToken), emailBytes)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("recovery token did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	tokenBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	recovery := string(tokenBytes)
+	if !auditLogContains(t, auditPath, "recovery token for email: "+em+" issued by: "+adminEmail) {
+		t.Errorf("audit log does not contain the issuing admin")
+		return
+	}
+
+	pwd := "N3w!Passw0rd"
+	newBytes, err := json.Marshal(Credential{Email: &em, Password: &pwd})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	if resp, err = do(http.MethodPut, testServerUpdate.URL, recovery, newBytes); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("recovery did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	if resp, err = do(http.MethodPut, testServerUpdate.URL, recovery, newBytes); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("recovery token reuse did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	if _, _, err := login(t, newBytes); err != nil {
+		return
+	}
+}
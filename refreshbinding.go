@@ -0,0 +1,76 @@
+package authjwt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+
+	"github.com/paulfdunn/go-helper/logh"
+)
+
+// RefreshBindingMode is how strictly a refresh must come from the client the token was
+// originally issued to.
+type RefreshBindingMode int
+
+const (
+	// RefreshBindingNone allows a refresh from any client.
+	RefreshBindingNone RefreshBindingMode = iota
+	// RefreshBindingSubnet requires a refresh from the same subnet (IPv4 /24, IPv6 /64) as
+	// the login.
+	RefreshBindingSubnet
+	// RefreshBindingClient requires a refresh from the same IP and User-Agent as the login.
+	RefreshBindingClient
+)
+
+const (
+	// clientFingerprintLength is the length in bytes of the hash used as a client fingerprint;
+	// the fingerprint is hex encoded.
+	clientFingerprintLength = 16
+	// refreshBindingSubnetIPv4Bits and refreshBindingSubnetIPv6Bits are the prefix lengths of
+	// the subnets for RefreshBindingSubnet.
+	refreshBindingSubnetIPv4Bits = 24
+	refreshBindingSubnetIPv6Bits = 64
+)
+
+// clientFingerprint returns the fingerprint of the client making request r, per
+// config.RefreshBinding; empty for RefreshBindingNone. The fingerprint is a hash, so the
+// client IP is not readable from the token.
+func clientFingerprint(r *http.Request) string {
+	var client string
+	switch config.RefreshBinding {
+	case RefreshBindingSubnet:
+		client = clientSubnet(clientIP(r))
+	case RefreshBindingClient:
+		client = clientIP(r) + "|" + r.UserAgent()
+	default:
+		return ""
+	}
+	sum := sha256.Sum256([]byte(client))
+	return hex.EncodeToString(sum[:clientFingerprintLength])
+}
+
+// clientSubnet returns the subnet of ip for RefreshBindingSubnet, or ip when it does not
+// parse.
+func clientSubnet(ip string) string {
+	pip := net.ParseIP(ip)
+	if pip == nil {
+		return ip
+	}
+	if ip4 := pip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(refreshBindingSubnetIPv4Bits, 8*net.IPv4len)).String()
+	}
+	return pip.Mask(net.CIDRMask(refreshBindingSubnetIPv6Bits, 8*net.IPv6len)).String()
+}
+
+// refreshBindingRejected writes the header with http.StatusForbidden and returns true when
+// config.RefreshBinding requires the refresh request r to come from the client claims were
+// issued to, and it does not.
+func refreshBindingRejected(w http.ResponseWriter, r *http.Request, claims *CustomClaims) bool {
+	if config.RefreshBinding == RefreshBindingNone || claims.Client == clientFingerprint(r) {
+		return false
+	}
+	lpf(logh.Warning, "refresh from a different client rejected for email: %s", claims.Email)
+	w.WriteHeader(http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,133 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHandlerRefreshBinding verifies refreshes from the login client succeed, and refreshes
+// from a different client are rejected per RefreshBinding.
+func TestHandlerRefreshBinding(t *testing.T) {
+	tests := []struct {
+		mode        RefreshBindingMode
+		refreshAddr string
+		refreshUA   string
+		status      int
+	}{
+		{RefreshBindingNone, "10.1.2.3:1234", "other", http.StatusCreated},
+		{RefreshBindingSubnet, "192.168.1.2:1234", "agent", http.StatusCreated},
+		{RefreshBindingSubnet, "192.168.1.200:4321", "other", http.StatusCreated},
+		{RefreshBindingSubnet, "192.168.2.2:1234", "agent", http.StatusForbidden},
+		{RefreshBindingClient, "192.168.1.2:4321", "agent", http.StatusCreated},
+		{RefreshBindingClient, "192.168.1.3:1234", "agent", http.StatusForbidden},
+		{RefreshBindingClient, "192.168.1.2:1234", "other", http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		testSetup()
+		config.RefreshBinding = tc.mode
+		_, credBytes, err := createAuth(t, nil)
+		if err != nil {
+			return
+		}
+
+		req := httptest.NewRequest(http.MethodPut, "/auth/login", bytes.NewBuffer(credBytes))
+		req.RemoteAddr = "192.168.1.2:1234"
+		req.Header.Set("User-Agent", "agent")
+		rr := httptest.NewRecorder()
+		handlerLogin(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("login did not return proper status: %d", rr.Code)
+			return
+		}
+		token := rr.Body.String()
+
+		// A second refresh, with the refreshed token, checks the fingerprint is kept.
+		for i := 0; i < 2; i++ {
+			req = httptest.NewRequest(http.MethodPost, "/auth/refresh", bytes.NewBufferString("{}"))
+			req.RemoteAddr = tc.refreshAddr
+			req.Header.Set("User-Agent", tc.refreshUA)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr = httptest.NewRecorder()
+			HandlerFuncAuthJWTWrapper(handlerRefresh)(rr, req)
+			if rr.Code != tc.status {
+				t.Errorf("mode %d, refresh %d from %s %s did not return proper status: %d", tc.mode, i,
+					tc.refreshAddr, tc.refreshUA, rr.Code)
+				return
+			}
+			token = rr.Body.String()
+			if tc.status != http.StatusCreated {
+				break
+			}
+		}
+	}
+}
+
+// TestHandlerTokenRefreshBinding verifies, with RefreshBindingClient, refresh tokens are only
+// exchanged from the login client, and the new tokens keep the login client.
+func TestHandlerTokenRefreshBinding(t *testing.T) {
+	testSetup()
+	config.IssueRefreshToken = true
+	config.RefreshBinding = RefreshBindingClient
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	do := func(hf http.HandlerFunc, method string, addr string, body []byte, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", bytes.NewBuffer(body))
+		req.RemoteAddr = addr
+		req.Header.Set("User-Agent", "agent")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		hf(rr, req)
+		return rr
+	}
+	exchange := func(addr string, lt *LoginTokens) int {
+		b, err := json.Marshal(OneTimeToken{Token: lt.RefreshToken})
+		if err != nil {
+			t.Errorf("marshal error: %v", err)
+			return 0
+		}
+		rr := do(handlerFuncNoAuthWrapperCommon(handlerToken, false), http.MethodPost, addr, b, "")
+		if rr.Code == http.StatusOK {
+			*lt = LoginTokens{}
+			if err := json.Unmarshal(rr.Body.Bytes(), lt); err != nil {
+				t.Errorf("unmarshal error: %v", err)
+			}
+		}
+		return rr.Code
+	}
+
+	login, other := "192.168.1.2:1234", "10.1.2.3:1234"
+	rr := do(handlerLogin, http.MethodPut, login, credBytes, "")
+	lt := LoginTokens{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &lt); err != nil || rr.Code != http.StatusOK {
+		t.Errorf("login did not return proper status: %d, error: %v", rr.Code, err)
+		return
+	}
+	if status := exchange(other, &lt); status != http.StatusForbidden {
+		t.Errorf("exchange from other client did not return proper status: %d", status)
+		return
+	}
+	// Tokens from an exchange are bound to the login client.
+	if status := exchange(login, &lt); status != http.StatusOK {
+		t.Errorf("exchange from login client did not return proper status: %d", status)
+		return
+	}
+	if rr := do(HandlerFuncAuthJWTWrapper(handlerRefresh), http.MethodPost, other, []byte("{}"), lt.AccessToken); rr.Code != http.StatusForbidden {
+		t.Errorf("refresh of exchanged token from other client did not return proper status: %d", rr.Code)
+		return
+	}
+	if status := exchange(other, &lt); status != http.StatusForbidden {
+		t.Errorf("second exchange from other client did not return proper status: %d", status)
+		return
+	}
+	if status := exchange(login, &lt); status != http.StatusOK {
+		t.Errorf("second exchange from login client did not return proper status: %d", status)
+		return
+	}
+}
@@ -0,0 +1,68 @@
+package authjwt
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRefreshLimitInterval = time.Minute
+	// refreshLimitPruneSize is the number of tracked users at which expired windows are
+	// pruned, so refreshLimits does not grow with every user that ever refreshed.
+	refreshLimitPruneSize = 1024
+)
+
+// refreshWindow counts the refreshes of a user in the window starting at start.
+type refreshWindow struct {
+	count int
+	start time.Time
+}
+
+var (
+	// refreshLimits tracks refreshes per Email, protected by refreshLimitMutex.
+	refreshLimits     = map[string]refreshWindow{}
+	refreshLimitMutex sync.Mutex
+)
+
+// refreshLimited returns true, and writes the header with http.StatusTooManyRequests and a
+// Retry-After, when email has already refreshed config.RefreshLimit times in the current
+// config.RefreshLimitInterval. Otherwise the refresh is counted.
+func refreshLimited(w http.ResponseWriter, email string) bool {
+	if config.RefreshLimit <= 0 {
+		return false
+	}
+	refreshLimitMutex.Lock()
+	defer refreshLimitMutex.Unlock()
+
+	now := timeNow()
+	if len(refreshLimits) >= refreshLimitPruneSize {
+		for k, v := range refreshLimits {
+			if now.Sub(v.start) >= config.RefreshLimitInterval {
+				delete(refreshLimits, k)
+			}
+		}
+	}
+	rw, ok := refreshLimits[email]
+	if !ok || now.Sub(rw.start) >= config.RefreshLimitInterval {
+		rw = refreshWindow{start: now}
+	}
+	if rw.count >= config.RefreshLimit {
+		retry := rw.start.Add(config.RefreshLimitInterval).Sub(now)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return true
+	}
+	rw.count++
+	refreshLimits[email] = rw
+	return false
+}
+
+// refreshLimitReset clears the tracked refreshes.
+func refreshLimitReset() {
+	refreshLimitMutex.Lock()
+	defer refreshLimitMutex.Unlock()
+	refreshLimits = map[string]refreshWindow{}
+}
@@ -0,0 +1,129 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestHandlerRefreshLimit verifies refreshes beyond RefreshLimit get
+// http.StatusTooManyRequests with a Retry-After, other users are not limited, and refreshes
+// are allowed again after RefreshLimitInterval.
+func TestHandlerRefreshLimit(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+	config.RefreshLimit = 2
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	otherEmail := "other@auth.com"
+	_, otherCredBytes, err := createAuth(t, &otherEmail)
+	if err != nil {
+		return
+	}
+	otherTokenBytes, _, err := login(t, otherCredBytes)
+	if err != nil {
+		return
+	}
+	token, otherToken := string(tokenBytes), string(otherTokenBytes)
+
+	refresh := func(token *string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/auth/refresh", bytes.NewBufferString("{}"))
+		req.Header.Set("Authorization", "Bearer "+*token)
+		rr := httptest.NewRecorder()
+		HandlerFuncAuthJWTWrapper(handlerRefresh)(rr, req)
+		if rr.Code == http.StatusCreated {
+			*token = rr.Body.String()
+		}
+		return rr
+	}
+
+	for i := 0; i < config.RefreshLimit; i++ {
+		if rr := refresh(&token); rr.Code != http.StatusCreated {
+			t.Errorf("refresh %d did not return proper status: %d", i, rr.Code)
+			return
+		}
+	}
+	now = now.Add(20 * time.Second)
+	rr := refresh(&token)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "40" {
+		t.Errorf("refresh over limit did not return proper status: %d, headers: %v", rr.Code, rr.Header())
+		return
+	}
+	if rr := refresh(&otherToken); rr.Code != http.StatusCreated {
+		t.Errorf("other user refresh did not return proper status: %d", rr.Code)
+		return
+	}
+
+	now = now.Add(config.RefreshLimitInterval)
+	if rr := refresh(&token); rr.Code != http.StatusCreated {
+		t.Errorf("refresh after interval did not return proper status: %d", rr.Code)
+		return
+	}
+}
+
+// TestHandlerTokenRefreshLimit verifies refresh token exchanges beyond RefreshLimit get
+// http.StatusTooManyRequests, without consuming the refresh token.
+func TestHandlerTokenRefreshLimit(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+	config.IssueRefreshToken = true
+	config.RefreshLimit = 1
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	rr := httptest.NewRecorder()
+	handlerLogin(rr, httptest.NewRequest(http.MethodPut, "/auth/login", bytes.NewBuffer(credBytes)))
+	lt := LoginTokens{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &lt); err != nil || rr.Code != http.StatusOK {
+		t.Errorf("login did not return proper status: %d, error: %v", rr.Code, err)
+		return
+	}
+	exchange := func() int {
+		b, err := json.Marshal(OneTimeToken{Token: lt.RefreshToken})
+		if err != nil {
+			t.Errorf("marshal error: %v", err)
+			return 0
+		}
+		rr := httptest.NewRecorder()
+		handlerFuncNoAuthWrapperCommon(handlerToken, false)(rr, httptest.NewRequest(http.MethodPost, "/auth/token", bytes.NewBuffer(b)))
+		if rr.Code == http.StatusOK {
+			lt = LoginTokens{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &lt); err != nil {
+				t.Errorf("unmarshal error: %v", err)
+			}
+		}
+		return rr.Code
+	}
+
+	tests := []struct {
+		elapsed time.Duration
+		status  int
+	}{
+		{0, http.StatusOK},
+		{time.Second, http.StatusTooManyRequests},
+		// The limited refresh token was not consumed.
+		{config.RefreshLimitInterval, http.StatusOK},
+	}
+	start := now
+	for i, tc := range tests {
+		now = start.Add(tc.elapsed)
+		if status := exchange(); status != tc.status {
+			t.Errorf("test %d, exchange did not return proper status: %d, expected: %d", i, status, tc.status)
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package authjwt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+const (
+	defaultRefreshTokenExpirationInterval = 30 * 24 * time.Hour
+	// familySeparator separates the family from the random ID in a TokenID.
+	familySeparator = "."
+)
+
+// handlerToken exchanges the refresh token in the OneTimeToken body for LoginTokens with a new
+// access token and refresh token in the same family; refresh tokens are rotated on every use.
+// A refresh token that is used again, I.E. stolen and replayed by either the thief or the
+// user, gets http.StatusUnauthorized and the whole family is revoked, so neither party keeps
+// a valid token. A refresh token bound to a DPoP key gets http.StatusBadRequest without a
+// valid DPoP proof, and one bound to a client certificate gets http.StatusUnauthorized on a
+// connection without the certificate. As for handlerRefresh, refreshes from a client other
+// than the login client are rejected per config.RefreshBinding, and limited per
+// config.RefreshLimit. The new access token counts toward config.RoleSessionLimits, as for a
+// login.
+func handlerToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ott := OneTimeToken{}
+	if err := httph.BodyUnmarshal(w, r, &ott); err != nil {
+		lpf(logh.Error, "token exchange error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+
+	// The proof of a bound refresh token, the client, and the refresh limit are checked first,
+	// so the token is not consumed by a rejected request.
+	if bound, err := parseClaims(ott.Token); err == nil {
+		if bound.Confirmation != nil && bound.Confirmation.JKT != "" {
+			if err := dpopKeyValidate(r, "", bound.Confirmation.JKT); err != nil {
+				lpf(logh.Warning, "refresh token DPoP proof rejected:%v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if err := mtlsBindingValidate(r, bound); err != nil {
+			lpf(logh.Warning, "refresh token rejected:%v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if refreshBindingRejected(w, r, bound) || refreshLimited(w, bound.Email) {
+			return
+		}
+	}
+
+	claims, err := oneTimeTokenConsume(ott.Token, PurposeRefreshToken)
+	if errors.Is(err, errOneTimeTokenUsed) {
+		// The token was validly issued and already used, so the family is compromised.
+		used, perr := parseClaims(ott.Token)
+		if perr == nil && used.Family != "" {
+			n, rerr := tokenFamilyRevoke(used.Email, used.Family)
+			if rerr != nil {
+				lpf(logh.Error, "tokenFamilyRevoke error:%v", rerr)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			lpf(logh.Warning, "refresh token reused, %d tokens of family revoked for email: %s", n, auditEmail(used.Email))
+			if aw, ok := w.(*AuditWriter); ok {
+				aw.Message = fmt.Sprintf("refresh token reused, %d tokens of family revoked for email: %s", n, auditEmail(used.Email))
+			}
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The auth may have been deleted, disabled, or required to change password after login.
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil || auth.Disabled || passwordChangeRequired(auth) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The new access token is a session, so is subject to the session limit as for logins.
+	unlock, ok := sessionLimitEnforce(w, claims.Email, auth, "refresh token exchange")
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	lt := LoginTokens{}
+	// The tokens keep the login client, as for handlerRefresh.
+	to := tokenOptions{authTime: claims.AuthTime, client: claims.Client, cnf: claims.Confirmation, family: claims.Family,
+		method: claims.AuthMethod}
+	if lt.AccessToken, err = authTokenStringCreateClient(r, claims.Email, to); err != nil {
+		lpf(logh.Error, "authTokenStringCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if lt.RefreshToken, err = refreshTokenCreate(claims.Email, to); err != nil {
+		lpf(logh.Error, "refreshTokenCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(lt)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("refresh token exchanged for email: %s", auditEmail(claims.Email))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// familyTokenID returns the TokenID of a token in family, with random ID id; id when family is
+// empty. Tokens of a family are found by the key prefix Email|family, as with tokenKVSKey.
+func familyTokenID(family string, id string) string {
+	if family == "" {
+		return id
+	}
+	return family + familySeparator + id
+}
+
+// refreshTokenCreate creates a refresh token for email, with the tokenOptions to of the login;
+// a single use token valid for config.RefreshTokenExpirationInterval.
+func refreshTokenCreate(email string, to tokenOptions) (string, error) {
+	return oneTimeTokenCreateCommon(email, PurposeRefreshToken, to, config.RefreshTokenExpirationInterval)
+}
+
+// tokenFamilyRevoke removes the access tokens from kvsToken, and refresh tokens from
+// kvsOneTime, of email in family. The number of tokens removed is returned.
+func tokenFamilyRevoke(email string, family string) (int, error) {
+	prefix := email + "|" + family + familySeparator
+	n := 0
+	for _, store := range []tokenStore{kvsToken, kvsOneTime} {
+		keys, err := store.Keys()
+		if err != nil {
+			return n, runtimeh.SourceInfoError("token store Keys error", err)
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			d, err := tokenDelete(store, key)
+			if err != nil {
+				return n, runtimeh.SourceInfoError("token store Delete error", err)
+			}
+			n += int(d)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,309 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRefreshToken verifies login returns a refresh token with IssueRefreshToken, the refresh
+// token cannot authenticate requests, it is exchanged once at PathToken for new tokens with
+// the AuthMethod of the login, and logout-all revokes refresh tokens.
+func TestRefreshToken(t *testing.T) {
+	testSetup()
+	config.IssueRefreshToken = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	testServerToken := httptest.NewServer(http.HandlerFunc(handlerFuncNoAuthWrapperCommon(handlerToken, false)))
+	defer testServerToken.Close()
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	testServerLogoutAll := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLogoutAll)))
+	defer testServerLogoutAll.Close()
+
+	do := func(method string, url string, body []byte, token string) (*http.Response, LoginTokens, error) {
+		lt := LoginTokens{}
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, lt, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, lt, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&lt)
+		}
+		return resp, lt, err
+	}
+	exchange := func(refreshToken string) (*http.Response, LoginTokens, error) {
+		b, err := json.Marshal(OneTimeToken{Token: refreshToken})
+		if err != nil {
+			return nil, LoginTokens{}, err
+		}
+		return do(http.MethodPost, testServerToken.URL, b, "")
+	}
+
+	resp, login, err := do(http.MethodPut, testServerLogin.URL, credBytes, "")
+	if err != nil || resp.StatusCode != http.StatusOK || login.AccessToken == "" || login.RefreshToken == "" {
+		t.Errorf("login did not return tokens: %+v, error: %v", login, err)
+		return
+	}
+	if resp, _, err := do(http.MethodGet, testServer.URL, nil, login.RefreshToken); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("refresh token authenticated a request, error: %v", err)
+		return
+	}
+
+	resp, exchanged, err := exchange(login.RefreshToken)
+	if err != nil || resp.StatusCode != http.StatusOK || exchanged.AccessToken == "" || exchanged.RefreshToken == "" {
+		t.Errorf("exchange did not return tokens: %+v, error: %v", exchanged, err)
+		return
+	}
+	claims, err := parseClaims(exchanged.AccessToken)
+	if err != nil || claims.Email != em || claims.AuthMethod != AuthMethodPassword {
+		t.Errorf("wrong access token claims: %+v, error: %v", claims, err)
+		return
+	}
+	if resp, _, err := do(http.MethodGet, testServer.URL, nil, exchanged.AccessToken); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("exchanged access token did not authenticate, error: %v", err)
+		return
+	}
+	if resp, _, err := exchange(login.RefreshToken); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("used refresh token was exchanged again, error: %v", err)
+		return
+	}
+
+	// Reuse revoked the family of login, so logout-all uses a new login.
+	resp, login, err = do(http.MethodPut, testServerLogin.URL, credBytes, "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("login did not return tokens: %+v, error: %v", login, err)
+		return
+	}
+	if resp, _, err := do(http.MethodDelete, testServerLogoutAll.URL, nil, login.AccessToken); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("logout-all did not return proper status, error: %v", err)
+		return
+	}
+	if resp, _, err := exchange(login.RefreshToken); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("refresh token exchanged after logout-all, error: %v", err)
+		return
+	}
+}
+
+// TestRefreshTokenReuse verifies exchanging a used refresh token revokes the access and
+// refresh tokens of its family, and not tokens of another login.
+func TestRefreshTokenReuse(t *testing.T) {
+	testSetup()
+	config.IssueRefreshToken = true
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	testServerToken := httptest.NewServer(http.HandlerFunc(handlerFuncNoAuthWrapperCommon(handlerToken, false)))
+	defer testServerToken.Close()
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+
+	do := func(method string, url string, body []byte, token string) (int, LoginTokens, error) {
+		lt := LoginTokens{}
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+		if err != nil {
+			return 0, lt, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, lt, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&lt)
+		}
+		return resp.StatusCode, lt, err
+	}
+	exchange := func(refreshToken string) (int, LoginTokens, error) {
+		b, err := json.Marshal(OneTimeToken{Token: refreshToken})
+		if err != nil {
+			return 0, LoginTokens{}, err
+		}
+		return do(http.MethodPost, testServerToken.URL, b, "")
+	}
+
+	var logins [2]LoginTokens
+	for i := range logins {
+		var status int
+		status, logins[i], err = do(http.MethodPut, testServerLogin.URL, credBytes, "")
+		if err != nil || status != http.StatusOK {
+			t.Errorf("login did not return tokens, status: %d, error: %v", status, err)
+			return
+		}
+	}
+	access, err := parseClaims(logins[0].AccessToken)
+	if err != nil || access.Family == "" {
+		t.Errorf("access token has no family: %+v, error: %v", access, err)
+		return
+	}
+	refresh, err := parseClaims(logins[0].RefreshToken)
+	if err != nil || refresh.Family != access.Family {
+		t.Errorf("refresh token family: %s, expected: %s, error: %v", refresh.Family, access.Family, err)
+		return
+	}
+
+	status, exchanged, err := exchange(logins[0].RefreshToken)
+	if err != nil || status != http.StatusOK {
+		t.Errorf("exchange did not return tokens, status: %d, error: %v", status, err)
+		return
+	}
+	if claims, err := parseClaims(exchanged.AccessToken); err != nil || claims.Family != access.Family {
+		t.Errorf("exchanged access token family: %s, expected: %s, error: %v", claims.Family, access.Family, err)
+		return
+	}
+	if status, _, err := exchange(logins[0].RefreshToken); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("reused refresh token did not return proper status: %d, error: %v", status, err)
+		return
+	}
+
+	tests := []struct {
+		token    string
+		exchange bool
+		status   int
+	}{
+		{logins[0].AccessToken, false, http.StatusUnauthorized},
+		{exchanged.AccessToken, false, http.StatusUnauthorized},
+		{exchanged.RefreshToken, true, http.StatusUnauthorized},
+		{logins[1].AccessToken, false, http.StatusNoContent},
+		{logins[1].RefreshToken, true, http.StatusOK},
+	}
+	for i, tc := range tests {
+		var status int
+		if tc.exchange {
+			status, _, err = exchange(tc.token)
+		} else {
+			status, _, err = do(http.MethodGet, testServer.URL, nil, tc.token)
+		}
+		if err != nil || status != tc.status {
+			t.Errorf("test %d, status: %d, expected: %d, error: %v", i, status, tc.status, err)
+			return
+		}
+	}
+}
+
+// TestRefreshTokenVersion verifies refresh tokens issued before BumpTokenVersion or
+// AuthTokenVersionBump cannot be exchanged, with TokenVersionEnforced.
+func TestRefreshTokenVersion(t *testing.T) {
+	for _, global := range []bool{false, true} {
+		testSetup()
+		config.IssueRefreshToken = true
+		config.TokenVersionEnforced = true
+
+		em, credBytes, err := createAuth(t, nil)
+		if err != nil {
+			return
+		}
+		testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+		defer testServerLogin.Close()
+		testServerToken := httptest.NewServer(http.HandlerFunc(handlerFuncNoAuthWrapperCommon(handlerToken, false)))
+		defer testServerToken.Close()
+
+		req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("login error: %v", err)
+			return
+		}
+		login := LoginTokens{}
+		err = json.NewDecoder(resp.Body).Decode(&login)
+		resp.Body.Close()
+		if err != nil || login.RefreshToken == "" {
+			t.Errorf("login did not return a refresh token: %+v, error: %v", login, err)
+			return
+		}
+
+		if global {
+			_, err = BumpTokenVersion()
+		} else {
+			err = AuthTokenVersionBump(em)
+		}
+		if err != nil {
+			t.Errorf("global: %t, bump error: %v", global, err)
+			return
+		}
+		b, err := json.Marshal(OneTimeToken{Token: login.RefreshToken})
+		if err != nil {
+			t.Errorf("marshal error: %v", err)
+			return
+		}
+		resp, err = http.Post(testServerToken.URL, "application/json", bytes.NewBuffer(b))
+		if err != nil {
+			t.Errorf("exchange error: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("global: %t, pre-bump refresh token exchange status: %d", global, resp.StatusCode)
+			return
+		}
+	}
+}
+
+// TestRefreshTokenDelete verifies deleting an auth removes its refresh tokens, so they are
+// rejected after an auth with the same email is created again.
+func TestRefreshTokenDelete(t *testing.T) {
+	testSetup()
+	config.IssueRefreshToken = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	req := httptest.NewRequest(http.MethodPut, "/", bytes.NewBuffer(credBytes))
+	rr := httptest.NewRecorder()
+	handlerLogin(rr, req)
+	login := LoginTokens{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &login); err != nil || login.RefreshToken == "" {
+		t.Errorf("login did not return a refresh token: %+v, error: %v", login, err)
+		return
+	}
+	req = httptest.NewRequest(http.MethodDelete, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+login.AccessToken)
+	rr = httptest.NewRecorder()
+	HandlerFuncAuthJWTWrapper(handlerDelete)(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("delete did not return proper status: %d", rr.Code)
+		return
+	}
+	if _, _, err := createAuth(t, &em); err != nil {
+		return
+	}
+
+	b, err := json.Marshal(OneTimeToken{Token: login.RefreshToken})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	rr = httptest.NewRecorder()
+	handlerFuncNoAuthWrapperCommon(handlerToken, false)(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(b)))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token of deleted auth did not return proper status: %d", rr.Code)
+		return
+	}
+}
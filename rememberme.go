@@ -0,0 +1,159 @@
+package authjwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+const (
+	defaultRememberMeExpirationInterval = 30 * 24 * time.Hour
+
+	// PurposeRememberMe is the Purpose of remember me tokens, issued at login with
+	// Credential.RememberMe. Unlike the other Purpose* tokens they are stored in kvsToken, and
+	// may be used until they expire or are revoked; they can only be used at PathRememberMe.
+	PurposeRememberMe = "remember-me"
+)
+
+// handlerRememberMe exchanges the remember me token in the OneTimeToken body for LoginTokens
+// with a new access token, with AuthMethodRememberMe, and a refresh token with
+// Config.IssueRefreshToken. The remember me token is not consumed, and the new token starts a
+// new session. A token bound to a DPoP key gets http.StatusBadRequest without a valid DPoP
+// proof, and one bound to a client certificate gets http.StatusUnauthorized on a connection
+// without the certificate.
+func handlerRememberMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ott := OneTimeToken{}
+	if err := httph.BodyUnmarshal(w, r, &ott); err != nil {
+		lpf(logh.Error, "remember me error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	claims, err := tokenAuthenticated(r.Context(), ott.Token, true, PurposeRememberMe, false)
+	if err == nil && claims.Purpose != PurposeRememberMe {
+		err = fmt.Errorf("%s token with purpose %q is not a remember me token", runtimeh.SourceInfo(), claims.Purpose)
+	}
+	if err != nil {
+		lpf(logh.Info, "remember me token rejected:%v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if claims.Confirmation != nil && claims.Confirmation.JKT != "" {
+		if err := dpopKeyValidate(r, "", claims.Confirmation.JKT); err != nil {
+			lpf(logh.Warning, "remember me DPoP proof rejected:%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if err := mtlsBindingValidate(r, claims); err != nil {
+		lpf(logh.Warning, "remember me token rejected:%v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The auth may have been deleted, disabled, or required to change password after login.
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil || auth.Disabled || passwordChangeRequired(auth) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var family string
+	if config.IssueRefreshToken {
+		if family, err = uniqueID(false); err != nil {
+			lpf(logh.Error, "uniqueID error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	authTime := timeNow().Unix()
+	lt := LoginTokens{}
+	to := tokenOptions{authTime: authTime, client: clientFingerprint(r), cnf: claims.Confirmation, family: family,
+		method: AuthMethodRememberMe}
+	if lt.AccessToken, err = authTokenStringCreateClient(r, claims.Email, to); err != nil {
+		lpf(logh.Error, "authTokenStringCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if config.IssueRefreshToken {
+		if lt.RefreshToken, err = refreshTokenCreate(claims.Email, to); err != nil {
+			lpf(logh.Error, "refreshTokenCreate error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	b, err := json.Marshal(lt)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("remember me token exchanged for email: %s", auditEmail(claims.Email))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// rememberMeTokenCreate stores in kvsToken, with the tokenMetadata of request r, and returns a
+// remember me token for email, bound per cnf when not nil, valid for
+// config.RememberMeExpirationInterval. Config.IdleTimeout does not apply to the token.
+func rememberMeTokenCreate(r *http.Request, email string, cnf *Confirmation) (string, error) {
+	tokenID, err := uniqueID(true)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("uniqueID error", err)
+	}
+	tv, utv, err := tokenVersions(email)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("rememberMeTokenCreate error", err)
+	}
+	claims := CustomClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  config.Audience,
+			ExpiresAt: timeNow().Add(config.RememberMeExpirationInterval).Unix(),
+			Id:        tokenID,
+			Issuer:    tokenIssuer(),
+		},
+		AuthMethod:       AuthMethodPassword,
+		Confirmation:     cnf,
+		Email:            email,
+		TokenID:          tokenID,
+		Purpose:          PurposeRememberMe,
+		TokenVersion:     tv,
+		UserTokenVersion: utv,
+	}
+
+	if err := tokenIDUnused(kvsToken, claims.tokenKVSKey()); err != nil {
+		return "", err
+	}
+	tm := requestTokenMetadata(r)
+	tm.Purpose = PurposeRememberMe
+	b, err := tokenValue(claims.ExpiresAt, tm)
+	if err != nil {
+		return "", err
+	}
+	if err := kvsToken.Set(claims.tokenKVSKey(), b); err != nil {
+		return "", runtimeh.SourceInfoError("kvsToken.Set error", err)
+	}
+	return tokenSign(claims)
+}
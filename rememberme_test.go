@@ -0,0 +1,131 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRememberMe verifies a login with RememberMe returns a remember me token that cannot
+// authenticate requests, is exchanged repeatedly at PathRememberMe for tokens with
+// AuthMethodRememberMe, is listed as a session, and is revoked independently.
+func TestRememberMe(t *testing.T) {
+	testSetup()
+	config.RememberMeEnabled = true
+	config.PathSessions = "/auth/sessions"
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	cred := Credential{}
+	if err := json.Unmarshal(credBytes, &cred); err != nil {
+		t.Errorf("unmarshal error: %v", err)
+		return
+	}
+	cred.RememberMe = true
+	rememberBytes, err := json.Marshal(cred)
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+
+	do := func(hf http.HandlerFunc, method string, target string, token string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewBuffer(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		hf(rr, req)
+		return rr
+	}
+	exchange := func(token string) (int, LoginTokens) {
+		b, err := json.Marshal(OneTimeToken{Token: token})
+		if err != nil {
+			t.Errorf("marshal error: %v", err)
+			return 0, LoginTokens{}
+		}
+		rr := do(handlerFuncNoAuthWrapperCommon(handlerRememberMe, false), http.MethodPost, "/auth/remember-me", "", b)
+		lt := LoginTokens{}
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &lt); err != nil {
+				t.Errorf("unmarshal error: %v", err)
+			}
+		}
+		return rr.Code, lt
+	}
+	authenticate := func(token string) int {
+		return do(HandlerFuncAuthJWTWrapper(handlerTest), http.MethodGet, "/", token, nil).Code
+	}
+
+	// Logins without RememberMe return the token.
+	if rr := do(handlerLogin, http.MethodPut, "/auth/login", "", credBytes); rr.Code != http.StatusOK || authenticate(rr.Body.String()) != http.StatusNoContent {
+		t.Errorf("login without RememberMe did not return proper status: %d", rr.Code)
+		return
+	}
+	rr := do(handlerLogin, http.MethodPut, "/auth/login", "", rememberBytes)
+	login := LoginTokens{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &login); err != nil || rr.Code != http.StatusOK || login.RememberMeToken == "" {
+		t.Errorf("login did not return a remember me token: %d, %+v, error: %v", rr.Code, login, err)
+		return
+	}
+	if status := authenticate(login.RememberMeToken); status != http.StatusUnauthorized {
+		t.Errorf("remember me token authenticated a request: %d", status)
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		status, lt := exchange(login.RememberMeToken)
+		if status != http.StatusOK || authenticate(lt.AccessToken) != http.StatusNoContent {
+			t.Errorf("exchange %d did not return proper status: %d", i, status)
+			return
+		}
+		claims, err := parseClaims(lt.AccessToken)
+		if err != nil || claims.AuthMethod != AuthMethodRememberMe {
+			t.Errorf("wrong access token claims: %+v, error: %v", claims, err)
+			return
+		}
+	}
+	if status, _ := exchange(login.AccessToken); status != http.StatusUnauthorized {
+		t.Errorf("exchange of an access token did not return proper status: %d", status)
+		return
+	}
+
+	sessions, err := sessionsList(em)
+	if err != nil {
+		t.Errorf("sessionsList error: %v", err)
+		return
+	}
+	remember, err := parseClaims(login.RememberMeToken)
+	if err != nil {
+		t.Errorf("parseClaims error: %v", err)
+		return
+	}
+	found := false
+	for _, s := range sessions {
+		found = found || (s.TokenID == remember.TokenID && s.Purpose == PurposeRememberMe)
+	}
+	if !found {
+		t.Errorf("remember me token not in sessions: %+v", sessions)
+		return
+	}
+	if n, err := sessionsActive(em); err != nil || n != 4 {
+		t.Errorf("sessionsActive: %d, error: %v", n, err)
+		return
+	}
+
+	if rr := do(HandlerFuncAuthJWTWrapper(handlerSessions), http.MethodDelete, config.PathSessions+"/"+remember.TokenID, login.AccessToken, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("session revoke did not return proper status: %d", rr.Code)
+		return
+	}
+	if status, _ := exchange(login.RememberMeToken); status != http.StatusUnauthorized {
+		t.Errorf("exchange of revoked remember me token did not return proper status: %d", status)
+		return
+	}
+	if status := authenticate(login.AccessToken); status != http.StatusNoContent {
+		t.Errorf("access token of login revoked with remember me token: %d", status)
+		return
+	}
+}
@@ -0,0 +1,98 @@
+package authjwt
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// TokenRestriction limits the requests a token is valid for, I.E. a file download link; see
+// AuthTokenCreateRestricted.
+type TokenRestriction struct {
+	// Methods are the HTTP methods the token is valid for; any method when empty.
+	Methods []string `json:"methods,omitempty"`
+	// Paths are the URL path prefixes the token is valid for, matched on whole path segments,
+	// so /files matches /files and /files/a but not /filesystem; any path when empty.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// AuthTokenCreateRestricted creates a token for the auth with email that is only valid for
+// requests allowed by restriction, valid for ttl; the token TTL of the auth when ttl is zero or
+// longer. HandlerFuncAuthJWTWrapper and Authenticated reject other requests with
+// http.StatusForbidden, and the token cannot be used with the authjwt handlers, I.E. to refresh
+// or create an API key. The token is stored, so it can be revoked; see TokenRevoke.
+func AuthTokenCreateRestricted(email string, restriction TokenRestriction, ttl time.Duration) (string, error) {
+	if len(restriction.Methods) == 0 && len(restriction.Paths) == 0 {
+		return "", fmt.Errorf("%s restriction has no methods or paths", runtimeh.SourceInfo())
+	}
+	auth, err := authGet(email)
+	if err != nil {
+		return "", err
+	}
+	if auth.Email == nil {
+		return "", fmt.Errorf("%s auth does not exist for email: %s", runtimeh.SourceInfo(), email)
+	}
+	if max := tokenTTL(email); ttl <= 0 || ttl > max {
+		ttl = max
+	}
+	claims, err := authClaimsCreate(email, tokenOptions{}, ttl)
+	if err != nil {
+		return "", err
+	}
+	claims.Restriction = &restriction
+	return authClaimsStore(nil, claims)
+}
+
+// Allowed returns true if a request with method and URL path is allowed by tr. A nil tr
+// allows all requests; used by callers of ValidateTokenString.
+func (tr *TokenRestriction) Allowed(method string, path string) bool {
+	if tr == nil {
+		return true
+	}
+	if len(tr.Methods) > 0 && !restrictionContains(tr.Methods, method) {
+		return false
+	}
+	if len(tr.Paths) == 0 {
+		return true
+	}
+	for _, p := range tr.Paths {
+		prefix := strings.TrimSuffix(p, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictedRejected returns true, and writes http.StatusForbidden, for tokens with a
+// TokenRestriction. Used by the authjwt handlers, so restricted tokens cannot obtain other
+// tokens or change the account.
+func restrictedRejected(w http.ResponseWriter, claims *CustomClaims) bool {
+	if claims.Restriction == nil {
+		return false
+	}
+	w.WriteHeader(http.StatusForbidden)
+	return true
+}
+
+// restrictionContains returns true if values contains value.
+func restrictionContains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictionValidate returns an error if claims have a TokenRestriction that does not allow
+// request r.
+func restrictionValidate(r *http.Request, claims *CustomClaims) error {
+	if !claims.Restriction.Allowed(r.Method, r.URL.Path) {
+		return fmt.Errorf("%s restricted token used for %s %s", runtimeh.SourceInfo(), r.Method, r.URL.Path)
+	}
+	return nil
+}
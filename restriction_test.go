@@ -0,0 +1,91 @@
+package authjwt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAuthTokenCreateRestricted verifies restricted tokens are only valid for the allowed methods
+// and paths, and cannot be used with the authjwt handlers.
+func TestAuthTokenCreateRestricted(t *testing.T) {
+	testSetup()
+
+	em, _, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	if _, err := AuthTokenCreateRestricted(em, TokenRestriction{}, 0); err == nil {
+		t.Errorf("token created without a restriction")
+		return
+	}
+	if _, err := AuthTokenCreateRestricted("none@auth.com", TokenRestriction{Paths: []string{"/files"}}, 0); err == nil {
+		t.Errorf("token created for an auth that does not exist")
+		return
+	}
+	token, err := AuthTokenCreateRestricted(em, TokenRestriction{Methods: []string{http.MethodGet}, Paths: []string{"/files/"}}, time.Minute)
+	if err != nil {
+		t.Errorf("AuthTokenCreateRestricted error: %v", err)
+		return
+	}
+	claims, err := parseClaims(token)
+	if err != nil || claims.ExpiresAt > timeNow().Add(time.Minute).Unix() {
+		t.Errorf("wrong claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	tests := []struct {
+		hf     http.HandlerFunc
+		method string
+		target string
+		status int
+	}{
+		{HandlerFuncAuthJWTWrapper(handlerTest), http.MethodGet, "/files", http.StatusNoContent},
+		{HandlerFuncAuthJWTWrapper(handlerTest), http.MethodGet, "/files/report.pdf", http.StatusNoContent},
+		{HandlerFuncAuthJWTWrapper(handlerTest), http.MethodGet, "/filesystem", http.StatusForbidden},
+		{HandlerFuncAuthJWTWrapper(handlerTest), http.MethodDelete, "/files/report.pdf", http.StatusForbidden},
+		{HandlerFuncAuthJWTWrapper(handlerTest), http.MethodGet, "/", http.StatusForbidden},
+		// An authjwt handler within the restriction still rejects the token.
+		{HandlerFuncAuthJWTWrapper(handlerInfo), http.MethodGet, "/files/info", http.StatusForbidden},
+	}
+	for i, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		tc.hf(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("test %d, %s %s did not return proper status: %d, expected: %d", i, tc.method, tc.target, rr.Code, tc.status)
+			return
+		}
+	}
+
+	if found, err := TokenRevoke(claims.TokenID); err != nil || !found {
+		t.Errorf("TokenRevoke found: %t, error: %v", found, err)
+		return
+	}
+}
+
+// TestTokenRestrictionAllowed verifies methods and path prefixes of TokenRestriction.
+func TestTokenRestrictionAllowed(t *testing.T) {
+	tests := []struct {
+		tr      *TokenRestriction
+		method  string
+		path    string
+		allowed bool
+	}{
+		{nil, http.MethodPost, "/any", true},
+		{&TokenRestriction{Methods: []string{http.MethodGet}}, http.MethodGet, "/any", true},
+		{&TokenRestriction{Methods: []string{http.MethodGet}}, http.MethodPost, "/any", false},
+		{&TokenRestriction{Paths: []string{"/a", "/b/c"}}, http.MethodPost, "/b/c/d", true},
+		{&TokenRestriction{Paths: []string{"/a", "/b/c"}}, http.MethodPost, "/b", false},
+		{&TokenRestriction{Paths: []string{"/a"}}, http.MethodGet, "/ab", false},
+		{&TokenRestriction{Methods: []string{http.MethodGet}, Paths: []string{"/a"}}, http.MethodPut, "/a", false},
+	}
+	for i, tc := range tests {
+		if allowed := tc.tr.Allowed(tc.method, tc.path); allowed != tc.allowed {
+			t.Errorf("test %d, allowed: %t, expected: %t", i, allowed, tc.allowed)
+			return
+		}
+	}
+}
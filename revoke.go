@@ -0,0 +1,64 @@
+package authjwt
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/paulfdunn/go-helper/logh"
+)
+
+// handlerRevoke implements token revocation per RFC 7009; the token in the form parameter
+// token is removed from the token store immediately, so gateways and admins can revoke a
+// compromised token by value. Having the token is the authorization to revoke it. Access
+// tokens, including tokens from PathTokenExchange, and refresh tokens are revoked; revoking a
+// refresh token revokes its refresh token family. The token_type_hint parameter is not
+// needed, and ignored. Per RFC 7009, invalid, expired, and
+// already revoked tokens get http.StatusOK, so the response does not show if the token was
+// valid.
+func handlerRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, oauthInvalidRequest, err)
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		oauthError(w, oauthInvalidRequest, fmt.Errorf("no token"))
+		return
+	}
+
+	claims, err := parseClaimsCommon(token, true)
+	if err != nil {
+		lpf(logh.Info, "revoke of invalid token:%v", err)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var n int64
+	switch {
+	case claims.Purpose == PurposeRefreshToken && claims.Family != "":
+		// Per RFC 7009 the access tokens issued with the refresh token are also revoked.
+		var revoked int
+		revoked, err = tokenFamilyRevoke(claims.Email, claims.Family)
+		n = int64(revoked)
+	case claims.Purpose == PurposeRememberMe:
+		n, err = tokenDelete(kvsToken, claims.tokenKVSKey())
+	case claims.Purpose != "":
+		n, err = kvsOneTime.Delete(claims.tokenKVSKey())
+	default:
+		n, err = tokenDelete(kvsToken, claims.tokenKVSKey())
+	}
+	if err != nil {
+		lpf(logh.Error, "token revoke error:%v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if n > 0 {
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("token revoked for email: %s, jti: %s", claims.auditAuth(), claims.TokenID)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
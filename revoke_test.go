@@ -0,0 +1,110 @@
+package authjwt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestRevoke verifies tokens are revoked by value, immediately and without revoking other
+// tokens of the user, revoking a refresh token revokes its family, and invalid tokens get
+// http.StatusOK.
+func TestRevoke(t *testing.T) {
+	testSetup()
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	revoked, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	kept, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	refresh, err := refreshTokenCreate(em, tokenOptions{method: AuthMethodPassword})
+	if err != nil {
+		t.Errorf("refreshTokenCreate error: %v", err)
+		return
+	}
+	family, err := uniqueID(false)
+	if err != nil {
+		t.Errorf("uniqueID error: %v", err)
+		return
+	}
+	familyAccess, err := authTokenStringCreateClient(nil, em, tokenOptions{family: family, method: AuthMethodPassword})
+	if err != nil {
+		t.Errorf("authTokenStringCreateClient error: %v", err)
+		return
+	}
+	familyRefresh, err := refreshTokenCreate(em, tokenOptions{family: family, method: AuthMethodPassword})
+	if err != nil {
+		t.Errorf("refreshTokenCreate error: %v", err)
+		return
+	}
+	testServerRevoke := httptest.NewServer(http.HandlerFunc(handlerFuncNoAuthWrapperCommon(handlerRevoke, false)))
+	defer testServerRevoke.Close()
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+
+	revoke := func(form url.Values) (int, error) {
+		resp, err := http.Post(testServerRevoke.URL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	request := func(token []byte) (int, error) {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	tests := []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{"token": {string(revoked)}}, http.StatusOK},
+		{url.Values{"token": {string(revoked)}, "token_type_hint": {"access_token"}}, http.StatusOK},
+		{url.Values{"token": {refresh}, "token_type_hint": {"refresh_token"}}, http.StatusOK},
+		{url.Values{"token": {familyRefresh}}, http.StatusOK},
+		{url.Values{"token": {"not a token"}}, http.StatusOK},
+		{url.Values{}, http.StatusBadRequest},
+	}
+	for i, tc := range tests {
+		if status, err := revoke(tc.form); err != nil || status != tc.status {
+			t.Errorf("test %d, status: %d, expected: %d, error: %v", i, status, tc.status, err)
+			return
+		}
+	}
+
+	if status, err := request(revoked); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("revoked token did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if status, err := request([]byte(familyAccess)); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("access token of revoked refresh token family did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if status, err := request(kept); err != nil || status != http.StatusNoContent {
+		t.Errorf("other token did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if _, err := oneTimeTokenConsume(refresh, PurposeRefreshToken); err == nil {
+		t.Errorf("revoked refresh token was consumed")
+		return
+	}
+}
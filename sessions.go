@@ -0,0 +1,378 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// sessionLastUsedInterval is the resolution of tokenMetadata.LastUsed; the token store is
+// written at most once per interval for each token, rather than on every request.
+const sessionLastUsedInterval = time.Minute
+
+// tokenMetadata is the metadata stored with each token in kvsToken, following the expiration;
+// see tokenValue.
+type tokenMetadata struct {
+	IP        string `json:"ip,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	LastUsed  int64  `json:"used,omitempty"`
+	Purpose   string `json:"purpose,omitempty"`
+	UserAgent string `json:"ua,omitempty"`
+}
+
+var (
+	// sessionLimitMutex makes the session count and token create atomic, see sessionLimitEnforce,
+	// so concurrent logins cannot exceed a limit from config.RoleSessionLimits.
+	sessionLimitMutex sync.Mutex
+	// tokenDeleteMutex is held to remove tokens from the token stores, see tokenDelete, and by
+	// sessionUsed from checking a token exists to storing its use, so a token removed during a
+	// request is not stored again.
+	tokenDeleteMutex sync.Mutex
+)
+
+// handlerSessions returns the Session of each outstanding token of the caller, so users can
+// review where they are logged in, or with http.MethodDelete and a TokenID following the path,
+// revokes that session; see sessionRevoke. Admins may list or revoke the sessions of another
+// user with query parameter email.
+func handlerSessions(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, config.PathSessions), "/")
+	if !(r.Method == http.MethodGet && id == "") && !(r.Method == http.MethodDelete && id != "") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	email := claims.Email
+	if qe := emailNormalize(r.URL.Query().Get("email")); qe != "" && qe != claims.Email {
+		if !adminAuthorized(w, r, claims) {
+			return
+		}
+		email = qe
+	}
+	if r.Method == http.MethodDelete {
+		sessionRevoke(w, email, id)
+		return
+	}
+
+	sessions, err := sessionsList(email)
+	if err != nil {
+		lpf(logh.Error, "sessionsList error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(sessions)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// requestTokenMetadata returns the tokenMetadata for a token issued now for request r; r may be
+// nil for tokens issued without a request.
+func requestTokenMetadata(r *http.Request) tokenMetadata {
+	tm := tokenMetadata{IssuedAt: timeNow().Unix()}
+	if r != nil {
+		tm.IP = clientIP(r)
+		tm.UserAgent = r.UserAgent()
+	}
+	return tm
+}
+
+// sessionExpiration returns exp, limited to the end of the session started at authTime per
+// config.MaxSessionLifetime.
+func sessionExpiration(authTime int64, exp int64) int64 {
+	if config.MaxSessionLifetime <= 0 || authTime == 0 {
+		return exp
+	}
+	if end := time.Unix(authTime, 0).Add(config.MaxSessionLifetime).Unix(); end < exp {
+		return end
+	}
+	return exp
+}
+
+// sessionLifetimeValidate returns an error if the session of claims is older than
+// config.MaxSessionLifetime, with config.ClockSkewLeeway; so tokens issued before
+// MaxSessionLifetime was set or reduced are also rejected.
+func sessionLifetimeValidate(claims *CustomClaims) error {
+	if config.MaxSessionLifetime <= 0 || claims.AuthTime == 0 {
+		return nil
+	}
+	end := time.Unix(claims.AuthTime, 0).Add(config.MaxSessionLifetime + config.ClockSkewLeeway)
+	if !jwt.TimeFunc().Before(end) {
+		return fmt.Errorf("%s session of email: %s ended at %v", runtimeh.SourceInfo(), auditEmail(claims.Email), end)
+	}
+	return nil
+}
+
+// sessionLimit returns the limit from config.RoleSessionLimits for auth; the limit of the
+// first role of auth, in the order set with AuthRolesSet, that has a limit, otherwise the
+// limit for the empty role. ok is false when no limit applies.
+func sessionLimit(auth authentication) (limit int, ok bool) {
+	for _, role := range authRoles(auth) {
+		if limit, ok = config.RoleSessionLimits[role]; ok {
+			return limit, true
+		}
+	}
+	limit, ok = config.RoleSessionLimits[""]
+	return limit, ok
+}
+
+// sessionLimitEnforce applies the session limit of auth, per sessionLimit, before a session is
+// created for email. When the limit is reached the oldest sessions are revoked, with
+// config.SessionLimitEvictOldest, otherwise http.StatusConflict is written and ok is false.
+// When ok is true the caller must call unlock after creating the token, so concurrent logins
+// cannot exceed the limit. login is the type of login in audit messages, I.E. "login".
+func sessionLimitEnforce(w http.ResponseWriter, email string, auth authentication, login string) (unlock func(), ok bool) {
+	limit, limited := sessionLimit(auth)
+	if !limited {
+		return func() {}, true
+	}
+	sessionLimitMutex.Lock()
+	n, err := sessionsActive(email)
+	if err != nil {
+		sessionLimitMutex.Unlock()
+		lpf(logh.Error, "sessionsActive error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	if n >= limit && config.SessionLimitEvictOldest {
+		evicted, err := sessionsEvict(email, n-limit+1)
+		if err != nil {
+			sessionLimitMutex.Unlock()
+			lpf(logh.Error, "sessionsEvict error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil, false
+		}
+		lpf(logh.Info, "%s for email: %s, session limit %d reached, evicted sessions: %v", login, auditEmail(email), limit, evicted)
+	} else if n >= limit {
+		sessionLimitMutex.Unlock()
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("%s for email: %s, session limit %d reached", login, auditEmail(email), limit)
+		}
+		w.WriteHeader(http.StatusConflict)
+		return nil, false
+	}
+	return sessionLimitMutex.Unlock, true
+}
+
+// sessionRevoke revokes the token of email with TokenID id, so a user can log out one
+// device, per sessionTokenRevoke. http.StatusNotFound is written if there is no such token.
+func sessionRevoke(w http.ResponseWriter, email string, id string) {
+	b, err := kvsToken.Get(email + "|" + id)
+	if err != nil {
+		lpf(logh.Error, "kvsToken.Get error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if b == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := sessionTokenRevoke(email, id); err != nil {
+		lpf(logh.Error, "sessionTokenRevoke error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("session revoked for email: %s, jti: %s", auditEmail(email), id)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionsActive returns the number of unexpired tokens in kvsToken for email, excluding
+// remember me tokens.
+func sessionsActive(email string) (int, error) {
+	keys, err := userTokenKeys(email)
+	if err != nil {
+		return 0, err
+	}
+	now := timeNow().Unix()
+	active := 0
+	for _, key := range keys {
+		b, err := kvsToken.Get(key)
+		if err != nil {
+			return 0, runtimeh.SourceInfoError("kvsToken.Get error", err)
+		}
+		if b == nil {
+			continue
+		}
+		expiresAt, tm, err := tokenValueParse(b)
+		if err != nil {
+			return 0, err
+		}
+		if expiresAt > now && tm.Purpose == "" {
+			active++
+		}
+	}
+	return active, nil
+}
+
+// sessionsEvict revokes the n unexpired sessions of email, excluding remember me tokens, with
+// the oldest IssuedAt, per sessionTokenRevoke, and returns the TokenIDs of the revoked sessions.
+func sessionsEvict(email string, n int) ([]string, error) {
+	sessions, err := sessionsList(email)
+	if err != nil {
+		return nil, err
+	}
+	now := timeNow().Unix()
+	active := []Session{}
+	for _, s := range sessions {
+		if s.ExpiresAt > now && s.Purpose == "" {
+			active = append(active, s)
+		}
+	}
+	sort.SliceStable(active, func(i, j int) bool { return active[i].IssuedAt < active[j].IssuedAt })
+	evicted := []string{}
+	for _, s := range active {
+		if len(evicted) >= n {
+			break
+		}
+		if err := sessionTokenRevoke(email, s.TokenID); err != nil {
+			return evicted, err
+		}
+		evicted = append(evicted, s.TokenID)
+	}
+	return evicted, nil
+}
+
+// sessionsList returns the Session of each token in kvsToken for email.
+func sessionsList(email string) ([]Session, error) {
+	keys, err := userTokenKeys(email)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	for _, key := range keys {
+		b, err := kvsToken.Get(key)
+		if err != nil {
+			return nil, runtimeh.SourceInfoError("kvsToken.Get error", err)
+		}
+		if b == nil {
+			continue
+		}
+		expiresAt, tm, err := tokenValueParse(b)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, Session{ExpiresAt: expiresAt, IP: tm.IP, IssuedAt: tm.IssuedAt, LastUsed: tm.LastUsed,
+			Purpose: tm.Purpose, TokenID: strings.TrimPrefix(key, email+"|"), UserAgent: tm.UserAgent})
+	}
+	return sessions, nil
+}
+
+// sessionTokenRevoke removes the token of email with TokenID id from kvsToken; tokens in a
+// refresh token family are revoked with the family, so the device cannot refresh.
+func sessionTokenRevoke(email string, id string) error {
+	if family, _, ok := strings.Cut(id, familySeparator); ok {
+		_, err := tokenFamilyRevoke(email, family)
+		return err
+	}
+	if _, err := tokenDelete(kvsToken, email+"|"+id); err != nil {
+		return runtimeh.SourceInfoError("kvsToken.Delete error", err)
+	}
+	return nil
+}
+
+// sessionUsed records the use of the token with claims and value b from kvsToken to
+// authenticate a request; LastUsed is updated, and for tokens without a Purpose the expiration
+// extended with config.IdleTimeout, per idleExpiration. An error is returned, and the token
+// removed, if the token was not used within config.IdleTimeout. An error is also returned if
+// the token was removed from kvsToken after b was read, and the token is not stored again.
+func sessionUsed(claims *CustomClaims, b []byte) error {
+	expiresAt, tm, err := tokenValueParse(b)
+	if err != nil {
+		return err
+	}
+	now := timeNow()
+	idle := config.IdleTimeout > 0 && claims.Purpose == ""
+	if idle && !now.Before(time.Unix(expiresAt, 0)) {
+		if _, err := tokenDelete(kvsToken, claims.tokenKVSKey()); err != nil {
+			lpf(logh.Error, "kvsToken.Delete error:%+v", err)
+		}
+		return fmt.Errorf("%s token idle timeout for email: %s", runtimeh.SourceInfo(), auditEmail(claims.Email))
+	}
+	extended := expiresAt
+	if idle {
+		extended = idleExpiration(claims.ExpiresAt)
+	}
+	if extended <= expiresAt && now.Sub(time.Unix(tm.LastUsed, 0)) < sessionLastUsedInterval {
+		return nil
+	}
+	if extended < expiresAt {
+		extended = expiresAt
+	}
+	tm.LastUsed = now.Unix()
+	value, err := tokenValue(extended, tm)
+	if err != nil {
+		return err
+	}
+	// The token may have been removed, I.E. by a logout, since b was read.
+	tokenDeleteMutex.Lock()
+	defer tokenDeleteMutex.Unlock()
+	if b, err := kvsToken.Get(claims.tokenKVSKey()); b == nil || err != nil {
+		return fmt.Errorf("%s token removed while in use, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if err := kvsToken.Set(claims.tokenKVSKey(), value); err != nil {
+		return runtimeh.SourceInfoError("kvsToken.Set error", err)
+	}
+	return nil
+}
+
+// tokenDelete removes key from store, a token store, holding tokenDeleteMutex; see
+// sessionUsed.
+func tokenDelete(store tokenStore, key string) (int64, error) {
+	tokenDeleteMutex.Lock()
+	defer tokenDeleteMutex.Unlock()
+	return store.Delete(key)
+}
+
+// tokenValue returns the value stored in kvsToken for a token; expiresAt as an int64 little
+// endian, followed by tm as JSON. Readers that only need the expiration read the first 8
+// bytes, so values stored before tokenMetadata are still valid.
+func tokenValue(expiresAt int64, tm tokenMetadata) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, expiresAt); err != nil {
+		return nil, runtimeh.SourceInfoError("binary.Write failed", err)
+	}
+	b, err := json.Marshal(tm)
+	if err != nil {
+		return buf.Bytes(), runtimeh.SourceInfoError("json.Marshal error", err)
+	}
+	buf.Write(b)
+	return buf.Bytes(), nil
+}
+
+// tokenValueParse returns the expiration and tokenMetadata of value b from kvsToken. The
+// tokenMetadata is empty for values stored without it.
+func tokenValueParse(b []byte) (int64, tokenMetadata, error) {
+	tm := tokenMetadata{}
+	buf := bytes.NewBuffer(b)
+	var expiresAt int64
+	if err := binary.Read(buf, binary.LittleEndian, &expiresAt); err != nil {
+		return 0, tm, runtimeh.SourceInfoError("reading expiresAt error", err)
+	}
+	if buf.Len() > 0 {
+		if err := json.Unmarshal(buf.Bytes(), &tm); err != nil {
+			return 0, tm, runtimeh.SourceInfoError("token metadata unmarshal error", err)
+		}
+	}
+	return expiresAt, tm, nil
+}
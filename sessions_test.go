@@ -0,0 +1,591 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TestHandlerLoginRoleSessionLimits verifies users of different roles are limited to the
+// sessions for their role, and logging out a session allows another login.
+func TestHandlerLoginRoleSessionLimits(t *testing.T) {
+	testSetup()
+	config.RoleSessionLimits = map[string]int{RoleAdmin: 2, "": 3}
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(em, []string{"auditor"}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	adminEmail := "admin@auth.com"
+	_, adminCredBytes, err := createAuth(t, &adminEmail)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(adminEmail, []string{"auditor", RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	loginStatus := func(credBytes []byte) int {
+		req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return 0
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Do error: %v", err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		email     string
+		credBytes []byte
+		limit     int
+	}{
+		{em, credBytes, 3},
+		{adminEmail, adminCredBytes, 2},
+	}
+	for _, tc := range tests {
+		for i := 0; i < tc.limit; i++ {
+			if s := loginStatus(tc.credBytes); s != http.StatusOK {
+				t.Errorf("login %d for %s did not return proper status: %d", i, tc.email, s)
+				return
+			}
+		}
+		if s := loginStatus(tc.credBytes); s != http.StatusConflict {
+			t.Errorf("login over limit for %s did not return proper status: %d", tc.email, s)
+			return
+		}
+		keys, err := userTokenKeys(tc.email)
+		if err != nil || len(keys) != tc.limit {
+			t.Errorf("wrong tokens for %s: %v, error: %v", tc.email, keys, err)
+			return
+		}
+		if _, err := kvsToken.Delete(keys[0]); err != nil {
+			t.Errorf("Delete error: %v", err)
+			return
+		}
+		if s := loginStatus(tc.credBytes); s != http.StatusOK {
+			t.Errorf("login after logout for %s did not return proper status: %d", tc.email, s)
+			return
+		}
+	}
+}
+
+// TestMaxSessionLifetime verifies refreshed tokens keep the AuthTime of the login, expire at
+// the end of the session, and refresh fails after MaxSessionLifetime despite activity.
+func TestMaxSessionLifetime(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+	jwt.TimeFunc = func() time.Time { return now }
+	defer func() { jwt.TimeFunc = time.Now }()
+	config.IssueRefreshToken = true
+	config.JWTAuthExpirationInterval = 40 * time.Minute
+	config.MaxSessionLifetime = time.Hour
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	req := httptest.NewRequest(http.MethodPut, "/auth/login", bytes.NewBuffer(credBytes))
+	rr := httptest.NewRecorder()
+	handlerLogin(rr, req)
+	lt := LoginTokens{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &lt); err != nil || rr.Code != http.StatusOK {
+		t.Errorf("login did not return proper status: %d, error: %v", rr.Code, err)
+		return
+	}
+	authTime := now.Unix()
+	sessionEnd := now.Add(config.MaxSessionLifetime).Unix()
+
+	refresh := func() int {
+		b, err := json.Marshal(OneTimeToken{Token: lt.RefreshToken})
+		if err != nil {
+			t.Errorf("marshal error: %v", err)
+			return 0
+		}
+		req := httptest.NewRequest(http.MethodPost, "/auth/token", bytes.NewBuffer(b))
+		rr := httptest.NewRecorder()
+		handlerFuncNoAuthWrapperCommon(handlerToken, false)(rr, req)
+		if rr.Code == http.StatusOK {
+			lt = LoginTokens{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &lt); err != nil {
+				t.Errorf("unmarshal error: %v", err)
+			}
+		}
+		return rr.Code
+	}
+
+	tests := []struct {
+		elapsed time.Duration
+		status  int
+		exp     int64
+	}{
+		{30 * time.Minute, http.StatusOK, sessionEnd},
+		{59 * time.Minute, http.StatusOK, sessionEnd},
+		{61 * time.Minute, http.StatusUnauthorized, 0},
+	}
+	start := now
+	for i, tc := range tests {
+		now = start.Add(tc.elapsed)
+		if status := refresh(); status != tc.status {
+			t.Errorf("test %d, refresh did not return proper status: %d, expected: %d", i, status, tc.status)
+			return
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		claims, err := parseClaims(lt.AccessToken)
+		if err != nil || claims.AuthTime != authTime || claims.ExpiresAt != tc.exp {
+			t.Errorf("test %d, wrong access token claims: %+v, error: %v", i, claims, err)
+			return
+		}
+	}
+
+	// Tokens issued before MaxSessionLifetime was reduced are rejected.
+	now = start.Add(59 * time.Minute)
+	config.MaxSessionLifetime = 30 * time.Minute
+	if _, err := parseClaims(lt.AccessToken); err == nil {
+		t.Errorf("token of ended session was valid")
+		return
+	}
+}
+
+// TestHandlerInfoSessions verifies PathInfo returns the IP, User-Agent, and issue time of each
+// token, admins can get the sessions of another user, and other users cannot.
+func TestHandlerInfoSessions(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	login := func(credBytes []byte, userAgent string) string {
+		req := httptest.NewRequest(http.MethodPut, "/auth/login", bytes.NewBuffer(credBytes))
+		req.Header.Set("User-Agent", userAgent)
+		rr := httptest.NewRecorder()
+		handlerLogin(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("login did not return proper status: %d", rr.Code)
+		}
+		return rr.Body.String()
+	}
+	token := login(credBytes, "laptop")
+	now = now.Add(time.Minute)
+	login(credBytes, "phone")
+	adminEmail := "admin@auth.com"
+	_, adminCredBytes, err := createAuth(t, &adminEmail)
+	if err != nil {
+		return
+	}
+	if err := AuthRolesSet(adminEmail, []string{RoleAdmin}); err != nil {
+		t.Errorf("AuthRolesSet error: %v", err)
+		return
+	}
+	adminToken := login(adminCredBytes, "admin")
+
+	info := func(token string, query string) (int, Info) {
+		req := httptest.NewRequest(http.MethodGet, "/auth/info"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		HandlerFuncAuthJWTWrapper(handlerInfo)(rr, req)
+		info := Info{}
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+				t.Errorf("unmarshal error: %v", err)
+			}
+		}
+		return rr.Code, info
+	}
+
+	for _, tc := range []struct {
+		token string
+		query string
+	}{
+		{token, ""},
+		{adminToken, "?email=" + em},
+	} {
+		status, info := info(tc.token, tc.query)
+		if status != http.StatusOK || info.OutstandingTokens != 2 || len(info.Sessions) != 2 {
+			t.Errorf("info did not return proper status: %d, info: %+v", status, info)
+			return
+		}
+		issued := map[string]int64{}
+		for _, s := range info.Sessions {
+			if s.IP != "192.0.2.1" || s.TokenID == "" || s.ExpiresAt <= s.IssuedAt {
+				t.Errorf("wrong session: %+v", s)
+				return
+			}
+			issued[s.UserAgent] = s.IssuedAt
+		}
+		if issued["laptop"] != now.Add(-time.Minute).Unix() || issued["phone"] != now.Unix() {
+			t.Errorf("wrong session user agents or issue times: %+v", info.Sessions)
+			return
+		}
+	}
+	if status, _ := info(token, "?email="+adminEmail); status != http.StatusForbidden {
+		t.Errorf("non admin info of another user did not return proper status: %d", status)
+		return
+	}
+}
+
+// TestTokenValueParse verifies token values round trip, and values stored without
+// tokenMetadata parse with an empty tokenMetadata.
+func TestTokenValueParse(t *testing.T) {
+	tm := tokenMetadata{IP: "192.0.2.1", IssuedAt: 100, UserAgent: "agent"}
+	b, err := tokenValue(200, tm)
+	if err != nil {
+		t.Errorf("tokenValue error: %v", err)
+		return
+	}
+	if expiresAt, got, err := tokenValueParse(b); err != nil || expiresAt != 200 || got != tm {
+		t.Errorf("tokenValueParse: %d, %+v, error: %v", expiresAt, got, err)
+		return
+	}
+	if expiresAt, got, err := tokenValueParse(b[:8]); err != nil || expiresAt != 200 || got != (tokenMetadata{}) {
+		t.Errorf("tokenValueParse without metadata: %d, %+v, error: %v", expiresAt, got, err)
+		return
+	}
+}
+
+// TestHandlerSessions verifies PathSessions lists the sessions of the caller, with the time
+// each token was last used, and LastUsed is written at most once per sessionLastUsedInterval.
+func TestHandlerSessions(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+	config.PathSessions = "/auth/sessions"
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	sessions := func() (int, []Session) {
+		req := httptest.NewRequest(http.MethodGet, "/auth/sessions", nil)
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		rr := httptest.NewRecorder()
+		HandlerFuncAuthJWTWrapper(handlerSessions)(rr, req)
+		sessions := []Session{}
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &sessions); err != nil {
+				t.Errorf("unmarshal error: %v", err)
+			}
+		}
+		return rr.Code, sessions
+	}
+
+	start := now
+	tests := []struct {
+		elapsed  time.Duration
+		lastUsed time.Time
+	}{
+		{0, start},
+		// Within sessionLastUsedInterval of the last write.
+		{30 * time.Second, start},
+		{2 * time.Minute, start.Add(2 * time.Minute)},
+	}
+	for i, tc := range tests {
+		now = start.Add(tc.elapsed)
+		status, s := sessions()
+		if status != http.StatusOK || len(s) != 1 || s[0].LastUsed != tc.lastUsed.Unix() || s[0].IssuedAt != start.Unix() {
+			t.Errorf("test %d, sessions did not return proper status: %d, sessions: %+v", i, status, s)
+			return
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+	rr := httptest.NewRecorder()
+	HandlerFuncAuthJWTWrapper(handlerSessions)(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST sessions did not return proper status: %d", rr.Code)
+		return
+	}
+}
+
+// TestHandlerSessionRevoke verifies a user can revoke one session by TokenID, revoking its
+// refresh token family, without revoking other sessions, and other users cannot.
+func TestHandlerSessionRevoke(t *testing.T) {
+	testSetup()
+	config.IssueRefreshToken = true
+	config.PathSessions = "/auth/sessions"
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	otherEmail := "other@auth.com"
+	_, otherCredBytes, err := createAuth(t, &otherEmail)
+	if err != nil {
+		return
+	}
+	login := func(credBytes []byte) LoginTokens {
+		req := httptest.NewRequest(http.MethodPut, "/auth/login", bytes.NewBuffer(credBytes))
+		rr := httptest.NewRecorder()
+		handlerLogin(rr, req)
+		lt := LoginTokens{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &lt); err != nil || rr.Code != http.StatusOK {
+			t.Errorf("login did not return proper status: %d, error: %v", rr.Code, err)
+		}
+		return lt
+	}
+	laptop, phone, other := login(credBytes), login(credBytes), login(otherCredBytes)
+	phoneClaims, err := parseClaims(phone.AccessToken)
+	if err != nil {
+		t.Errorf("parseClaims error: %v", err)
+		return
+	}
+
+	do := func(hf http.HandlerFunc, method string, target string, token string, body []byte) int {
+		req := httptest.NewRequest(method, target, bytes.NewBuffer(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		hf(rr, req)
+		return rr.Code
+	}
+	sessions := HandlerFuncAuthJWTWrapper(handlerSessions)
+	phonePath := config.PathSessions + "/" + phoneClaims.TokenID
+
+	tests := []struct {
+		method string
+		target string
+		token  string
+		status int
+	}{
+		{http.MethodDelete, config.PathSessions, laptop.AccessToken, http.StatusMethodNotAllowed},
+		{http.MethodGet, phonePath, laptop.AccessToken, http.StatusMethodNotAllowed},
+		{http.MethodDelete, phonePath + "?email=" + em, other.AccessToken, http.StatusForbidden},
+		// The other user has no session with the TokenID.
+		{http.MethodDelete, phonePath, other.AccessToken, http.StatusNotFound},
+		{http.MethodDelete, phonePath, laptop.AccessToken, http.StatusNoContent},
+		{http.MethodDelete, phonePath, laptop.AccessToken, http.StatusNotFound},
+		{http.MethodGet, "/", phone.AccessToken, http.StatusUnauthorized},
+		{http.MethodGet, "/", laptop.AccessToken, http.StatusNoContent},
+	}
+	for i, tc := range tests {
+		hf := sessions
+		if tc.target == "/" {
+			hf = HandlerFuncAuthJWTWrapper(handlerTest)
+		}
+		if status := do(hf, tc.method, tc.target, tc.token, nil); status != tc.status {
+			t.Errorf("test %d, %s %s did not return proper status: %d, expected: %d", i, tc.method, tc.target, status, tc.status)
+			return
+		}
+	}
+
+	// The refresh token of the revoked session cannot be exchanged for new tokens.
+	b, err := json.Marshal(OneTimeToken{Token: phone.RefreshToken})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	if status := do(handlerFuncNoAuthWrapperCommon(handlerToken, false), http.MethodPost, "/auth/token", "", b); status != http.StatusUnauthorized {
+		t.Errorf("refresh of revoked session did not return proper status: %d", status)
+		return
+	}
+}
+
+// TestSessionLimitEvictOldest verifies logins beyond RoleSessionLimits evict the oldest
+// sessions with SessionLimitEvictOldest.
+func TestSessionLimitEvictOldest(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+	config.RoleSessionLimits = map[string]int{"": 2}
+	config.SessionLimitEvictOldest = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokens := []string{}
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		tokenBytes, _, err := login(t, credBytes)
+		if err != nil {
+			return
+		}
+		tokens = append(tokens, string(tokenBytes))
+	}
+
+	for i, token := range tokens {
+		expected := http.StatusNoContent
+		if i < 2 {
+			expected = http.StatusUnauthorized
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		HandlerFuncAuthJWTWrapper(handlerTest)(rr, req)
+		if rr.Code != expected {
+			t.Errorf("token %d did not return proper status: %d, expected: %d", i, rr.Code, expected)
+			return
+		}
+	}
+	if n, err := sessionsActive(em); err != nil || n != 2 {
+		t.Errorf("sessionsActive: %d, error: %v", n, err)
+		return
+	}
+}
+
+// TestSessionLimitRefreshToken verifies refresh token exchanges are subject to
+// RoleSessionLimits, as for logins.
+func TestSessionLimitRefreshToken(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+	config.IssueRefreshToken = true
+	config.RoleSessionLimits = map[string]int{"": 1}
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	do := func(hf http.HandlerFunc, method string, body []byte) (int, LoginTokens) {
+		now = now.Add(time.Second)
+		rr := httptest.NewRecorder()
+		hf(rr, httptest.NewRequest(method, "/", bytes.NewBuffer(body)))
+		lt := LoginTokens{}
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &lt); err != nil {
+				t.Errorf("json.Unmarshal error: %v", err)
+			}
+		}
+		return rr.Code, lt
+	}
+	exchange := func(refreshToken string) (int, LoginTokens) {
+		b, err := json.Marshal(OneTimeToken{Token: refreshToken})
+		if err != nil {
+			t.Errorf("json.Marshal error: %v", err)
+		}
+		return do(handlerFuncNoAuthWrapperCommon(handlerToken, false), http.MethodPost, b)
+	}
+
+	status, lt := do(handlerLogin, http.MethodPut, credBytes)
+	if status != http.StatusOK || lt.RefreshToken == "" {
+		t.Errorf("login did not return proper status: %d, tokens: %+v", status, lt)
+		return
+	}
+	if status, _ := exchange(lt.RefreshToken); status != http.StatusConflict {
+		t.Errorf("exchange beyond the session limit did not return proper status: %d", status)
+		return
+	}
+
+	config.SessionLimitEvictOldest = true
+	if status, lt = do(handlerLogin, http.MethodPut, credBytes); status != http.StatusOK {
+		t.Errorf("login did not return proper status: %d", status)
+		return
+	}
+	status, exchanged := exchange(lt.RefreshToken)
+	if status != http.StatusOK || exchanged.AccessToken == "" {
+		t.Errorf("exchange did not return proper status: %d, tokens: %+v", status, exchanged)
+		return
+	}
+	for token, expected := range map[string]int{lt.AccessToken: http.StatusUnauthorized, exchanged.AccessToken: http.StatusNoContent} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		HandlerFuncAuthJWTWrapper(handlerTest)(rr, req)
+		if rr.Code != expected {
+			t.Errorf("token did not return proper status: %d, expected: %d", rr.Code, expected)
+			return
+		}
+	}
+	if n, err := sessionsActive(em); err != nil || n != 1 {
+		t.Errorf("sessionsActive: %d, error: %v", n, err)
+		return
+	}
+}
+
+// TestSessionUsedLogout verifies a logout while a request using the token is authenticated
+// is not undone when sessionUsed records the use of the token.
+func TestSessionUsedLogout(t *testing.T) {
+	testSetup()
+	now := time.Now()
+	config.TimeSource = func() time.Time { return now }
+	config.IdleTimeout = time.Minute
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	request := func(method string, hf http.HandlerFunc) int {
+		req := httptest.NewRequest(method, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		rr := httptest.NewRecorder()
+		HandlerFuncAuthJWTWrapper(hf)(rr, req)
+		return rr.Code
+	}
+
+	// Logout, in another request, after the token is read to authenticate the first request,
+	// and before sessionUsed stores the extended expiration.
+	hook := &tokenStoreHook{tokenStore: kvsToken}
+	kvsToken = hook
+	defer func() { kvsToken = hook.tokenStore }()
+	logoutStatus := make(chan int, 1)
+	hook.get = func(key string) {
+		if key != claims.tokenKVSKey() {
+			return
+		}
+		hook.get = nil
+		go func() { logoutStatus <- request(http.MethodDelete, handlerLogout) }()
+		if status := <-logoutStatus; status != http.StatusNoContent {
+			t.Errorf("logout did not return proper status: %d", status)
+		}
+	}
+	now = now.Add(30 * time.Second)
+	if status := request(http.MethodGet, handlerTest); status != http.StatusUnauthorized {
+		t.Errorf("request during logout did not return proper status: %d", status)
+		return
+	}
+	if b, err := kvsToken.Get(claims.tokenKVSKey()); b != nil || err != nil {
+		t.Errorf("logged out token stored again, error: %v", err)
+		return
+	}
+	if status := request(http.MethodGet, handlerTest); status != http.StatusUnauthorized {
+		t.Errorf("logged out token did not return proper status: %d", status)
+		return
+	}
+}
+
+// tokenStoreHook calls get, when not nil, after each Get from a tokenStore.
+type tokenStoreHook struct {
+	tokenStore
+	get func(key string)
+}
+
+func (tsh *tokenStoreHook) Get(key string) ([]byte, error) {
+	b, err := tsh.tokenStore.Get(key)
+	if tsh.get != nil {
+		tsh.get(key)
+	}
+	return b, err
+}
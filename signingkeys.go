@@ -0,0 +1,141 @@
+package authjwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// previousKeys holds the public keys loaded from config.JWTPreviousPublicKeyPaths, by kid.
+var previousKeys map[string]interface{}
+
+// supportedAlgorithms are the values allowed in config.JWTAllowedAlgorithms.
+var supportedAlgorithms = []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodRS384.Alg(),
+	jwt.SigningMethodRS512.Alg(), SigningAlgorithmEdDSA}
+
+// algorithmAllowed returns true if alg is in config.JWTAllowedAlgorithms.
+func algorithmAllowed(alg string) bool {
+	for _, a := range config.JWTAllowedAlgorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedAlgorithmsLoad sets the default config.JWTAllowedAlgorithms, or returns an error if
+// it has an unsupported value. Call after the keys are loaded.
+func allowedAlgorithmsLoad() error {
+	if len(config.JWTAllowedAlgorithms) == 0 {
+		if config.RemoteJWKSURL != "" {
+			config.JWTAllowedAlgorithms = append([]string{}, supportedAlgorithms...)
+			return nil
+		}
+		allowed := []string{config.JWTSigningAlgorithm}
+		for _, key := range previousKeys {
+			if alg := signingMethodForKey(key).Alg(); alg != allowed[0] {
+				allowed = append(allowed, alg)
+				break
+			}
+		}
+		config.JWTAllowedAlgorithms = allowed
+		return nil
+	}
+	for _, a := range config.JWTAllowedAlgorithms {
+		supported := false
+		for _, s := range supportedAlgorithms {
+			supported = supported || a == s
+		}
+		if !supported {
+			return fmt.Errorf("%s unsupported algorithm: %s", runtimeh.SourceInfo(), a)
+		}
+	}
+	return nil
+}
+
+// keyID returns the kid of public key key; the base64url encoded SHA-256 of its PKIX
+// encoding, so the kid is the same wherever the key is loaded.
+func keyID(key interface{}) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k == nil {
+			return "", fmt.Errorf("%s no RSA public key", runtimeh.SourceInfo())
+		}
+	case ed25519.PublicKey:
+		if len(k) == 0 {
+			return "", fmt.Errorf("%s no Ed25519 public key", runtimeh.SourceInfo())
+		}
+	}
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("marshal public key", err)
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// previousKeysLoad loads the public keys at config.JWTPreviousPublicKeyPaths into previousKeys.
+func previousKeysLoad(config Config) error {
+	keys := make(map[string]interface{}, len(config.JWTPreviousPublicKeyPaths))
+	for _, path := range config.JWTPreviousPublicKeyPaths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return runtimeh.SourceInfoError(fmt.Sprintf("reading previous public key: %s", path), err)
+		}
+		key, err := publicKeyParse(b)
+		if err != nil {
+			return runtimeh.SourceInfoError(fmt.Sprintf("parsing previous public key: %s", path), err)
+		}
+		kid, err := keyID(key)
+		if err != nil {
+			return err
+		}
+		keys[kid] = key
+	}
+	previousKeys = keys
+	return nil
+}
+
+// publicKeyParse returns the RSA or Ed25519 public key in PEM encoded PKIX bytes b.
+func publicKeyParse(b []byte) (interface{}, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s no PEM data", runtimeh.SourceInfo())
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("x509.ParsePKIXPublicKey", err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%s unsupported public key type: %T", runtimeh.SourceInfo(), key)
+	}
+}
+
+// signingKey returns the signing method, private key, and public key for
+// config.JWTSigningAlgorithm.
+func signingKey() (jwt.SigningMethod, interface{}, interface{}) {
+	if config.JWTSigningAlgorithm == SigningAlgorithmEdDSA {
+		return signingMethodEdDSA, ed25519PrivateKey, ed25519PublicKey
+	}
+	return jwt.SigningMethodRS256, rsaPrivateKey, rsaPublicKey
+}
+
+// signingMethodForKey returns the signing method used with public key key.
+func signingMethodForKey(key interface{}) jwt.SigningMethod {
+	if _, ok := key.(ed25519.PublicKey); ok {
+		return signingMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
@@ -0,0 +1,156 @@
+package authjwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TestSigningKeyRotation verifies tokens carry the kid of the signing key, and after rotation
+// tokens of the previous key are still accepted, new tokens are signed with the new key, and
+// tokens with an unknown kid, or signed by a key other than the kid, are rejected.
+func TestSigningKeyRotation(t *testing.T) {
+	testSetup()
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	oldTokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	oldKid, err := keyID(rsaPublicKey)
+	if err != nil {
+		t.Errorf("keyID error: %v", err)
+		return
+	}
+	if kid := testTokenKid(t, oldTokenBytes); kid != oldKid {
+		t.Errorf("token kid: %s, expected: %s", kid, oldKid)
+		return
+	}
+
+	// Rotate; the previous public key is loaded from a file as with JWTPreviousPublicKeyPaths.
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(rsaPublicKey)
+	if err != nil {
+		t.Errorf("MarshalPKIXPublicKey error: %v", err)
+		return
+	}
+	previousPath := filepath.Join(t.TempDir(), "previous.pub")
+	if err := os.WriteFile(previousPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes}), 0600); err != nil {
+		t.Errorf("WriteFile error: %v", err)
+		return
+	}
+	if err := previousKeysLoad(Config{JWTPreviousPublicKeyPaths: []string{previousPath}}); err != nil {
+		t.Errorf("previousKeysLoad error: %v", err)
+		return
+	}
+	oldPrivateKey := rsaPrivateKey
+	if rsaPrivateKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		t.Errorf("GenerateKey error: %v", err)
+		return
+	}
+	rsaPublicKey = &rsaPrivateKey.PublicKey
+
+	if _, err := parseClaims(string(oldTokenBytes)); err != nil {
+		t.Errorf("token of previous key not accepted: %v", err)
+		return
+	}
+	newTokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	newKid, err := keyID(rsaPublicKey)
+	if err != nil {
+		t.Errorf("keyID error: %v", err)
+		return
+	}
+	if kid := testTokenKid(t, newTokenBytes); kid != newKid || kid == oldKid {
+		t.Errorf("token kid: %s, expected: %s", kid, newKid)
+		return
+	}
+	if _, err := parseClaims(string(newTokenBytes)); err != nil {
+		t.Errorf("token of new key not accepted: %v", err)
+		return
+	}
+
+	// testTokenSigned is the jwks_test helper that signs with RS256 and sets the kid.
+	if _, err := parseClaims(testTokenSigned(t, "unknown", rsaPrivateKey)); err == nil {
+		t.Errorf("token with unknown kid was accepted")
+		return
+	}
+	if _, err := parseClaims(testTokenSigned(t, oldKid, rsaPrivateKey)); err == nil {
+		t.Errorf("token with previous kid signed by the new key was accepted")
+		return
+	}
+	if _, err := parseClaims(testTokenSigned(t, newKid, oldPrivateKey)); err == nil {
+		t.Errorf("token with new kid signed by the previous key was accepted")
+		return
+	}
+}
+
+// TestJWTAllowedAlgorithms verifies the default JWTAllowedAlgorithms, that unsupported values
+// are rejected, and tokens with an algorithm not allowed, including none, are rejected.
+func TestJWTAllowedAlgorithms(t *testing.T) {
+	testSetup()
+
+	if len(config.JWTAllowedAlgorithms) != 1 || config.JWTAllowedAlgorithms[0] != SigningAlgorithmRS256 {
+		t.Errorf("wrong default JWTAllowedAlgorithms: %v", config.JWTAllowedAlgorithms)
+		return
+	}
+	claims := CustomClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()},
+		Email: "someone@auth.com"}
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Errorf("SignedString error: %v", err)
+		return
+	}
+	if _, err := parseClaims(none); err == nil {
+		t.Errorf("token with alg none was accepted")
+		return
+	}
+	rs256, err := tokenSign(claims)
+	if err != nil {
+		t.Errorf("tokenSign error: %v", err)
+		return
+	}
+	config.JWTAllowedAlgorithms = []string{SigningAlgorithmEdDSA}
+	if _, err := parseClaims(rs256); err == nil {
+		t.Errorf("RS256 token was accepted when not allowed")
+		return
+	}
+
+	for _, alg := range []string{"none", "HS256", "ES256"} {
+		config.JWTAllowedAlgorithms = []string{SigningAlgorithmRS256, alg}
+		if err := allowedAlgorithmsLoad(); err == nil {
+			t.Errorf("allowedAlgorithmsLoad did not error for: %s", alg)
+			return
+		}
+	}
+
+	config.JWTAllowedAlgorithms = nil
+	previousKeys = map[string]interface{}{"previous": ed25519PublicKey}
+	if err := allowedAlgorithmsLoad(); err != nil || len(config.JWTAllowedAlgorithms) != 2 ||
+		config.JWTAllowedAlgorithms[1] != SigningAlgorithmEdDSA {
+		t.Errorf("wrong default JWTAllowedAlgorithms with previous key: %v, error: %v", config.JWTAllowedAlgorithms, err)
+		return
+	}
+}
+
+// testTokenKid returns the kid header of tokenBytes.
+func testTokenKid(t *testing.T, tokenBytes []byte) string {
+	token, _, err := new(jwt.Parser).ParseUnverified(string(tokenBytes), &CustomClaims{})
+	if err != nil {
+		t.Errorf("ParseUnverified error: %v", err)
+		return ""
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
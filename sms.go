@@ -0,0 +1,334 @@
+package authjwt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+const (
+	defaultSMSCodeExpirationInterval = 5 * time.Minute
+	// smsCodeLength is the number of digits of SMS codes.
+	smsCodeLength = 6
+	// smsCodeMaxAttempts is the number of wrong codes after which a code is removed, so the
+	// short codes cannot be guessed.
+	smsCodeMaxAttempts = 5
+	// smsCodeResendInterval is the minimum time between codes sent for a phone, or a phone
+	// registration, so callers cannot flood a phone with messages.
+	smsCodeResendInterval = 30 * time.Second
+
+	smsKeyLogin    = "login:"
+	smsKeyRegister = "register:"
+)
+
+// SMSCode is the body of requests to PathPhone, PathSMSCode, and PathSMSLogin; the Phone, in
+// E.164 format, and the Code sent to it.
+type SMSCode struct {
+	Code  string `json:",omitempty"`
+	Phone string
+}
+
+// smsCode is a code sent with config.SMSSender, stored in kvsSMSCode; for login, by Phone, or
+// for registering a phone, by identifier.
+type smsCode struct {
+	Attempts   int
+	CodeHash   []byte
+	ExpiresAt  time.Time
+	Identifier string
+	Phone      string
+	SentAt     time.Time
+}
+
+var (
+	// phoneValidation matches phone numbers in E.164 format.
+	phoneValidation = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+)
+
+// AuthPhoneSet sets the Phone of the existing auth for identifier to phone, or clears it when
+// phone is empty. With Config.SMSLoginEnabled, users login with a code sent to the Phone. The
+// Phone must be in E.164 format, I.E. +15555550123, and not the Phone of another auth. Users
+// register their own phone at PathPhone, with a code sent to the phone.
+func AuthPhoneSet(identifier string, phone string) error {
+	if phone != "" && !phoneValidation.MatchString(phone) {
+		return fmt.Errorf("%s phone is not in E.164 format: %s", runtimeh.SourceInfo(), phone)
+	}
+	return phoneIndex().set(identifier, phone)
+}
+
+// handlerPhone registers the Phone of the SMSCode body as the Phone of the caller, in two steps;
+// a request without a Code sends a code to the Phone, and a request with that Code sets the
+// Phone, so the user must receive messages at the Phone. http.MethodDelete clears the Phone.
+func handlerPhone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get the claims.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	if impersonationRejected(w, claims) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if err := AuthPhoneSet(claims.Email, ""); err != nil {
+			lpf(logh.Error, "AuthPhoneSet error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("phone removed for email: %s", auditEmail(claims.Email))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
+
+	sc := SMSCode{}
+	if err := httph.BodyUnmarshal(w, r, &sc); err != nil {
+		lpf(logh.Error, "phone error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+
+	key := smsKeyRegister + claims.Email
+	if sc.Code != "" {
+		code, ok, err := smsCodeVerify(key, sc.Code)
+		if err != nil {
+			lpf(logh.Error, "smsCodeVerify error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := AuthPhoneSet(claims.Email, code.Phone); err != nil {
+			authCreateFailed(w, err)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("phone registered for email: %s", auditEmail(claims.Email))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !phoneValidation.MatchString(sc.Phone) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	owner, err := phoneIndex().identifier(sc.Phone)
+	if err != nil {
+		lpf(logh.Error, "phone identifier error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if owner != "" && owner != claims.Email {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err := smsCodeSend(key, claims.Email, sc.Phone); err != nil {
+		lpf(logh.Error, "smsCodeSend error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerSMSCode sends a login code, using Config.SMSSender, to the Phone in the SMSCode body.
+// The code is valid for config.SMSCodeExpirationInterval. The status is http.StatusAccepted
+// whether or not there is an auth with the Phone, so callers cannot use this handler to
+// discover which phones are registered.
+func handlerSMSCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
+
+	sc := SMSCode{}
+	if err := httph.BodyUnmarshal(w, r, &sc); err != nil {
+		lpf(logh.Error, "SMS code error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	if !phoneValidation.MatchString(sc.Phone) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	identifier, err := phoneIndex().identifier(sc.Phone)
+	if err != nil {
+		lpf(logh.Error, "phone identifier error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if identifier != "" {
+		if err := smsCodeSend(smsKeyLogin+sc.Phone, identifier, sc.Phone); err != nil {
+			lpf(logh.Error, "smsCodeSend error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("SMS code sent for email: %s", auditEmail(identifier))
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerSMSLogin returns a token for the auth with the Phone in the SMSCode body, when the Code
+// is the code sent to the Phone from PathSMSCode; the same response as from PathLogin, with
+// AuthMethodSMS. The code cannot be used again. Wrong codes are login failures for
+// Config.LockoutThreshold.
+func handlerSMSLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !contentTypeJSON(w, r) {
+		return
+	}
+
+	sc := SMSCode{}
+	if err := httph.BodyUnmarshal(w, r, &sc); err != nil {
+		lpf(logh.Error, "SMS login error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+
+	identifier, err := phoneIndex().identifier(sc.Phone)
+	if err != nil {
+		lpf(logh.Error, "phone identifier error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if identifier == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if lockoutLocked(w, r, identifier) {
+		return
+	}
+	code, ok, err := smsCodeVerify(smsKeyLogin+sc.Phone, sc.Code)
+	if err != nil {
+		lpf(logh.Error, "smsCodeVerify error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok || code.Identifier != identifier {
+		if err := lockoutFailure(r, identifier); err != nil {
+			lpf(logh.Error, "lockoutFailure error:%v", err)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err := lockoutSuccess(identifier); err != nil {
+		lpf(logh.Error, "lockoutSuccess error:%v", err)
+	}
+
+	auth, err := authGet(identifier)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Disabled {
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("SMS login for disabled email: %s", auditEmail(identifier))
+		}
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	jkt, ok := dpopLoginBinding(w, r)
+	if !ok {
+		return
+	}
+
+	loginTokensWrite(w, r, identifier, auth, "SMS login", AuthMethodSMS, tokenConfirmation(r, jkt), false)
+}
+
+// smsCodeHash returns the hash of code stored in kvsSMSCode, so the store does not contain
+// usable codes.
+func smsCodeHash(code string) []byte {
+	sum := sha256.Sum256([]byte(code))
+	return sum[:]
+}
+
+// smsCodeSend creates a code for the auth with identifier, stores it in kvsSMSCode with key,
+// replacing any prior code, and sends it to phone with config.SMSSender. No code is sent if
+// one was sent for key within smsCodeResendInterval.
+func smsCodeSend(key string, identifier string, phone string) error {
+	now := timeNow()
+	prior := smsCode{}
+	if err := kvsSMSCode.Deserialize(key, &prior); err != nil {
+		return runtimeh.SourceInfoError("kvsSMSCode.Deserialize error", err)
+	}
+	if now.Sub(prior.SentAt) < smsCodeResendInterval && prior.Phone == phone {
+		return nil
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return runtimeh.SourceInfoError("rand.Int error", err)
+	}
+	code := fmt.Sprintf("%0*d", smsCodeLength, n)
+	sc := smsCode{CodeHash: smsCodeHash(code), ExpiresAt: now.Add(config.SMSCodeExpirationInterval),
+		Identifier: identifier, Phone: phone, SentAt: now}
+	if err := kvsSMSCode.Serialize(key, sc); err != nil {
+		return runtimeh.SourceInfoError("kvsSMSCode.Serialize error", err)
+	}
+	return runtimeh.SourceInfoError("SMSSender error", config.SMSSender(phone, code))
+}
+
+// smsCodeVerify returns the smsCode for key, and true if code is the code sent and it has not
+// expired; the code is then removed, so it cannot be used again. Wrong codes are counted, and
+// the code is removed after smsCodeMaxAttempts.
+func smsCodeVerify(key string, code string) (smsCode, bool, error) {
+	smsCodeMutex.Lock()
+	defer smsCodeMutex.Unlock()
+
+	b, err := kvsSMSCode.Get(key)
+	if err != nil {
+		return smsCode{}, false, runtimeh.SourceInfoError("kvsSMSCode.Get error", err)
+	}
+	if b == nil {
+		return smsCode{}, false, nil
+	}
+	sc := smsCode{}
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return smsCode{}, false, runtimeh.SourceInfoError("json.Unmarshal error", err)
+	}
+	if !timeNow().Before(sc.ExpiresAt) {
+		_, err := kvsSMSCode.Delete(key)
+		return smsCode{}, false, runtimeh.SourceInfoError("kvsSMSCode.Delete error", err)
+	}
+	if subtle.ConstantTimeCompare(smsCodeHash(code), sc.CodeHash) != 1 {
+		sc.Attempts++
+		if sc.Attempts >= smsCodeMaxAttempts {
+			_, err := kvsSMSCode.Delete(key)
+			return smsCode{}, false, runtimeh.SourceInfoError("kvsSMSCode.Delete error", err)
+		}
+		return smsCode{}, false, runtimeh.SourceInfoError("kvsSMSCode.Serialize error", kvsSMSCode.Serialize(key, sc))
+	}
+	if _, err := kvsSMSCode.Delete(key); err != nil {
+		return smsCode{}, false, runtimeh.SourceInfoError("kvsSMSCode.Delete error", err)
+	}
+	return sc, true, nil
+}
@@ -0,0 +1,252 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAuthPhoneSet verifies phones must be in E.164 format and belong to one auth.
+func TestAuthPhoneSet(t *testing.T) {
+	testSetup()
+
+	em, _, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	otherEmail := "other@auth.com"
+	if _, _, err := createAuth(t, &otherEmail); err != nil {
+		return
+	}
+	phone := "+15555550123"
+	for _, invalid := range []string{"5555550123", "+0555550123", "+1555", "+1555555012345678"} {
+		if err := AuthPhoneSet(em, invalid); err == nil {
+			t.Errorf("AuthPhoneSet did not reject phone: %s", invalid)
+			return
+		}
+	}
+	if err := AuthPhoneSet(em, phone); err != nil {
+		t.Errorf("AuthPhoneSet error: %v", err)
+		return
+	}
+	if err := AuthPhoneSet(otherEmail, phone); !errors.Is(err, ErrAuthExists) {
+		t.Errorf("phone of another auth did not return ErrAuthExists: %v", err)
+		return
+	}
+	if ud, err := userData(em); err != nil || ud.Phone != phone {
+		t.Errorf("wrong UserData Phone: %+v, error: %v", ud, err)
+		return
+	}
+	if err := AuthPhoneSet(em, ""); err != nil {
+		t.Errorf("AuthPhoneSet error: %v", err)
+		return
+	}
+	if err := AuthPhoneSet(otherEmail, phone); err != nil {
+		t.Errorf("AuthPhoneSet error: %v", err)
+		return
+	}
+}
+
+// TestSMSLogin tests registering a phone with a code sent to it, and login with a code sent
+// to the phone; codes are single use, and are removed after too many wrong codes.
+func TestSMSLogin(t *testing.T) {
+	testSetup()
+	sent := map[string]string{}
+	config.SMSLoginEnabled = true
+	config.SMSSender = func(phone string, code string) error {
+		sent[phone] = code
+		return nil
+	}
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	testServerPhone := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerPhone)))
+	defer testServerPhone.Close()
+	testServerCode := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerSMSCode)))
+	defer testServerCode.Close()
+	testServerLogin := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerSMSLogin)))
+	defer testServerLogin.Close()
+	do := func(method string, url string, sc SMSCode, token []byte) (int, []byte, error) {
+		b, err := json.Marshal(sc)
+		if err != nil {
+			return 0, nil, err
+		}
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(b))
+		if err != nil {
+			return 0, nil, err
+		}
+		if token != nil {
+			req.Header.Set("Authorization", "Bearer "+string(token))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, body, err
+	}
+
+	// Register the phone.
+	phone := "+15555550123"
+	if status, _, err := do(http.MethodPut, testServerPhone.URL, SMSCode{Phone: phone}, tokenBytes); err != nil || status != http.StatusAccepted {
+		t.Errorf("phone code did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	code, ok := sent[phone]
+	if !ok || len(code) != smsCodeLength {
+		t.Errorf("code not sent: %v", sent)
+		return
+	}
+	if status, _, err := do(http.MethodPut, testServerPhone.URL, SMSCode{Code: "x" + code}, tokenBytes); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("wrong phone code did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if status, _, err := do(http.MethodPut, testServerPhone.URL, SMSCode{Code: code}, tokenBytes); err != nil || status != http.StatusNoContent {
+		t.Errorf("phone register did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if ud, err := userData(em); err != nil || ud.Phone != phone {
+		t.Errorf("wrong UserData Phone: %+v, error: %v", ud, err)
+		return
+	}
+
+	// Codes are only sent to registered phones, with the same status.
+	delete(sent, phone)
+	unknown := "+15555550199"
+	if status, _, err := do(http.MethodPost, testServerCode.URL, SMSCode{Phone: unknown}, nil); err != nil || status != http.StatusAccepted {
+		t.Errorf("unknown phone did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if _, ok := sent[unknown]; ok {
+		t.Errorf("code sent to unknown phone")
+		return
+	}
+	if status, _, err := do(http.MethodPost, testServerCode.URL, SMSCode{Phone: phone}, nil); err != nil || status != http.StatusAccepted {
+		t.Errorf("SMS code did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if code, ok = sent[phone]; !ok {
+		t.Errorf("login code not sent")
+		return
+	}
+
+	if status, _, err := do(http.MethodPost, testServerLogin.URL, SMSCode{Code: "x" + code, Phone: phone}, nil); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("wrong login code did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	status, body, err := do(http.MethodPost, testServerLogin.URL, SMSCode{Code: code, Phone: phone}, nil)
+	if err != nil || status != http.StatusOK {
+		t.Errorf("SMS login did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	claims, err := parseClaims(string(body))
+	if err != nil || claims.Email != em || claims.AuthMethod != AuthMethodSMS {
+		t.Errorf("wrong claims: %+v, error: %v", claims, err)
+		return
+	}
+	if status, _, err := do(http.MethodPost, testServerLogin.URL, SMSCode{Code: code, Phone: phone}, nil); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("reused login code did not return proper status: %d, error: %v", status, err)
+		return
+	}
+
+	// Too many wrong codes remove the code.
+	if err := smsCodeSend(smsKeyLogin+phone, em, phone); err != nil {
+		t.Errorf("smsCodeSend error: %v", err)
+		return
+	}
+	code = sent[phone]
+	for i := 0; i < smsCodeMaxAttempts; i++ {
+		if _, ok, err := smsCodeVerify(smsKeyLogin+phone, "x"+code); err != nil || ok {
+			t.Errorf("wrong code %d verified, error: %v", i, err)
+			return
+		}
+	}
+	if _, ok, err := smsCodeVerify(smsKeyLogin+phone, code); err != nil || ok {
+		t.Errorf("code verified after too many wrong codes, error: %v", err)
+		return
+	}
+}
+
+// TestSMSLoginRules verifies SMS logins get the same response as password logins: LoginTokens,
+// the session limit, and only a token for changing the password when the password must be
+// changed.
+func TestSMSLoginRules(t *testing.T) {
+	testSetup()
+	sent := map[string]string{}
+	config.IssueRefreshToken = true
+	config.RoleSessionLimits = map[string]int{"": 2}
+	config.SMSLoginEnabled = true
+	config.SMSSender = func(phone string, code string) error {
+		sent[phone] = code
+		return nil
+	}
+
+	em, _, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	phone := "+15555550123"
+	if err := AuthPhoneSet(em, phone); err != nil {
+		t.Errorf("AuthPhoneSet error: %v", err)
+		return
+	}
+	smsLogin := func() (*httptest.ResponseRecorder, error) {
+		if err := smsCodeSend(smsKeyLogin+phone, em, phone); err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(SMSCode{Code: sent[phone], Phone: phone})
+		if err != nil {
+			return nil, err
+		}
+		req := httptest.NewRequest(http.MethodPost, "/sms/login", bytes.NewBuffer(b))
+		w := httptest.NewRecorder()
+		handlerSMSLogin(w, req)
+		return w, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		w, err := smsLogin()
+		if err != nil || w.Code != http.StatusOK {
+			t.Errorf("SMS login %d did not return proper status: %+v, error: %v", i, w, err)
+			return
+		}
+		lt := LoginTokens{}
+		if err := json.Unmarshal(w.Body.Bytes(), &lt); err != nil || lt.RefreshToken == "" {
+			t.Errorf("SMS login %d did not return LoginTokens: %+v, error: %v", i, lt, err)
+			return
+		}
+		if claims, err := parseClaims(lt.AccessToken); err != nil || claims.AuthMethod != AuthMethodSMS {
+			t.Errorf("wrong claims: %+v, error: %v", claims, err)
+			return
+		}
+	}
+	if w, err := smsLogin(); err != nil || w.Code != http.StatusConflict {
+		t.Errorf("SMS login beyond the session limit did not return proper status: %+v, error: %v", w, err)
+		return
+	}
+
+	if err := AuthMustChangePasswordSet(em, true); err != nil {
+		t.Errorf("AuthMustChangePasswordSet error: %v", err)
+		return
+	}
+	w, err := smsLogin()
+	if err != nil || w.Code != http.StatusOK || w.Header().Get(passwordChangeRequiredHeader) != "true" {
+		t.Errorf("SMS login did not return proper status: %+v, error: %v", w, err)
+		return
+	}
+	if claims, err := parseClaims(w.Body.String()); err != nil || claims.Purpose != PurposeChangePassword {
+		t.Errorf("wrong claims: %+v, error: %v", claims, err)
+		return
+	}
+}
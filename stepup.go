@@ -0,0 +1,80 @@
+package authjwt
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+)
+
+// handlerStepUp verifies the password of the caller, deletes the callers current token, and
+// returns a new token with AuthMethod AuthMethodStepUp. Handlers for sensitive operations can
+// then require AuthMethodStepUp, with AuthMethodRequired, without the user logging in again.
+func handlerStepUp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get the claims.
+	claims, err := requestClaims(w, r)
+	if err != nil {
+		return
+	}
+	if impersonationRejected(w, claims) {
+		return
+	}
+
+	pw := ""
+	cred := Credential{Password: &pw}
+	if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+		lpf(logh.Error, "step up error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+
+	release, ok := loginSemaphoreAcquire(w)
+	if !ok {
+		return
+	}
+	defer release()
+
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ok, err = passwordVerifyLocked(w, r, claims.Email, passwordTrim(pw), auth.PasswordHash)
+	if !ok {
+		return
+	}
+	if err != nil {
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("step up failed for email: %s", auditEmail(claims.Email))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	tokenString, err := authTokenStringCreateClient(r, claims.Email, tokenOptions{authTime: claims.AuthTime, client: claims.Client,
+		cnf: claims.Confirmation, family: claims.Family, method: AuthMethodStepUp})
+	if err != nil {
+		lpf(logh.Error, "authTokenStringCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tokenDelete(kvsToken, claims.tokenKVSKey()); err != nil {
+		lpf(logh.Error, "kvsToken.Delete error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("step up from auth method: %s for email: %s", claims.AuthMethod, auditEmail(claims.Email))
+	}
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write([]byte(tokenString)); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
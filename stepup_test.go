@@ -0,0 +1,103 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHandlerStepUp verifies re-entering the password upgrades the token to AuthMethodStepUp,
+// unlocking a handler requiring step up, and the prior token is invalidated.
+func TestHandlerStepUp(t *testing.T) {
+	testSetup()
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	cred := Credential{}
+	if err := json.Unmarshal(credBytes, &cred); err != nil {
+		t.Errorf("unmarshal error: %v", err)
+		return
+	}
+
+	handlerSensitive := func(w http.ResponseWriter, r *http.Request) {
+		claims, err := Authenticated(w, r)
+		if err != nil {
+			return
+		}
+		if !AuthMethodRequired(w, claims, AuthMethodStepUp) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	testServerSensitive := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerSensitive)))
+	defer testServerSensitive.Close()
+	testServerStepUp := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerStepUp)))
+	defer testServerStepUp.Close()
+	client := &http.Client{}
+	sensitive := func(token []byte) (int, error) {
+		req, err := http.NewRequest(http.MethodGet, testServerSensitive.URL, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	stepUp := func(password string) ([]byte, int, error) {
+		b, err := json.Marshal(Credential{Password: &password})
+		if err != nil {
+			return nil, 0, err
+		}
+		req, err := http.NewRequest(http.MethodPost, testServerStepUp.URL, bytes.NewBuffer(b))
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(tokenBytes))
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return body, resp.StatusCode, err
+	}
+
+	if status, err := sensitive(tokenBytes); err != nil || status != http.StatusForbidden {
+		t.Errorf("password token did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if _, status, err := stepUp("wrong" + *cred.Password); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("step up with wrong password did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	stepUpToken, status, err := stepUp(*cred.Password)
+	if err != nil || status != http.StatusCreated {
+		t.Errorf("step up did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if claims, err := parseClaims(string(stepUpToken)); err != nil || claims.AuthMethod != AuthMethodStepUp {
+		t.Errorf("wrong auth method for step up: %+v, error: %v", claims, err)
+		return
+	}
+	if status, err := sensitive(stepUpToken); err != nil || status != http.StatusNoContent {
+		t.Errorf("step up token did not return proper status: %d, error: %v", status, err)
+		return
+	}
+	if status, err := sensitive(tokenBytes); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("token prior to step up did not return proper status: %d, error: %v", status, err)
+		return
+	}
+}
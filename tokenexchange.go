@@ -0,0 +1,200 @@
+package authjwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// Values of the RFC 8693 token exchange request and response, and RFC 6749 error codes.
+const (
+	TokenExchangeGrantType    = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TokenTypeAccessToken      = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeJWT              = "urn:ietf:params:oauth:token-type:jwt"
+	oauthInvalidDPoPProof     = "invalid_dpop_proof"
+	oauthInvalidRequest       = "invalid_request"
+	oauthInvalidScope         = "invalid_scope"
+	oauthInvalidTarget        = "invalid_target"
+	oauthUnsupportedGrantType = "unsupported_grant_type"
+
+	defaultTokenExchangeExpirationInterval = 5 * time.Minute
+)
+
+// TokenExchangeResponse is the response from PathTokenExchange; RFC 8693 section 2.2.1.
+type TokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	ExpiresIn       int64  `json:"expires_in"`
+	IssuedTokenType string `json:"issued_token_type"`
+	Scope           string `json:"scope,omitempty"`
+	TokenType       string `json:"token_type"`
+}
+
+// handlerTokenExchange implements the token exchange of RFC 8693, so a service holding a
+// token of a user can call a downstream service as the user. The form parameter
+// subject_token, a valid token, is exchanged for a token of the same user with the audience
+// parameter, one of Config.TokenExchangeAudiences. The new token has the scope parameter,
+// which must be a subset of the scope of the subject token, if any, and is valid for
+// Config.TokenExchangeExpirationInterval, but not past the expiration of the subject token.
+// The new token is in the refresh token family of the subject token. A subject token bound to
+// a DPoP key or client certificate requires a DPoP proof, or the certificate, for the exchange
+// request, and the new token has the same binding. Errors are
+// http.StatusBadRequest with the RFC 6749 error response.
+func handlerTokenExchange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, oauthInvalidRequest, err)
+		return
+	}
+	if r.PostForm.Get("grant_type") != TokenExchangeGrantType {
+		oauthError(w, oauthUnsupportedGrantType, fmt.Errorf("grant_type %s", r.PostForm.Get("grant_type")))
+		return
+	}
+	if tt := r.PostForm.Get("subject_token_type"); tt != TokenTypeAccessToken && tt != TokenTypeJWT {
+		oauthError(w, oauthInvalidRequest, fmt.Errorf("subject_token_type %s", tt))
+		return
+	}
+	if tt := r.PostForm.Get("requested_token_type"); tt != "" && tt != TokenTypeAccessToken {
+		oauthError(w, oauthInvalidRequest, fmt.Errorf("requested_token_type %s", tt))
+		return
+	}
+	audiences := r.PostForm["audience"]
+	if len(audiences) != 1 || !tokenExchangeAudience(audiences[0]) {
+		oauthError(w, oauthInvalidTarget, fmt.Errorf("audience %v", audiences))
+		return
+	}
+
+	subject, err := tokenAuthenticated(r.Context(), r.PostForm.Get("subject_token"), tokenInvalidationEnabled(), "", true)
+	if err != nil {
+		oauthError(w, oauthInvalidRequest, err)
+		return
+	}
+	if subject.Confirmation != nil && subject.Confirmation.JKT != "" {
+		if err := dpopKeyValidate(r, "", subject.Confirmation.JKT); err != nil {
+			oauthError(w, oauthInvalidDPoPProof, err)
+			return
+		}
+	}
+	if err := mtlsBindingValidate(r, subject); err != nil {
+		oauthError(w, oauthInvalidRequest, err)
+		return
+	}
+	scope, err := tokenExchangeScope(subject.Scope, r.PostForm.Get("scope"))
+	if err != nil {
+		oauthError(w, oauthInvalidScope, err)
+		return
+	}
+
+	token, expiresAt, err := tokenExchangeCreate(r, *subject, audiences[0], scope)
+	if err != nil {
+		lpf(logh.Error, "tokenExchangeCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("token exchanged for email: %s, audience: %s", subject.auditAuth(), audiences[0])
+	}
+
+	ter := TokenExchangeResponse{
+		AccessToken:     token,
+		ExpiresIn:       expiresAt - timeNow().Unix(),
+		IssuedTokenType: TokenTypeAccessToken,
+		Scope:           scope,
+		TokenType:       "Bearer",
+	}
+	b, err := json.Marshal(ter)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// tokenExchangeAudience returns true if audience is one of config.TokenExchangeAudiences.
+func tokenExchangeAudience(audience string) bool {
+	for _, a := range config.TokenExchangeAudiences {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenExchangeCreate stores and returns a token for request r, for the user of subject, with
+// audience and scope, and the expiration of the token.
+func tokenExchangeCreate(r *http.Request, subject CustomClaims, audience string, scope string) (string, int64, error) {
+	tokenID, err := uniqueID(true)
+	if err != nil {
+		return "", 0, runtimeh.SourceInfoError("uniqueID error", err)
+	}
+	tokenID = familyTokenID(subject.Family, tokenID)
+	expiresAt := timeNow().Add(config.TokenExchangeExpirationInterval).Unix()
+	if subject.ExpiresAt < expiresAt {
+		expiresAt = subject.ExpiresAt
+	}
+
+	// The user, how they authenticated, and the versions are those of the subject token.
+	claims := subject
+	claims.StandardClaims = jwt.StandardClaims{
+		Audience:  audience,
+		ExpiresAt: expiresAt,
+		Id:        tokenID,
+		Issuer:    tokenIssuer(),
+	}
+	claims.Scope = scope
+	claims.TokenID = tokenID
+	token, err := authClaimsStore(r, claims)
+	return token, expiresAt, err
+}
+
+// oauthError logs err and writes the RFC 6749 error response with code.
+func oauthError(w http.ResponseWriter, code string, err error) {
+	lpf(logh.Warning, "OAuth request rejected, %s:%v", code, err)
+	b, err := json.Marshal(map[string]string{"error": code})
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// tokenExchangeScope returns the scope of an exchanged token; requested, or subject when
+// requested is empty. An error is returned if subject is not empty and requested has a scope
+// not in subject, as the scope can only be reduced.
+func tokenExchangeScope(subject string, requested string) (string, error) {
+	if requested == "" {
+		return subject, nil
+	}
+	scopes := strings.Fields(requested)
+	if subject != "" {
+		allowed := map[string]bool{}
+		for _, s := range strings.Fields(subject) {
+			allowed[s] = true
+		}
+		for _, s := range scopes {
+			if !allowed[s] {
+				return "", fmt.Errorf("%s scope %s is not in the subject token scope", runtimeh.SourceInfo(), s)
+			}
+		}
+	}
+	return strings.Join(scopes, " "), nil
+}
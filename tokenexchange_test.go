@@ -0,0 +1,129 @@
+package authjwt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTokenExchange verifies a token is exchanged for a token of the same user for a
+// downstream audience, with reduced scope and a short TTL, that the exchanged token is
+// rejected for authentication but can be exchanged again, and invalid requests are rejected.
+func TestTokenExchange(t *testing.T) {
+	testSetup()
+	config.TokenExchangeAudiences = []string{"orders", "billing"}
+	config.TokenExchangeExpirationInterval = time.Minute
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	testServerExchange := httptest.NewServer(http.HandlerFunc(handlerFuncNoAuthWrapperCommon(handlerTokenExchange, false)))
+	defer testServerExchange.Close()
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+
+	exchange := func(form url.Values) (int, TokenExchangeResponse, error) {
+		ter := TokenExchangeResponse{}
+		resp, err := http.Post(testServerExchange.URL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+		if err != nil {
+			return 0, ter, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&ter)
+		}
+		return resp.StatusCode, ter, err
+	}
+	form := func(subject string, audience string, scope string) url.Values {
+		return url.Values{
+			"audience":           {audience},
+			"grant_type":         {TokenExchangeGrantType},
+			"scope":              {scope},
+			"subject_token":      {subject},
+			"subject_token_type": {TokenTypeAccessToken},
+		}
+	}
+
+	status, orders, err := exchange(form(string(tokenBytes), "orders", "read write"))
+	if err != nil || status != http.StatusOK || orders.Scope != "read write" || orders.TokenType != "Bearer" ||
+		orders.ExpiresIn <= 0 || orders.ExpiresIn > 60 {
+		t.Errorf("exchange did not return a token, status: %d, response: %+v, error: %v", status, orders, err)
+		return
+	}
+	claims, err := parseClaimsCommon(orders.AccessToken, true)
+	if err != nil || claims.Email != em || claims.Audience != "orders" || claims.Scope != "read write" {
+		t.Errorf("wrong exchanged token claims: %+v, error: %v", claims, err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+orders.AccessToken)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("exchanged token authenticated a request, error: %v", err)
+		return
+	}
+
+	// The downstream service exchanges its token for a further downstream service.
+	status, billing, err := exchange(form(orders.AccessToken, "billing", "read"))
+	if err != nil || status != http.StatusOK || billing.Scope != "read" {
+		t.Errorf("chained exchange did not return a token, status: %d, response: %+v, error: %v", status, billing, err)
+		return
+	}
+	if claims, err := parseClaimsCommon(billing.AccessToken, true); err != nil || claims.Email != em || claims.Audience != "billing" {
+		t.Errorf("wrong chained token claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	tests := []struct {
+		form url.Values
+	}{
+		{form(string(tokenBytes), "unknown", "")},
+		{form(string(tokenBytes), "", "")},
+		{form("not a token", "orders", "")},
+		{form(orders.AccessToken, "billing", "admin")},
+		{url.Values{"grant_type": {"password"}, "audience": {"orders"}, "subject_token": {string(tokenBytes)},
+			"subject_token_type": {TokenTypeAccessToken}}},
+		{url.Values{"grant_type": {TokenExchangeGrantType}, "audience": {"orders"}, "subject_token": {string(tokenBytes)}}},
+	}
+	for i, tc := range tests {
+		if status, _, err := exchange(tc.form); err != nil || status != http.StatusBadRequest {
+			t.Errorf("test %d, status: %d, error: %v", i, status, err)
+			return
+		}
+	}
+}
+
+// TestTokenExchangeScope verifies the scope of exchanged tokens can only be reduced.
+func TestTokenExchangeScope(t *testing.T) {
+	tests := []struct {
+		subject   string
+		requested string
+		scope     string
+		err       bool
+	}{
+		{"", "", "", false},
+		{"", "a  b", "a b", false},
+		{"a b", "", "a b", false},
+		{"a b", "b", "b", false},
+		{"a b", "a c", "", true},
+	}
+	for i, tc := range tests {
+		scope, err := tokenExchangeScope(tc.subject, tc.requested)
+		if (err != nil) != tc.err || scope != tc.scope {
+			t.Errorf("test %d, scope: %s, expected: %s, error: %v", i, scope, tc.scope, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package authjwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+const (
+	// kvsTokenVersionKey is the kvsTokenVersion key of the global token version.
+	kvsTokenVersionKey = "version"
+)
+
+var (
+	// tokenVersionMutex makes the read and update in BumpTokenVersion atomic.
+	tokenVersionMutex sync.Mutex
+)
+
+// BumpTokenVersion increments the global token version, and returns the new version. When
+// Config.TokenVersionEnforced is true, all tokens issued before the bump are rejected;
+// I.E. to log out all users after a key compromise, without iterating the token store.
+func BumpTokenVersion() (int64, error) {
+	tokenVersionMutex.Lock()
+	defer tokenVersionMutex.Unlock()
+	v, err := tokenVersion()
+	if err != nil {
+		return 0, runtimeh.SourceInfoError("BumpTokenVersion error", err)
+	}
+	v++
+	if err := kvsTokenVersion.Serialize(kvsTokenVersionKey, v); err != nil {
+		return 0, runtimeh.SourceInfoError("kvsTokenVersion.Serialize error", err)
+	}
+	return v, nil
+}
+
+// tokenVersion returns the global token version; zero if never bumped. The version is read
+// from kvsTokenVersion so bumps are seen by all instances sharing the DataSourcePath.
+func tokenVersion() (int64, error) {
+	b, err := kvsTokenVersion.Get(kvsTokenVersionKey)
+	if err != nil {
+		return 0, runtimeh.SourceInfoError("kvsTokenVersion.Get error", err)
+	}
+	if b == nil {
+		return 0, nil
+	}
+	var v int64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return 0, runtimeh.SourceInfoError("token version Unmarshal error", err)
+	}
+	return v, nil
+}
+
+// tokenVersions returns the global token version and the TokenVersion of the auth for email,
+// for stamping into new tokens.
+func tokenVersions(email string) (int64, int64, error) {
+	tv, err := tokenVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	auth, err := authGet(email)
+	if err != nil {
+		return 0, 0, runtimeh.SourceInfoError("authGet error", err)
+	}
+	return tv, auth.TokenVersion, nil
+}
+
+// tokenVersionValidate returns an error if config.TokenVersionEnforced is true and
+// claims were issued before the current global token version, or before the current
+// TokenVersion of the auth. Without a DataSourcePath there are no token versions, and all
+// tokens are accepted.
+func tokenVersionValidate(claims *CustomClaims) error {
+	if !config.TokenVersionEnforced || config.DataSourcePath == "" {
+		return nil
+	}
+	v, err := tokenVersion()
+	if err != nil {
+		return runtimeh.SourceInfoError("tokenVersionValidate error", err)
+	}
+	if claims.TokenVersion < v {
+		return fmt.Errorf("%s token version %d is before the current version %d", runtimeh.SourceInfo(), claims.TokenVersion, v)
+	}
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		return runtimeh.SourceInfoError("authGet error", err)
+	}
+	if claims.UserTokenVersion < auth.TokenVersion {
+		return fmt.Errorf("%s user token version %d is before the current version %d for email: %s",
+			runtimeh.SourceInfo(), claims.UserTokenVersion, auth.TokenVersion, claims.Email)
+	}
+	return nil
+}
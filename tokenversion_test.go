@@ -0,0 +1,173 @@
+package authjwt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestBumpTokenVersion verifies tokens issued before BumpTokenVersion are rejected when
+// TokenVersionEnforced is true, tokens issued after are accepted, and without enforcement
+// all tokens are accepted.
+func TestBumpTokenVersion(t *testing.T) {
+	testSetup()
+	config.TokenVersionEnforced = true
+
+	_, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	oldToken, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	client := &http.Client{}
+	status := func(token []byte) int {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return 0
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("Do error: %v", err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if s := status(oldToken); s != http.StatusNoContent {
+		t.Errorf("token before bump did not return proper status: %d", s)
+		return
+	}
+	v, err := BumpTokenVersion()
+	if err != nil || v != 1 {
+		t.Errorf("BumpTokenVersion version: %d, error: %v", v, err)
+		return
+	}
+	if s := status(oldToken); s != http.StatusUnauthorized {
+		t.Errorf("token issued before bump did not return proper status: %d", s)
+		return
+	}
+	newToken, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	claims, err := parseClaims(string(newToken))
+	if err != nil || claims.TokenVersion != 1 {
+		t.Errorf("new token version: %+v, error: %v", claims, err)
+		return
+	}
+	if s := status(newToken); s != http.StatusNoContent {
+		t.Errorf("token issued after bump did not return proper status: %d", s)
+		return
+	}
+
+	config.TokenVersionEnforced = false
+	if s := status(oldToken); s != http.StatusNoContent {
+		t.Errorf("token before bump without enforcement did not return proper status: %d", s)
+		return
+	}
+}
+
+// TestAuthTokenVersionBump verifies bumping the token version of one user, or that user
+// changing their password, rejects only that user's existing tokens.
+func TestAuthTokenVersionBump(t *testing.T) {
+	testSetup()
+	config.TokenVersionEnforced = true
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	token, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	otherEmail := "other@auth.com"
+	_, otherCredBytes, err := createAuth(t, &otherEmail)
+	if err != nil {
+		return
+	}
+	otherToken, _, err := login(t, otherCredBytes)
+	if err != nil {
+		return
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	client := &http.Client{}
+	status := func(token []byte) int {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return 0
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("Do error: %v", err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if err := AuthTokenVersionBump(em); err != nil {
+		t.Errorf("AuthTokenVersionBump error: %v", err)
+		return
+	}
+	if s := status(token); s != http.StatusUnauthorized {
+		t.Errorf("token issued before bump did not return proper status: %d", s)
+		return
+	}
+	if s := status(otherToken); s != http.StatusNoContent {
+		t.Errorf("other user token did not return proper status: %d", s)
+		return
+	}
+	token, _, err = login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if s := status(token); s != http.StatusNoContent {
+		t.Errorf("token issued after bump did not return proper status: %d", s)
+		return
+	}
+
+	// A password change also invalidates existing tokens.
+	cred := Credential{}
+	if err := json.Unmarshal(credBytes, &cred); err != nil {
+		t.Errorf("Unmarshal error: %v", err)
+		return
+	}
+	pwd := *cred.Password + "1"
+	cred.Password = &pwd
+	if err := cred.AuthCreate(); err != nil {
+		t.Errorf("AuthCreate error: %v", err)
+		return
+	}
+	if s := status(token); s != http.StatusUnauthorized {
+		t.Errorf("token issued before password change did not return proper status: %d", s)
+		return
+	}
+	newCredBytes, err := json.Marshal(cred)
+	if err != nil {
+		t.Errorf("Marshal error: %v", err)
+		return
+	}
+	if token, _, err = login(t, newCredBytes); err != nil {
+		return
+	}
+	if s := status(token); s != http.StatusNoContent {
+		t.Errorf("token issued after password change did not return proper status: %d", s)
+		return
+	}
+	if s := status(otherToken); s != http.StatusNoContent {
+		t.Errorf("other user token after password change did not return proper status: %d", s)
+		return
+	}
+}
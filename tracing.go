@@ -0,0 +1,54 @@
+package authjwt
+
+import (
+	"context"
+)
+
+// Tracer starts spans for auth operations when Config.TracingEnabled is true. The interface
+// is the subset of a distributed tracing API used by this package; I.E. an application
+// using OpenTelemetry provides a Tracer that starts an OpenTelemetry span and sets attributes
+// with attribute.String/attribute.Int.
+type Tracer interface {
+	// Start starts a span named name, as a child of any span in ctx, and returns a context
+	// carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// End ends the span.
+	End()
+	// SetAttribute sets an attribute of the span; value is a string, bool, or int.
+	SetAttribute(key string, value any)
+}
+
+// Span names and attribute keys.
+const (
+	SpanAuthGet        = "authjwt.authGet"
+	SpanPasswordVerify = "authjwt.passwordVerify"
+	SpanRequest        = "authjwt.request"
+	SpanTokenStoreGet  = "authjwt.tokenStore.get"
+
+	// AttributeEmail is the Email, or pseudonym with Config.AuditPseudonymizeEmails.
+	AttributeEmail = "authjwt.email"
+	// AttributeOutcome is true when the operation succeeded.
+	AttributeOutcome    = "authjwt.outcome"
+	AttributeHTTPMethod = "http.method"
+	AttributeHTTPRoute  = "http.route"
+	AttributeHTTPStatus = "http.status_code"
+)
+
+// noopSpan is returned from spanStart when tracing is disabled.
+type noopSpan struct{}
+
+func (noopSpan) End()                     {}
+func (noopSpan) SetAttribute(string, any) {}
+
+// spanStart starts a span with config.Tracer, when config.TracingEnabled is true. Otherwise
+// ctx and a span that does nothing are returned.
+func spanStart(ctx context.Context, name string) (context.Context, Span) {
+	if !config.TracingEnabled || config.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return config.Tracer.Start(ctx, name)
+}
@@ -0,0 +1,133 @@
+package authjwt
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testSpan is a span recorded by testTracer.
+type testSpan struct {
+	attributes map[string]any
+	ended      bool
+	name       string
+	parent     *testSpan
+}
+
+func (s *testSpan) End() { s.ended = true }
+
+func (s *testSpan) SetAttribute(key string, value any) { s.attributes[key] = value }
+
+// testSpanContextKey is the context key for the current testSpan.
+type testSpanContextKey struct{}
+
+// testTracer is an in memory Tracer that records all spans.
+type testTracer struct {
+	mutex sync.Mutex
+	spans []*testSpan
+}
+
+func (tt *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+	parent, _ := ctx.Value(testSpanContextKey{}).(*testSpan)
+	s := &testSpan{attributes: map[string]any{}, name: name, parent: parent}
+	tt.spans = append(tt.spans, s)
+	return context.WithValue(ctx, testSpanContextKey{}, s), s
+}
+
+// TestTracing verifies spans, with attributes, are produced for the wrappers, login, and
+// token store reads when TracingEnabled is true, and no spans are produced otherwise.
+func TestTracing(t *testing.T) {
+	testSetup()
+	tracer := &testTracer{}
+	config.Tracer = tracer
+
+	em, credBytes, err := createAuth(t, nil)
+	if err != nil {
+		return
+	}
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerFuncNoAuthWrapperCommon(handlerLogin, false)))
+	defer testServerLogin.Close()
+	login := func() []byte {
+		req, err := http.NewRequest(http.MethodPut, testServerLogin.URL+"/auth/login", bytes.NewBuffer(credBytes))
+		if err != nil {
+			t.Errorf("NewRequest error: %v", err)
+			return nil
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("login did not return proper status: %d, error: %v", resp.StatusCode, err)
+			return nil
+		}
+		b := new(bytes.Buffer)
+		if _, err := b.ReadFrom(resp.Body); err != nil {
+			t.Errorf("ReadFrom error: %v", err)
+			return nil
+		}
+		resp.Body.Close()
+		return b.Bytes()
+	}
+
+	if login() == nil {
+		return
+	}
+	if len(tracer.spans) != 0 {
+		t.Errorf("spans produced with tracing disabled: %d", len(tracer.spans))
+		return
+	}
+
+	config.TracingEnabled = true
+	token := login()
+	if token == nil {
+		return
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	req, err := http.NewRequest(http.MethodPost, testServer.URL+"/test", nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("request did not return proper status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+
+	tests := []struct {
+		name       string
+		parent     int
+		attributes map[string]any
+	}{
+		{SpanRequest, -1, map[string]any{AttributeHTTPMethod: http.MethodPut, AttributeHTTPRoute: "/auth/login",
+			AttributeHTTPStatus: http.StatusOK, AttributeOutcome: true}},
+		{SpanAuthGet, 0, map[string]any{AttributeEmail: em, AttributeOutcome: true}},
+		{SpanPasswordVerify, 0, map[string]any{AttributeEmail: em, AttributeOutcome: true}},
+		{SpanRequest, -1, map[string]any{AttributeEmail: em, AttributeHTTPMethod: http.MethodPost,
+			AttributeHTTPRoute: "/test", AttributeHTTPStatus: http.StatusNoContent, AttributeOutcome: true}},
+		{SpanTokenStoreGet, 3, map[string]any{AttributeEmail: em, AttributeOutcome: true}},
+	}
+	if len(tracer.spans) != len(tests) {
+		t.Errorf("wrong number of spans: %d", len(tracer.spans))
+		return
+	}
+	for i, tc := range tests {
+		s := tracer.spans[i]
+		if s.name != tc.name || !s.ended || (tc.parent < 0 && s.parent != nil) ||
+			(tc.parent >= 0 && s.parent != tracer.spans[tc.parent]) {
+			t.Errorf("span %d wrong: %+v", i, s)
+			return
+		}
+		for k, v := range tc.attributes {
+			if s.attributes[k] != v {
+				t.Errorf("span %d %s attribute %s: %v, expected: %v", i, s.name, k, s.attributes[k], v)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package authjwt
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+var (
+	// usernameValidation matches the identifiers accepted by IdentifierValidateUsername. There
+	// is no @, so a username is never the ContactEmail of another auth.
+	usernameValidation = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+)
+
+// AuthContactEmailSet sets the ContactEmail of the existing auth for identifier to email, or
+// clears it when email is empty; I.E. for auths identified by a username. With
+// Config.LoginByContactEmail, users can login with the ContactEmail instead of the identifier.
+// The ContactEmail must be an email, and not the ContactEmail of another auth.
+func AuthContactEmailSet(identifier string, email string) error {
+	email = emailNormalize(email)
+	if email != "" {
+		if err := identifierValidateEmail(email); err != nil {
+			return err
+		}
+	}
+	return contactEmailIndex().set(identifier, email)
+}
+
+// IdentifierValidateUsername is an IdentifierValidator for usernames; 1 to 64 letters, digits,
+// '.', '_', or '-', starting with a letter or digit.
+func IdentifierValidateUsername(id string) error {
+	if !usernameValidation.MatchString(id) {
+		return fmt.Errorf("%s identifier is not a valid username: %s", runtimeh.SourceInfo(), id)
+	}
+	return nil
+}
+
+// loginIdentifier returns the identifier of the auth to login with the Credential.Email id;
+// id, or with config.LoginByContactEmail the identifier of the auth with ContactEmail id when
+// there is no auth for id. auth is the auth for id.
+func loginIdentifier(id string, auth authentication) (string, authentication, error) {
+	if !config.LoginByContactEmail || auth.Email != nil {
+		return id, auth, nil
+	}
+	identifier, err := contactEmailIndex().identifier(id)
+	if err != nil || identifier == "" {
+		return id, auth, err
+	}
+	auth, err = authGet(identifier)
+	if err != nil {
+		return id, authentication{}, err
+	}
+	return identifier, auth, nil
+}
@@ -0,0 +1,116 @@
+package authjwt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestIdentifierValidateUsername verifies the usernames accepted by IdentifierValidateUsername.
+func TestIdentifierValidateUsername(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"jdoe", true},
+		{"J.Doe_2-x", true},
+		{"7", true},
+		{"", false},
+		{".jdoe", false},
+		{"jdoe@auth.com", false},
+		{"j doe", false},
+		{"jdoe0123456789012345678901234567890123456789012345678901234567890", false},
+	}
+	for i, tc := range tests {
+		if err := IdentifierValidateUsername(tc.id); (err == nil) != tc.valid {
+			t.Errorf("test %d, id: %s, valid: %t, error: %v", i, tc.id, tc.valid, err)
+			return
+		}
+	}
+}
+
+// TestLoginByContactEmail verifies auths identified by a username login with the username,
+// or with LoginByContactEmail the ContactEmail, and that a ContactEmail belongs to one auth.
+func TestLoginByContactEmail(t *testing.T) {
+	testSetup()
+	config.IdentifierValidator = IdentifierValidateUsername
+
+	username := "jdoe"
+	_, credBytes, err := createAuth(t, &username)
+	if err != nil {
+		return
+	}
+	other := "asmith"
+	if _, _, err := createAuth(t, &other); err != nil {
+		return
+	}
+	contact := "jdoe@auth.com"
+	if err := AuthContactEmailSet(username, "not an email"); err == nil {
+		t.Errorf("AuthContactEmailSet did not reject an invalid email")
+		return
+	}
+	if err := AuthContactEmailSet(username, contact); err != nil {
+		t.Errorf("AuthContactEmailSet error: %v", err)
+		return
+	}
+	if err := AuthContactEmailSet(other, contact); !errors.Is(err, ErrAuthExists) {
+		t.Errorf("contact email of another auth did not return ErrAuthExists: %v", err)
+		return
+	}
+	if ud, err := userData(username); err != nil || ud.ContactEmail != contact {
+		t.Errorf("wrong UserData ContactEmail: %+v, error: %v", ud, err)
+		return
+	}
+
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	pwd := "P@ssword1234"
+	contactBytes, err := json.Marshal(Credential{Email: &contact, Password: &pwd})
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return
+	}
+	loginStatus := func() (int, error) {
+		req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(contactBytes))
+		if err != nil {
+			return 0, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if _, claims, err := login(t, credBytes); err != nil || claims.Email != username {
+		t.Errorf("login with username, claims: %+v, error: %v", claims, err)
+		return
+	}
+	if status, err := loginStatus(); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("login with contact email without LoginByContactEmail, status: %d, error: %v", status, err)
+		return
+	}
+	config.LoginByContactEmail = true
+	if _, claims, err := login(t, contactBytes); err != nil || claims.Email != username {
+		t.Errorf("login with contact email, claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	// Another auth can use the contact email once it is cleared.
+	if err := AuthContactEmailSet(username, ""); err != nil {
+		t.Errorf("AuthContactEmailSet error: %v", err)
+		return
+	}
+	if status, err := loginStatus(); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("login with cleared contact email, status: %d, error: %v", status, err)
+		return
+	}
+	if err := AuthContactEmailSet(other, contact); err != nil {
+		t.Errorf("AuthContactEmailSet error: %v", err)
+		return
+	}
+}